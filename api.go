@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the path of the versioned JSON API. Fields are only added to
+// the responses of a version, never renamed or removed.
+const apiPrefix = "/api/v1/"
+
+// APIDevices is the response of /api/v1/devices.
+type APIDevices struct {
+	Timestamp time.Time `json:"timestamp"`
+	Devices   []*Device `json:"devices"`
+}
+
+// APIDevice is the response of /api/v1/devices/{uuid}.
+type APIDevice struct {
+	Timestamp time.Time `json:"timestamp"`
+	Device    *Device   `json:"device"`
+}
+
+// APIDriver is the response of /api/v1/driver.
+type APIDriver struct {
+	Timestamp     time.Time `json:"timestamp"`
+	DriverVersion string    `json:"driver_version"`
+	NVMLVersion   string    `json:"nvml_version,omitempty"`
+	CUDAVersion   string    `json:"cuda_version,omitempty"`
+	DeviceCount   int       `json:"device_count"`
+}
+
+// APIError is the response of a failed request.
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// apiHandler serves the latest snapshot of the cache as JSON, stamped with the
+// time it was collected. The stream shares the collections of the streamer.
+func apiHandler(cache *snapshotCache, stream *streamer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeAPI(w, http.StatusMethodNotAllowed, APIError{"method not allowed"})
+			return
+		}
+
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+		if path == "stream" {
+			stream.ServeHTTP(w, r)
+			return
+		}
+		if path != "devices" && path != "driver" && !strings.HasPrefix(path, "devices/") {
+			writeAPI(w, http.StatusNotFound, APIError{"not found"})
+			return
+		}
+
+		data, collected, err := cache.latest()
+		if err != nil {
+			writeAPI(w, http.StatusServiceUnavailable, APIError{err.Error()})
+			return
+		}
+
+		switch {
+		case path == "devices":
+			devices := data.Devices
+			if devices == nil {
+				devices = []*Device{}
+			}
+			writeAPI(w, http.StatusOK, APIDevices{collected, devices})
+		case path == "driver":
+			writeAPI(w, http.StatusOK, APIDriver{collected, data.Version, data.NVMLVersion, data.CUDAVersion, len(data.Devices)})
+		default:
+			uuid := strings.TrimPrefix(path, "devices/")
+			for _, d := range data.Devices {
+				if strings.EqualFold(d.UUID, uuid) {
+					writeAPI(w, http.StatusOK, APIDevice{collected, d})
+					return
+				}
+			}
+			writeAPI(w, http.StatusNotFound, APIError{"device " + uuid + " not found"})
+		}
+	})
+}
+
+func writeAPI(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode API response: %s\n", err)
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(APIError{err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
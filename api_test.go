@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// apiRequest serves a request with the handler and decodes the response into
+// v, checking the status.
+func apiRequest(t *testing.T, handler http.Handler, method, path string, status int, v interface{}) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	if rec.Code != status {
+		t.Errorf("%s %s: got status %d, want %d: %s", method, path, rec.Code, status, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("%s %s: got Content-Type %q", method, path, got)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s %s: %s", method, path, err)
+	}
+}
+
+// fixTimestamp checks that the response was collected now and replaces the
+// timestamp for the golden file.
+func fixTimestamp(t *testing.T, ts *time.Time) {
+	if time.Since(*ts) > time.Minute || ts.Location() != time.UTC {
+		t.Errorf("got timestamp %s, want the time of the collection in UTC", ts)
+	}
+	*ts = fixedTime
+}
+
+func TestAPIDevices(t *testing.T) {
+	// The backends only report finite DCGM readings, see dcgmValue.
+	data := testSnapshot()
+	data.Devices[1].DCGMFields["sm_active"] = 0.25
+	handler := apiHandler(newSnapshotCache(&staticBackend{metrics: data}), nil)
+
+	var devices APIDevices
+	apiRequest(t, handler, "GET", "/api/v1/devices", http.StatusOK, &devices)
+	fixTimestamp(t, &devices.Timestamp)
+	golden(t, "testdata/api/devices.json", devices)
+
+	// UUIDs are matched regardless of case.
+	var device APIDevice
+	apiRequest(t, handler, "GET", "/api/v1/devices/gpu-9b2d1c7e-0f43-4a55-8e61-2c7d9a0b3e12/", http.StatusOK, &device)
+	fixTimestamp(t, &device.Timestamp)
+	golden(t, "testdata/api/device.json", device)
+
+	var driver APIDriver
+	apiRequest(t, handler, "GET", "/api/v1/driver", http.StatusOK, &driver)
+	fixTimestamp(t, &driver.Timestamp)
+	golden(t, "testdata/api/driver.json", driver)
+}
+
+func TestAPISnapshotCache(t *testing.T) {
+	data := testSnapshot()
+	data.Devices[1].DCGMFields["sm_active"] = 0.25
+	backend := &staticBackend{metrics: data}
+	cache := newSnapshotCache(backend)
+	handler := apiHandler(cache, nil)
+
+	// The snapshot of a scrape is served, stamped with its collection.
+	gather(t, NewExporter(cache))
+	collected := cache.collected
+	var devices APIDevices
+	apiRequest(t, handler, "GET", "/api/v1/devices", http.StatusOK, &devices)
+	var driver APIDriver
+	apiRequest(t, handler, "GET", "/api/v1/driver", http.StatusOK, &driver)
+	if backend.collections != 1 {
+		t.Errorf("got %d collections, want only the scrape", backend.collections)
+	}
+	if !devices.Timestamp.Equal(collected) || !driver.Timestamp.Equal(collected) {
+		t.Errorf("got timestamps %s and %s, want the scrape at %s", devices.Timestamp, driver.Timestamp, collected)
+	}
+
+	// A snapshot older than snapshotMaxAge is collected again.
+	cache.collected = collected.Add(-2 * snapshotMaxAge)
+	apiRequest(t, handler, "GET", "/api/v1/devices", http.StatusOK, &devices)
+	if backend.collections != 2 || !devices.Timestamp.After(collected) {
+		t.Errorf("got %d collections and timestamp %s, want a new collection", backend.collections, devices.Timestamp)
+	}
+}
+
+func TestAPIEmpty(t *testing.T) {
+	var devices map[string]interface{}
+	apiRequest(t, apiHandler(newSnapshotCache(&staticBackend{metrics: &Metrics{}}), nil), "GET", "/api/v1/devices", http.StatusOK, &devices)
+	if list, ok := devices["devices"].([]interface{}); !ok || len(list) != 0 {
+		t.Errorf("got devices %v, want an empty list", devices["devices"])
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	handler := apiHandler(newSnapshotCache(&staticBackend{metrics: testSnapshot()}), nil)
+	for _, test := range []struct {
+		method, path string
+		status       int
+		message      string
+	}{
+		{"POST", "/api/v1/devices", http.StatusMethodNotAllowed, "method not allowed"},
+		{"GET", "/api/v1/processes", http.StatusNotFound, "not found"},
+		{"GET", "/api/v1/devices/GPU-00000000-0000-0000-0000-000000000000", http.StatusNotFound, "device GPU-00000000-0000-0000-0000-000000000000 not found"},
+	} {
+		var resp APIError
+		apiRequest(t, handler, test.method, test.path, test.status, &resp)
+		if resp.Error != test.message {
+			t.Errorf("%s %s: got error %q, want %q", test.method, test.path, resp.Error, test.message)
+		}
+	}
+
+	var resp APIError
+	apiRequest(t, apiHandler(newSnapshotCache(&staticBackend{err: errors.New("could not load NVML library")}), nil), "GET", "/api/v1/driver", http.StatusServiceUnavailable, &resp)
+	if resp.Error != "could not load NVML library" {
+		t.Errorf("got error %q, want the error of the backend", resp.Error)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Backend collects a snapshot of the driver and its devices.
+type Backend interface {
+	Collect() (*Metrics, error)
+}
+
+var (
+	superviseMinBackoff = 1 * time.Second
+	superviseMaxBackoff = 1 * time.Minute
+
+	// snapshotMaxAge is the age up to which the latest snapshot is served
+	// instead of collecting a new one.
+	snapshotMaxAge = 30 * time.Second
+)
+
+// instrumentedBackend is implemented by backends that export metrics about
+// their own operation.
+type instrumentedBackend interface {
+	Collectors() []prometheus.Collector
+}
+
+// snapshotCache keeps the latest collection of the wrapped backend. The
+// exporter and the push outputs collect through it, the API, the gRPC service
+// and the InfluxDB handler serve the latest snapshot and only collect when it
+// is older than snapshotMaxAge.
+type snapshotCache struct {
+	Backend
+
+	mu        sync.Mutex
+	metrics   *Metrics
+	err       error
+	collected time.Time
+}
+
+func newSnapshotCache(backend Backend) *snapshotCache {
+	return &snapshotCache{Backend: backend}
+}
+
+func (c *snapshotCache) Collect() (*Metrics, error) {
+	metrics, _, err := c.collect()
+	return metrics, err
+}
+
+// collect collects from the backend and keeps the snapshot along with the
+// time of the collection.
+func (c *snapshotCache) collect() (*Metrics, time.Time, error) {
+	metrics, err := c.Backend.Collect()
+	collected := time.Now().UTC()
+
+	c.mu.Lock()
+	c.metrics, c.err, c.collected = metrics, err, collected
+	c.mu.Unlock()
+	return metrics, collected, err
+}
+
+// latest returns the latest snapshot and the time it was collected at,
+// collecting a new one if there is none younger than snapshotMaxAge.
+func (c *snapshotCache) latest() (*Metrics, time.Time, error) {
+	c.mu.Lock()
+	metrics, collected, err := c.metrics, c.collected, c.err
+	c.mu.Unlock()
+	if !collected.IsZero() && time.Since(collected) <= snapshotMaxAge {
+		return metrics, collected, err
+	}
+	return c.collect()
+}
+
+// nvmlBackend queries NVML in-process through libnvidia-ml.
+type nvmlBackend struct {
+	info *prometheus.GaugeVec
+}
+
+func (*nvmlBackend) Collect() (*Metrics, error) {
+	return collectMetrics()
+}
+
+func (b *nvmlBackend) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{b.info}
+}
+
+// BackendConfig holds the flags of all backends. Only the fields of the
+// selected backend are used.
+type BackendConfig struct {
+	NVMLLibraryPath   string
+	NvidiaSMIPath     string
+	NvidiaSMIInterval time.Duration
+	DCGMPath          string
+	DCGMHost          string
+	DCGMInterval      time.Duration
+	DCGMFieldGroups   string
+	ReplayFile        string
+	ReplaySpeed       float64
+	ReplayLoop        bool
+	SimulatorConfig   string
+	SimulatorSeed     int64
+}
+
+// addFlags registers the flags configuring the backends on fs.
+func (c *BackendConfig) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.NVMLLibraryPath, "nvml.library-path", "", "Path to libnvidia-ml.so.1 or the directory holding it, searched for in common driver roots by default.")
+	fs.StringVar(&c.NvidiaSMIPath, "nvidia-smi.path", "nvidia-smi", "Path to the nvidia-smi binary used by the nvidia-smi backends.")
+	fs.DurationVar(&c.NvidiaSMIInterval, "nvidia-smi.interval", 1*time.Second, "Sampling interval of the nvidia-smi-query backend.")
+	fs.StringVar(&c.DCGMPath, "dcgm.path", "dcgmi", "Path to the dcgmi binary used by the dcgm backend.")
+	fs.StringVar(&c.DCGMHost, "dcgm.host", "", "Address of nv-hostengine, defaults to the local host engine.")
+	fs.DurationVar(&c.DCGMInterval, "dcgm.interval", 1*time.Second, "Sampling interval of the dcgm backend.")
+	fs.StringVar(&c.DCGMFieldGroups, "dcgm.field-groups", "", "JSON file with the DCGM field groups to watch, defaults to the profiling fields.")
+	fs.StringVar(&c.ReplayFile, "replay.file", "", "Recording served by the replay backend.")
+	fs.Float64Var(&c.ReplaySpeed, "replay.speed", 1, "Playback speed of the replay backend, 2 replays twice as fast.")
+	fs.BoolVar(&c.ReplayLoop, "replay.loop", false, "Restart the replay backend at the end of the recording.")
+	fs.StringVar(&c.SimulatorConfig, "simulator.config", "", "YAML file with the devices and profiles of the simulator backend, defaults to the built-in ones.")
+	fs.Int64Var(&c.SimulatorSeed, "simulator.seed", 1, "Seed of the simulator backend, the same seed and configuration produce the same readings.")
+}
+
+// NewBackend returns the backend registered under name.
+func NewBackend(name string, config BackendConfig) (Backend, error) {
+	switch name {
+	case "nvml":
+		// Without a configured path the exporter keeps running when no
+		// library is found and reports nvidia_up 0.
+		library, err := loadNVMLLibrary(config.NVMLLibraryPath)
+		if err != nil {
+			if config.NVMLLibraryPath != "" {
+				return nil, err
+			}
+			log.Println(err)
+		}
+		return &nvmlBackend{info: newLibraryInfo(library)}, nil
+	case "nvidia-smi":
+		return &smiBackend{path: config.NvidiaSMIPath}, nil
+	case "nvidia-smi-query":
+		return newSMICSVBackend(config.NvidiaSMIPath, config.NvidiaSMIInterval), nil
+	case "dcgm":
+		groups := DefaultDCGMFieldGroups
+		if config.DCGMFieldGroups != "" {
+			var err error
+			if groups, err = LoadDCGMFieldGroups(config.DCGMFieldGroups); err != nil {
+				return nil, err
+			}
+		}
+		return newDCGMBackend(config.DCGMPath, config.DCGMHost, config.DCGMInterval, groups), nil
+	case "replay":
+		// A nil *replayBackend must not be returned as a Backend.
+		backend, err := newReplayBackend(config.ReplayFile, config.ReplaySpeed, config.ReplayLoop)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	case "simulator":
+		simulatorConfig, err := LoadSimulatorConfig(config.SimulatorConfig)
+		if err != nil {
+			return nil, err
+		}
+		return newSimulatorBackend(simulatorConfig, config.SimulatorSeed), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", name)
+}
+
+// supervise calls run, which is expected to block for the lifetime of a child
+// process, forever. Restarts are delayed with exponential backoff and
+// counted in restarts.
+func supervise(name string, restarts prometheus.Counter, run func() error) {
+	backoff := superviseMinBackoff
+	for {
+		started := time.Now()
+		err := run()
+		log.Printf("%s exited: %v\n", name, err)
+
+		if time.Since(started) > superviseMaxBackoff {
+			backoff = superviseMinBackoff
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > superviseMaxBackoff {
+			backoff = superviseMaxBackoff
+		}
+		restarts.Inc()
+	}
+}
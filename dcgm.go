@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// DCGMField is a DCGM field id and the name it is exported under.
+type DCGMField struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// DCGMFieldGroup is a named set of DCGM fields that are watched together.
+type DCGMFieldGroup struct {
+	Name   string      `json:"name"`
+	Fields []DCGMField `json:"fields"`
+}
+
+// dcgmDeviceFields are always watched and fill the common Device fields.
+// Readings with a field name record blank values in the errors of the
+// device.
+var dcgmDeviceFields = []struct {
+	id    int
+	field string
+	set   func(d *Device, v float64)
+}{
+	{150, "temperature_celsius", func(d *Device, v float64) { d.Temperature = v }},
+	{155, "power_usage_milliwatts", func(d *Device, v float64) { d.PowerUsage = v * 1000 }},
+	{191, "fan_speed_percent", func(d *Device, v float64) { d.FanSpeed = v }},
+	{203, "utilization_gpu_percent", func(d *Device, v float64) { d.UtilizationGPU = v }},
+	{204, "utilization_memory_percent", func(d *Device, v float64) { d.UtilizationMemory = v }},
+	{250, "", func(d *Device, v float64) { d.MemoryTotal = v * (1 << 20) }},
+	{252, "", func(d *Device, v float64) { d.MemoryUsed = v * (1 << 20) }},
+}
+
+// DefaultDCGMFieldGroups are the profiling fields watched when no field
+// group file is given.
+var DefaultDCGMFieldGroups = []DCGMFieldGroup{
+	{
+		Name: "profiling",
+		Fields: []DCGMField{
+			{1001, "gr_engine_active"},
+			{1002, "sm_active"},
+			{1003, "sm_occupancy"},
+			{1004, "tensor_active"},
+			{1005, "dram_active"},
+			{1009, "pcie_tx_bytes"},
+			{1010, "pcie_rx_bytes"},
+			{1011, "nvlink_tx_bytes"},
+			{1012, "nvlink_rx_bytes"},
+		},
+	},
+}
+
+// LoadDCGMFieldGroups reads field groups from a JSON file holding a list of
+// DCGMFieldGroup.
+func LoadDCGMFieldGroups(path string) ([]DCGMFieldGroup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var groups []DCGMFieldGroup
+	if err := json.NewDecoder(f).Decode(&groups); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	if err := validateDCGMFieldGroups(groups); err != nil {
+		return nil, fmt.Errorf("invalid field groups in %s: %s", path, err)
+	}
+	return groups, nil
+}
+
+// validateDCGMFieldGroups checks that every field is exported under a valid
+// metric name that no other field uses.
+func validateDCGMFieldGroups(groups []DCGMFieldGroup) error {
+	names := map[string]string{}
+	for _, g := range groups {
+		for _, f := range g.Fields {
+			if !model.IsValidMetricName(model.LabelValue(dcgmMetricName(f.Name))) {
+				return fmt.Errorf("field %d of group %q: %q is not a valid metric name", f.ID, g.Name, f.Name)
+			}
+			if group, ok := names[f.Name]; ok {
+				return fmt.Errorf("field %d of group %q: %q is already used in group %q", f.ID, g.Name, f.Name, group)
+			}
+			names[f.Name] = g.Name
+		}
+	}
+	return nil
+}
+
+// dcgmMetricName is the name a DCGM field is exported under.
+func dcgmMetricName(field string) string {
+	return prometheus.BuildFQName(namespace, "dcgm", field)
+}
+
+// dcgmBackend reads field values from the DCGM host engine (nv-hostengine)
+// through a long running `dcgmi dmon`. The fields of dcgmDeviceFields fill
+// the common Device fields, the fields of the configured groups are stored
+// in Device.DCGMFields. Devices that stop being reported are dropped once
+// their reading is stale, like in smiCSVBackend.
+type dcgmBackend struct {
+	path     string
+	host     string
+	interval time.Duration
+	fields   []DCGMField
+	restarts prometheus.Counter
+
+	mu         sync.Mutex
+	identities map[string]dcgmIdentity
+	devices    map[string]*dcgmReading
+	updated    time.Time
+}
+
+// dcgmReading is the most recent reading of a device.
+type dcgmReading struct {
+	device  *Device
+	updated time.Time
+}
+
+// dcgmIdentity is the name and UUID of a GPU as listed by dcgmi discovery.
+type dcgmIdentity struct {
+	name string
+	uuid string
+}
+
+func newDCGMBackend(path, host string, interval time.Duration, groups []DCGMFieldGroup) *dcgmBackend {
+	b := &dcgmBackend{
+		path:     path,
+		host:     host,
+		interval: interval,
+		restarts: newCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "dcgm_restarts_total",
+				Help:      "Restarts of the dcgmi child process",
+			},
+		),
+		devices: map[string]*dcgmReading{},
+	}
+	for _, g := range groups {
+		b.fields = append(b.fields, g.Fields...)
+	}
+	go supervise("dcgmi", b.restarts, b.stream)
+	return b
+}
+
+func (b *dcgmBackend) Collect() (*Metrics, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.updated.IsZero() {
+		return nil, errors.New("no readings from dcgmi yet")
+	}
+	staleAfter := 3 * b.interval
+	if staleAfter < smiTimeout {
+		staleAfter = smiTimeout
+	}
+	if age := time.Since(b.updated); age > staleAfter {
+		return nil, fmt.Errorf("last reading from dcgmi is %s old", age)
+	}
+
+	metrics := &Metrics{}
+	for index, r := range b.devices {
+		if time.Since(r.updated) > staleAfter {
+			delete(b.devices, index)
+			continue
+		}
+		device := *r.device
+		metrics.Devices = append(metrics.Devices, &device)
+	}
+	sort.Slice(metrics.Devices, func(i, j int) bool {
+		x, _ := strconv.Atoi(metrics.Devices[i].Index)
+		y, _ := strconv.Atoi(metrics.Devices[j].Index)
+		return x < y
+	})
+
+	return metrics, nil
+}
+
+func (b *dcgmBackend) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{b.restarts}
+}
+
+// ids returns the field ids passed to dcgmi, device fields first.
+func (b *dcgmBackend) ids() []string {
+	var ids []string
+	for _, f := range dcgmDeviceFields {
+		ids = append(ids, strconv.Itoa(f.id))
+	}
+	for _, f := range b.fields {
+		ids = append(ids, strconv.Itoa(f.ID))
+	}
+	return ids
+}
+
+// discover lists the GPUs known to the host engine.
+func (b *dcgmBackend) discover() error {
+	args := []string{"discovery", "-l"}
+	if b.host != "" {
+		args = append(args, "--host", b.host)
+	}
+
+	out, err := exec.Command(b.path, args...).Output()
+	if err != nil {
+		return err
+	}
+
+	identities := parseDCGMDiscovery(string(out))
+	b.mu.Lock()
+	b.identities = identities
+	b.mu.Unlock()
+	return nil
+}
+
+// parseDCGMDiscovery parses the table printed by `dcgmi discovery -l`:
+//
+//	| GPU ID | Device Information                  |
+//	| 0      | Name: NVIDIA A100-SXM4-40GB         |
+//	|        | PCI Bus ID: 00000000:07:00.0        |
+//	|        | Device UUID: GPU-1d82f4df-...       |
+func parseDCGMDiscovery(out string) map[string]dcgmIdentity {
+	identities := map[string]dcgmIdentity{}
+	var id string
+	for _, line := range strings.Split(out, "\n") {
+		columns := strings.Split(line, "|")
+		if len(columns) < 3 {
+			continue
+		}
+		if c := strings.TrimSpace(columns[1]); c != "" {
+			id = c
+		}
+		key, value := splitDCGMInfo(columns[2])
+		identity := identities[id]
+		switch key {
+		case "Name":
+			identity.name = value
+		case "Device UUID":
+			identity.uuid = value
+		default:
+			continue
+		}
+		identities[id] = identity
+	}
+	return identities
+}
+
+func splitDCGMInfo(s string) (string, string) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", ""
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+}
+
+// stream runs dcgmi until it exits and stores every reading.
+func (b *dcgmBackend) stream() error {
+	if err := b.discover(); err != nil {
+		return fmt.Errorf("discovery failed: %s", err)
+	}
+
+	args := []string{"dmon",
+		"-e", strings.Join(b.ids(), ","),
+		"-d", strconv.Itoa(int(b.interval / time.Millisecond)),
+	}
+	if b.host != "" {
+		args = append(args, "--host", b.host)
+	}
+
+	cmd := exec.Command(b.path, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = b.read(stdout)
+	if err != nil {
+		cmd.Process.Kill()
+	}
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// read parses the output of `dcgmi dmon` until r is closed. Header lines
+// start with # or ID and are repeated periodically, data lines look like
+// "GPU 0  61.442  35  0.000". Entities other than GPUs are ignored.
+func (b *dcgmBackend) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		device, err := b.parse(scanner.Text())
+		if err != nil {
+			return err
+		}
+		if device == nil {
+			continue
+		}
+
+		now := time.Now()
+		b.mu.Lock()
+		device.Name = b.identities[device.Index].name
+		device.UUID = b.identities[device.Index].uuid
+		b.devices[device.Index] = &dcgmReading{device, now}
+		b.updated = now
+		b.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("unexpected end of output")
+}
+
+// parse converts a line of `dcgmi dmon` output into a Device. Lines that
+// don't hold GPU readings return nil. Fields of the configured groups
+// without a value are left out of DCGMFields, their error is recorded as
+// dcgm_fields.<name>.
+func (b *dcgmBackend) parse(line string) (*Device, error) {
+	columns := strings.Fields(line)
+	if len(columns) < 2 || columns[0] != "GPU" {
+		return nil, nil
+	}
+
+	values := columns[2:]
+	if len(values) != len(dcgmDeviceFields)+len(b.fields) {
+		return nil, fmt.Errorf("expected %d values, got %q", len(dcgmDeviceFields)+len(b.fields), line)
+	}
+
+	device := &Device{
+		Index:       columns[1],
+		MinorNumber: columns[1],
+		DCGMFields:  map[string]float64{},
+	}
+	errs := deviceErrors{}
+	for i, f := range dcgmDeviceFields {
+		value, err := dcgmValue(values[i])
+		if err != nil && f.field != "" {
+			errs[f.field] = err.Error()
+		}
+		f.set(device, value)
+	}
+	for i, f := range b.fields {
+		value, err := dcgmValue(values[len(dcgmDeviceFields)+i])
+		if err != nil {
+			errs["dcgm_fields."+f.Name] = err.Error()
+			continue
+		}
+		device.DCGMFields[f.Name] = value
+	}
+	// DCGM averages on its own sampling interval, the readings are used for
+	// both.
+	device.PowerUsageAverage = device.PowerUsage
+	device.UtilizationGPUAverage = device.UtilizationGPU
+	if err, failed := errs["power_usage_milliwatts"]; failed {
+		errs["power_usage_average_milliwatts"] = err
+	}
+	if err, failed := errs["utilization_gpu_percent"]; failed {
+		errs["utilization_gpu_average_percent"] = err
+	}
+	device.Errors = errs.orNil()
+
+	return device, nil
+}
+
+// dcgmValue parses a value printed by dcgmi. Blank values are printed as N/A,
+// and like nan or inf they can't be encoded in the JSON of the device.
+func dcgmValue(s string) (float64, error) {
+	if s == "N/A" {
+		return 0, errors.New("n/a")
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return value, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateDCGMFieldGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []DCGMFieldGroup
+		err    string
+	}{
+		{
+			name:   "default",
+			groups: DefaultDCGMFieldGroups,
+		},
+		{
+			name: "invalid name",
+			groups: []DCGMFieldGroup{
+				{Name: "profiling", Fields: []DCGMField{{1002, "sm-active"}}},
+			},
+			err: `"sm-active" is not a valid metric name`,
+		},
+		{
+			name: "duplicate name",
+			groups: []DCGMFieldGroup{
+				{Name: "profiling", Fields: []DCGMField{{1002, "sm_active"}}},
+				{Name: "custom", Fields: []DCGMField{{1003, "sm_active"}}},
+			},
+			err: `field 1003 of group "custom": "sm_active" is already used in group "profiling"`,
+		},
+	}
+
+	for _, test := range tests {
+		err := validateDCGMFieldGroups(test.groups)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestLoadDCGMFieldGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcgm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "groups.json")
+	ioutil.WriteFile(path, []byte(`[{"name": "custom", "fields": [{"id": 1002, "name": "sm-active"}]}]`), 0644)
+	if _, err := LoadDCGMFieldGroups(path); err == nil {
+		t.Error("expected an error for an invalid field name")
+	}
+
+	ioutil.WriteFile(path, []byte(`[{"name": "custom", "fields": [{"id": 1002, "name": "sm_active"}]}]`), 0644)
+	groups, err := LoadDCGMFieldGroups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DCGMFieldGroup{{Name: "custom", Fields: []DCGMField{{1002, "sm_active"}}}}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got %+v, want %+v", groups, want)
+	}
+}
+
+// fakeDCGMI is a script in place of dcgmi that answers discovery and
+// prints two rounds of dmon output, recording the arguments of dmon.
+const fakeDCGMI = `#!/bin/sh
+case "$1" in
+discovery)
+	cat <<'EOF'
+1 GPU found.
++--------+----------------------------------------------------------------------+
+| GPU ID | Device Information                                                   |
++--------+----------------------------------------------------------------------+
+| 0      | Name: NVIDIA A100-SXM4-40GB                                          |
+|        | PCI Bus ID: 00000000:07:00.0                                         |
+|        | Device UUID: GPU-3f1a2b4c-5d6e-7f80-91a2-b3c4d5e6f701                |
++--------+----------------------------------------------------------------------+
+0 NvSwitches found.
+EOF
+	;;
+dmon)
+	echo "$@" > "$(dirname "$0")/args"
+	cat <<'EOF'
+#Entity   TMPTR  POWER    FAN  GPUTL  MCUTL  FBTTL  FBUSD  SMACT  SMOCC
+ID
+GPU 0     33     54.120   N/A  0      0      40536  3      0.000  0.000
+GPU 0     34     312.771  N/A  87     41     40536  8123   0.812  0.403
+Switch 0  N/A    N/A      N/A  N/A    N/A    N/A    N/A    N/A    N/A
+EOF
+	;;
+esac
+`
+
+func TestDCGMBackendStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcgmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dcgmi")
+	if err := ioutil.WriteFile(path, []byte(fakeDCGMI), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &dcgmBackend{
+		path:     path,
+		host:     "10.0.0.2",
+		interval: 500 * time.Millisecond,
+		fields:   []DCGMField{{1002, "sm_active"}, {1003, "sm_occupancy"}},
+		devices:  map[string]*dcgmReading{},
+	}
+	if err := b.stream(); err == nil || err.Error() != "unexpected end of output" {
+		t.Errorf("got error %v, want unexpected end of output", err)
+	}
+
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if want := "dmon -e 150,155,191,203,204,250,252,1002,1003 -d 500 --host 10.0.0.2\n"; string(args) != want {
+		t.Errorf("dmon called with %q, want %q", args, want)
+	}
+
+	metrics, err := b.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Device{{
+		Index:                 "0",
+		MinorNumber:           "0",
+		Name:                  "NVIDIA A100-SXM4-40GB",
+		UUID:                  "GPU-3f1a2b4c-5d6e-7f80-91a2-b3c4d5e6f701",
+		Temperature:           34,
+		PowerUsage:            312771,
+		PowerUsageAverage:     312771,
+		UtilizationGPU:        87,
+		UtilizationGPUAverage: 87,
+		UtilizationMemory:     41,
+		MemoryTotal:           40536 << 20,
+		MemoryUsed:            8123 << 20,
+		DCGMFields:            map[string]float64{"sm_active": 0.812, "sm_occupancy": 0.403},
+		Errors:                map[string]string{"fan_speed_percent": "n/a"},
+	}}
+	if !reflect.DeepEqual(metrics.Devices, want) {
+		t.Errorf("got %+v, want %+v", metrics.Devices, want)
+	}
+}
+
+func TestDCGMBackendParseMismatch(t *testing.T) {
+	b := &dcgmBackend{fields: []DCGMField{{1002, "sm_active"}}}
+	if _, err := b.parse("GPU 0  33  54.120  N/A  0  0  40536  3"); err == nil {
+		t.Error("expected an error for a line with missing values")
+	}
+}
+
+func TestDCGMBackendParseUnsupported(t *testing.T) {
+	b := &dcgmBackend{fields: []DCGMField{{1002, "sm_active"}, {1003, "sm_occupancy"}}}
+	device, err := b.parse("GPU 1  41  N/A  N/A  12  3  15360  812  N/A  nan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"power_usage_milliwatts":         "n/a",
+		"power_usage_average_milliwatts": "n/a",
+		"fan_speed_percent":              "n/a",
+		"dcgm_fields.sm_active":          "n/a",
+		"dcgm_fields.sm_occupancy":       `invalid value "nan"`,
+	}
+	if !reflect.DeepEqual(device.Errors, want) {
+		t.Errorf("got errors %v, want %v", device.Errors, want)
+	}
+	if len(device.DCGMFields) != 0 {
+		t.Errorf("got fields %v, want none", device.DCGMFields)
+	}
+	if device.Temperature != 41 || device.UtilizationGPU != 12 {
+		t.Errorf("got %+v, want the supported readings", device)
+	}
+}
+
+func TestDCGMBackendStale(t *testing.T) {
+	now := time.Now()
+	b := &dcgmBackend{
+		interval: time.Second,
+		updated:  now,
+		devices: map[string]*dcgmReading{
+			"0": {&Device{Index: "0"}, now},
+			"1": {&Device{Index: "1"}, now.Add(-time.Minute)},
+		},
+	}
+
+	metrics, err := b.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics.Devices) != 1 || metrics.Devices[0].Index != "0" {
+		t.Errorf("got devices %+v, want only GPU 0", metrics.Devices)
+	}
+	if _, ok := b.devices["1"]; ok {
+		t.Error("stale device wasn't dropped")
+	}
+
+	b.updated = now.Add(-time.Minute)
+	if _, err := b.Collect(); err == nil {
+		t.Error("expected an error for a stale dcgmi")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// graphiteBatch is the number of datapoints in a message, carbon rejects
+// large pickle messages.
+const graphiteBatch = 500
+
+var (
+	graphiteUnsafe      = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+	graphitePlaceholder = regexp.MustCompile(`\{[a-z]+\}`)
+)
+
+// GraphiteConfig configures pushing to a Carbon receiver.
+type GraphiteConfig struct {
+	Address  string
+	Protocol string
+	Template string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+type graphiteDatapoint struct {
+	path  string
+	value float64
+}
+
+// graphiteWriter periodically pushes the readings of the backend to Carbon
+// with the plaintext or pickle protocol.
+type graphiteWriter struct {
+	config     GraphiteConfig
+	backend    Backend
+	hostname   string
+	conn       net.Conn
+	datapoints *counterVec
+}
+
+func newGraphiteWriter(config GraphiteConfig, backend Backend) (*graphiteWriter, error) {
+	if config.Protocol != "plaintext" && config.Protocol != "pickle" {
+		return nil, fmt.Errorf("unknown Graphite protocol %q, expected plaintext or pickle", config.Protocol)
+	}
+	for _, p := range graphitePlaceholder.FindAllString(config.Template, -1) {
+		switch p {
+		case "{hostname}", "{index}", "{minor}", "{uuid}", "{name}", "{metric}":
+		default:
+			return nil, fmt.Errorf("unknown placeholder %s in Graphite template %q", p, config.Template)
+		}
+	}
+	if !strings.Contains(config.Template, "{metric}") {
+		return nil, fmt.Errorf("Graphite template %q doesn't contain {metric}", config.Template)
+	}
+
+	hostname, _ := os.Hostname()
+	return &graphiteWriter{
+		config:   config,
+		backend:  backend,
+		hostname: hostname,
+		datapoints: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "graphite_datapoints_total",
+				Help:      "Graphite datapoints by result, sent or dropped",
+			},
+			[]string{"result"},
+		),
+	}, nil
+}
+
+func (w *graphiteWriter) Describe(descs chan<- *prometheus.Desc) {
+	w.datapoints.Describe(descs)
+}
+
+func (w *graphiteWriter) Collect(metrics chan<- prometheus.Metric) {
+	w.datapoints.Collect(metrics)
+}
+
+// run pushes every interval until the process exits.
+func (w *graphiteWriter) run() {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := w.push(time.Now()); err != nil {
+			log.Printf("Failed to push to Graphite %s: %s\n", w.config.Address, err)
+		}
+		<-ticker.C
+	}
+}
+
+func (w *graphiteWriter) push(now time.Time) error {
+	data, err := w.backend.Collect()
+	if err != nil {
+		return err
+	}
+	datapoints := graphiteDatapoints(data, w.config.Template, w.hostname)
+
+	var messages [][]byte
+	var sizes []int
+	for i := 0; i < len(datapoints); i += graphiteBatch {
+		end := i + graphiteBatch
+		if end > len(datapoints) {
+			end = len(datapoints)
+		}
+		if w.config.Protocol == "pickle" {
+			messages = append(messages, graphitePickle(datapoints[i:end], now))
+		} else {
+			messages = append(messages, graphitePlaintext(datapoints[i:end], now))
+		}
+		sizes = append(sizes, end-i)
+	}
+
+	// Carbon closes idle connections and restarts, so a failed write is
+	// retried once on a new connection, from the message that failed.
+	var written int
+	for attempt := 0; ; attempt++ {
+		n, err := w.write(messages[written:])
+		for _, size := range sizes[written : written+n] {
+			w.datapoints.WithLabelValues("sent").Add(float64(size))
+		}
+		written += n
+		if err == nil {
+			return nil
+		}
+		if attempt > 0 {
+			for _, size := range sizes[written:] {
+				w.datapoints.WithLabelValues("dropped").Add(float64(size))
+			}
+			return err
+		}
+	}
+}
+
+// write sends the messages, dialing Carbon if there is no connection. It
+// returns the number of messages written before an error.
+func (w *graphiteWriter) write(messages [][]byte) (int, error) {
+	if w.conn == nil {
+		conn, err := net.DialTimeout("tcp", w.config.Address, w.config.Timeout)
+		if err != nil {
+			return 0, err
+		}
+		w.conn = conn
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(w.config.Timeout))
+	for i, msg := range messages {
+		if _, err := w.conn.Write(msg); err != nil {
+			w.conn.Close()
+			w.conn = nil
+			return i, err
+		}
+	}
+	return len(messages), nil
+}
+
+// graphiteDatapoints returns a datapoint for every reading of every device,
+// with the path built from the template.
+func graphiteDatapoints(data *Metrics, template, hostname string) []graphiteDatapoint {
+	var datapoints []graphiteDatapoint
+	for _, d := range data.Devices {
+		values := map[string]string{
+			"{hostname}": hostname,
+			"{index}":    d.Index,
+			"{minor}":    d.MinorNumber,
+			"{uuid}":     d.UUID,
+			"{name}":     d.Name,
+		}
+
+		readings := d.readings()
+		names := make([]string, 0, len(readings))
+		for name := range readings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if math.IsNaN(readings[name]) || math.IsInf(readings[name], 0) {
+				continue
+			}
+			values["{metric}"] = name
+			path := graphitePlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+				// Dots separate the nodes of the path, e.g. of the hostname.
+				return graphiteUnsafe.ReplaceAllString(values[p], "_")
+			})
+			datapoints = append(datapoints, graphiteDatapoint{path, readings[name]})
+		}
+	}
+	return datapoints
+}
+
+// graphitePlaintext encodes the datapoints in the plaintext protocol, a
+// "path value timestamp" line each.
+func graphitePlaintext(datapoints []graphiteDatapoint, now time.Time) []byte {
+	var b bytes.Buffer
+	for _, dp := range datapoints {
+		fmt.Fprintf(&b, "%s %s %d\n", dp.path, strconv.FormatFloat(dp.value, 'f', -1, 64), now.Unix())
+	}
+	return b.Bytes()
+}
+
+// graphitePickle encodes the datapoints as a message of the pickle
+// protocol, a length prefixed pickle of [(path, (timestamp, value)), ...].
+func graphitePickle(datapoints []graphiteDatapoint, now time.Time) []byte {
+	var b bytes.Buffer
+	float := func(v float64) {
+		b.WriteByte('G') // BINFLOAT
+		binary.Write(&b, binary.BigEndian, v)
+	}
+
+	b.WriteString("\x80\x02") // PROTO 2
+	b.WriteString("](")       // EMPTY_LIST, MARK
+	for _, dp := range datapoints {
+		b.WriteByte('X') // BINUNICODE
+		binary.Write(&b, binary.LittleEndian, uint32(len(dp.path)))
+		b.WriteString(dp.path)
+		float(float64(now.Unix()))
+		float(dp.value)
+		b.WriteString("\x86\x86") // TUPLE2, TUPLE2
+	}
+	b.WriteString("e.") // APPENDS, STOP
+
+	msg := make([]byte, 4, 4+b.Len())
+	binary.BigEndian.PutUint32(msg, uint32(b.Len()))
+	return append(msg, b.Bytes()...)
+}
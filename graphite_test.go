@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var graphiteTime = time.Unix(1552140161, 0)
+
+// carbonListener accepts a connection on a local port and returns everything
+// written to it until it is closed.
+func carbonListener(t *testing.T) (net.Listener, <-chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+	return l, received
+}
+
+// brokenConn is a connection Carbon closed after a number of writes.
+type brokenConn struct {
+	net.Conn
+	writes   int
+	messages [][]byte
+}
+
+func (c *brokenConn) Write(b []byte) (int, error) {
+	if len(c.messages) == c.writes {
+		return 0, errors.New("write: broken pipe")
+	}
+	c.messages = append(c.messages, b)
+	return len(b), nil
+}
+
+func (c *brokenConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *brokenConn) Close() error                     { return nil }
+
+// graphiteDevices returns a snapshot with more datapoints than fit in a
+// message.
+func graphiteDevices() *Metrics {
+	var data Metrics
+	for i := 0; i < 40; i++ {
+		d := *testSnapshot().Devices[0]
+		d.MinorNumber = strconv.Itoa(i)
+		data.Devices = append(data.Devices, &d)
+	}
+	return &data
+}
+
+func newTestGraphiteWriter(t *testing.T, address, protocol string, data *Metrics) *graphiteWriter {
+	w, err := newGraphiteWriter(GraphiteConfig{
+		Address:  address,
+		Protocol: protocol,
+		Template: "gpu.{hostname}.{minor}.{metric}",
+		Timeout:  time.Second,
+	}, &staticBackend{metrics: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.hostname = "gpu-node-17.example.com"
+	return w
+}
+
+func TestGraphitePlaintext(t *testing.T) {
+	datapoints := graphiteDatapoints(testSnapshot(), "gpu.{hostname}.{minor}.{metric}", "gpu-node-17.example.com")
+	goldenBytes(t, "testdata/graphite/plaintext.txt", graphitePlaintext(datapoints, graphiteTime))
+}
+
+func TestGraphitePickle(t *testing.T) {
+	msg := graphitePickle([]graphiteDatapoint{{"gpu.node.0.temperature_celsius", 41}}, graphiteTime)
+	want := []byte("\x00\x00\x00\x3d" +
+		"\x80\x02](" +
+		"X\x1e\x00\x00\x00gpu.node.0.temperature_celsius" +
+		"G\x41\xd7\x20\xf1\xe0\x40\x00\x00" +
+		"G\x40\x44\x80\x00\x00\x00\x00\x00" +
+		"\x86\x86e.")
+	if !bytes.Equal(msg, want) {
+		t.Errorf("got\n%q\nwant\n%q", msg, want)
+	}
+}
+
+func TestGraphiteWriter(t *testing.T) {
+	for _, protocol := range []string{"plaintext", "pickle"} {
+		l, received := carbonListener(t)
+		w := newTestGraphiteWriter(t, l.Addr().String(), protocol, testSnapshot())
+		if err := w.push(graphiteTime); err != nil {
+			t.Fatal(err)
+		}
+		w.conn.Close()
+		l.Close()
+
+		datapoints := graphiteDatapoints(testSnapshot(), w.config.Template, w.hostname)
+		want := graphitePlaintext(datapoints, graphiteTime)
+		if protocol == "pickle" {
+			want = graphitePickle(datapoints, graphiteTime)
+		}
+		if got := <-received; !bytes.Equal(got, want) {
+			t.Errorf("%s: got\n%q\nwant\n%q", protocol, got, want)
+		}
+		if sent := gather(t, w)["nvidia_graphite_datapoints_total"]; sent.Metric[0].Counter.GetValue() != float64(len(datapoints)) {
+			t.Errorf("%s: got %v, want %d sent datapoints", protocol, sent, len(datapoints))
+		}
+	}
+}
+
+func TestGraphiteWriterRetry(t *testing.T) {
+	data := graphiteDevices()
+	datapoints := graphiteDatapoints(data, "gpu.{hostname}.{minor}.{metric}", "gpu-node-17.example.com")
+	if len(datapoints) <= graphiteBatch || len(datapoints) > 2*graphiteBatch {
+		t.Fatalf("got %d datapoints, want two messages", len(datapoints))
+	}
+
+	// The first message is written before the connection breaks, only the
+	// second one is sent again.
+	l, received := carbonListener(t)
+	w := newTestGraphiteWriter(t, l.Addr().String(), "plaintext", data)
+	broken := &brokenConn{writes: 1}
+	w.conn = broken
+	if err := w.push(graphiteTime); err != nil {
+		t.Fatal(err)
+	}
+	w.conn.Close()
+	l.Close()
+
+	if want := graphitePlaintext(datapoints[:graphiteBatch], graphiteTime); len(broken.messages) != 1 || !bytes.Equal(broken.messages[0], want) {
+		t.Errorf("got %d messages on the broken connection, want the first", len(broken.messages))
+	}
+	if got, want := <-received, graphitePlaintext(datapoints[graphiteBatch:], graphiteTime); !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes on the new connection, want the %d bytes of the second message", len(got), len(want))
+	}
+	families := gather(t, w)["nvidia_graphite_datapoints_total"]
+	if len(families.Metric) != 1 || families.Metric[0].Counter.GetValue() != float64(len(datapoints)) {
+		t.Errorf("got %v, want %d sent datapoints", families, len(datapoints))
+	}
+
+	// Carbon is down, the datapoints of the failed message are dropped.
+	w = newTestGraphiteWriter(t, l.Addr().String(), "plaintext", data)
+	w.conn = &brokenConn{writes: 1}
+	if err := w.push(graphiteTime); err == nil {
+		t.Fatal("expected an error")
+	}
+	families = gather(t, w)["nvidia_graphite_datapoints_total"]
+	if len(families.Metric) != 2 {
+		t.Fatalf("got %v, want sent and dropped datapoints", families)
+	}
+	for _, m := range families.Metric {
+		want := float64(graphiteBatch)
+		if m.Label[0].GetValue() == "dropped" {
+			want = float64(len(datapoints) - graphiteBatch)
+		}
+		if m.Counter.GetValue() != want {
+			t.Errorf("got %s %v, want %v", m.Label[0].GetValue(), m.Counter.GetValue(), want)
+		}
+	}
+}
+
+func TestNewGraphiteWriterInvalid(t *testing.T) {
+	for _, config := range []GraphiteConfig{
+		{Protocol: "json", Template: "gpu.{metric}"},
+		{Protocol: "plaintext", Template: "gpu.{host}.{metric}"},
+		{Protocol: "pickle", Template: "gpu.{hostname}"},
+	} {
+		if _, err := newGraphiteWriter(config, &staticBackend{}); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// grpcService is the path prefix of the methods of the Telemetry service,
+// see telemetry.proto.
+const grpcService = "/nvidiaexporter.v1.Telemetry/"
+
+// grpcMaxRequest is the maximum size of a request message.
+const grpcMaxRequest = 1 << 20
+
+// gRPC status codes, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcOK              = 0
+	grpcCanceled        = 1
+	grpcInvalidArgument = 3
+	grpcNotFound        = 5
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+	grpcUnavailable     = 14
+)
+
+var grpcCodeNames = map[int]string{
+	grpcOK:              "OK",
+	grpcCanceled:        "CANCELED",
+	grpcInvalidArgument: "INVALID_ARGUMENT",
+	grpcNotFound:        "NOT_FOUND",
+	grpcUnimplemented:   "UNIMPLEMENTED",
+	grpcInternal:        "INTERNAL",
+	grpcUnavailable:     "UNAVAILABLE",
+}
+
+// grpcStatus is the status a call ends with.
+type grpcStatus struct {
+	code    int
+	message string
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) *grpcStatus {
+	return &grpcStatus{code, fmt.Sprintf(format, args...)}
+}
+
+// grpcServer serves the Telemetry service of telemetry.proto. It speaks the
+// gRPC protocol over the HTTP/2 of net/http rather than pulling in a gRPC
+// library, with hand encoded messages. ListDevices and GetDevice serve the
+// latest snapshot of the cache, WatchDevices the snapshots of the stream.
+type grpcServer struct {
+	cache    *snapshotCache
+	stream   *streamer
+	requests *counterVec
+}
+
+func newGRPCServer(cache *snapshotCache, stream *streamer) *grpcServer {
+	return &grpcServer{
+		cache:  cache,
+		stream: stream,
+		requests: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "grpc_requests_total",
+				Help:      "gRPC requests by method and status code",
+			},
+			[]string{"method", "code"},
+		),
+	}
+}
+
+func (s *grpcServer) Describe(descs chan<- *prometheus.Desc) {
+	s.requests.Describe(descs)
+}
+
+func (s *grpcServer) Collect(metrics chan<- prometheus.Metric) {
+	s.requests.Collect(metrics)
+}
+
+// listenAndServe serves on a TCP address, or on a unix socket given as
+// unix:///path/to/socket. With a certificate and key it serves over TLS,
+// otherwise over plaintext HTTP/2.
+func (s *grpcServer) listenAndServe(address, certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("gRPC over TLS needs both a certificate and a key file")
+	}
+	l, err := grpcListen(address)
+	if err != nil {
+		return err
+	}
+	return s.serve(l, certFile, keyFile)
+}
+
+// serve serves on l until it fails. net/http negotiates HTTP/2 with TLS on
+// every Go version, without TLS it needs Go 1.24.
+func (s *grpcServer) serve(l net.Listener, certFile, keyFile string) error {
+	srv := &http.Server{Handler: s}
+	if certFile != "" {
+		return srv.ServeTLS(l, certFile, keyFile)
+	}
+	if err := h2cServer(srv); err != nil {
+		l.Close()
+		return err
+	}
+	return srv.Serve(l)
+}
+
+func grpcListen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, "unix://")
+	// A socket left behind by a previous run would fail the listen, any
+	// other file is left alone.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+func (s *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	method := strings.TrimPrefix(r.URL.Path, grpcService)
+	status := s.call(w, r, method)
+	if status == nil {
+		status = &grpcStatus{code: grpcOK}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(status.code))
+	if status.message != "" {
+		w.Header().Set("Grpc-Message", url.PathEscape(status.message))
+	}
+
+	if method != "ListDevices" && method != "GetDevice" && method != "WatchDevices" {
+		method = "unknown"
+	}
+	s.requests.WithLabelValues(method, grpcCodeNames[status.code]).Inc()
+}
+
+func (s *grpcServer) call(w http.ResponseWriter, r *http.Request, method string) *grpcStatus {
+	if !strings.HasPrefix(r.URL.Path, grpcService) {
+		return grpcErrorf(grpcUnimplemented, "unknown service %s", r.URL.Path)
+	}
+	req, status := readGRPCMessage(r.Body)
+	if status != nil {
+		return status
+	}
+	fields, err := protoStrings(req)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "invalid request: %s", err)
+	}
+
+	switch method {
+	case "ListDevices":
+		data, collected, err := s.cache.latest()
+		if err != nil {
+			return grpcErrorf(grpcUnavailable, "%s", err)
+		}
+		return writeGRPCMessage(w, encodeGRPCSnapshot(collected, data.Devices))
+
+	case "GetDevice":
+		// The last value of a repeated scalar field wins.
+		var uuid string
+		if n := len(fields[1]); n > 0 {
+			uuid = fields[1][n-1]
+		}
+		if uuid == "" {
+			return grpcErrorf(grpcInvalidArgument, "uuid is required")
+		}
+		data, collected, err := s.cache.latest()
+		if err != nil {
+			return grpcErrorf(grpcUnavailable, "%s", err)
+		}
+		for _, d := range data.Devices {
+			if strings.EqualFold(d.UUID, uuid) {
+				msg := proto.NewBuffer(nil)
+				protoBytes(msg, 1, encodeGRPCTimestamp(collected))
+				protoBytes(msg, 2, encodeGRPCDevice(d))
+				return writeGRPCMessage(w, msg.Bytes())
+			}
+		}
+		return grpcErrorf(grpcNotFound, "device %s not found", uuid)
+
+	case "WatchDevices":
+		c := &streamClient{frames: make(chan streamFrame, 1)}
+		if len(fields[1]) > 0 {
+			c.devices = make(map[string]bool)
+			for _, u := range fields[1] {
+				c.devices[strings.ToLower(u)] = true
+			}
+		}
+		s.stream.subscribe(c)
+		defer s.stream.unsubscribe(c)
+		for {
+			select {
+			case frame := <-c.frames:
+				// A failed collection ends the call, clients retry as
+				// they would on a lost connection.
+				if frame.err != nil {
+					return grpcErrorf(grpcUnavailable, "%s", frame.err)
+				}
+				var devices []*Device
+				for _, d := range frame.snapshot.Devices {
+					if c.devices == nil || c.devices[strings.ToLower(d.UUID)] {
+						devices = append(devices, d)
+					}
+				}
+				if status := writeGRPCMessage(w, encodeGRPCSnapshot(frame.snapshot.Timestamp, devices)); status != nil {
+					return status
+				}
+			case <-r.Context().Done():
+				return grpcErrorf(grpcCanceled, "%s", r.Context().Err())
+			}
+		}
+	}
+	return grpcErrorf(grpcUnimplemented, "unknown method %s", method)
+}
+
+// readGRPCMessage reads the single, length prefixed message of a request.
+func readGRPCMessage(body io.Reader) ([]byte, *grpcStatus) {
+	frame, err := ioutil.ReadAll(io.LimitReader(body, grpcMaxRequest+5))
+	if err != nil {
+		return nil, grpcErrorf(grpcInternal, "reading request: %s", err)
+	}
+	if len(frame) < 5 {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	if frame[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages aren't supported")
+	}
+	if n := binary.BigEndian.Uint32(frame[1:]); n > grpcMaxRequest || int(n) != len(frame)-5 {
+		return nil, grpcErrorf(grpcInvalidArgument, "expected a single request message of at most %d bytes", grpcMaxRequest)
+	}
+	return frame[5:], nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) *grpcStatus {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := w.Write(append(frame, msg...)); err != nil {
+		return grpcErrorf(grpcUnavailable, "%s", err)
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func encodeGRPCSnapshot(now time.Time, devices []*Device) []byte {
+	msg := proto.NewBuffer(nil)
+	protoBytes(msg, 1, encodeGRPCTimestamp(now))
+	for _, d := range devices {
+		protoBytes(msg, 2, encodeGRPCDevice(d))
+	}
+	return msg.Bytes()
+}
+
+// encodeGRPCTimestamp encodes a google.protobuf.Timestamp.
+func encodeGRPCTimestamp(t time.Time) []byte {
+	msg := proto.NewBuffer(nil)
+	protoVarint(msg, 1, uint64(t.Unix()))
+	if t.Nanosecond() != 0 {
+		protoVarint(msg, 2, uint64(t.Nanosecond()))
+	}
+	return msg.Bytes()
+}
+
+func encodeGRPCDevice(d *Device) []byte {
+	msg := proto.NewBuffer(nil)
+	for i, s := range []string{d.Index, d.MinorNumber, d.Name, d.UUID} {
+		if s != "" {
+			protoString(msg, uint64(1+i), s)
+		}
+	}
+	for i, v := range []float64{
+		d.Temperature, d.PowerUsage, d.PowerUsageAverage, d.FanSpeed,
+		d.MemoryTotal, d.MemoryUsed,
+		d.UtilizationMemory, d.UtilizationGPU, d.UtilizationGPUAverage,
+	} {
+		protoDouble(msg, uint64(5+i), v)
+	}
+
+	if c := d.Clocks; c != nil {
+		protoBytes(msg, 14, encodeGRPCDoubles(c.Graphics, c.SM, c.Memory, c.Video, c.MaxGraphics, c.MaxSM, c.MaxMemory, c.MaxVideo))
+	}
+	if e := d.ECC; e != nil {
+		protoBytes(msg, 15, encodeGRPCDoubles(e.Enabled, e.VolatileCorrected, e.VolatileUncorrected, e.AggregateCorrected, e.AggregateUncorrected))
+	}
+	if p := d.PCIe; p != nil {
+		pcie := proto.NewBuffer(nil)
+		if p.BusID != "" {
+			protoString(pcie, 1, p.BusID)
+		}
+		for i, v := range []float64{p.LinkGen, p.LinkGenMax, p.LinkWidth, p.LinkWidthMax, p.TxBytes, p.RxBytes, p.ReplayCounter} {
+			protoDouble(pcie, uint64(2+i), v)
+		}
+		protoBytes(msg, 16, pcie.Bytes())
+	}
+	for _, p := range d.Processes {
+		protoBytes(msg, 17, encodeGRPCFields([]string{p.PID, p.Name, p.Type}, p.MemoryUsed).Bytes())
+	}
+	for _, m := range d.MigInstances {
+		protoBytes(msg, 18, encodeGRPCFields(
+			[]string{m.GPUInstance, m.ComputeInstance, m.Profile, m.UUID},
+			m.GPUInstanceSlices, m.ComputeInstanceSlices, m.MemoryTotal, m.MemoryUsed,
+		).Bytes())
+	}
+
+	// Map fields are repeated key/value entries, sorted for a deterministic
+	// encoding.
+	names := make([]string, 0, len(d.DCGMFields))
+	for name := range d.DCGMFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := proto.NewBuffer(nil)
+		protoString(entry, 1, name)
+		protoDouble(entry, 2, d.DCGMFields[name])
+		protoBytes(msg, 19, entry.Bytes())
+	}
+	fields := make([]string, 0, len(d.Errors))
+	for field := range d.Errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		entry := proto.NewBuffer(nil)
+		protoString(entry, 1, field)
+		protoString(entry, 2, d.Errors[field])
+		protoBytes(msg, 20, entry.Bytes())
+	}
+
+	if m := d.MigMode; m != nil {
+		protoBytes(msg, 21, encodeGRPCDoubles(m.Current, m.Pending))
+	}
+	if d.VirtualizationMode != "" {
+		protoString(msg, 22, d.VirtualizationMode)
+	}
+	for _, v := range d.Vgpus {
+		protoBytes(msg, 23, encodeGRPCFields(
+			[]string{v.Instance, v.UUID, v.Type, v.VMID, v.VMIDType},
+			v.FramebufferUsed, v.EncoderSessions, v.UtilizationSM, v.UtilizationMemory, v.UtilizationEncoder, v.UtilizationDecoder,
+		).Bytes())
+	}
+	for _, t := range d.VgpuTypes {
+		vgpuType := encodeGRPCFields([]string{t.Name, t.Class}, t.Framebuffer, t.MaxInstances)
+		if t.Creatable {
+			protoVarint(vgpuType, 5, 1)
+		}
+		protoBytes(msg, 24, vgpuType.Bytes())
+	}
+	for _, l := range d.NVLinks {
+		protoBytes(msg, 25, encodeGRPCFields(
+			[]string{l.Link, l.RemoteType, l.RemoteBusID},
+			l.Active, l.TxBytes, l.RxBytes, l.ReplayErrors, l.RecoveryErrors, l.CRCFlitErrors, l.CRCDataErrors,
+		).Bytes())
+	}
+	if f := d.Fabric; f != nil {
+		protoBytes(msg, 26, encodeGRPCFields([]string{f.State, f.Status, f.CliqueID}).Bytes())
+	}
+	return msg.Bytes()
+}
+
+// encodeGRPCFields encodes a message of string fields numbered from 1,
+// followed by double fields.
+func encodeGRPCFields(texts []string, doubles ...float64) *proto.Buffer {
+	msg := proto.NewBuffer(nil)
+	for i, s := range texts {
+		if s != "" {
+			protoString(msg, uint64(1+i), s)
+		}
+	}
+	for i, v := range doubles {
+		protoDouble(msg, uint64(1+len(texts)+i), v)
+	}
+	return msg
+}
+
+// encodeGRPCDoubles encodes a message of double fields numbered from 1.
+func encodeGRPCDoubles(values ...float64) []byte {
+	msg := proto.NewBuffer(nil)
+	for i, v := range values {
+		protoDouble(msg, uint64(1+i), v)
+	}
+	return msg.Bytes()
+}
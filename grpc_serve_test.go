@@ -0,0 +1,204 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key to dir.
+func writeTestCertificate(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nvidia-exporter"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+// serveGRPC serves s on l in the background, over TLS with a certificate.
+func serveGRPC(t *testing.T, s *grpcServer, l net.Listener, certFile, keyFile string) {
+	go func() {
+		if err := s.serve(l, certFile, keyFile); err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Errorf("serving gRPC: %s", err)
+		}
+	}()
+}
+
+// callGRPC calls method over HTTP/2 and returns the status and messages.
+func callGRPC(t *testing.T, client *http.Client, base, method string, msg []byte) (string, string, [][]byte) {
+	resp, err := client.Do(grpcClientRequest(t, context.Background(), base, method, msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("got %s, want HTTP/2", resp.Proto)
+	}
+	return grpcResponse(t, resp)
+}
+
+func grpcClientRequest(t *testing.T, ctx context.Context, base, method string, msg []byte) *http.Request {
+	r := grpcRequest(method, msg)
+	req, err := http.NewRequestWithContext(ctx, "POST", base+r.URL.Path, r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = r.Header
+	req.Header.Set("Te", "trailers")
+	return req
+}
+
+func TestGRPCServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, pool := writeTestCertificate(t, dir)
+	socket := filepath.Join(dir, "nvidia-exporter.sock")
+
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	for _, test := range []struct {
+		name, address, base string
+		tls                 bool
+		transport           *http.Transport
+	}{
+		{
+			name: "plaintext", address: "127.0.0.1:0",
+			transport: &http.Transport{Protocols: &h2c},
+		},
+		{
+			name: "TLS", address: "127.0.0.1:0", tls: true,
+			transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true},
+		},
+		{
+			name: "unix socket", address: "unix://" + socket, base: "http://localhost",
+			transport: &http.Transport{
+				Protocols: &h2c,
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	} {
+		s := newGRPCServer(newSnapshotCache(&staticBackend{metrics: &Metrics{Devices: grpcTestDevices()}}), nil)
+		l, err := grpcListen(test.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := test.base
+		if base == "" {
+			base = "http://" + l.Addr().String()
+		}
+		if test.tls {
+			base = "https://" + l.Addr().String()
+			serveGRPC(t, s, l, certFile, keyFile)
+		} else {
+			serveGRPC(t, s, l, "", "")
+		}
+
+		client := &http.Client{Transport: test.transport, Timeout: 5 * time.Second}
+		status, message, messages := callGRPC(t, client, base, "ListDevices", nil)
+		var snapshot testSnapshotMsg
+		if status != "0" || len(messages) != 1 {
+			t.Errorf("%s: got status %s %q and %d messages", test.name, status, message, len(messages))
+		} else if err := proto.Unmarshal(messages[0], &snapshot); err != nil || len(snapshot.Devices) != 2 || snapshot.Devices[0].Fabric == nil {
+			t.Errorf("%s: got %v, %v, want both devices", test.name, snapshot.Devices, err)
+		}
+		l.Close()
+		test.transport.CloseIdleConnections()
+	}
+}
+
+func TestGRPCWatchDevices(t *testing.T) {
+	stream := newStreamer(&staticBackend{metrics: &Metrics{Devices: grpcTestDevices()}}, 10*time.Millisecond)
+	s := newGRPCServer(newSnapshotCache(&staticBackend{}), stream)
+	l, err := grpcListen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serveGRPC(t, s, l, "", "")
+
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: &h2c}
+	defer transport.CloseIdleConnections()
+
+	req := proto.NewBuffer(nil)
+	protoString(req, 1, "GPU-9B2D1C7E-0F43-4A55-8E61-2C7D9A0B3E12")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := (&http.Client{Transport: transport}).Do(grpcClientRequest(t, ctx, "http://"+l.Addr().String(), "WatchDevices", req.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Snapshots keep coming, limited to the requested device.
+	header := make([]byte, 5)
+	for i := 0; i < 3; i++ {
+		if _, err := io.ReadFull(resp.Body, header); err != nil {
+			t.Fatalf("snapshot %d: %s", i, err)
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(resp.Body, msg); err != nil {
+			t.Fatalf("snapshot %d: %s", i, err)
+		}
+		var snapshot testSnapshotMsg
+		if err := proto.Unmarshal(msg, &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshot.Devices) != 1 || snapshot.Devices[0].Name != "Tesla T4" || snapshot.Timestamp == nil {
+			t.Errorf("snapshot %d: got %v, want the Tesla T4", i, snapshot)
+		}
+	}
+	cancel()
+}
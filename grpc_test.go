@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The messages of telemetry.proto, decoded by the protobuf library to check
+// the encoding by hand.
+
+type testSnapshotMsg struct {
+	Timestamp *testTimestamp   `protobuf:"bytes,1,opt,name=timestamp" json:"timestamp"`
+	Devices   []*testDeviceMsg `protobuf:"bytes,2,rep,name=devices" json:"devices"`
+}
+
+type testDeviceSnapshotMsg struct {
+	Timestamp *testTimestamp `protobuf:"bytes,1,opt,name=timestamp" json:"timestamp"`
+	Device    *testDeviceMsg `protobuf:"bytes,2,opt,name=device" json:"device"`
+}
+
+type testTimestamp struct {
+	Seconds int64 `protobuf:"varint,1,opt,name=seconds,proto3" json:"seconds"`
+	Nanos   int32 `protobuf:"varint,2,opt,name=nanos,proto3" json:"nanos,omitempty"`
+}
+
+type testDeviceMsg struct {
+	Index                 string             `protobuf:"bytes,1,opt,name=index,proto3" json:"index"`
+	MinorNumber           string             `protobuf:"bytes,2,opt,name=minor_number,proto3" json:"minor_number"`
+	Name                  string             `protobuf:"bytes,3,opt,name=name,proto3" json:"name"`
+	UUID                  string             `protobuf:"bytes,4,opt,name=uuid,proto3" json:"uuid"`
+	Temperature           float64            `protobuf:"fixed64,5,opt,name=temperature_celsius,proto3" json:"temperature_celsius"`
+	PowerUsage            float64            `protobuf:"fixed64,6,opt,name=power_usage_milliwatts,proto3" json:"power_usage_milliwatts"`
+	PowerUsageAverage     float64            `protobuf:"fixed64,7,opt,name=power_usage_average_milliwatts,proto3" json:"power_usage_average_milliwatts"`
+	FanSpeed              float64            `protobuf:"fixed64,8,opt,name=fan_speed_percent,proto3" json:"fan_speed_percent"`
+	MemoryTotal           float64            `protobuf:"fixed64,9,opt,name=memory_total_bytes,proto3" json:"memory_total_bytes"`
+	MemoryUsed            float64            `protobuf:"fixed64,10,opt,name=memory_used_bytes,proto3" json:"memory_used_bytes"`
+	UtilizationMemory     float64            `protobuf:"fixed64,11,opt,name=utilization_memory_percent,proto3" json:"utilization_memory_percent"`
+	UtilizationGPU        float64            `protobuf:"fixed64,12,opt,name=utilization_gpu_percent,proto3" json:"utilization_gpu_percent"`
+	UtilizationGPUAverage float64            `protobuf:"fixed64,13,opt,name=utilization_gpu_average_percent,proto3" json:"utilization_gpu_average_percent"`
+	Clocks                *testClocksMsg     `protobuf:"bytes,14,opt,name=clocks" json:"clocks,omitempty"`
+	ECC                   *testECCMsg        `protobuf:"bytes,15,opt,name=ecc" json:"ecc,omitempty"`
+	PCIe                  *testPCIeMsg       `protobuf:"bytes,16,opt,name=pcie" json:"pcie,omitempty"`
+	Processes             []*testProcessMsg  `protobuf:"bytes,17,rep,name=processes" json:"processes,omitempty"`
+	MigInstances          []*testMigMsg      `protobuf:"bytes,18,rep,name=mig_instances" json:"mig_instances,omitempty"`
+	DCGMFields            map[string]float64 `protobuf:"bytes,19,rep,name=dcgm_fields" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"fixed64,2,opt,name=value,proto3" json:"dcgm_fields,omitempty"`
+	Errors                map[string]string  `protobuf:"bytes,20,rep,name=errors" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3" json:"errors,omitempty"`
+	MigMode               *testMigModeMsg    `protobuf:"bytes,21,opt,name=mig_mode" json:"mig_mode,omitempty"`
+	VirtualizationMode    string             `protobuf:"bytes,22,opt,name=virtualization_mode,proto3" json:"virtualization_mode,omitempty"`
+	Vgpus                 []*testVgpuMsg     `protobuf:"bytes,23,rep,name=vgpus" json:"vgpus,omitempty"`
+	VgpuTypes             []*testVgpuTypeMsg `protobuf:"bytes,24,rep,name=vgpu_types" json:"vgpu_types,omitempty"`
+	NVLinks               []*testNVLinkMsg   `protobuf:"bytes,25,rep,name=nvlinks" json:"nvlinks,omitempty"`
+	Fabric                *testFabricMsg     `protobuf:"bytes,26,opt,name=fabric" json:"fabric,omitempty"`
+}
+
+type testClocksMsg struct {
+	Graphics    float64 `protobuf:"fixed64,1,opt,name=graphics_mhz,proto3" json:"graphics_mhz"`
+	SM          float64 `protobuf:"fixed64,2,opt,name=sm_mhz,proto3" json:"sm_mhz"`
+	Memory      float64 `protobuf:"fixed64,3,opt,name=memory_mhz,proto3" json:"memory_mhz"`
+	Video       float64 `protobuf:"fixed64,4,opt,name=video_mhz,proto3" json:"video_mhz"`
+	MaxGraphics float64 `protobuf:"fixed64,5,opt,name=max_graphics_mhz,proto3" json:"max_graphics_mhz"`
+	MaxSM       float64 `protobuf:"fixed64,6,opt,name=max_sm_mhz,proto3" json:"max_sm_mhz"`
+	MaxMemory   float64 `protobuf:"fixed64,7,opt,name=max_memory_mhz,proto3" json:"max_memory_mhz"`
+	MaxVideo    float64 `protobuf:"fixed64,8,opt,name=max_video_mhz,proto3" json:"max_video_mhz"`
+}
+
+type testECCMsg struct {
+	Enabled              float64 `protobuf:"fixed64,1,opt,name=enabled,proto3" json:"enabled"`
+	VolatileCorrected    float64 `protobuf:"fixed64,2,opt,name=volatile_corrected,proto3" json:"volatile_corrected"`
+	VolatileUncorrected  float64 `protobuf:"fixed64,3,opt,name=volatile_uncorrected,proto3" json:"volatile_uncorrected"`
+	AggregateCorrected   float64 `protobuf:"fixed64,4,opt,name=aggregate_corrected,proto3" json:"aggregate_corrected"`
+	AggregateUncorrected float64 `protobuf:"fixed64,5,opt,name=aggregate_uncorrected,proto3" json:"aggregate_uncorrected"`
+}
+
+type testPCIeMsg struct {
+	BusID         string  `protobuf:"bytes,1,opt,name=bus_id,proto3" json:"bus_id"`
+	LinkGen       float64 `protobuf:"fixed64,2,opt,name=link_gen,proto3" json:"link_gen"`
+	LinkGenMax    float64 `protobuf:"fixed64,3,opt,name=link_gen_max,proto3" json:"link_gen_max"`
+	LinkWidth     float64 `protobuf:"fixed64,4,opt,name=link_width,proto3" json:"link_width"`
+	LinkWidthMax  float64 `protobuf:"fixed64,5,opt,name=link_width_max,proto3" json:"link_width_max"`
+	TxBytes       float64 `protobuf:"fixed64,6,opt,name=tx_bytes_per_second,proto3" json:"tx_bytes_per_second"`
+	RxBytes       float64 `protobuf:"fixed64,7,opt,name=rx_bytes_per_second,proto3" json:"rx_bytes_per_second"`
+	ReplayCounter float64 `protobuf:"fixed64,8,opt,name=replay_counter,proto3" json:"replay_counter"`
+}
+
+type testProcessMsg struct {
+	PID        string  `protobuf:"bytes,1,opt,name=pid,proto3" json:"pid"`
+	Name       string  `protobuf:"bytes,2,opt,name=name,proto3" json:"name"`
+	Type       string  `protobuf:"bytes,3,opt,name=type,proto3" json:"type"`
+	MemoryUsed float64 `protobuf:"fixed64,4,opt,name=memory_used_bytes,proto3" json:"memory_used_bytes"`
+}
+
+type testMigMsg struct {
+	GPUInstance           string  `protobuf:"bytes,1,opt,name=gpu_instance,proto3" json:"gpu_instance"`
+	ComputeInstance       string  `protobuf:"bytes,2,opt,name=compute_instance,proto3" json:"compute_instance"`
+	Profile               string  `protobuf:"bytes,3,opt,name=profile,proto3" json:"profile"`
+	UUID                  string  `protobuf:"bytes,4,opt,name=uuid,proto3" json:"uuid"`
+	GPUInstanceSlices     float64 `protobuf:"fixed64,5,opt,name=gpu_instance_slices,proto3" json:"gpu_instance_slices"`
+	ComputeInstanceSlices float64 `protobuf:"fixed64,6,opt,name=compute_instance_slices,proto3" json:"compute_instance_slices"`
+	MemoryTotal           float64 `protobuf:"fixed64,7,opt,name=memory_total_bytes,proto3" json:"memory_total_bytes"`
+	MemoryUsed            float64 `protobuf:"fixed64,8,opt,name=memory_used_bytes,proto3" json:"memory_used_bytes"`
+}
+
+type testMigModeMsg struct {
+	Current float64 `protobuf:"fixed64,1,opt,name=current,proto3" json:"current"`
+	Pending float64 `protobuf:"fixed64,2,opt,name=pending,proto3" json:"pending"`
+}
+
+type testVgpuMsg struct {
+	Instance           string  `protobuf:"bytes,1,opt,name=instance,proto3" json:"instance"`
+	UUID               string  `protobuf:"bytes,2,opt,name=uuid,proto3" json:"uuid"`
+	Type               string  `protobuf:"bytes,3,opt,name=type,proto3" json:"type"`
+	VMID               string  `protobuf:"bytes,4,opt,name=vm_id,proto3" json:"vm_id"`
+	VMIDType           string  `protobuf:"bytes,5,opt,name=vm_id_type,proto3" json:"vm_id_type"`
+	FramebufferUsed    float64 `protobuf:"fixed64,6,opt,name=framebuffer_used_bytes,proto3" json:"framebuffer_used_bytes"`
+	EncoderSessions    float64 `protobuf:"fixed64,7,opt,name=encoder_sessions,proto3" json:"encoder_sessions"`
+	UtilizationSM      float64 `protobuf:"fixed64,8,opt,name=utilization_sm_percent,proto3" json:"utilization_sm_percent"`
+	UtilizationMemory  float64 `protobuf:"fixed64,9,opt,name=utilization_memory_percent,proto3" json:"utilization_memory_percent"`
+	UtilizationEncoder float64 `protobuf:"fixed64,10,opt,name=utilization_encoder_percent,proto3" json:"utilization_encoder_percent"`
+	UtilizationDecoder float64 `protobuf:"fixed64,11,opt,name=utilization_decoder_percent,proto3" json:"utilization_decoder_percent"`
+}
+
+type testVgpuTypeMsg struct {
+	Name         string  `protobuf:"bytes,1,opt,name=name,proto3" json:"name"`
+	Class        string  `protobuf:"bytes,2,opt,name=class,proto3" json:"class"`
+	Framebuffer  float64 `protobuf:"fixed64,3,opt,name=framebuffer_bytes,proto3" json:"framebuffer_bytes"`
+	MaxInstances float64 `protobuf:"fixed64,4,opt,name=max_instances,proto3" json:"max_instances"`
+	Creatable    bool    `protobuf:"varint,5,opt,name=creatable,proto3" json:"creatable"`
+}
+
+type testNVLinkMsg struct {
+	Link           string  `protobuf:"bytes,1,opt,name=link,proto3" json:"link"`
+	RemoteType     string  `protobuf:"bytes,2,opt,name=remote_type,proto3" json:"remote_type"`
+	RemoteBusID    string  `protobuf:"bytes,3,opt,name=remote_bus_id,proto3" json:"remote_bus_id"`
+	Active         float64 `protobuf:"fixed64,4,opt,name=active,proto3" json:"active"`
+	TxBytes        float64 `protobuf:"fixed64,5,opt,name=tx_bytes,proto3" json:"tx_bytes"`
+	RxBytes        float64 `protobuf:"fixed64,6,opt,name=rx_bytes,proto3" json:"rx_bytes"`
+	ReplayErrors   float64 `protobuf:"fixed64,7,opt,name=replay_errors,proto3" json:"replay_errors"`
+	RecoveryErrors float64 `protobuf:"fixed64,8,opt,name=recovery_errors,proto3" json:"recovery_errors"`
+	CRCFlitErrors  float64 `protobuf:"fixed64,9,opt,name=crc_flit_errors,proto3" json:"crc_flit_errors"`
+	CRCDataErrors  float64 `protobuf:"fixed64,10,opt,name=crc_data_errors,proto3" json:"crc_data_errors"`
+}
+
+type testFabricMsg struct {
+	State    string `protobuf:"bytes,1,opt,name=state,proto3" json:"state"`
+	Status   string `protobuf:"bytes,2,opt,name=status,proto3" json:"status"`
+	CliqueID string `protobuf:"bytes,3,opt,name=clique_id,proto3" json:"clique_id"`
+}
+
+func (m *testSnapshotMsg) Reset()               { *m = testSnapshotMsg{} }
+func (m *testSnapshotMsg) String() string       { return proto.CompactTextString(m) }
+func (*testSnapshotMsg) ProtoMessage()          {}
+func (m *testDeviceSnapshotMsg) Reset()         { *m = testDeviceSnapshotMsg{} }
+func (m *testDeviceSnapshotMsg) String() string { return proto.CompactTextString(m) }
+func (*testDeviceSnapshotMsg) ProtoMessage()    {}
+func (m *testTimestamp) Reset()                 { *m = testTimestamp{} }
+func (m *testTimestamp) String() string         { return proto.CompactTextString(m) }
+func (*testTimestamp) ProtoMessage()            {}
+func (m *testDeviceMsg) Reset()                 { *m = testDeviceMsg{} }
+func (m *testDeviceMsg) String() string         { return proto.CompactTextString(m) }
+func (*testDeviceMsg) ProtoMessage()            {}
+func (m *testClocksMsg) Reset()                 { *m = testClocksMsg{} }
+func (m *testClocksMsg) String() string         { return proto.CompactTextString(m) }
+func (*testClocksMsg) ProtoMessage()            {}
+func (m *testECCMsg) Reset()                    { *m = testECCMsg{} }
+func (m *testECCMsg) String() string            { return proto.CompactTextString(m) }
+func (*testECCMsg) ProtoMessage()               {}
+func (m *testPCIeMsg) Reset()                   { *m = testPCIeMsg{} }
+func (m *testPCIeMsg) String() string           { return proto.CompactTextString(m) }
+func (*testPCIeMsg) ProtoMessage()              {}
+func (m *testProcessMsg) Reset()                { *m = testProcessMsg{} }
+func (m *testProcessMsg) String() string        { return proto.CompactTextString(m) }
+func (*testProcessMsg) ProtoMessage()           {}
+func (m *testMigMsg) Reset()                    { *m = testMigMsg{} }
+func (m *testMigMsg) String() string            { return proto.CompactTextString(m) }
+func (*testMigMsg) ProtoMessage()               {}
+func (m *testMigModeMsg) Reset()                { *m = testMigModeMsg{} }
+func (m *testMigModeMsg) String() string        { return proto.CompactTextString(m) }
+func (*testMigModeMsg) ProtoMessage()           {}
+func (m *testVgpuMsg) Reset()                   { *m = testVgpuMsg{} }
+func (m *testVgpuMsg) String() string           { return proto.CompactTextString(m) }
+func (*testVgpuMsg) ProtoMessage()              {}
+func (m *testVgpuTypeMsg) Reset()               { *m = testVgpuTypeMsg{} }
+func (m *testVgpuTypeMsg) String() string       { return proto.CompactTextString(m) }
+func (*testVgpuTypeMsg) ProtoMessage()          {}
+func (m *testNVLinkMsg) Reset()                 { *m = testNVLinkMsg{} }
+func (m *testNVLinkMsg) String() string         { return proto.CompactTextString(m) }
+func (*testNVLinkMsg) ProtoMessage()            {}
+func (m *testFabricMsg) Reset()                 { *m = testFabricMsg{} }
+func (m *testFabricMsg) String() string         { return proto.CompactTextString(m) }
+func (*testFabricMsg) ProtoMessage()            {}
+
+// protoField is a field of a message of telemetry.proto. Map fields have
+// the key and value types of their entries.
+type protoField struct {
+	name       string
+	kind       string
+	repeated   bool
+	key, value string
+}
+
+// protoFieldPattern matches the field definitions of telemetry.proto.
+var protoFieldPattern = regexp.MustCompile(`^(repeated )?(?:map<(\w+), (\w+)>|([\w.]+)) (\w+) = (\d+);$`)
+
+// protoRPCPattern matches the methods of the service of telemetry.proto.
+var protoRPCPattern = regexp.MustCompile(`^rpc (\w+)\((\w+)\) returns \((?:stream )?(\w+)\);$`)
+
+// parseTelemetryProto returns the fields of the messages of telemetry.proto
+// by message name and field number, along with google.protobuf.Timestamp,
+// and the response messages of the methods. It only parses the syntax the
+// file uses.
+func parseTelemetryProto(t *testing.T) (map[string]map[uint64]protoField, map[string]string) {
+	body, err := ioutil.ReadFile("telemetry.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[string]map[uint64]protoField{
+		"google.protobuf.Timestamp": {1: {name: "seconds", kind: "int64"}, 2: {name: "nanos", kind: "int32"}},
+	}
+	rpcs := map[string]string{}
+	var fields map[uint64]protoField
+	for i, line := range strings.Split(string(body), "\n") {
+		if c := strings.Index(line, "//"); c >= 0 {
+			line = line[:c]
+		}
+		switch line = strings.TrimSpace(line); {
+		case strings.HasPrefix(line, "message "):
+			fields = map[uint64]protoField{}
+			messages[strings.Fields(line)[1]] = fields
+		case line == "}":
+			fields = nil
+		case strings.HasPrefix(line, "rpc "):
+			m := protoRPCPattern.FindStringSubmatch(line)
+			if m == nil {
+				t.Fatalf("telemetry.proto:%d: unknown syntax %q", i+1, line)
+			}
+			rpcs[m[1]] = m[3]
+		case fields != nil && line != "":
+			m := protoFieldPattern.FindStringSubmatch(line)
+			if m == nil {
+				t.Fatalf("telemetry.proto:%d: unknown syntax %q", i+1, line)
+			}
+			number, _ := strconv.ParseUint(m[6], 10, 29)
+			if _, ok := fields[number]; ok || number == 0 {
+				t.Fatalf("telemetry.proto:%d: invalid or duplicate field number %s", i+1, m[6])
+			}
+			fields[number] = protoField{name: m[5], kind: m[4], repeated: m[1] != "", key: m[2], value: m[3]}
+		}
+	}
+	return messages, rpcs
+}
+
+// decodeProto decodes msg as the named message of telemetry.proto into its
+// values by field name, failing on fields the message doesn't define or
+// encoded with another wire type.
+func decodeProto(messages map[string]map[uint64]protoField, name string, msg []byte) (map[string]interface{}, error) {
+	fields, ok := messages[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown message %s", name)
+	}
+	values := map[string]interface{}{}
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, fmt.Errorf("%s: invalid tag", name)
+		}
+		msg = msg[n:]
+		field, ok := fields[tag>>3]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown field %d", name, tag>>3)
+		}
+		wire := uint64(2)
+		switch field.kind {
+		case "double":
+			wire = 1
+		case "bool", "int32", "int64":
+			wire = 0
+		}
+		if tag&7 != wire {
+			return nil, fmt.Errorf("%s.%s: wire type %d, want %d", name, field.name, tag&7, wire)
+		}
+
+		var value interface{}
+		switch wire {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return nil, fmt.Errorf("%s.%s: invalid varint", name, field.name)
+			}
+			msg = msg[n:]
+			if value = int64(v); field.kind == "bool" {
+				value = v != 0
+			}
+		case 1:
+			if len(msg) < 8 {
+				return nil, fmt.Errorf("%s.%s: truncated", name, field.name)
+			}
+			value, msg = math.Float64frombits(binary.LittleEndian.Uint64(msg)), msg[8:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return nil, fmt.Errorf("%s.%s: invalid length", name, field.name)
+			}
+			b := msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+			if field.kind == "string" {
+				value = string(b)
+				break
+			}
+			kind := field.kind
+			if field.key != "" {
+				kind = name + "." + field.name + "Entry"
+				messages[kind] = map[uint64]protoField{1: {name: "key", kind: field.key}, 2: {name: "value", kind: field.value}}
+			}
+			var err error
+			if value, err = decodeProto(messages, kind, b); err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", name, field.name, err)
+			}
+		}
+
+		switch {
+		case field.key != "":
+			m, _ := values[field.name].(map[string]interface{})
+			if m == nil {
+				m = map[string]interface{}{}
+				values[field.name] = m
+			}
+			entry := value.(map[string]interface{})
+			m[fmt.Sprint(entry["key"])] = entry["value"]
+		case field.repeated:
+			list, _ := values[field.name].([]interface{})
+			values[field.name] = append(list, value)
+		default:
+			values[field.name] = value
+		}
+	}
+	return values, nil
+}
+
+// grpcTestDevices returns the devices of the test snapshot, with MIG, vGPU,
+// NVLink and fabric state on the first.
+func grpcTestDevices() []*Device {
+	devices := testSnapshot().Devices
+	devices[1].DCGMFields["sm_active"] = 0.25
+	d := devices[0]
+	d.MigMode = &MigMode{Current: 1, Pending: 1}
+	d.MigInstances = []*MigInstance{{
+		GPUInstance: "1", ComputeInstance: "0", Profile: "1g.5gb",
+		UUID:              "MIG-5c5b4a1e-7b3d-5f7e-9c1d-2f4e6a8b0c12",
+		GPUInstanceSlices: 1, ComputeInstanceSlices: 1, MemoryTotal: 5 << 30, MemoryUsed: 1 << 30,
+	}}
+	d.VirtualizationMode = "host_vgpu"
+	d.Vgpus = []*Vgpu{{
+		Instance: "3251634213", UUID: "a1b2c3d4-0000-1111-2222-333344445555", Type: "GRID A100-4C",
+		VMID: "vm-17", VMIDType: "uuid", FramebufferUsed: 1 << 30, EncoderSessions: 2,
+		UtilizationSM: 40, UtilizationMemory: 10, UtilizationEncoder: 5,
+	}}
+	d.VgpuTypes = []*VgpuType{
+		{Name: "GRID A100-4C", Class: "Compute", Framebuffer: 4 << 30, MaxInstances: 10, Creatable: true},
+		{Name: "GRID A100-40C", Class: "Compute", Framebuffer: 40 << 30, MaxInstances: 1},
+	}
+	d.NVLinks = []*NVLink{
+		{Link: "0", Active: 1, RemoteType: "switch", RemoteBusID: "0000:05:00.0", TxBytes: 1 << 40, RxBytes: 1 << 39, ReplayErrors: 2, CRCFlitErrors: 7},
+		{Link: "1"},
+	}
+	d.Fabric = &Fabric{State: "completed", Status: "success", CliqueID: "4"}
+	return devices
+}
+
+// grpcRequest frames msg as the request body of a call.
+func grpcRequest(method string, msg []byte) *http.Request {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	r := httptest.NewRequest("POST", grpcService+method, bytes.NewReader(append(frame, msg...)))
+	r.Header.Set("Content-Type", "application/grpc")
+	return r
+}
+
+// grpcResponse returns the status and the messages of a response.
+func grpcResponse(t *testing.T, resp *http.Response) (string, string, [][]byte) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages [][]byte
+	for len(body) >= 5 {
+		n := int(binary.BigEndian.Uint32(body[1:]))
+		messages = append(messages, body[5:5+n])
+		body = body[5+n:]
+	}
+	message, _ := url.PathUnescape(resp.Trailer.Get("Grpc-Message"))
+	return resp.Trailer.Get("Grpc-Status"), message, messages
+}
+
+func grpcCall(t *testing.T, s *grpcServer, method string, msg []byte) (string, string, [][]byte) {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, grpcRequest(method, msg))
+	return grpcResponse(t, rec.Result())
+}
+
+func TestEncodeGRPCSnapshot(t *testing.T) {
+	var msg testSnapshotMsg
+	if err := proto.Unmarshal(encodeGRPCSnapshot(fixedTime.Add(123), grpcTestDevices()), &msg); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "testdata/grpc/snapshot.json", msg)
+}
+
+// TestGRPCProto decodes the responses with the messages of telemetry.proto
+// rather than the test messages above, which mirror the encoder.
+func TestGRPCProto(t *testing.T) {
+	messages, rpcs := parseTelemetryProto(t)
+	cache := newSnapshotCache(&staticBackend{metrics: &Metrics{Devices: grpcTestDevices()}})
+	s := newGRPCServer(cache, newStreamer(cache, time.Hour))
+
+	uuid := proto.NewBuffer(nil)
+	protoString(uuid, 1, "GPU-9b2d1c7e-0f43-4a55-8e61-2c7d9a0b3e12")
+	for _, test := range []struct {
+		method  string
+		request []byte
+		devices int
+	}{
+		{"ListDevices", nil, 2},
+		{"GetDevice", uuid.Bytes(), 1},
+		{"WatchDevices", uuid.Bytes(), 1},
+	} {
+		response, ok := rpcs[test.method]
+		if !ok {
+			t.Fatalf("%s isn't a method of telemetry.proto", test.method)
+		}
+		// WatchDevices runs until the call is canceled.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, grpcRequest(test.method, test.request).WithContext(ctx))
+		cancel()
+		_, _, msgs := grpcResponse(t, rec.Result())
+		if len(msgs) != 1 {
+			t.Fatalf("%s: got %d messages, want 1", test.method, len(msgs))
+		}
+
+		msg, err := decodeProto(messages, response, msgs[0])
+		if err != nil {
+			t.Fatalf("%s: %s", test.method, err)
+		}
+		if timestamp, _ := msg["timestamp"].(map[string]interface{}); timestamp["seconds"] != cache.collected.Unix() {
+			t.Errorf("%s: got timestamp %v, want the collection at %s", test.method, timestamp, cache.collected)
+		}
+		delete(msg, "timestamp")
+		devices, _ := msg["devices"].([]interface{})
+		if device, ok := msg["device"]; ok {
+			devices = append(devices, device)
+		}
+		if len(devices) != test.devices {
+			t.Errorf("%s: got %d devices, want %d", test.method, len(devices), test.devices)
+		}
+		if test.method == "ListDevices" {
+			golden(t, "testdata/grpc/proto.json", msg)
+		}
+	}
+}
+
+func TestGRPCServer(t *testing.T) {
+	backend := &staticBackend{metrics: &Metrics{Devices: grpcTestDevices()}}
+	cache := newSnapshotCache(backend)
+	s := newGRPCServer(cache, nil)
+
+	status, _, messages := grpcCall(t, s, "ListDevices", nil)
+	var snapshot testSnapshotMsg
+	if status != "0" || len(messages) != 1 {
+		t.Fatalf("ListDevices: got status %s and %d messages", status, len(messages))
+	}
+	if err := proto.Unmarshal(messages[0], &snapshot); err != nil || len(snapshot.Devices) != 2 {
+		t.Errorf("ListDevices: got %v, %v, want both devices", snapshot.Devices, err)
+	}
+	collected := &testTimestamp{Seconds: cache.collected.Unix(), Nanos: int32(cache.collected.Nanosecond())}
+	if !proto.Equal(snapshot.Timestamp, collected) {
+		t.Errorf("ListDevices: got timestamp %v, want the collection at %v", snapshot.Timestamp, collected)
+	}
+
+	// UUIDs are matched regardless of case, the last one wins.
+	req := proto.NewBuffer(nil)
+	protoString(req, 1, "GPU-00000000-0000-0000-0000-000000000000")
+	protoString(req, 1, "gpu-9b2d1c7e-0f43-4a55-8e61-2c7d9a0b3e12")
+	status, _, messages = grpcCall(t, s, "GetDevice", req.Bytes())
+	var device testDeviceSnapshotMsg
+	if status != "0" || len(messages) != 1 {
+		t.Fatalf("GetDevice: got status %s and %d messages", status, len(messages))
+	}
+	if err := proto.Unmarshal(messages[0], &device); err != nil || device.Device.Name != "Tesla T4" {
+		t.Errorf("GetDevice: got %v, %v, want the Tesla T4", device.Device, err)
+	}
+	// Both calls are served from the snapshot of the first.
+	if backend.collections != 1 || !proto.Equal(device.Timestamp, collected) {
+		t.Errorf("GetDevice: got %d collections and timestamp %v, want the snapshot of ListDevices", backend.collections, device.Timestamp)
+	}
+
+	for _, test := range []struct {
+		method  string
+		msg     []byte
+		status  string
+		message string
+	}{
+		{"GetDevice", nil, "3", "uuid is required"},
+		{"GetDevice", []byte{0x0a, 0x03, 'G', 'P', 'U'}, "5", "device GPU not found"},
+		{"GetDevice", []byte{0x0a, 0x10}, "3", "invalid request: invalid length of field 1"},
+		{"ListProcesses", nil, "12", "unknown method ListProcesses"},
+	} {
+		status, message, messages := grpcCall(t, s, test.method, test.msg)
+		if status != test.status || message != test.message || len(messages) != 0 {
+			t.Errorf("%s %x: got status %s %q and %d messages, want %s %q", test.method, test.msg, status, message, len(messages), test.status, test.message)
+		}
+	}
+
+	requests := gather(t, s)["nvidia_grpc_requests_total"]
+	counts := map[string]float64{}
+	for _, m := range requests.Metric {
+		labels := map[string]string{}
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		counts[labels["method"]+" "+labels["code"]] = m.Counter.GetValue()
+	}
+	for key, want := range map[string]float64{
+		"ListDevices OK": 1, "GetDevice OK": 1, "GetDevice INVALID_ARGUMENT": 2,
+		"GetDevice NOT_FOUND": 1, "unknown UNIMPLEMENTED": 1,
+	} {
+		if counts[key] != want {
+			t.Errorf("got %v requests %s, want %v", counts[key], key, want)
+		}
+	}
+}
+
+func TestGRPCServerErrors(t *testing.T) {
+	backend := &staticBackend{err: errors.New("could not load NVML library")}
+	s := newGRPCServer(newSnapshotCache(backend), newStreamer(backend, 10*time.Millisecond))
+	if status, message, _ := grpcCall(t, s, "ListDevices", nil); status != "14" || message != "could not load NVML library" {
+		t.Errorf("got status %s %q, want UNAVAILABLE with the error of the backend", status, message)
+	}
+	if status, message, messages := grpcCall(t, s, "WatchDevices", nil); status != "14" || message != "could not load NVML library" || len(messages) != 0 {
+		t.Errorf("WatchDevices: got status %s %q and %d messages, want UNAVAILABLE with the error of the backend", status, message, len(messages))
+	}
+
+	compressed := grpcRequest("ListDevices", nil)
+	body, _ := ioutil.ReadAll(compressed.Body)
+	body[0] = 1
+	compressed.Body = ioutil.NopCloser(bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, compressed)
+	if status, _, _ := grpcResponse(t, rec.Result()); status != "12" {
+		t.Errorf("got status %s for a compressed message, want UNIMPLEMENTED", status)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", grpcService+"ListDevices", nil))
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("got HTTP status %d for a plain request, want 415", rec.Code)
+	}
+}
+
+func TestGRPCListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A socket left behind by a previous run is replaced.
+	path := filepath.Join(dir, "nvidia-exporter.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := grpcListen("unix://" + path)
+	if err != nil {
+		t.Fatalf("listening on a stale socket: %s", err)
+	}
+	l.Close()
+
+	// Any other file is left alone.
+	file := filepath.Join(dir, "exporter.conf")
+	ioutil.WriteFile(file, []byte("keep me\n"), 0644)
+	if _, err := grpcListen("unix://" + file); err == nil {
+		t.Error("expected an error listening on a regular file")
+	}
+	if data, _ := ioutil.ReadFile(file); string(data) != "keep me\n" {
+		t.Errorf("the file was removed or changed, got %q", data)
+	}
+
+	if err := newGRPCServer(newSnapshotCache(&staticBackend{}), nil).listenAndServe("127.0.0.1:0", "server.crt", ""); err == nil {
+		t.Error("expected an error with a certificate but no key")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import "net/http"
+
+// h2cTransport returns a transport speaking HTTP/2 without TLS, as gRPC
+// does with plaintext endpoints.
+func h2cTransport() (http.RoundTripper, error) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Transport{Protocols: &protocols}, nil
+}
+
+// h2cServer makes srv speak HTTP/2 without TLS, as gRPC clients do with
+// plaintext targets.
+func h2cServer(srv *http.Server) error {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv.Protocols = &protocols
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	influxMeasurementEscape = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscape         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// InfluxDBConfig configures writing to an InfluxDB v2 write API.
+type InfluxDBConfig struct {
+	URL       string
+	TokenFile string
+	Org       string
+	Bucket    string
+	Interval  time.Duration
+	Timeout   time.Duration
+}
+
+// influxLine builds a line of the InfluxDB line protocol.
+type influxLine struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]float64
+}
+
+func (l influxLine) write(w *bytes.Buffer, ts int64) {
+	if len(l.fields) == 0 {
+		return
+	}
+	w.WriteString(influxMeasurementEscape.Replace(l.measurement))
+	tags := make([]string, 0, len(l.tags))
+	for k := range l.tags {
+		tags = append(tags, k)
+	}
+	// Tags are sorted for the best write performance.
+	sort.Strings(tags)
+	for _, k := range tags {
+		if l.tags[k] == "" {
+			continue
+		}
+		fmt.Fprintf(w, ",%s=%s", influxTagEscape.Replace(k), influxTagEscape.Replace(l.tags[k]))
+	}
+
+	fields := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	sep := byte(' ')
+	for _, k := range fields {
+		w.WriteByte(sep)
+		sep = ','
+		fmt.Fprintf(w, "%s=%s", influxTagEscape.Replace(k), strconv.FormatFloat(l.fields[k], 'f', -1, 64))
+	}
+	fmt.Fprintf(w, " %d\n", ts)
+}
+
+// influxLines returns the snapshot in the InfluxDB line protocol. Devices
+// are the nvidia_gpu measurement tagged with their identity, processes the
+// nvidia_gpu_process measurement, with values in the units of the metrics.
+func influxLines(data *Metrics, now time.Time) []byte {
+	var w bytes.Buffer
+	ts := now.UnixNano()
+	for _, d := range data.Devices {
+		tags := map[string]string{
+			"index":          d.Index,
+			"minor":          d.MinorNumber,
+			"name":           d.Name,
+			"uuid":           d.UUID,
+			"driver_version": data.Version,
+		}
+		if d.PCIe != nil {
+			tags["pci_bus_id"] = d.PCIe.BusID
+		}
+		fields := d.readings()
+		// The line protocol has no NaN or infinity.
+		for field, v := range fields {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				delete(fields, field)
+			}
+		}
+		influxLine{"nvidia_gpu", tags, fields}.write(&w, ts)
+
+		for _, p := range d.Processes {
+			influxLine{
+				"nvidia_gpu_process",
+				map[string]string{"minor": d.MinorNumber, "uuid": d.UUID, "pid": p.PID, "process_name": p.Name, "type": p.Type},
+				map[string]float64{"memory_used_bytes": p.MemoryUsed},
+			}.write(&w, ts)
+		}
+	}
+	return w.Bytes()
+}
+
+// influxHandler serves the latest snapshot of the cache in the InfluxDB line
+// protocol, e.g. for the Telegraf http input, timestamped with the time it was
+// collected.
+func influxHandler(cache *snapshotCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, collected, err := cache.latest()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(influxLines(data, collected))
+	})
+}
+
+// influxWriter periodically writes the snapshot of the backend to an
+// InfluxDB v2 write API.
+type influxWriter struct {
+	config   InfluxDBConfig
+	backend  Backend
+	client   *http.Client
+	requests *counterVec
+}
+
+func newInfluxWriter(config InfluxDBConfig, backend Backend) *influxWriter {
+	return &influxWriter{
+		config:  config,
+		backend: backend,
+		client:  &http.Client{Timeout: config.Timeout},
+		requests: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "influxdb_write_requests_total",
+				Help:      "InfluxDB write requests by result, sent or dropped",
+			},
+			[]string{"result"},
+		),
+	}
+}
+
+func (w *influxWriter) Describe(descs chan<- *prometheus.Desc) {
+	w.requests.Describe(descs)
+}
+
+func (w *influxWriter) Collect(metrics chan<- prometheus.Metric) {
+	w.requests.Collect(metrics)
+}
+
+// run writes every interval until the process exits.
+func (w *influxWriter) run() {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := w.write(time.Now()); err != nil {
+			log.Printf("Failed to write to InfluxDB: %s\n", err)
+			w.requests.WithLabelValues("dropped").Inc()
+		} else {
+			w.requests.WithLabelValues("sent").Inc()
+		}
+		<-ticker.C
+	}
+}
+
+func (w *influxWriter) write(now time.Time) error {
+	data, err := w.backend.Collect()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("org", w.config.Org)
+	query.Set("bucket", w.config.Bucket)
+	query.Set("precision", "ns")
+	req, err := http.NewRequest("POST", strings.TrimSuffix(w.config.URL, "/")+"/api/v2/write?"+query.Encode(), bytes.NewReader(influxLines(data, now)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.config.TokenFile != "" {
+		token, err := ioutil.ReadFile(w.config.TokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Token "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("server returned HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var influxTime = time.Unix(1552140161, 123456789)
+
+func TestInfluxLines(t *testing.T) {
+	goldenBytes(t, "testdata/influx/lines.txt", influxLines(testSnapshot(), influxTime))
+}
+
+func TestInfluxLineEscape(t *testing.T) {
+	var w bytes.Buffer
+	influxLine{
+		measurement: "nvidia gpu,test",
+		tags:        map[string]string{"name": "Tesla T4, rev=1", "empty": ""},
+		fields:      map[string]float64{"utilization gpu": 87.5},
+	}.write(&w, 1)
+	if got, want := w.String(), `nvidia\ gpu\,test,name=Tesla\ T4\,\ rev\=1 utilization\ gpu=87.5 1`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestInfluxHandler(t *testing.T) {
+	backend := &staticBackend{metrics: testSnapshot()}
+	cache := newSnapshotCache(backend)
+	cache.Collect()
+	rec := httptest.NewRecorder()
+	influxHandler(cache).ServeHTTP(rec, httptest.NewRequest("GET", "/influx", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "nvidia_gpu,driver_version=535.129.03,") {
+		t.Errorf("got %d %q", rec.Code, rec.Body)
+	}
+	if want := fmt.Sprintf(" %d\n", cache.collected.UnixNano()); backend.collections != 1 || !strings.HasSuffix(rec.Body.String(), want) {
+		t.Errorf("got %d collections and %q, want the cached snapshot timestamped%s", backend.collections, rec.Body, want)
+	}
+
+	backend = &staticBackend{err: errors.New("NVML is not loaded")}
+	rec = httptest.NewRecorder()
+	influxHandler(newSnapshotCache(backend)).ServeHTTP(rec, httptest.NewRequest("GET", "/influx", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d for a failed collection, want 500", rec.Code)
+	}
+}
+
+func TestInfluxWriter(t *testing.T) {
+	var (
+		requests []*http.Request
+		bodies   []string
+		status   = http.StatusNoContent
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+		if status != http.StatusNoContent {
+			http.Error(w, `{"code":"unauthorized","message":"unauthorized access"}`, status)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	token := filepath.Join(dir, "token")
+	ioutil.WriteFile(token, []byte("s3cr3t\n"), 0600)
+
+	w := newInfluxWriter(InfluxDBConfig{
+		URL:       server.URL + "/",
+		TokenFile: token,
+		Org:       "gpu team",
+		Bucket:    "nvidia",
+		Timeout:   time.Second,
+	}, &staticBackend{metrics: testSnapshot()})
+	if err := w.write(influxTime); err != nil {
+		t.Fatal(err)
+	}
+
+	r := requests[0]
+	if r.Method != "POST" || r.URL.Path != "/api/v2/write" {
+		t.Errorf("got %s %s, want POST /api/v2/write", r.Method, r.URL.Path)
+	}
+	if got, want := r.URL.RawQuery, "bucket=nvidia&org=gpu+team&precision=ns"; got != want {
+		t.Errorf("got query %q, want %q", got, want)
+	}
+	if got := r.Header.Get("Authorization"); got != "Token s3cr3t" {
+		t.Errorf("got Authorization %q, want Token s3cr3t", got)
+	}
+	if want := string(influxLines(testSnapshot(), influxTime)); bodies[0] != want {
+		t.Errorf("got body\n%s\nwant\n%s", bodies[0], want)
+	}
+
+	status = http.StatusUnauthorized
+	err = w.write(influxTime)
+	if err == nil || !strings.Contains(err.Error(), "HTTP status 401") || !strings.Contains(err.Error(), "unauthorized access") {
+		t.Errorf("got error %v, want the message of InfluxDB", err)
+	}
+}
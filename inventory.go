@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var inventoryInfoDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "inventory_info"),
+	"Static inventory info as reported by the device",
+	[]string{
+		"minor", "uuid", "serial", "part_number", "vbios", "inforom_image", "inforom_oem", "inforom_ecc",
+		"brand", "architecture", "compute_capability", "pcie_gen_max", "board_id", "multi_gpu_board",
+	}, nil,
+)
+
+// inventoryDevice is the part of the NVML device API read by readInventory.
+type inventoryDevice interface {
+	UUID() (string, error)
+	Serial() (string, error)
+	BoardPartNumber() (string, error)
+	VbiosVersion() (string, error)
+	InforomImageVersion() (string, error)
+	InforomVersion(object string) (string, error)
+	Brand() (string, error)
+	Architecture() (string, error)
+	CudaComputeCapability() (int, int, error)
+	MaxPcieLinkGeneration() (uint, error)
+	BoardID() (uint, error)
+	MultiGPUBoard() (bool, error)
+}
+
+// newInventoryCollector exports the inventory of the devices for asset
+// management. Values the device doesn't report are left empty.
+func newInventoryCollector() *staticCollector {
+	return newStaticCollector("device inventory", []*prometheus.Desc{inventoryInfoDesc}, func(devices []staticDevice, minors []string) ([]prometheus.Metric, error) {
+		inventory := make([]inventoryDevice, len(devices))
+		for i, device := range devices {
+			inventory[i] = device
+		}
+		return readInventory(inventory, minors)
+	})
+}
+
+func readInventory(devices []inventoryDevice, minors []string) ([]prometheus.Metric, error) {
+	var metrics []prometheus.Metric
+	for i, device := range devices {
+		var err error
+		// value returns s unless the device doesn't support it.
+		value := func(s string, e error) string {
+			if e != nil && e != errNVMLNotSupported && err == nil {
+				err = e
+			}
+			if e != nil {
+				return ""
+			}
+			return s
+		}
+
+		uuid := value(device.UUID())
+		serial := value(device.Serial())
+		partNumber := value(device.BoardPartNumber())
+		vbios := value(device.VbiosVersion())
+		inforomImage := value(device.InforomImageVersion())
+		inforomOEM := value(device.InforomVersion("oem"))
+		inforomECC := value(device.InforomVersion("ecc"))
+		brand := value(device.Brand())
+		architecture := value(device.Architecture())
+
+		major, minor, e := device.CudaComputeCapability()
+		computeCapability := value(fmt.Sprintf("%d.%d", major, minor), e)
+		gen, e := device.MaxPcieLinkGeneration()
+		pcieGenMax := value(strconv.Itoa(int(gen)), e)
+		id, e := device.BoardID()
+		boardID := value(fmt.Sprintf("0x%x", id), e)
+		multi, e := device.MultiGPUBoard()
+		multiGPUBoard := value(strconv.FormatBool(multi), e)
+
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(inventoryInfoDesc, prometheus.GaugeValue, 1,
+			minors[i], uuid, serial, partNumber, vbios, inforomImage, inforomOEM, inforomECC,
+			brand, architecture, computeCapability, pcieGenMax, boardID, multiGPUBoard))
+	}
+	return metrics, nil
+}
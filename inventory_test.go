@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+// fakeInventoryDevice returns err for the fields in errs.
+type fakeInventoryDevice struct {
+	uuid string
+	errs map[string]error
+}
+
+func (d *fakeInventoryDevice) value(field, s string) (string, error) {
+	if err := d.errs[field]; err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+func (d *fakeInventoryDevice) UUID() (string, error)   { return d.value("uuid", d.uuid) }
+func (d *fakeInventoryDevice) Serial() (string, error) { return d.value("serial", "1320421012345") }
+func (d *fakeInventoryDevice) BoardPartNumber() (string, error) {
+	return d.value("part_number", "692-2G506-0200-002")
+}
+func (d *fakeInventoryDevice) VbiosVersion() (string, error) {
+	return d.value("vbios", "92.00.45.00.03")
+}
+func (d *fakeInventoryDevice) InforomImageVersion() (string, error) {
+	return d.value("inforom_image", "G506.0200.00.04")
+}
+func (d *fakeInventoryDevice) InforomVersion(object string) (string, error) {
+	return d.value("inforom_"+object, "2.0")
+}
+func (d *fakeInventoryDevice) Brand() (string, error) { return d.value("brand", "nvidia") }
+func (d *fakeInventoryDevice) Architecture() (string, error) {
+	return d.value("architecture", "ampere")
+}
+func (d *fakeInventoryDevice) CudaComputeCapability() (int, int, error) {
+	_, err := d.value("compute_capability", "")
+	return 8, 0, err
+}
+func (d *fakeInventoryDevice) MaxPcieLinkGeneration() (uint, error) {
+	_, err := d.value("pcie_gen_max", "")
+	return 4, err
+}
+func (d *fakeInventoryDevice) BoardID() (uint, error) {
+	_, err := d.value("board_id", "")
+	return 0x700, err
+}
+func (d *fakeInventoryDevice) MultiGPUBoard() (bool, error) {
+	_, err := d.value("multi_gpu_board", "")
+	return false, err
+}
+
+func TestReadInventory(t *testing.T) {
+	// The second device is a GeForce without serial, part number and infoROM
+	// objects.
+	devices := []inventoryDevice{
+		&fakeInventoryDevice{uuid: "GPU-3f1a2b4c-5d6e-7f80-91a2-b3c4d5e6f701"},
+		&fakeInventoryDevice{uuid: "GPU-9b2d1c7e-0f43-4a55-8e61-2c7d9a0b3e12", errs: map[string]error{
+			"serial":        errNVMLNotSupported,
+			"part_number":   errNVMLNotSupported,
+			"inforom_image": errNVMLNotSupported,
+			"inforom_oem":   errNVMLNotSupported,
+			"inforom_ecc":   errNVMLNotSupported,
+			"board_id":      errNVMLNotSupported,
+		}},
+	}
+	metrics, err := readInventory(devices, []string{"0", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	goldenMetrics(t, "testdata/inventory/metrics.prom", metricsCollector(metrics))
+
+	// Any other error drops the inventory.
+	devices[1].(*fakeInventoryDevice).errs["vbios"] = errNVMLTimeout
+	if metrics, err := readInventory(devices, []string{"0", "1"}); err != errNVMLTimeout || metrics != nil {
+		t.Errorf("got %d metrics and %v, want the timeout returned", len(metrics), err)
+	}
+}
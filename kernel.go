@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	kernelModuleInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "kernel", "module_info"),
+		"Version of the loaded NVIDIA kernel module",
+		[]string{"version"}, nil,
+	)
+	kernelGPUInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "kernel", "gpu_info"),
+		"Info as reported by the NVIDIA kernel module",
+		[]string{"pci_bus_id", "minor", "uuid", "model", "vbios", "bus_type"}, nil,
+	)
+	pciLinkSpeedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pci", "link_speed"),
+		"Current PCIe link speed in GT/s as reported by sysfs",
+		[]string{"pci_bus_id"}, nil,
+	)
+	pciLinkSpeedMaxDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pci", "link_speed_max"),
+		"Maximum PCIe link speed in GT/s as reported by sysfs",
+		[]string{"pci_bus_id"}, nil,
+	)
+	pciLinkWidthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pci", "link_width"),
+		"Current PCIe link width as reported by sysfs",
+		[]string{"pci_bus_id"}, nil,
+	)
+	pciLinkWidthMaxDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pci", "link_width_max"),
+		"Maximum PCIe link width as reported by sysfs",
+		[]string{"pci_bus_id"}, nil,
+	)
+	pciPowerStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pci", "power_state"),
+		"PCI power state (D0 to D3cold) as reported by sysfs",
+		[]string{"pci_bus_id", "state"}, nil,
+	)
+	nvswitchInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "nvswitch", "info"),
+		"Info of the NVSwitch as reported by the nvidia-nvswitch kernel module",
+		[]string{"pci_bus_id", "uuid", "vbios", "physical_id"}, nil,
+	)
+	fabricManagerUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "fabric_manager", "up"),
+		"Whether the fabric manager (nv-fabricmanager) is running",
+		nil, nil,
+	)
+	pciAERErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pci", "aer_errors_total"),
+		"PCIe Advanced Error Reporting errors as reported by sysfs",
+		[]string{"pci_bus_id", "severity", "error"}, nil,
+	)
+
+	// kernelModuleVersion matches the proprietary ("Kernel Module  535.129.03")
+	// and the open ("Open Kernel Module for x86_64  535.129.03") module.
+	kernelModuleVersion = regexp.MustCompile(`Kernel Module(?: for \S+)?\s+(\S+)`)
+
+	// pciAERFiles maps the AER counter files to their severity.
+	pciAERFiles = map[string]string{
+		"aer_dev_correctable": "correctable",
+		"aer_dev_nonfatal":    "nonfatal",
+		"aer_dev_fatal":       "fatal",
+	}
+)
+
+// kernelCollector exports what the NVIDIA kernel module and the PCI core
+// expose in procfs and sysfs. It doesn't load NVML and keeps working when
+// NVML hangs or can't be loaded.
+type kernelCollector struct {
+	procPath string
+	sysPath  string
+}
+
+func newKernelCollector(procPath, sysPath string) *kernelCollector {
+	return &kernelCollector{
+		procPath: procPath,
+		sysPath:  sysPath,
+	}
+}
+
+func (c *kernelCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- kernelModuleInfoDesc
+	descs <- kernelGPUInfoDesc
+	descs <- pciLinkSpeedDesc
+	descs <- pciLinkSpeedMaxDesc
+	descs <- pciLinkWidthDesc
+	descs <- pciLinkWidthMaxDesc
+	descs <- pciPowerStateDesc
+	descs <- pciAERErrorsDesc
+	descs <- nvswitchInfoDesc
+	descs <- fabricManagerUpDesc
+}
+
+func (c *kernelCollector) Collect(metrics chan<- prometheus.Metric) {
+	if version, err := c.moduleVersion(); err == nil {
+		metrics <- prometheus.MustNewConstMetric(kernelModuleInfoDesc, prometheus.GaugeValue, 1, version)
+	} else if !os.IsNotExist(err) {
+		log.Printf("Failed to read NVIDIA kernel module version: %s\n", err)
+	}
+
+	busIDs, err := c.gpus()
+	if err != nil {
+		log.Printf("Failed to list NVIDIA GPUs: %s\n", err)
+		return
+	}
+
+	for _, busID := range busIDs {
+		info, err := readKeyValues(filepath.Join(c.procPath, "driver/nvidia/gpus", busID, "information"))
+		if err == nil {
+			metrics <- prometheus.MustNewConstMetric(kernelGPUInfoDesc, prometheus.GaugeValue, 1,
+				busID, info["Device Minor"], info["GPU UUID"], info["Model"], info["Video BIOS"], info["Bus Type"])
+		} else if !os.IsNotExist(err) {
+			log.Printf("Failed to read kernel info of GPU %s: %s\n", busID, err)
+		}
+
+		c.collectPCI(metrics, busID)
+	}
+
+	c.collectNVSwitches(metrics)
+}
+
+// collectNVSwitches exports the NVSwitches of HGX systems and whether the
+// fabric manager, which configures them, is running.
+func (c *kernelCollector) collectNVSwitches(metrics chan<- prometheus.Metric) {
+	busIDs, err := c.pciDevices(func(class string) bool {
+		// Bridge, other (0x0680).
+		return strings.HasPrefix(class, "0x0680")
+	})
+	if err != nil {
+		log.Printf("Failed to list NVSwitches: %s\n", err)
+		return
+	}
+	if len(busIDs) == 0 {
+		return
+	}
+
+	for _, busID := range busIDs {
+		info, err := readKeyValues(filepath.Join(c.procPath, "driver/nvidia-nvswitch/devices", busID, "information"))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to read kernel info of NVSwitch %s: %s\n", busID, err)
+		}
+		metrics <- prometheus.MustNewConstMetric(nvswitchInfoDesc, prometheus.GaugeValue, 1,
+			busID, info["UUID"], info["BIOS Version"], info["Physical location ID"])
+
+		c.collectPCI(metrics, busID)
+	}
+
+	running, err := c.processRunning("nv-fabricmanager")
+	if err != nil {
+		log.Printf("Failed to look for the fabric manager: %s\n", err)
+		return
+	}
+	metrics <- prometheus.MustNewConstMetric(fabricManagerUpDesc, prometheus.GaugeValue, boolToFloat64(running))
+}
+
+// processRunning reports whether a process with the given command name is
+// running.
+func (c *kernelCollector) processRunning(name string) (bool, error) {
+	comms, err := filepath.Glob(filepath.Join(c.procPath, "[0-9]*", "comm"))
+	if err != nil {
+		return false, err
+	}
+	// comm is truncated to 15 characters.
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	for _, comm := range comms {
+		if s, err := readSysfsString(comm); err == nil && s == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// collectPCI exports the sysfs attributes of a PCI device. Attributes the
+// kernel doesn't provide are skipped.
+func (c *kernelCollector) collectPCI(metrics chan<- prometheus.Metric, busID string) {
+	dir := filepath.Join(c.sysPath, "bus/pci/devices", busID)
+
+	for file, desc := range map[string]*prometheus.Desc{
+		"current_link_speed": pciLinkSpeedDesc,
+		"max_link_speed":     pciLinkSpeedMaxDesc,
+		"current_link_width": pciLinkWidthDesc,
+		"max_link_width":     pciLinkWidthMaxDesc,
+	} {
+		s, err := readSysfsString(filepath.Join(dir, file))
+		if err != nil {
+			continue
+		}
+		// Link speeds read "16.0 GT/s PCIe" or "8 GT/s".
+		value, err := strconv.ParseFloat(strings.Fields(s + " ")[0], 64)
+		if err != nil {
+			continue
+		}
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, busID)
+	}
+
+	if state, err := readSysfsString(filepath.Join(dir, "power_state")); err == nil {
+		metrics <- prometheus.MustNewConstMetric(pciPowerStateDesc, prometheus.GaugeValue, 1, busID, state)
+	}
+
+	for file, severity := range pciAERFiles {
+		counters, err := readCounters(filepath.Join(dir, file))
+		if err != nil {
+			continue
+		}
+		for name, value := range counters {
+			// The TOTAL_ERR_* lines sum up the other counters.
+			if strings.HasPrefix(name, "TOTAL_") {
+				continue
+			}
+			metrics <- prometheus.MustNewConstMetric(pciAERErrorsDesc, prometheus.CounterValue, value, busID, severity, name)
+		}
+	}
+}
+
+func (c *kernelCollector) moduleVersion() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.procPath, "driver/nvidia/version"))
+	if err != nil {
+		return "", err
+	}
+	m := kernelModuleVersion.FindStringSubmatch(string(data))
+	if m == nil {
+		return "", os.ErrNotExist
+	}
+	return m[1], nil
+}
+
+// gpus returns the PCI bus ids of the NVIDIA GPUs, taken from the devices
+// known to the kernel module and from sysfs, so GPUs are found without the
+// module loaded too.
+func (c *kernelCollector) gpus() ([]string, error) {
+	found := map[string]bool{}
+
+	dirs, err := ioutil.ReadDir(filepath.Join(c.procPath, "driver/nvidia/gpus"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, d := range dirs {
+		found[d.Name()] = true
+	}
+
+	devices, err := c.pciDevices(func(class string) bool {
+		// Display controllers: VGA (0x0300) and 3D (0x0302).
+		return strings.HasPrefix(class, "0x0300") || strings.HasPrefix(class, "0x0302")
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, busID := range devices {
+		found[busID] = true
+	}
+
+	var busIDs []string
+	for busID := range found {
+		busIDs = append(busIDs, busID)
+	}
+	sort.Strings(busIDs)
+	return busIDs, nil
+}
+
+// pciDevices returns the bus ids of the NVIDIA PCI devices whose class is
+// accepted by match.
+func (c *kernelCollector) pciDevices(match func(class string) bool) ([]string, error) {
+	devices, err := ioutil.ReadDir(filepath.Join(c.sysPath, "bus/pci/devices"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var busIDs []string
+	for _, d := range devices {
+		dir := filepath.Join(c.sysPath, "bus/pci/devices", d.Name())
+		vendor, _ := readSysfsString(filepath.Join(dir, "vendor"))
+		class, _ := readSysfsString(filepath.Join(dir, "class"))
+		if vendor == "0x10de" && match(class) {
+			busIDs = append(busIDs, d.Name())
+		}
+	}
+	return busIDs, nil
+}
+
+func readSysfsString(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readKeyValues reads a file of "Key: value" lines.
+func readKeyValues(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return values, scanner.Err()
+}
+
+// readCounters reads a file of "NAME value" lines as written for the AER
+// counters.
+func readCounters(path string) (map[string]float64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := map[string]float64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		counters[fields[0]] = value
+	}
+	return counters, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The fixture tree in testdata/kernel holds a GPU known to the kernel module,
+// a GPU only found in sysfs, an NVSwitch with the fabric manager running
+// and a PCI device of another vendor.
+
+func TestKernelCollector(t *testing.T) {
+	goldenMetrics(t, "testdata/kernel/metrics.prom",
+		newKernelCollector("testdata/kernel/proc", "testdata/kernel/sys"))
+}
+
+func TestKernelCollectorGPUs(t *testing.T) {
+	c := newKernelCollector("testdata/kernel/proc", "testdata/kernel/sys")
+	busIDs, err := c.gpus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0000:07:00.0", "0000:0f:00.0"}; !reflect.DeepEqual(busIDs, want) {
+		t.Errorf("got GPUs %v, want %v", busIDs, want)
+	}
+}
+
+func TestKernelCollectorMissing(t *testing.T) {
+	// Without the module and sysfs nothing is exported, and nothing fails.
+	goldenMetrics(t, "testdata/kernel/missing.prom",
+		newKernelCollector("testdata/kernel/none", "testdata/kernel/none"))
+}
+
+func TestKernelModuleVersion(t *testing.T) {
+	for line, version := range map[string]string{
+		"NVRM version: NVIDIA UNIX x86_64 Kernel Module  535.129.03  Thu Oct 19 18:56:32 UTC 2023":             "535.129.03",
+		"NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  550.54.15  Release Build  (dvs-builder@U16)": "550.54.15",
+	} {
+		m := kernelModuleVersion.FindStringSubmatch(line)
+		if m == nil || m[1] != version {
+			t.Errorf("%q: got %v, want %s", line, m, version)
+		}
+	}
+}
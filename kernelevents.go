@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// KernelEventPattern counts kernel log lines matching Pattern as Event. The
+// PCI bus id is taken from a pci_bus_id group of the pattern if there is one,
+// otherwise from the first bus id in the line.
+type KernelEventPattern struct {
+	Event   string `yaml:"event"`
+	Pattern string `yaml:"pattern"`
+}
+
+// DefaultKernelEventPatterns are matched when no pattern file is given.
+var DefaultKernelEventPatterns = []KernelEventPattern{
+	{"xid", `NVRM: Xid `},
+	{"fallen_off_bus", `GPU has fallen off the bus`},
+	{"rm_init_adapter_failed", `RmInitAdapter failed`},
+	{"rm_shutdown", `Rm ?Shutdown`},
+	{"api_mismatch", `NVRM: API mismatch`},
+	{"sxid", `SXid \(PCI:(?P<pci_bus_id>[0-9a-fA-F:.]+)\)`},
+}
+
+var (
+	// kernelEventBusID matches PCI bus ids as printed by the kernel module,
+	// "0000:07:00", "0000:07:00.0" or NVML's "00000000:07:00.0".
+	kernelEventBusID = regexp.MustCompile(`\b[0-9a-fA-F]{4,8}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}(?:\.[0-7])?\b`)
+
+	// kernelEventKmsgHeader matches the record header of /dev/kmsg.
+	kernelEventKmsgHeader = regexp.MustCompile(`^\d+,\d+,\d+,[^;]*;`)
+
+	// kernelEventField matches the fields of the journald export format and
+	// the dictionary lines that follow a /dev/kmsg record, e.g.
+	// " DEVICE=+pci:0000:07:00.0". Only the MESSAGE field is a log message.
+	kernelEventField = regexp.MustCompile(`^ ?[A-Z_][A-Z0-9_]*=`)
+)
+
+// LoadKernelEventPatterns reads a YAML list of KernelEventPattern.
+func LoadKernelEventPatterns(path string) ([]KernelEventPattern, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []KernelEventPattern
+	if err := yaml.UnmarshalStrict(data, &patterns); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	return patterns, nil
+}
+
+// kernelEvent is a kernel log line that matched a pattern.
+type kernelEvent struct {
+	Time     time.Time `json:"time"`
+	PCIBusID string    `json:"pci_bus_id"`
+	Event    string    `json:"event"`
+	Message  string    `json:"message"`
+}
+
+type kernelEventMatcher struct {
+	event   string
+	pattern *regexp.Regexp
+}
+
+// kernelEventWatcher follows the kernel log, /dev/kmsg or a journald export
+// file, counts the lines matching its patterns and keeps the most recent
+// matches.
+type kernelEventWatcher struct {
+	path     string
+	matchers []kernelEventMatcher
+	events   *counterVec
+	restarts prometheus.Counter
+
+	mu     sync.Mutex
+	recent []kernelEvent
+	size   int
+}
+
+func newKernelEventWatcher(path string, patterns []KernelEventPattern, size int) (*kernelEventWatcher, error) {
+	w := &kernelEventWatcher{
+		path: path,
+		size: size,
+		events: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "kernel_events_total",
+				Help:      "Kernel log messages matching an event pattern",
+			},
+			[]string{"pci_bus_id", "event"},
+		),
+		restarts: newCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "kernel_events_restarts_total",
+				Help:      "Restarts of the kernel log watcher",
+			},
+		),
+	}
+	var err error
+	if w.matchers, err = compileKernelEventPatterns(patterns); err != nil {
+		return nil, err
+	}
+	go supervise("kernel log watcher", w.restarts, func() error {
+		return followLog(w.path, w.match)
+	})
+	return w, nil
+}
+
+func compileKernelEventPatterns(patterns []KernelEventPattern) ([]kernelEventMatcher, error) {
+	var matchers []kernelEventMatcher
+	for _, p := range patterns {
+		pattern, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for event %s: %s", p.Event, err)
+		}
+		matchers = append(matchers, kernelEventMatcher{p.Event, pattern})
+	}
+	return matchers, nil
+}
+
+func (w *kernelEventWatcher) Describe(descs chan<- *prometheus.Desc) {
+	w.events.Describe(descs)
+	w.restarts.Describe(descs)
+}
+
+func (w *kernelEventWatcher) Collect(metrics chan<- prometheus.Metric) {
+	w.events.Collect(metrics)
+	w.restarts.Collect(metrics)
+}
+
+// match counts a log line for every pattern it matches.
+func (w *kernelEventWatcher) match(line string) {
+	message, ok := kernelMessage(line)
+	if !ok {
+		return
+	}
+
+	for _, m := range w.matchers {
+		match := m.pattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+
+		var busID string
+		for i, name := range m.pattern.SubexpNames() {
+			if name == "pci_bus_id" {
+				busID = match[i]
+			}
+		}
+		if busID == "" {
+			busID = kernelEventBusID.FindString(message)
+		}
+		busID = normalizeBusID(busID)
+
+		w.events.WithLabelValues(busID, m.event).Inc()
+		w.record(kernelEvent{
+			Time:     time.Now(),
+			PCIBusID: busID,
+			Event:    m.event,
+			Message:  message,
+		})
+	}
+}
+
+func (w *kernelEventWatcher) record(e kernelEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.recent = append(w.recent, e)
+	if len(w.recent) > w.size {
+		w.recent = w.recent[len(w.recent)-w.size:]
+	}
+}
+
+// ServeHTTP returns the recent events as JSON, oldest first.
+func (w *kernelEventWatcher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	recent := append([]kernelEvent{}, w.recent...)
+	w.mu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(recent)
+}
+
+// kernelMessage returns the message of a line of /dev/kmsg, a journald export
+// or a plain log file. Other fields of a journald export and the dictionary
+// of a /dev/kmsg record aren't messages.
+func kernelMessage(line string) (string, bool) {
+	if strings.HasPrefix(line, "MESSAGE=") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "MESSAGE=")), true
+	}
+	if kernelEventField.MatchString(line) {
+		return "", false
+	}
+	return strings.TrimSpace(kernelEventKmsgHeader.ReplaceAllString(line, "")), true
+}
+
+// normalizeBusID converts a PCI bus id into the sysfs form, e.g.
+// "0000:07:00.0".
+func normalizeBusID(busID string) string {
+	if busID == "" {
+		return ""
+	}
+	busID = strings.ToLower(busID)
+	if i := strings.Index(busID, ":"); i > 4 {
+		busID = busID[i-4:]
+	}
+	if !strings.Contains(busID, ".") {
+		busID += ".0"
+	}
+	return busID
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestKernelEventWatcher(t *testing.T, patterns []KernelEventPattern, size int) *kernelEventWatcher {
+	matchers, err := compileKernelEventPatterns(patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &kernelEventWatcher{
+		matchers: matchers,
+		size:     size,
+		events: newCounterVec(
+			prometheus.CounterOpts{Name: "kernel_events_total", Help: "Kernel events"},
+			[]string{"pci_bus_id", "event"},
+		),
+	}
+}
+
+func TestKernelEventWatcherMatch(t *testing.T) {
+	for _, test := range []struct {
+		path   string
+		events map[string]float64
+		first  string
+	}{
+		{
+			path: "testdata/kernel-events/kmsg.log",
+			events: map[string]float64{
+				"0000:07:00.0/xid":                    1,
+				"0000:07:00.0/fallen_off_bus":         1,
+				"0000:07:00.0/rm_init_adapter_failed": 1,
+				"0000:05:00.0/sxid":                   1,
+			},
+			first: "NVRM: Xid (PCI:0000:07:00): 79, pid=0, GPU has fallen off the bus.",
+		},
+		{
+			// Only the MESSAGE fields count, not the raw copy of a message.
+			path: "testdata/kernel-events/journal.export",
+			events: map[string]float64{
+				"0000:07:00.0/xid": 1,
+				"/api_mismatch":    1,
+			},
+			first: "NVRM: Xid (PCI:0000:07:00): 31, pid=48211, name=python3, Ch 00000010, intr 10000000. MMU Fault: ENGINE GRAPHICS GPCCLIENT_T1_0 faulted @ 0x7f12_3c000000. Fault is of type FAULT_PDE ACCESS_TYPE_VIRT_READ",
+		},
+		{
+			path: "testdata/kernel-events/syslog.log",
+			events: map[string]float64{
+				"0000:07:00.0/xid":         1,
+				"0000:0f:00.0/rm_shutdown": 1,
+			},
+			first: "Mar  9 14:02:41 gpu-node-17 kernel: [ 3501.173412] NVRM: Xid (PCI:0000:07:00): 31, pid=48211, name=python3, Ch 00000010",
+		},
+	} {
+		w := newTestKernelEventWatcher(t, DefaultKernelEventPatterns, 10)
+		for _, line := range readLines(t, test.path) {
+			w.match(line)
+		}
+
+		events := map[string]float64{}
+		for _, m := range gather(t, w.events)["kernel_events_total"].GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			events[labels["pci_bus_id"]+"/"+labels["event"]] = m.GetCounter().GetValue()
+		}
+		if !reflect.DeepEqual(events, test.events) {
+			t.Errorf("%s: got events %v, want %v", test.path, events, test.events)
+		}
+		if len(w.recent) == 0 || w.recent[0].Message != test.first {
+			t.Errorf("%s: got recent events %+v, want the first with message %q", test.path, w.recent, test.first)
+		}
+	}
+}
+
+func TestKernelEventWatcherRecent(t *testing.T) {
+	w := newTestKernelEventWatcher(t, []KernelEventPattern{{"xid", `NVRM: Xid \((?:PCI:)?(?P<pci_bus_id>[0-9a-fA-F:]+)\)`}}, 2)
+	for _, line := range []string{
+		"NVRM: Xid (PCI:0000:07:00): 13, Graphics Exception",
+		"NVRM: Xid (PCI:0000:0F:00): 31, pid=1, MMU Fault",
+		"NVRM: Xid (0000:03:00): 43, Ch 00000010",
+	} {
+		w.match(line)
+	}
+
+	var busIDs []string
+	for _, e := range w.recent {
+		busIDs = append(busIDs, e.PCIBusID)
+	}
+	if want := []string{"0000:0f:00.0", "0000:03:00.0"}; !reflect.DeepEqual(busIDs, want) {
+		t.Errorf("got recent events of %v, want %v", busIDs, want)
+	}
+}
+
+func TestNormalizeBusID(t *testing.T) {
+	for busID, want := range map[string]string{
+		"0000:07:00":       "0000:07:00.0",
+		"0000:07:00.1":     "0000:07:00.1",
+		"00000000:0F:00.0": "0000:0f:00.0",
+		"":                 "",
+	} {
+		if got := normalizeBusID(busID); got != want {
+			t.Errorf("normalizeBusID(%q) = %q, want %q", busID, got, want)
+		}
+	}
+}
+
+func TestCompileKernelEventPatterns(t *testing.T) {
+	if _, err := compileKernelEventPatterns([]KernelEventPattern{{"broken", `Xid (`}}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+// libnvidia-ml is loaded by gonvml and nvml.go through dlopen by its soname.
+// Loading it by path beforehand, and never unloading it, makes those dlopen
+// calls return the already loaded library, so libraries outside of the
+// dynamic linker search path can be used.
+
+// #cgo LDFLAGS: -ldl
+/*
+#define _GNU_SOURCE
+#include <stddef.h>
+#include <dlfcn.h>
+#include <link.h>
+#include <stdlib.h>
+
+static void *nvmlxLibrary;
+
+static const char *nvmlxLibraryOpen(const char *path) {
+  void *handle = dlopen(path, RTLD_LAZY | RTLD_GLOBAL);
+  if (handle == NULL) {
+    return dlerror();
+  }
+  nvmlxLibrary = handle;
+  return NULL;
+}
+
+static const char *nvmlxLibraryPath(void) {
+  struct link_map *map;
+  if (nvmlxLibrary == NULL || dlinfo(nvmlxLibrary, RTLD_DI_LINKMAP, &map) != 0) {
+    return NULL;
+  }
+  return map->l_name;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const nvmlLibraryName = "libnvidia-ml.so.1"
+
+var (
+	// nvmlDriverRoots are the roots the driver is commonly installed under:
+	// the host, the driver container of the GPU operator and the host root
+	// mounted into a container.
+	nvmlDriverRoots = []string{"/", "/run/nvidia/driver", "/host"}
+
+	// nvmlLibraryDirs are searched below every driver root.
+	nvmlLibraryDirs = []string{
+		"usr/lib/x86_64-linux-gnu",
+		"usr/lib/aarch64-linux-gnu",
+		"usr/lib64",
+		"usr/lib",
+		"usr/local/nvidia/lib64",
+		"home/kubernetes/bin/nvidia/lib64",
+	}
+)
+
+// nvmlLibrary is the libnvidia-ml loaded by loadNVMLLibrary.
+type nvmlLibrary struct {
+	Path    string
+	Version string
+}
+
+// loadNVMLLibrary loads libnvidia-ml from path, which is either the library
+// or the directory holding it. Without a path the dynamic linker search path
+// is tried first, then the library directories below the driver roots. Every
+// failed attempt is logged.
+func loadNVMLLibrary(path string) (*nvmlLibrary, error) {
+	candidates := nvmlLibraryCandidates(path)
+	for _, candidate := range candidates {
+		library, err := openNVMLLibrary(candidate)
+		if err != nil {
+			log.Printf("Failed to load NVML library %s: %s\n", candidate, err)
+			continue
+		}
+		log.Printf("Loaded NVML library %s, version %s\n", library.Path, library.Version)
+		return library, nil
+	}
+
+	return nil, fmt.Errorf("no NVML library found in %d locations", len(candidates))
+}
+
+// nvmlLibraryCandidates returns the libraries tried by loadNVMLLibrary, in
+// order.
+func nvmlLibraryCandidates(path string) []string {
+	if path != "" {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			path = filepath.Join(path, nvmlLibraryName)
+		}
+		return []string{path}
+	}
+
+	candidates := []string{nvmlLibraryName}
+	for _, root := range nvmlDriverRoots {
+		for _, dir := range nvmlLibraryDirs {
+			candidates = append(candidates, filepath.Join(root, dir, nvmlLibraryName))
+		}
+	}
+	return candidates
+}
+
+func openNVMLLibrary(path string) (*nvmlLibrary, error) {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	if filepath.IsAbs(path) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, errors.New("not found")
+		}
+	}
+	if msg := C.nvmlxLibraryOpen(cpath); msg != nil {
+		return nil, errors.New(strings.TrimPrefix(C.GoString(msg), path+": "))
+	}
+
+	library := &nvmlLibrary{
+		Path: path,
+	}
+	if p := C.nvmlxLibraryPath(); p != nil && C.GoString(p) != "" {
+		library.Path = C.GoString(p)
+	}
+
+	// The driver installs libnvidia-ml.so.1 as a link to
+	// libnvidia-ml.so.<driver version>.
+	if resolved, err := filepath.EvalSymlinks(library.Path); err == nil {
+		library.Version = strings.TrimPrefix(filepath.Base(resolved), "libnvidia-ml.so.")
+	}
+
+	return library, nil
+}
+
+// newLibraryInfo returns the nvidia_library_info metric for library, which
+// may be nil.
+func newLibraryInfo(library *nvmlLibrary) *prometheus.GaugeVec {
+	info := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "library_info",
+			Help:      "Path and version of the loaded NVML library",
+		},
+		[]string{"path", "version"},
+	)
+	if library != nil {
+		info.WithLabelValues(library.Path, library.Version).Set(1)
+	}
+	return info
+}
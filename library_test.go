@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNVMLLibraryCandidates(t *testing.T) {
+	candidates := nvmlLibraryCandidates("")
+	if want := 1 + len(nvmlDriverRoots)*len(nvmlLibraryDirs); len(candidates) != want {
+		t.Fatalf("got %d candidates, want %d", len(candidates), want)
+	}
+	// The dynamic linker search path first, then the host before the driver
+	// container and the mounted host root.
+	for i, want := range map[int]string{
+		0:  "libnvidia-ml.so.1",
+		1:  "/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1",
+		3:  "/usr/lib64/libnvidia-ml.so.1",
+		7:  "/run/nvidia/driver/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1",
+		18: "/host/home/kubernetes/bin/nvidia/lib64/libnvidia-ml.so.1",
+	} {
+		if candidates[i] != want {
+			t.Errorf("candidate %d: got %s, want %s", i, candidates[i], want)
+		}
+	}
+}
+
+func TestNVMLLibraryCandidatesPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nvml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	library := filepath.Join(dir, "libnvidia-ml.so.535.129.03")
+	ioutil.WriteFile(library, nil, 0644)
+
+	for _, test := range []struct {
+		path, want string
+	}{
+		{dir, filepath.Join(dir, "libnvidia-ml.so.1")},
+		{library, library},
+		{filepath.Join(dir, "missing"), filepath.Join(dir, "missing")},
+	} {
+		if got := nvmlLibraryCandidates(test.path); len(got) != 1 || got[0] != test.want {
+			t.Errorf("%s: got %v, want %s", test.path, got, test.want)
+		}
+	}
+
+	// The directory holds no libnvidia-ml.so.1.
+	if _, err := loadNVMLLibrary(dir); err == nil || err.Error() != "no NVML library found in 1 locations" {
+		t.Errorf("got error %v, want no NVML library found", err)
+	}
+}
+
+func TestLibraryInfo(t *testing.T) {
+	library := &nvmlLibrary{
+		Path:    "/run/nvidia/driver/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1",
+		Version: "535.129.03",
+	}
+	m := gather(t, newLibraryInfo(library))["nvidia_library_info"]
+	if m == nil || len(m.Metric) != 1 {
+		t.Fatalf("got %v, want one series", m)
+	}
+	labels := map[string]string{}
+	for _, l := range m.Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["path"] != library.Path || labels["version"] != library.Version || m.Metric[0].Gauge.GetValue() != 1 {
+		t.Errorf("got %v, want the path and version of the library", m.Metric[0])
+	}
+
+	if m := gather(t, newLibraryInfo(nil))["nvidia_library_info"]; m != nil {
+		t.Errorf("got %v without a library, want no series", m)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+var (
+	logPollInterval = 1 * time.Second
+)
+
+// followLog calls handle for every line written to the log at path after it
+// was opened, until reading fails. path is either /dev/kmsg, where every read
+// returns one record, or a regular file that is polled for new lines and
+// reopened from its start when it is rotated or truncated.
+func followLog(path string, handle func(line string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	var pending string
+	for {
+		line, err := r.ReadString('\n')
+		pending += line
+		// /dev/kmsg returns EPIPE when records were overwritten before they
+		// were read.
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EPIPE {
+			continue
+		}
+		if err == io.EOF {
+			rotated, err := logRotated(f, path)
+			if err != nil {
+				return err
+			}
+			if rotated {
+				f.Close()
+				if f, err = os.Open(path); err != nil {
+					return err
+				}
+				r.Reset(f)
+				pending = ""
+				continue
+			}
+			time.Sleep(logPollInterval)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		handle(pending)
+		pending = ""
+	}
+}
+
+// logRotated reports whether the log at path is no longer the file f, or f
+// was truncated.
+func logRotated(f *os.File, path string) (bool, error) {
+	current, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !current.Mode().IsRegular() {
+		return false, nil
+	}
+	latest, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(current, latest) || current.Size() < offset, nil
+}
@@ -5,16 +5,27 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 )
 
 const (
 	namespace = "nvidia"
 )
 
+// VERSION and REVISION are set at build time, see the Makefile.
+var (
+	VERSION  = "unknown"
+	REVISION = "unknown"
+)
+
 type Exporter struct {
+	backend               Backend
 	up                    prometheus.Gauge
 	info                  *prometheus.GaugeVec
 	deviceCount           prometheus.Gauge
@@ -28,18 +39,236 @@ type Exporter struct {
 	utilizationMemory     *prometheus.GaugeVec
 	utilizationGPU        *prometheus.GaugeVec
 	utilizationGPUAverage *prometheus.GaugeVec
+	migModeCurrent        *prometheus.GaugeVec
+	migModePending        *prometheus.GaugeVec
+	migInfo               *prometheus.GaugeVec
+	migGPUInstanceSlices  *prometheus.GaugeVec
+	migComputeSlices      *prometheus.GaugeVec
+	migMemoryTotal        *prometheus.GaugeVec
+	migMemoryUsed         *prometheus.GaugeVec
+	virtualizationMode    *prometheus.GaugeVec
+	vgpuInfo              *prometheus.GaugeVec
+	vgpuFramebufferUsed   *prometheus.GaugeVec
+	vgpuEncoderSessions   *prometheus.GaugeVec
+	vgpuUtilizationSM     *prometheus.GaugeVec
+	vgpuUtilizationMemory *prometheus.GaugeVec
+	vgpuUtilizationEnc    *prometheus.GaugeVec
+	vgpuUtilizationDec    *prometheus.GaugeVec
+	vgpuTypeInfo          *prometheus.GaugeVec
+	vgpuTypeCreatable     *prometheus.GaugeVec
+	vgpuTypeFramebuffer   *prometheus.GaugeVec
+	vgpuTypeMaxInstances  *prometheus.GaugeVec
+	clock                 *prometheus.GaugeVec
+	clockMax              *prometheus.GaugeVec
+	eccMode               *prometheus.GaugeVec
+	eccErrors             *prometheus.GaugeVec
+	pcieLinkGen           *prometheus.GaugeVec
+	pcieLinkGenMax        *prometheus.GaugeVec
+	pcieLinkWidth         *prometheus.GaugeVec
+	pcieLinkWidthMax      *prometheus.GaugeVec
+	pcieTxBytes           *prometheus.GaugeVec
+	pcieRxBytes           *prometheus.GaugeVec
+	pcieReplayCounter     *prometheus.GaugeVec
+	processMemoryUsed     *prometheus.GaugeVec
+	nvlinkActive          *prometheus.GaugeVec
+	nvlinkInfo            *prometheus.GaugeVec
+	nvlinkTxBytes         *prometheus.Desc
+	nvlinkRxBytes         *prometheus.Desc
+	nvlinkErrors          *prometheus.Desc
+	fabricState           *prometheus.GaugeVec
+
+	// dcgmDescs holds the descriptions of the DCGM fields by name, built on
+	// first use. Names that aren't valid metric names map to nil.
+	dcgmMu    sync.Mutex
+	dcgmDescs map[string]*prometheus.Desc
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "push" {
+		os.Exit(runPush(os.Args[2:]))
+	}
+
 	var (
-		listenAddress = flag.String("web.listen-address", ":9401", "Address to listen on for web interface and telemetry.")
-		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		listenAddress  = flag.String("web.listen-address", ":9401", "Address to listen on for web interface and telemetry.")
+		metricsPath    = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		legacyNames    = flag.Bool("web.legacy-metric-names", false, "Also expose the metrics renamed to base units under their former names.")
+		backendName    = flag.String("backend", "nvml", "Backend to collect metrics with, one of nvml, nvidia-smi, nvidia-smi-query, dcgm, replay or simulator.")
+		recordPath     = flag.String("record", "", "Record every collection to this gzip compressed JSON-lines file.")
+		procPath       = flag.String("path.procfs", "/proc", "procfs mountpoint.")
+		sysPath        = flag.String("path.sysfs", "/sys", "sysfs mountpoint.")
+		xidSource      = flag.String("xid.source", "auto", "Source of Xid errors, one of nvml, log, auto (NVML events with the kernel log as fallback) or none.")
+		xidLog         = flag.String("xid.log", "/dev/kmsg", "Kernel log scanned for Xid errors when NVML events are not used.")
+		eventsLog      = flag.String("kernel-events.log", "", "Kernel log, /dev/kmsg or a journald export file, to count GPU fault messages in. Disabled by default.")
+		eventsFile     = flag.String("kernel-events.patterns", "", "YAML file with the kernel log event patterns, defaults to the built-in ones.")
+		eventsSize     = flag.Int("kernel-events.recent", 100, "Number of recent kernel log events kept for the events endpoint.")
+		eventsPath     = flag.String("web.events-path", "", "Path under which to expose recent kernel log events as JSON, e.g. /events. Disabled by default.")
+		nvswitchLinks  = flag.Bool("nvswitch.link-status", false, "Export the NVSwitch port states and counters read with dcgmi, see -dcgm.path and -dcgm.host.")
+		influxPath     = flag.String("web.influx-path", "", "Path under which to expose the devices in the InfluxDB line protocol, e.g. /influx. Disabled by default.")
+		enableAPI      = flag.Bool("web.enable-api", false, "Serve the current state of the devices as JSON under /api/v1/.")
+		streamInterval = flag.Duration("web.stream-interval", time.Second, "Interval between the snapshots of /api/v1/stream and WatchDevices.")
+		grpcAddress    = flag.String("grpc.listen-address", "", "Address to serve the gRPC service on, e.g. :9402 or unix:///run/nvidia-exporter.sock. Disabled by default.")
+		grpcCertFile   = flag.String("grpc.tls-cert-file", "", "Certificate file to serve gRPC over TLS with, plaintext by default.")
+		grpcKeyFile    = flag.String("grpc.tls-key-file", "", "Key file of the gRPC certificate.")
+		backendConfig  BackendConfig
+		remoteWrite    RemoteWriteConfig
+		influxDB       InfluxDBConfig
+		otlp           OTLPConfig
+		statsd         StatsDConfig
+		graphite       GraphiteConfig
 	)
+	backendConfig.addFlags(flag.CommandLine)
+	flag.StringVar(&remoteWrite.URL, "remote-write.url", "", "URL of a Prometheus remote_write receiver to push the metrics to. Disabled by default.")
+	flag.DurationVar(&remoteWrite.Interval, "remote-write.interval", 15*time.Second, "Interval between remote writes.")
+	flag.DurationVar(&remoteWrite.Timeout, "remote-write.timeout", 30*time.Second, "Timeout of a remote write request.")
+	flag.StringVar(&remoteWrite.Username, "remote-write.username", "", "Username for basic authentication with the remote_write receiver.")
+	flag.StringVar(&remoteWrite.PasswordFile, "remote-write.password-file", "", "File with the password for basic authentication with the remote_write receiver.")
+	flag.StringVar(&remoteWrite.BearerTokenFile, "remote-write.bearer-token-file", "", "File with the bearer token sent to the remote_write receiver.")
+	flag.StringVar(&remoteWrite.Labels, "remote-write.labels", "job=nvidia-exporter", "Comma separated name=value labels added to every pushed series, instance defaults to the hostname.")
+	flag.IntVar(&remoteWrite.Retries, "remote-write.retries", 3, "Retries with exponential backoff of a failed remote write before it's buffered.")
+	flag.StringVar(&remoteWrite.WALDir, "remote-write.wal-dir", "", "Directory buffering remote writes while the receiver is unavailable. Disabled by default.")
+	flag.Int64Var(&remoteWrite.WALMaxSize, "remote-write.wal-max-size", 256<<20, "Maximum size in bytes of the remote write buffer, the oldest writes are dropped first.")
+	flag.StringVar(&influxDB.URL, "influxdb.url", "", "URL of an InfluxDB v2 server to write the devices to, e.g. http://localhost:8086. Disabled by default.")
+	flag.StringVar(&influxDB.TokenFile, "influxdb.token-file", "", "File with the InfluxDB API token.")
+	flag.StringVar(&influxDB.Org, "influxdb.org", "", "InfluxDB organization to write to.")
+	flag.StringVar(&influxDB.Bucket, "influxdb.bucket", "", "InfluxDB bucket to write to.")
+	flag.DurationVar(&influxDB.Interval, "influxdb.interval", 15*time.Second, "Interval between InfluxDB writes.")
+	flag.DurationVar(&influxDB.Timeout, "influxdb.timeout", 10*time.Second, "Timeout of an InfluxDB write.")
+	flag.StringVar(&otlp.Endpoint, "otlp.endpoint", "", "URL of an OpenTelemetry collector to export the devices to, e.g. http://localhost:4318. Disabled by default.")
+	flag.StringVar(&otlp.Protocol, "otlp.protocol", "http/protobuf", "OTLP protocol, http/protobuf or grpc.")
+	flag.StringVar(&otlp.Headers, "otlp.headers", "", "Comma separated name=value headers sent with every export, e.g. for authentication.")
+	flag.DurationVar(&otlp.Interval, "otlp.interval", 15*time.Second, "Interval between OTLP exports.")
+	flag.DurationVar(&otlp.Timeout, "otlp.timeout", 10*time.Second, "Timeout of an OTLP export.")
+	flag.StringVar(&statsd.Address, "statsd.address", "", "DogStatsD address to send the devices to, host:port for UDP or unix:///path for a unix datagram socket. Disabled by default.")
+	flag.StringVar(&statsd.Prefix, "statsd.prefix", "nvidia.gpu.", "Prefix of the StatsD gauge names.")
+	flag.StringVar(&statsd.Tags, "statsd.tags", "", "Comma separated name:value tags added to every StatsD gauge.")
+	flag.DurationVar(&statsd.Interval, "statsd.interval", 10*time.Second, "Interval between StatsD emissions.")
+	flag.IntVar(&statsd.MaxPacketSize, "statsd.max-packet-size", 1432, "Maximum size of a StatsD datagram, e.g. 8192 for unix sockets.")
+	flag.StringVar(&graphite.Address, "graphite.address", "", "Carbon host:port to push the devices to, usually port 2003 for plaintext and 2004 for pickle. Disabled by default.")
+	flag.StringVar(&graphite.Protocol, "graphite.protocol", "plaintext", "Carbon protocol, plaintext or pickle.")
+	flag.StringVar(&graphite.Template, "graphite.template", "gpu.{hostname}.{minor}.{metric}", "Path of the Graphite metrics, with the {hostname}, {index}, {minor}, {uuid}, {name} and {metric} placeholders.")
+	flag.DurationVar(&graphite.Interval, "graphite.interval", 60*time.Second, "Interval between Graphite pushes.")
+	flag.DurationVar(&graphite.Timeout, "graphite.timeout", 10*time.Second, "Timeout of connecting and writing to Carbon.")
 	flag.Parse()
 
-	prometheus.MustRegister(NewExporter())
+	log.Printf("Starting nvidia-exporter %s (revision %s, %s)\n", VERSION, REVISION, runtime.Version())
+
+	backend, err := NewBackend(*backendName, backendConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if b, ok := backend.(instrumentedBackend); ok {
+		prometheus.MustRegister(b.Collectors()...)
+	}
 
-	http.Handle("/metrics", promhttp.Handler())
+	if *recordPath != "" {
+		if backend, err = newRecordingBackend(backend, *recordPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	prometheus.MustRegister(newBuildInfo(VERSION, REVISION, runtime.Version()))
+
+	// The exporter and the outputs collect through the cache, the API serves
+	// their latest snapshot.
+	cache := newSnapshotCache(backend)
+	prometheus.MustRegister(NewExporter(cache))
+	prometheus.MustRegister(newKernelCollector(*procPath, *sysPath))
+	if *backendName == "nvml" {
+		prometheus.MustRegister(newTopologyCollector(*sysPath))
+		prometheus.MustRegister(newInventoryCollector())
+	}
+	if *nvswitchLinks {
+		prometheus.MustRegister(newNVSwitchLinkCollector(backendConfig.DCGMPath, backendConfig.DCGMHost))
+	}
+	if *xidSource != "none" {
+		prometheus.MustRegister(newXidWatcher(*xidSource, *xidLog, *procPath))
+	}
+
+	if *eventsLog != "" {
+		patterns := DefaultKernelEventPatterns
+		if *eventsFile != "" {
+			if patterns, err = LoadKernelEventPatterns(*eventsFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		watcher, err := newKernelEventWatcher(*eventsLog, patterns, *eventsSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prometheus.MustRegister(watcher)
+		if *eventsPath != "" {
+			http.Handle(*eventsPath, watcher)
+		}
+	}
+
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *legacyNames {
+		gatherer = legacyGatherer{gatherer}
+	}
+	if remoteWrite.URL != "" {
+		writer, err := newRemoteWriter(remoteWrite, gatherer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prometheus.MustRegister(writer)
+		log.Printf("Pushing metrics to %s every %s\n", remoteWrite.URL, remoteWrite.Interval)
+		go writer.run()
+	}
+	if influxDB.URL != "" {
+		writer := newInfluxWriter(influxDB, cache)
+		prometheus.MustRegister(writer)
+		log.Printf("Writing to InfluxDB %s every %s\n", influxDB.URL, influxDB.Interval)
+		go writer.run()
+	}
+	if otlp.Endpoint != "" {
+		exporter, err := newOTLPExporter(otlp, cache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prometheus.MustRegister(exporter)
+		log.Printf("Exporting to %s with OTLP %s every %s\n", otlp.Endpoint, otlp.Protocol, otlp.Interval)
+		go exporter.run()
+	}
+	if statsd.Address != "" {
+		emitter, err := newStatsDEmitter(statsd, cache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prometheus.MustRegister(emitter)
+		log.Printf("Sending to StatsD %s every %s\n", statsd.Address, statsd.Interval)
+		go emitter.run()
+	}
+	if graphite.Address != "" {
+		writer, err := newGraphiteWriter(graphite, cache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prometheus.MustRegister(writer)
+		log.Printf("Pushing to Graphite %s every %s\n", graphite.Address, graphite.Interval)
+		go writer.run()
+	}
+	if *influxPath != "" {
+		http.Handle(*influxPath, influxHandler(cache))
+	}
+	// The stream and WatchDevices share a single collection per interval.
+	var stream *streamer
+	if *enableAPI || *grpcAddress != "" {
+		stream = newStreamer(cache, *streamInterval)
+		prometheus.MustRegister(stream)
+	}
+	if *grpcAddress != "" {
+		server := newGRPCServer(cache, stream)
+		prometheus.MustRegister(server)
+		log.Printf("Serving gRPC on %s\n", *grpcAddress)
+		go func() {
+			log.Fatal(server.listenAndServe(*grpcAddress, *grpcCertFile, *grpcKeyFile))
+		}()
+	}
+	if *enableAPI {
+		http.Handle(apiPrefix, apiHandler(cache, stream))
+	}
+	http.Handle(*metricsPath, metricsHandler(gatherer))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>NVML Exporter</title></head>
@@ -53,8 +282,23 @@ func main() {
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
 
-func NewExporter() *Exporter {
+// newBuildInfo returns the nvidia_exporter_build_info metric.
+func newBuildInfo(version, revision, goVersion string) *prometheus.GaugeVec {
+	info := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_build_info",
+			Help:      "Version, revision and Go version the exporter was built with",
+		},
+		[]string{"version", "revision", "goversion"},
+	)
+	info.WithLabelValues(version, revision, goVersion).Set(1)
+	return info
+}
+
+func NewExporter(backend Backend) *Exporter {
 	return &Exporter{
+		backend: backend,
 		up: prometheus.NewGauge(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
@@ -68,7 +312,7 @@ func NewExporter() *Exporter {
 				Name:      "driver_info",
 				Help:      "NVML Info",
 			},
-			[]string{"version"},
+			[]string{"version", "nvml_version", "cuda_version"},
 		),
 		deviceCount: prometheus.NewGauge(
 			prometheus.GaugeOpts{
@@ -88,39 +332,39 @@ func NewExporter() *Exporter {
 		temperatures: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "temperatures",
-				Help:      "Temperature as reported by the device",
+				Name:      "temperature_celsius",
+				Help:      "Temperature in degrees Celsius as reported by the device",
 			},
 			[]string{"minor"},
 		),
 		powerUsage: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "power_usage",
-				Help:      "Power usage as reported by the device",
+				Name:      "power_usage_watts",
+				Help:      "Power usage in watts as reported by the device",
 			},
 			[]string{"minor"},
 		),
 		powerUsageAverage: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "power_usage_average",
-				Help:      "Power usage as reported by the device averaged over 10s",
+				Name:      "power_usage_average_watts",
+				Help:      "Power usage in watts as reported by the device averaged over 10s",
 			},
 			[]string{"minor"},
 		),
 		fanSpeed: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "fanspeed",
-				Help:      "Fan speed as reported by the device",
+				Name:      "fan_speed_ratio",
+				Help:      "Fan speed as a ratio of its maximum as reported by the device",
 			},
 			[]string{"minor"},
 		),
 		memoryTotal: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "memory_total",
+				Name:      "memory_total_bytes",
 				Help:      "Total memory as reported by the device",
 			},
 			[]string{"minor"},
@@ -128,7 +372,7 @@ func NewExporter() *Exporter {
 		memoryUsed: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "memory_used",
+				Name:      "memory_used_bytes",
 				Help:      "Used memory as reported by the device",
 			},
 			[]string{"minor"},
@@ -136,32 +380,319 @@ func NewExporter() *Exporter {
 		utilizationMemory: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "utilization_memory",
-				Help:      "Memory Utilization as reported by the device",
+				Name:      "utilization_memory_ratio",
+				Help:      "Memory utilization as a ratio as reported by the device",
 			},
 			[]string{"minor"},
 		),
 		utilizationGPU: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "utilization_gpu",
-				Help:      "GPU utilization as reported by the device",
+				Name:      "utilization_gpu_ratio",
+				Help:      "GPU utilization as a ratio as reported by the device",
 			},
 			[]string{"minor"},
 		),
 		utilizationGPUAverage: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "utilization_gpu_average",
-				Help:      "Used memory as reported by the device averraged over 10s",
+				Name:      "utilization_gpu_average_ratio",
+				Help:      "GPU utilization as a ratio as reported by the device averaged over 10s",
+			},
+			[]string{"minor"},
+		),
+		migModeCurrent: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "mig_mode_current",
+				Help:      "Whether MIG mode is currently enabled on the device",
+			},
+			[]string{"minor"},
+		),
+		migModePending: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "mig_mode_pending",
+				Help:      "Whether MIG mode will be enabled on the device after the next reset",
+			},
+			[]string{"minor"},
+		),
+		migInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "mig_info",
+				Help:      "Info as reported by the MIG device",
+			},
+			[]string{"minor", "gpu_instance", "compute_instance", "mig_profile", "uuid"},
+		),
+		migGPUInstanceSlices: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "mig_gpu_instance_slices",
+				Help:      "GPU instance slices used by the MIG device",
+			},
+			[]string{"minor", "gpu_instance", "compute_instance", "mig_profile"},
+		),
+		migComputeSlices: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "mig_compute_instance_slices",
+				Help:      "Compute instance slices used by the MIG device",
+			},
+			[]string{"minor", "gpu_instance", "compute_instance", "mig_profile"},
+		),
+		migMemoryTotal: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "mig_memory_total_bytes",
+				Help:      "Total memory as reported by the MIG device",
+			},
+			[]string{"minor", "gpu_instance", "compute_instance", "mig_profile"},
+		),
+		migMemoryUsed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "mig_memory_used_bytes",
+				Help:      "Used memory as reported by the MIG device",
+			},
+			[]string{"minor", "gpu_instance", "compute_instance", "mig_profile"},
+		),
+		virtualizationMode: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "virtualization_mode",
+				Help:      "Virtualization mode of the device",
+			},
+			[]string{"minor", "mode"},
+		),
+		vgpuInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_info",
+				Help:      "Info as reported by the vGPU instance",
+			},
+			[]string{"minor", "vgpu_instance", "vm_id", "vm_id_type", "uuid", "vgpu_type"},
+		),
+		vgpuFramebufferUsed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_framebuffer_used_bytes",
+				Help:      "Framebuffer used by the vGPU instance",
+			},
+			[]string{"minor", "vgpu_instance", "vm_id"},
+		),
+		vgpuEncoderSessions: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_encoder_sessions",
+				Help:      "Active encoder sessions of the vGPU instance",
+			},
+			[]string{"minor", "vgpu_instance", "vm_id"},
+		),
+		vgpuUtilizationSM: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_utilization_sm",
+				Help:      "SM utilization of the vGPU instance averaged over 10s",
+			},
+			[]string{"minor", "vgpu_instance", "vm_id"},
+		),
+		vgpuUtilizationMemory: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_utilization_memory",
+				Help:      "Memory utilization of the vGPU instance averaged over 10s",
+			},
+			[]string{"minor", "vgpu_instance", "vm_id"},
+		),
+		vgpuUtilizationEnc: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_utilization_encoder",
+				Help:      "Encoder utilization of the vGPU instance averaged over 10s",
+			},
+			[]string{"minor", "vgpu_instance", "vm_id"},
+		),
+		vgpuUtilizationDec: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_utilization_decoder",
+				Help:      "Decoder utilization of the vGPU instance averaged over 10s",
+			},
+			[]string{"minor", "vgpu_instance", "vm_id"},
+		),
+		vgpuTypeInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_type_info",
+				Help:      "vGPU type supported by the device",
+			},
+			[]string{"minor", "vgpu_type", "vgpu_class"},
+		),
+		vgpuTypeCreatable: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_type_creatable",
+				Help:      "Whether the vGPU type can currently be created on the device",
+			},
+			[]string{"minor", "vgpu_type"},
+		),
+		vgpuTypeFramebuffer: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_type_framebuffer_bytes",
+				Help:      "Framebuffer size of the vGPU type",
+			},
+			[]string{"minor", "vgpu_type"},
+		),
+		vgpuTypeMaxInstances: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "vgpu_type_max_instances",
+				Help:      "Maximum instances of the vGPU type on the device",
+			},
+			[]string{"minor", "vgpu_type"},
+		),
+		clock: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "clock_hertz",
+				Help:      "Current clock speed in hertz as reported by the device",
+			},
+			[]string{"minor", "clock"},
+		),
+		clockMax: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "clock_max_hertz",
+				Help:      "Maximum clock speed in hertz as reported by the device",
+			},
+			[]string{"minor", "clock"},
+		),
+		eccMode: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "ecc_mode",
+				Help:      "Whether ECC is enabled on the device",
+			},
+			[]string{"minor"},
+		),
+		eccErrors: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "ecc_errors",
+				Help:      "ECC errors as reported by the device",
+			},
+			[]string{"minor", "type", "counter"},
+		),
+		pcieLinkGen: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "pcie_link_gen",
+				Help:      "Current PCIe link generation as reported by the device",
+			},
+			[]string{"minor"},
+		),
+		pcieLinkGenMax: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "pcie_link_gen_max",
+				Help:      "Maximum PCIe link generation as reported by the device",
+			},
+			[]string{"minor"},
+		),
+		pcieLinkWidth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "pcie_link_width",
+				Help:      "Current PCIe link width as reported by the device",
+			},
+			[]string{"minor"},
+		),
+		pcieLinkWidthMax: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "pcie_link_width_max",
+				Help:      "Maximum PCIe link width as reported by the device",
+			},
+			[]string{"minor"},
+		),
+		pcieTxBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "pcie_tx_bytes",
+				Help:      "PCIe transmit throughput in bytes per second as reported by the device",
+			},
+			[]string{"minor"},
+		),
+		pcieRxBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "pcie_rx_bytes",
+				Help:      "PCIe receive throughput in bytes per second as reported by the device",
+			},
+			[]string{"minor"},
+		),
+		pcieReplayCounter: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "pcie_replay_counter",
+				Help:      "PCIe replay counter as reported by the device",
 			},
 			[]string{"minor"},
 		),
+		processMemoryUsed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "process_memory_used_bytes",
+				Help:      "Used memory of a process running on the device",
+			},
+			[]string{"minor", "pid", "name", "type"},
+		),
+		nvlinkActive: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "nvlink_active",
+				Help:      "Whether the NVLink is active",
+			},
+			[]string{"minor", "link"},
+		),
+		nvlinkInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "nvlink_info",
+				Help:      "Device at the other end of an active NVLink",
+			},
+			[]string{"minor", "link", "remote_type", "remote_pci_bus_id"},
+		),
+		nvlinkTxBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "nvlink", "tx_bytes_total"),
+			"Data transmitted over the NVLink in bytes",
+			[]string{"minor", "link"}, nil,
+		),
+		nvlinkRxBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "nvlink", "rx_bytes_total"),
+			"Data received over the NVLink in bytes",
+			[]string{"minor", "link"}, nil,
+		),
+		nvlinkErrors: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "nvlink", "errors_total"),
+			"NVLink errors as reported by the device",
+			[]string{"minor", "link", "counter"}, nil,
+		),
+		fabricState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "fabric_state",
+				Help:      "Fabric manager registration state of the device",
+			},
+			[]string{"minor", "state", "status", "clique_id"},
+		),
 	}
 }
 
 func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
-	data, err := collectMetrics()
+	data, err := e.backend.Collect()
 	if err != nil {
 		log.Printf("Failed to collect metrics: %s\n", err)
 		e.up.Set(0)
@@ -170,50 +701,307 @@ func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
 	}
 
 	e.up.Set(1)
-	e.info.WithLabelValues(data.Version).Set(1)
+	if data.Version != "" {
+		e.info.WithLabelValues(data.Version, data.NVMLVersion, data.CUDAVersion).Set(1)
+	}
 	e.deviceCount.Set(float64(len(data.Devices)))
 
+	// MIG instances come and go with reconfiguration, don't keep stale ones.
+	e.migInfo.Reset()
+	e.migGPUInstanceSlices.Reset()
+	e.migComputeSlices.Reset()
+	e.migMemoryTotal.Reset()
+	e.migMemoryUsed.Reset()
+
+	// The same applies to vGPU instances and types.
+	e.virtualizationMode.Reset()
+	e.vgpuInfo.Reset()
+	e.vgpuFramebufferUsed.Reset()
+	e.vgpuEncoderSessions.Reset()
+	e.vgpuUtilizationSM.Reset()
+	e.vgpuUtilizationMemory.Reset()
+	e.vgpuUtilizationEnc.Reset()
+	e.vgpuUtilizationDec.Reset()
+	e.vgpuTypeInfo.Reset()
+	e.vgpuTypeCreatable.Reset()
+	e.vgpuTypeFramebuffer.Reset()
+	e.vgpuTypeMaxInstances.Reset()
+	e.processMemoryUsed.Reset()
+	e.nvlinkInfo.Reset()
+	e.fabricState.Reset()
+
 	for i := 0; i < len(data.Devices); i++ {
 		d := data.Devices[i]
 		e.deviceInfo.WithLabelValues(d.Index, d.MinorNumber, d.Name, d.UUID).Set(1)
-		e.fanSpeed.WithLabelValues(d.MinorNumber).Set(d.FanSpeed)
+		setReading(e.fanSpeed, d, "fan_speed_percent", d.FanSpeed/100)
 		e.memoryTotal.WithLabelValues(d.MinorNumber).Set(d.MemoryTotal)
 		e.memoryUsed.WithLabelValues(d.MinorNumber).Set(d.MemoryUsed)
-		e.powerUsage.WithLabelValues(d.MinorNumber).Set(d.PowerUsage)
-		e.powerUsageAverage.WithLabelValues(d.MinorNumber).Set(d.PowerUsageAverage)
-		e.temperatures.WithLabelValues(d.MinorNumber).Set(d.Temperature)
-		e.utilizationGPU.WithLabelValues(d.MinorNumber).Set(d.UtilizationGPU)
-		e.utilizationGPUAverage.WithLabelValues(d.MinorNumber).Set(d.UtilizationGPUAverage)
-		e.utilizationMemory.WithLabelValues(d.MinorNumber).Set(d.UtilizationMemory)
+		setReading(e.powerUsage, d, "power_usage_milliwatts", d.PowerUsage/1000)
+		setReading(e.powerUsageAverage, d, "power_usage_average_milliwatts", d.PowerUsageAverage/1000)
+		setReading(e.temperatures, d, "temperature_celsius", d.Temperature)
+
+		if d.MigMode != nil {
+			e.migModeCurrent.WithLabelValues(d.MinorNumber).Set(d.MigMode.Current)
+			e.migModePending.WithLabelValues(d.MinorNumber).Set(d.MigMode.Pending)
+		}
+
+		for _, m := range d.MigInstances {
+			e.migInfo.WithLabelValues(d.MinorNumber, m.GPUInstance, m.ComputeInstance, m.Profile, m.UUID).Set(1)
+			e.migGPUInstanceSlices.WithLabelValues(d.MinorNumber, m.GPUInstance, m.ComputeInstance, m.Profile).Set(m.GPUInstanceSlices)
+			e.migComputeSlices.WithLabelValues(d.MinorNumber, m.GPUInstance, m.ComputeInstance, m.Profile).Set(m.ComputeInstanceSlices)
+			e.migMemoryTotal.WithLabelValues(d.MinorNumber, m.GPUInstance, m.ComputeInstance, m.Profile).Set(m.MemoryTotal)
+			e.migMemoryUsed.WithLabelValues(d.MinorNumber, m.GPUInstance, m.ComputeInstance, m.Profile).Set(m.MemoryUsed)
+		}
+
+		if d.VirtualizationMode != "" {
+			e.virtualizationMode.WithLabelValues(d.MinorNumber, d.VirtualizationMode).Set(1)
+		}
+
+		for _, v := range d.Vgpus {
+			e.vgpuInfo.WithLabelValues(d.MinorNumber, v.Instance, v.VMID, v.VMIDType, v.UUID, v.Type).Set(1)
+			e.vgpuFramebufferUsed.WithLabelValues(d.MinorNumber, v.Instance, v.VMID).Set(v.FramebufferUsed)
+			e.vgpuEncoderSessions.WithLabelValues(d.MinorNumber, v.Instance, v.VMID).Set(v.EncoderSessions)
+			e.vgpuUtilizationSM.WithLabelValues(d.MinorNumber, v.Instance, v.VMID).Set(v.UtilizationSM)
+			e.vgpuUtilizationMemory.WithLabelValues(d.MinorNumber, v.Instance, v.VMID).Set(v.UtilizationMemory)
+			e.vgpuUtilizationEnc.WithLabelValues(d.MinorNumber, v.Instance, v.VMID).Set(v.UtilizationEncoder)
+			e.vgpuUtilizationDec.WithLabelValues(d.MinorNumber, v.Instance, v.VMID).Set(v.UtilizationDecoder)
+		}
+
+		for _, t := range d.VgpuTypes {
+			e.vgpuTypeInfo.WithLabelValues(d.MinorNumber, t.Name, t.Class).Set(1)
+			e.vgpuTypeCreatable.WithLabelValues(d.MinorNumber, t.Name).Set(boolToFloat64(t.Creatable))
+			e.vgpuTypeFramebuffer.WithLabelValues(d.MinorNumber, t.Name).Set(t.Framebuffer)
+			e.vgpuTypeMaxInstances.WithLabelValues(d.MinorNumber, t.Name).Set(t.MaxInstances)
+		}
+
+		if c := d.Clocks; c != nil {
+			setClock(e.clock, d, "graphics", "clocks.graphics_mhz", c.Graphics)
+			setClock(e.clock, d, "sm", "clocks.sm_mhz", c.SM)
+			setClock(e.clock, d, "memory", "clocks.memory_mhz", c.Memory)
+			setClock(e.clock, d, "video", "clocks.video_mhz", c.Video)
+			setClock(e.clockMax, d, "graphics", "clocks.max_graphics_mhz", c.MaxGraphics)
+			setClock(e.clockMax, d, "sm", "clocks.max_sm_mhz", c.MaxSM)
+			setClock(e.clockMax, d, "memory", "clocks.max_memory_mhz", c.MaxMemory)
+			setClock(e.clockMax, d, "video", "clocks.max_video_mhz", c.MaxVideo)
+		}
+
+		if ecc := d.ECC; ecc != nil {
+			e.eccMode.WithLabelValues(d.MinorNumber).Set(ecc.Enabled)
+			e.eccErrors.WithLabelValues(d.MinorNumber, "corrected", "volatile").Set(ecc.VolatileCorrected)
+			e.eccErrors.WithLabelValues(d.MinorNumber, "uncorrected", "volatile").Set(ecc.VolatileUncorrected)
+			e.eccErrors.WithLabelValues(d.MinorNumber, "corrected", "aggregate").Set(ecc.AggregateCorrected)
+			e.eccErrors.WithLabelValues(d.MinorNumber, "uncorrected", "aggregate").Set(ecc.AggregateUncorrected)
+		}
+
+		if p := d.PCIe; p != nil {
+			e.pcieLinkGen.WithLabelValues(d.MinorNumber).Set(p.LinkGen)
+			e.pcieLinkGenMax.WithLabelValues(d.MinorNumber).Set(p.LinkGenMax)
+			e.pcieLinkWidth.WithLabelValues(d.MinorNumber).Set(p.LinkWidth)
+			e.pcieLinkWidthMax.WithLabelValues(d.MinorNumber).Set(p.LinkWidthMax)
+			e.pcieTxBytes.WithLabelValues(d.MinorNumber).Set(p.TxBytes)
+			e.pcieRxBytes.WithLabelValues(d.MinorNumber).Set(p.RxBytes)
+			e.pcieReplayCounter.WithLabelValues(d.MinorNumber).Set(p.ReplayCounter)
+		}
+
+		for _, p := range d.Processes {
+			e.processMemoryUsed.WithLabelValues(d.MinorNumber, p.PID, p.Name, p.Type).Set(p.MemoryUsed)
+		}
+
+		for _, l := range d.NVLinks {
+			e.nvlinkActive.WithLabelValues(d.MinorNumber, l.Link).Set(l.Active)
+			if l.Active == 0 {
+				continue
+			}
+			e.nvlinkInfo.WithLabelValues(d.MinorNumber, l.Link, l.RemoteType, l.RemoteBusID).Set(1)
+			// The counters are kept by the device and only exported while
+			// the link is active and supported.
+			for _, c := range []struct {
+				desc   *prometheus.Desc
+				field  string
+				value  float64
+				labels []string
+			}{
+				{e.nvlinkTxBytes, "tx_bytes", l.TxBytes, nil},
+				{e.nvlinkRxBytes, "rx_bytes", l.RxBytes, nil},
+				{e.nvlinkErrors, "replay_errors", l.ReplayErrors, []string{"replay"}},
+				{e.nvlinkErrors, "recovery_errors", l.RecoveryErrors, []string{"recovery"}},
+				{e.nvlinkErrors, "crc_flit_errors", l.CRCFlitErrors, []string{"crc_flit"}},
+				{e.nvlinkErrors, "crc_data_errors", l.CRCDataErrors, []string{"crc_data"}},
+			} {
+				if d.supported("nvlinks." + l.Link + "." + c.field) {
+					labels := append([]string{d.MinorNumber, l.Link}, c.labels...)
+					metrics <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, c.value, labels...)
+				}
+			}
+		}
+
+		if f := d.Fabric; f != nil {
+			e.fabricState.WithLabelValues(d.MinorNumber, f.State, f.Status, f.CliqueID).Set(1)
+		}
+
+		// The DCGM fields are configurable and can't be described upfront.
+		for name, value := range d.DCGMFields {
+			if desc := e.dcgmDesc(name); desc != nil {
+				metrics <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, d.MinorNumber)
+			}
+		}
+
+		// Utilization of a MIG enabled device can't be attributed to its
+		// instances and is not reported.
+		if d.MigMode != nil && d.MigMode.Current == 1 {
+			e.utilizationGPU.DeleteLabelValues(d.MinorNumber)
+			e.utilizationGPUAverage.DeleteLabelValues(d.MinorNumber)
+			e.utilizationMemory.DeleteLabelValues(d.MinorNumber)
+			continue
+		}
+
+		setReading(e.utilizationGPU, d, "utilization_gpu_percent", d.UtilizationGPU/100)
+		setReading(e.utilizationGPUAverage, d, "utilization_gpu_average_percent", d.UtilizationGPUAverage/100)
+		setReading(e.utilizationMemory, d, "utilization_memory_percent", d.UtilizationMemory/100)
 	}
 
+	e.clock.Collect(metrics)
+	e.clockMax.Collect(metrics)
 	e.deviceCount.Collect(metrics)
 	e.deviceInfo.Collect(metrics)
+	e.eccErrors.Collect(metrics)
+	e.eccMode.Collect(metrics)
+	e.fabricState.Collect(metrics)
 	e.fanSpeed.Collect(metrics)
 	e.info.Collect(metrics)
 	e.memoryTotal.Collect(metrics)
 	e.memoryUsed.Collect(metrics)
+	e.migComputeSlices.Collect(metrics)
+	e.migGPUInstanceSlices.Collect(metrics)
+	e.migInfo.Collect(metrics)
+	e.migMemoryTotal.Collect(metrics)
+	e.migMemoryUsed.Collect(metrics)
+	e.migModeCurrent.Collect(metrics)
+	e.migModePending.Collect(metrics)
+	e.nvlinkActive.Collect(metrics)
+	e.nvlinkInfo.Collect(metrics)
+	e.pcieLinkGen.Collect(metrics)
+	e.pcieLinkGenMax.Collect(metrics)
+	e.pcieLinkWidth.Collect(metrics)
+	e.pcieLinkWidthMax.Collect(metrics)
+	e.pcieReplayCounter.Collect(metrics)
+	e.pcieRxBytes.Collect(metrics)
+	e.pcieTxBytes.Collect(metrics)
 	e.powerUsage.Collect(metrics)
 	e.powerUsageAverage.Collect(metrics)
+	e.processMemoryUsed.Collect(metrics)
 	e.temperatures.Collect(metrics)
 	e.up.Collect(metrics)
 	e.utilizationGPU.Collect(metrics)
 	e.utilizationGPUAverage.Collect(metrics)
 	e.utilizationMemory.Collect(metrics)
+	e.vgpuEncoderSessions.Collect(metrics)
+	e.vgpuFramebufferUsed.Collect(metrics)
+	e.vgpuInfo.Collect(metrics)
+	e.vgpuTypeCreatable.Collect(metrics)
+	e.vgpuTypeFramebuffer.Collect(metrics)
+	e.vgpuTypeInfo.Collect(metrics)
+	e.vgpuTypeMaxInstances.Collect(metrics)
+	e.vgpuUtilizationDec.Collect(metrics)
+	e.vgpuUtilizationEnc.Collect(metrics)
+	e.vgpuUtilizationMemory.Collect(metrics)
+	e.vgpuUtilizationSM.Collect(metrics)
+	e.virtualizationMode.Collect(metrics)
+}
+
+// dcgmDesc returns the description of a DCGM field, or nil if the name of
+// the field isn't a valid metric name. The configured field groups are
+// validated when they are loaded, recordings may still hold other names.
+func (e *Exporter) dcgmDesc(name string) *prometheus.Desc {
+	e.dcgmMu.Lock()
+	defer e.dcgmMu.Unlock()
+
+	desc, ok := e.dcgmDescs[name]
+	if ok {
+		return desc
+	}
+	if e.dcgmDescs == nil {
+		e.dcgmDescs = map[string]*prometheus.Desc{}
+	}
+	fqName := dcgmMetricName(name)
+	if model.IsValidMetricName(model.LabelValue(fqName)) {
+		desc = prometheus.NewDesc(fqName, "DCGM field "+name+" as reported by the device", []string{"minor"}, nil)
+	} else {
+		log.Printf("Skipping DCGM field %q, %q is not a valid metric name\n", name, fqName)
+	}
+	e.dcgmDescs[name] = desc
+	return desc
 }
 
 func (e *Exporter) Describe(descs chan<- *prometheus.Desc) {
+	e.clock.Describe(descs)
+	e.clockMax.Describe(descs)
 	e.deviceCount.Describe(descs)
 	e.deviceInfo.Describe(descs)
+	e.eccErrors.Describe(descs)
+	e.eccMode.Describe(descs)
+	e.fabricState.Describe(descs)
 	e.fanSpeed.Describe(descs)
 	e.info.Describe(descs)
 	e.memoryTotal.Describe(descs)
 	e.memoryUsed.Describe(descs)
+	e.migComputeSlices.Describe(descs)
+	e.migGPUInstanceSlices.Describe(descs)
+	e.migInfo.Describe(descs)
+	e.migMemoryTotal.Describe(descs)
+	e.migMemoryUsed.Describe(descs)
+	e.migModeCurrent.Describe(descs)
+	e.migModePending.Describe(descs)
+	e.nvlinkActive.Describe(descs)
+	descs <- e.nvlinkErrors
+	e.nvlinkInfo.Describe(descs)
+	descs <- e.nvlinkRxBytes
+	descs <- e.nvlinkTxBytes
+	e.pcieLinkGen.Describe(descs)
+	e.pcieLinkGenMax.Describe(descs)
+	e.pcieLinkWidth.Describe(descs)
+	e.pcieLinkWidthMax.Describe(descs)
+	e.pcieReplayCounter.Describe(descs)
+	e.pcieRxBytes.Describe(descs)
+	e.pcieTxBytes.Describe(descs)
 	e.powerUsage.Describe(descs)
 	e.powerUsageAverage.Describe(descs)
+	e.processMemoryUsed.Describe(descs)
 	e.temperatures.Describe(descs)
 	e.up.Describe(descs)
 	e.utilizationGPU.Describe(descs)
 	e.utilizationGPUAverage.Describe(descs)
 	e.utilizationMemory.Describe(descs)
+	e.vgpuEncoderSessions.Describe(descs)
+	e.vgpuFramebufferUsed.Describe(descs)
+	e.vgpuInfo.Describe(descs)
+	e.vgpuTypeCreatable.Describe(descs)
+	e.vgpuTypeFramebuffer.Describe(descs)
+	e.vgpuTypeInfo.Describe(descs)
+	e.vgpuTypeMaxInstances.Describe(descs)
+	e.vgpuUtilizationDec.Describe(descs)
+	e.vgpuUtilizationEnc.Describe(descs)
+	e.vgpuUtilizationMemory.Describe(descs)
+	e.vgpuUtilizationSM.Describe(descs)
+	e.virtualizationMode.Describe(descs)
+}
+
+// setReading sets the gauge of a device reading, or removes it if the device
+// failed to report the reading.
+func setReading(g *prometheus.GaugeVec, d *Device, field string, value float64) {
+	if !d.supported(field) {
+		g.DeleteLabelValues(d.MinorNumber)
+		return
+	}
+	g.WithLabelValues(d.MinorNumber).Set(value)
+}
+
+// setClock sets the gauge of a clock in MHz, or removes it if the device
+// failed to report the clock.
+func setClock(g *prometheus.GaugeVec, d *Device, clock, field string, mhz float64) {
+	if !d.supported(field) {
+		g.DeleteLabelValues(d.MinorNumber, clock)
+		return
+	}
+	g.WithLabelValues(d.MinorNumber, clock).Set(mhz * 1e6)
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// golden compares got, encoded as JSON, with the golden file, or replaces
+// the file with -update.
+func golden(t *testing.T, path string, got interface{}) {
+	body, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goldenBytes(t, path, append(body, '\n'))
+}
+
+// goldenMetrics compares the metrics of c in the text format with the golden
+// file, or replaces the file with -update.
+func goldenMetrics(t *testing.T, path string, c prometheus.Collector) {
+	var body bytes.Buffer
+	for _, f := range gatherFamilies(t, c) {
+		if _, err := expfmt.MetricFamilyToText(&body, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	goldenBytes(t, path, body.Bytes())
+}
+
+func goldenBytes(t *testing.T, path string, body []byte) {
+	if *update {
+		if err := ioutil.WriteFile(path, body, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, want) {
+		t.Errorf("%s: got\n%s\nwant\n%s", path, body, want)
+	}
+}
+
+// staticBackend serves the same snapshot on every collection and counts
+// the collections.
+type staticBackend struct {
+	metrics     *Metrics
+	err         error
+	collections int
+}
+
+func (b *staticBackend) Collect() (*Metrics, error) {
+	b.collections++
+	return b.metrics, b.err
+}
+
+// gatherFamilies registers c in a new registry and returns the gathered
+// metric families.
+func gatherFamilies(t *testing.T, c prometheus.Collector) []*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+// gather returns the metric families of c by name.
+func gather(t *testing.T, c prometheus.Collector) map[string]*dto.MetricFamily {
+	byName := map[string]*dto.MetricFamily{}
+	for _, f := range gatherFamilies(t, c) {
+		byName[f.GetName()] = f
+	}
+	return byName
+}
+
+func TestExporterDCGMFields(t *testing.T) {
+	backend := &staticBackend{metrics: &Metrics{Devices: []*Device{
+		{Index: "0", MinorNumber: "0", DCGMFields: map[string]float64{"sm_active": 0.25, "sm-active": 1}},
+		{Index: "1", MinorNumber: "1", DCGMFields: map[string]float64{"sm_active": 0.75}},
+	}}}
+	exporter := NewExporter(backend)
+
+	// The descriptions are built once and reused by later scrapes.
+	for i := 0; i < 2; i++ {
+		families := gather(t, exporter)
+		family, ok := families["nvidia_dcgm_sm_active"]
+		if !ok {
+			t.Fatal("nvidia_dcgm_sm_active not exported")
+		}
+		if n := len(family.GetMetric()); n != 2 {
+			t.Errorf("got %d nvidia_dcgm_sm_active series, want 2", n)
+		}
+		for name := range families {
+			if name == "nvidia_dcgm_sm-active" {
+				t.Errorf("invalid metric name %s exported", name)
+			}
+		}
+	}
+	if n := len(exporter.dcgmDescs); n != 2 {
+		t.Errorf("got %d DCGM descriptions, want 2", n)
+	}
+}
+
+func TestExporterNVLinks(t *testing.T) {
+	backend := &staticBackend{metrics: &Metrics{Devices: []*Device{{
+		Index:       "0",
+		MinorNumber: "0",
+		NVLinks: []*NVLink{
+			{Link: "0", Active: 1, RemoteType: "gpu", RemoteBusID: "0000:0f:00.0", TxBytes: 1 << 40, RxBytes: 1 << 39, ReplayErrors: 2, CRCFlitErrors: 7},
+			{Link: "1", Active: 1, RemoteType: "switch", RemoteBusID: "0000:05:00.0", TxBytes: 4096, RxBytes: 8192, RecoveryErrors: 1, CRCDataErrors: 3},
+			{Link: "2"},
+		},
+		// Link 1 doesn't count its throughput nor CRC data errors.
+		Errors: map[string]string{
+			"nvlinks.1.tx_bytes":        "not supported",
+			"nvlinks.1.rx_bytes":        "not supported",
+			"nvlinks.1.crc_data_errors": "not supported",
+		},
+	}}}}
+	exporter := NewExporter(backend)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+	families, err := legacyGatherer{registry}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	for _, f := range families {
+		if strings.HasPrefix(f.GetName(), "nvidia_nvlink_") {
+			expfmt.MetricFamilyToText(&body, f)
+		}
+	}
+	goldenBytes(t, "testdata/nvlink/metrics.prom", body.Bytes())
+}
+
+func TestExporterVersions(t *testing.T) {
+	backend := &staticBackend{metrics: &Metrics{Version: "535.129.03", NVMLVersion: "12.535.129.03", CUDAVersion: "12.2"}}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewExporter(backend), newBuildInfo("0.3.0", "5f0c3a1", "go1.9.2"))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	for _, f := range families {
+		if f.GetName() == "nvidia_driver_info" || f.GetName() == "nvidia_exporter_build_info" {
+			expfmt.MetricFamilyToText(&body, f)
+		}
+	}
+	goldenBytes(t, "testdata/versions/metrics.prom", body.Bytes())
+}
+
+// testSnapshot is a snapshot of two devices for the push based outputs: an
+// A100 with every reading and a process, and a T4 without a fan and power
+// readings that carries a DCGM field the line protocols can't encode.
+func testSnapshot() *Metrics {
+	return &Metrics{
+		Version:     "535.129.03",
+		NVMLVersion: "12.535.129.03",
+		CUDAVersion: "12.2",
+		Devices: []*Device{
+			{
+				Index:                 "0",
+				MinorNumber:           "0",
+				Name:                  "NVIDIA A100-SXM4-40GB",
+				UUID:                  "GPU-3f1a2b4c-5d6e-7f80-91a2-b3c4d5e6f701",
+				Temperature:           41,
+				PowerUsage:            254120,
+				PowerUsageAverage:     248000,
+				MemoryTotal:           40 << 30,
+				MemoryUsed:            8 << 30,
+				UtilizationGPU:        87,
+				UtilizationGPUAverage: 80,
+				UtilizationMemory:     41,
+				Clocks:                &Clocks{Graphics: 1410, SM: 1410, Memory: 1215, Video: 1275},
+				ECC:                   &ECC{Enabled: 1, AggregateCorrected: 2},
+				PCIe:                  &PCIe{BusID: "0000:07:00.0", LinkGen: 4, LinkWidth: 16, TxBytes: 1 << 20, RxBytes: 2 << 20},
+				Processes:             []*Process{{PID: "2211", Name: "python3", Type: "C", MemoryUsed: 8 << 30}},
+				Errors:                map[string]string{"fan_speed_percent": "not supported"},
+			},
+			{
+				Index:             "1",
+				MinorNumber:       "1",
+				Name:              "Tesla T4",
+				UUID:              "GPU-9b2d1c7e-0f43-4a55-8e61-2c7d9a0b3e12",
+				Temperature:       35,
+				MemoryTotal:       15 << 30,
+				UtilizationMemory: 0,
+				DCGMFields:        map[string]float64{"sm_active": math.NaN()},
+				Errors: map[string]string{
+					"fan_speed_percent":              "not supported",
+					"power_usage_milliwatts":         "not supported",
+					"power_usage_average_milliwatts": "not supported",
+				},
+			},
+		},
+	}
+}
@@ -11,40 +11,109 @@ var (
 	averageDuration = 10 * time.Second
 )
 
+// Metrics is a snapshot of the driver and its devices. Its JSON encoding,
+// with units in the names, is used by the API and the recordings.
 type Metrics struct {
-	Version string
-	Devices []*Device
+	Version     string    `json:"driver_version"`
+	NVMLVersion string    `json:"nvml_version,omitempty"`
+	CUDAVersion string    `json:"cuda_version,omitempty"`
+	Devices     []*Device `json:"devices"`
 }
 
+// Device is a snapshot of a device. Readings the device failed to report are
+// left zero and their error is in Errors by JSON name, prefixed with the
+// name of the enclosing object for nested readings, e.g. clocks.sm_mhz.
 type Device struct {
-	Index                 string
-	MinorNumber           string
-	Name                  string
-	UUID                  string
-	Temperature           float64
-	PowerUsage            float64
-	PowerUsageAverage     float64
-	FanSpeed              float64
-	MemoryTotal           float64
-	MemoryUsed            float64
-	UtilizationMemory     float64
-	UtilizationGPU        float64
-	UtilizationGPUAverage float64
+	Index                 string             `json:"index"`
+	MinorNumber           string             `json:"minor_number"`
+	Name                  string             `json:"name"`
+	UUID                  string             `json:"uuid"`
+	Temperature           float64            `json:"temperature_celsius"`
+	PowerUsage            float64            `json:"power_usage_milliwatts"`
+	PowerUsageAverage     float64            `json:"power_usage_average_milliwatts"`
+	FanSpeed              float64            `json:"fan_speed_percent"`
+	MemoryTotal           float64            `json:"memory_total_bytes"`
+	MemoryUsed            float64            `json:"memory_used_bytes"`
+	UtilizationMemory     float64            `json:"utilization_memory_percent"`
+	UtilizationGPU        float64            `json:"utilization_gpu_percent"`
+	UtilizationGPUAverage float64            `json:"utilization_gpu_average_percent"`
+	MigMode               *MigMode           `json:"mig_mode,omitempty"`
+	MigInstances          []*MigInstance     `json:"mig_instances,omitempty"`
+	VirtualizationMode    string             `json:"virtualization_mode,omitempty"`
+	Vgpus                 []*Vgpu            `json:"vgpus,omitempty"`
+	VgpuTypes             []*VgpuType        `json:"vgpu_types,omitempty"`
+	Clocks                *Clocks            `json:"clocks,omitempty"`
+	ECC                   *ECC               `json:"ecc,omitempty"`
+	PCIe                  *PCIe              `json:"pcie,omitempty"`
+	Processes             []*Process         `json:"processes,omitempty"`
+	DCGMFields            map[string]float64 `json:"dcgm_fields,omitempty"`
+	NVLinks               []*NVLink          `json:"nvlinks,omitempty"`
+	Fabric                *Fabric            `json:"fabric,omitempty"`
+	Errors                map[string]string  `json:"errors,omitempty"`
+}
+
+type Clocks struct {
+	Graphics    float64 `json:"graphics_mhz"`
+	SM          float64 `json:"sm_mhz"`
+	Memory      float64 `json:"memory_mhz"`
+	Video       float64 `json:"video_mhz"`
+	MaxGraphics float64 `json:"max_graphics_mhz"`
+	MaxSM       float64 `json:"max_sm_mhz"`
+	MaxMemory   float64 `json:"max_memory_mhz"`
+	MaxVideo    float64 `json:"max_video_mhz"`
+}
+
+type ECC struct {
+	Enabled              float64 `json:"enabled"`
+	VolatileCorrected    float64 `json:"volatile_corrected"`
+	VolatileUncorrected  float64 `json:"volatile_uncorrected"`
+	AggregateCorrected   float64 `json:"aggregate_corrected"`
+	AggregateUncorrected float64 `json:"aggregate_uncorrected"`
+}
+
+type PCIe struct {
+	BusID         string  `json:"bus_id"`
+	LinkGen       float64 `json:"link_gen"`
+	LinkGenMax    float64 `json:"link_gen_max"`
+	LinkWidth     float64 `json:"link_width"`
+	LinkWidthMax  float64 `json:"link_width_max"`
+	TxBytes       float64 `json:"tx_bytes_per_second"`
+	RxBytes       float64 `json:"rx_bytes_per_second"`
+	ReplayCounter float64 `json:"replay_counter"`
+}
+
+type Process struct {
+	PID        string  `json:"pid"`
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	MemoryUsed float64 `json:"memory_used_bytes"`
 }
 
 func collectMetrics() (*Metrics, error) {
-	if err := gonvml.Initialize(); err != nil {
+	if err := nvmlInit(); err != nil {
 		return nil, err
 	}
-	defer gonvml.Shutdown()
+	defer nvmlShutdown()
 
 	version, err := gonvml.SystemDriverVersion()
 	if err != nil {
 		return nil, err
 	}
 
+	nvmlVersion, err := nvmlVersion()
+	if err != nil && err != errNVMLNotSupported {
+		return nil, err
+	}
+
+	cudaVersion, err := nvmlCudaDriverVersion()
+	if err != nil && err != errNVMLNotSupported {
+		return nil, err
+	}
+
 	metrics := &Metrics{
-		Version: version,
+		Version:     version,
+		NVMLVersion: nvmlVersion,
+		CUDAVersion: cudaVersion,
 	}
 
 	numDevices, err := gonvml.DeviceCount()
@@ -73,23 +142,24 @@ func collectMetrics() (*Metrics, error) {
 			return nil, err
 		}
 
+		errs := deviceErrors{}
 		temperature, err := device.Temperature()
-		if err != nil {
+		if err = errs.optional("temperature_celsius", gonvmlError(err)); err != nil {
 			return nil, err
 		}
 
 		powerUsage, err := device.PowerUsage()
-		if err != nil {
+		if err = errs.optional("power_usage_milliwatts", gonvmlError(err)); err != nil {
 			return nil, err
 		}
 
 		powerUsageAverage, err := device.AveragePowerUsage(averageDuration)
-		if err != nil {
+		if err = errs.optional("power_usage_average_milliwatts", gonvmlError(err)); err != nil {
 			return nil, err
 		}
 
 		fanSpeed, err := device.FanSpeed()
-		if err != nil {
+		if err = errs.optional("fan_speed_percent", gonvmlError(err)); err != nil {
 			return nil, err
 		}
 
@@ -98,16 +168,49 @@ func collectMetrics() (*Metrics, error) {
 			return nil, err
 		}
 
-		utilizationGPU, utilizationMemory, err := device.UtilizationRates()
+		handle, err := nvmlDeviceByIndex(uint(index))
 		if err != nil {
 			return nil, err
 		}
 
-		utilizationGPUAverage, err := device.AverageGPUUtilization(averageDuration)
+		migMode, migInstances, err := collectMig(handle)
 		if err != nil {
 			return nil, err
 		}
 
+		virtualizationMode, vgpus, vgpuTypes, err := collectVgpu(handle)
+		if err != nil {
+			return nil, err
+		}
+
+		nvlinks, err := collectNVLinks(handle, errs)
+		if err != nil {
+			return nil, err
+		}
+
+		fabric, err := collectFabric(handle)
+		if err != nil {
+			return nil, err
+		}
+
+		// Utilization is not available for the parent device while MIG is
+		// enabled.
+		var utilizationGPU, utilizationMemory, utilizationGPUAverage uint
+		if migMode == nil || migMode.Current == 0 {
+			utilizationGPU, utilizationMemory, err = device.UtilizationRates()
+			if err = errs.optional("utilization_gpu_percent", gonvmlError(err)); err != nil {
+				return nil, err
+			}
+			if _, failed := errs["utilization_gpu_percent"]; failed {
+				errs["utilization_memory_percent"] = errs["utilization_gpu_percent"]
+			}
+
+			utilizationGPUAverage, err = device.AverageGPUUtilization(averageDuration)
+			if err = errs.optional("utilization_gpu_average_percent", gonvmlError(err)); err != nil {
+				return nil, err
+			}
+		}
+
 		metrics.Devices = append(metrics.Devices,
 			&Device{
 				Index:                 strconv.Itoa(index),
@@ -123,8 +226,103 @@ func collectMetrics() (*Metrics, error) {
 				UtilizationMemory:     float64(utilizationMemory),
 				UtilizationGPU:        float64(utilizationGPU),
 				UtilizationGPUAverage: float64(utilizationGPUAverage),
+				MigMode:               migMode,
+				MigInstances:          migInstances,
+				VirtualizationMode:    virtualizationMode,
+				Vgpus:                 vgpus,
+				VgpuTypes:             vgpuTypes,
+				NVLinks:               nvlinks,
+				Fabric:                fabric,
+				Errors:                errs.orNil(),
 			})
 	}
 
 	return metrics, nil
 }
+
+// readingFields maps the readings that may be unsupported to their JSON
+// names.
+var readingFields = map[string]string{
+	"temperature_celsius":       "temperature_celsius",
+	"power_usage_watts":         "power_usage_milliwatts",
+	"power_usage_average_watts": "power_usage_average_milliwatts",
+	"fanspeed":                  "fan_speed_percent",
+	"utilization_gpu":           "utilization_gpu_percent",
+	"utilization_gpu_average":   "utilization_gpu_average_percent",
+	"utilization_memory":        "utilization_memory_percent",
+	"clock_graphics_hertz":      "clocks.graphics_mhz",
+	"clock_sm_hertz":            "clocks.sm_mhz",
+	"clock_memory_hertz":        "clocks.memory_mhz",
+	"clock_video_hertz":         "clocks.video_mhz",
+}
+
+// deviceErrors collects the readings a device failed to report.
+type deviceErrors map[string]string
+
+// optional records err for the reading if the device doesn't support it and
+// returns all other errors, which fail the collection.
+func (e deviceErrors) optional(field string, err error) error {
+	if err == errNVMLNotSupported {
+		e[field] = "not supported"
+		return nil
+	}
+	return err
+}
+
+func (e deviceErrors) orNil() map[string]string {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// supported reports whether the device reported the reading.
+func (d *Device) supported(field string) bool {
+	_, failed := d.Errors[field]
+	return !failed
+}
+
+// readings returns the values of the device by name, in the units of the
+// metrics, for the output formats keyed by name rather than labels.
+func (d *Device) readings() map[string]float64 {
+	values := map[string]float64{
+		"temperature_celsius":       d.Temperature,
+		"power_usage_watts":         d.PowerUsage / 1000,
+		"power_usage_average_watts": d.PowerUsageAverage / 1000,
+		"fanspeed":                  d.FanSpeed,
+		"memory_total_bytes":        d.MemoryTotal,
+		"memory_used_bytes":         d.MemoryUsed,
+		"utilization_gpu":           d.UtilizationGPU,
+		"utilization_gpu_average":   d.UtilizationGPUAverage,
+		"utilization_memory":        d.UtilizationMemory,
+	}
+	if c := d.Clocks; c != nil {
+		values["clock_graphics_hertz"] = c.Graphics * 1e6
+		values["clock_sm_hertz"] = c.SM * 1e6
+		values["clock_memory_hertz"] = c.Memory * 1e6
+		values["clock_video_hertz"] = c.Video * 1e6
+	}
+	if e := d.ECC; e != nil {
+		values["ecc_mode"] = e.Enabled
+		values["ecc_errors_volatile_corrected"] = e.VolatileCorrected
+		values["ecc_errors_volatile_uncorrected"] = e.VolatileUncorrected
+		values["ecc_errors_aggregate_corrected"] = e.AggregateCorrected
+		values["ecc_errors_aggregate_uncorrected"] = e.AggregateUncorrected
+	}
+	if p := d.PCIe; p != nil {
+		values["pcie_link_gen"] = p.LinkGen
+		values["pcie_link_width"] = p.LinkWidth
+		values["pcie_tx_bytes"] = p.TxBytes
+		values["pcie_rx_bytes"] = p.RxBytes
+		values["pcie_replay_counter"] = p.ReplayCounter
+	}
+	for name, v := range d.DCGMFields {
+		values["dcgm_"+name] = v
+	}
+	for name, field := range readingFields {
+		if !d.supported(field) {
+			delete(values, name)
+		}
+	}
+	return values
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeviceErrorsOptional(t *testing.T) {
+	errs := deviceErrors{}
+	if err := errs.optional("fan_speed_percent", errNVMLNotSupported); err != nil {
+		t.Errorf("got %v for an unsupported reading, want nil", err)
+	}
+	if err := errs.optional("temperature_celsius", nil); err != nil {
+		t.Errorf("got %v for a reading, want nil", err)
+	}
+	// Only the error value marks a reading unsupported, gonvml errors are
+	// converted first.
+	other := errors.New("nvml: Not Supported")
+	if err := errs.optional("power_usage_milliwatts", other); err != other {
+		t.Errorf("got %v, want the error returned", err)
+	}
+	if err := errs.optional("power_usage_milliwatts", gonvmlError(other)); err != nil {
+		t.Errorf("got %v for a converted gonvml error, want nil", err)
+	}
+	if err := gonvmlError(errors.New("could not load NVML library")); err != errNVMLNotLoaded {
+		t.Errorf("got %v, want the library load failure converted", err)
+	}
+	timeout := errors.New("nvml: Timeout")
+	if err := errs.optional("utilization_gpu_percent", gonvmlError(timeout)); err != timeout {
+		t.Errorf("got %v, want the timeout returned", err)
+	}
+
+	want := map[string]string{"fan_speed_percent": "not supported", "power_usage_milliwatts": "not supported"}
+	if len(errs) != len(want) || errs["fan_speed_percent"] != want["fan_speed_percent"] || errs["power_usage_milliwatts"] != want["power_usage_milliwatts"] {
+		t.Errorf("got errors %v, want %v", errs, want)
+	}
+	if (deviceErrors{}).orNil() != nil {
+		t.Error("expected no errors to be nil")
+	}
+}
+
+func TestDeviceReadingsUnsupported(t *testing.T) {
+	readings := testSnapshot().Devices[1].readings()
+	for _, name := range []string{"fanspeed", "power_usage_watts", "power_usage_average_watts"} {
+		if _, ok := readings[name]; ok {
+			t.Errorf("got unsupported reading %s", name)
+		}
+	}
+	for _, name := range []string{"temperature_celsius", "memory_used_bytes", "utilization_gpu", "dcgm_sm_active"} {
+		if _, ok := readings[name]; !ok {
+			t.Errorf("missing reading %s", name)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+type MigMode struct {
+	Current float64 `json:"current"`
+	Pending float64 `json:"pending"`
+}
+
+type MigInstance struct {
+	GPUInstance           string  `json:"gpu_instance"`
+	ComputeInstance       string  `json:"compute_instance"`
+	Profile               string  `json:"profile"`
+	UUID                  string  `json:"uuid"`
+	GPUInstanceSlices     float64 `json:"gpu_instance_slices"`
+	ComputeInstanceSlices float64 `json:"compute_instance_slices"`
+	MemoryTotal           float64 `json:"memory_total_bytes"`
+	MemoryUsed            float64 `json:"memory_used_bytes"`
+}
+
+// migDevice is the part of the NVML device API read by collectMig, for
+// both the parent device and its MIG devices. nvmlDevice implements it.
+type migDevice interface {
+	MigMode() (bool, bool, error)
+	MaxMigDeviceCount() (uint, error)
+	MigDeviceByIndex(index uint) (migDevice, error)
+	GPUInstanceID() (uint, error)
+	ComputeInstanceID() (uint, error)
+	UUID() (string, error)
+	Name() (string, error)
+	Slices() (uint, uint, error)
+	MemoryInfo() (uint64, uint64, error)
+}
+
+// collectMig returns the MIG mode of the device and, if MIG is enabled, one
+// instance per compute instance. Devices without MIG support return a nil
+// mode.
+func collectMig(device migDevice) (*MigMode, []*MigInstance, error) {
+	current, pending, err := device.MigMode()
+	if err == errNVMLNotSupported {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mode := &MigMode{
+		Current: boolToFloat64(current),
+		Pending: boolToFloat64(pending),
+	}
+	if !current {
+		return mode, nil, nil
+	}
+
+	count, err := device.MaxMigDeviceCount()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var instances []*MigInstance
+	for index := uint(0); index < count; index++ {
+		mig, err := device.MigDeviceByIndex(index)
+		if err == errNVMLNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		gpuInstance, err := mig.GPUInstanceID()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		computeInstance, err := mig.ComputeInstanceID()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		uuid, err := mig.UUID()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name, err := mig.Name()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		gpuInstanceSlices, computeInstanceSlices, err := mig.Slices()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		memoryTotal, memoryUsed, err := mig.MemoryInfo()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		instances = append(instances,
+			&MigInstance{
+				GPUInstance:           strconv.Itoa(int(gpuInstance)),
+				ComputeInstance:       strconv.Itoa(int(computeInstance)),
+				Profile:               migProfile(name),
+				UUID:                  uuid,
+				GPUInstanceSlices:     float64(gpuInstanceSlices),
+				ComputeInstanceSlices: float64(computeInstanceSlices),
+				MemoryTotal:           float64(memoryTotal),
+				MemoryUsed:            float64(memoryUsed),
+			})
+	}
+
+	return mode, instances, nil
+}
+
+// migProfile extracts the profile from a MIG device name such as
+// "NVIDIA A100-SXM4-40GB MIG 1g.5gb".
+func migProfile(name string) string {
+	if i := strings.LastIndex(name, "MIG "); i >= 0 {
+		return name[i+len("MIG "):]
+	}
+	return name
+}
+
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// fakeMigDevice is a GPU or, with a non-empty uuid, a MIG device of a fake
+// MIG topology.
+type fakeMigDevice struct {
+	migErr           error
+	current, pending bool
+	migs             []*fakeMigDevice // nil entries are free indices
+
+	gpuInstance, computeInstance uint
+	uuid, name                   string
+	gpuSlices, computeSlices     uint
+	memoryTotal, memoryUsed      uint64
+}
+
+func (d *fakeMigDevice) MigMode() (bool, bool, error) { return d.current, d.pending, d.migErr }
+func (d *fakeMigDevice) MaxMigDeviceCount() (uint, error) {
+	return uint(len(d.migs)), nil
+}
+func (d *fakeMigDevice) MigDeviceByIndex(index uint) (migDevice, error) {
+	if d.migs[index] == nil {
+		return nil, errNVMLNotFound
+	}
+	return d.migs[index], nil
+}
+func (d *fakeMigDevice) GPUInstanceID() (uint, error)     { return d.gpuInstance, nil }
+func (d *fakeMigDevice) ComputeInstanceID() (uint, error) { return d.computeInstance, nil }
+func (d *fakeMigDevice) UUID() (string, error)            { return d.uuid, nil }
+func (d *fakeMigDevice) Name() (string, error)            { return d.name, nil }
+func (d *fakeMigDevice) Slices() (uint, uint, error)      { return d.gpuSlices, d.computeSlices, nil }
+func (d *fakeMigDevice) MemoryInfo() (uint64, uint64, error) {
+	return d.memoryTotal, d.memoryUsed, nil
+}
+
+func TestCollectMig(t *testing.T) {
+	tests := []struct {
+		name      string
+		device    *fakeMigDevice
+		mode      *MigMode
+		instances []*MigInstance
+	}{
+		{
+			name:   "not supported",
+			device: &fakeMigDevice{migErr: errNVMLNotSupported},
+		},
+		{
+			name:   "disabled, enabled after reset",
+			device: &fakeMigDevice{pending: true, migs: make([]*fakeMigDevice, 7)},
+			mode:   &MigMode{Current: 0, Pending: 1},
+		},
+		{
+			name: "enabled",
+			device: &fakeMigDevice{current: true, pending: true, migs: []*fakeMigDevice{
+				{
+					gpuInstance: 1, computeInstance: 0,
+					uuid: "MIG-1", name: "NVIDIA A100-SXM4-40GB MIG 3g.20gb",
+					gpuSlices: 3, computeSlices: 3,
+					memoryTotal: 20 << 30, memoryUsed: 1 << 30,
+				},
+				nil,
+				{
+					gpuInstance: 2, computeInstance: 1,
+					uuid: "MIG-2", name: "NVIDIA A100-SXM4-40GB MIG 1c.3g.20gb",
+					gpuSlices: 3, computeSlices: 1,
+					memoryTotal: 20 << 30,
+				},
+			}},
+			mode: &MigMode{Current: 1, Pending: 1},
+			instances: []*MigInstance{
+				{
+					GPUInstance: "1", ComputeInstance: "0", Profile: "3g.20gb", UUID: "MIG-1",
+					GPUInstanceSlices: 3, ComputeInstanceSlices: 3,
+					MemoryTotal: 20 << 30, MemoryUsed: 1 << 30,
+				},
+				{
+					GPUInstance: "2", ComputeInstance: "1", Profile: "1c.3g.20gb", UUID: "MIG-2",
+					GPUInstanceSlices: 3, ComputeInstanceSlices: 1,
+					MemoryTotal: 20 << 30,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		mode, instances, err := collectMig(test.device)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(mode, test.mode) {
+			t.Errorf("%s: got mode %+v, want %+v", test.name, mode, test.mode)
+		}
+		if !reflect.DeepEqual(instances, test.instances) {
+			t.Errorf("%s: got instances %+v, want %+v", test.name, instances, test.instances)
+		}
+	}
+}
+
+func TestMigProfile(t *testing.T) {
+	for name, profile := range map[string]string{
+		"NVIDIA A100-SXM4-40GB MIG 1g.5gb":     "1g.5gb",
+		"NVIDIA H100 80GB HBM3 MIG 1g.10gb+me": "1g.10gb+me",
+		"1g.5gb":                               "1g.5gb",
+	} {
+		if got := migProfile(name); got != profile {
+			t.Errorf("migProfile(%q) = %q, want %q", name, got, profile)
+		}
+	}
+}
+
+func TestExporterMig(t *testing.T) {
+	// An A100 split into a 3g.20gb instance with two compute instances and a
+	// 2g.10gb instance, and an H100 with a 1g.10gb and a 1g.10gb+me instance.
+	parents := []*fakeMigDevice{
+		{current: true, pending: true, migs: []*fakeMigDevice{
+			{
+				gpuInstance: 1, computeInstance: 0,
+				uuid: "MIG-5c4b2e1a-0d3f-5a6b-9c8d-7e6f5a4b3c21", name: "NVIDIA A100-SXM4-40GB MIG 1c.3g.20gb",
+				gpuSlices: 3, computeSlices: 1,
+				memoryTotal: 20 << 30, memoryUsed: 6 << 30,
+			},
+			{
+				gpuInstance: 1, computeInstance: 1,
+				uuid: "MIG-7a9e3d2c-1b4f-5e6a-8d7c-6b5a4f3e2d10", name: "NVIDIA A100-SXM4-40GB MIG 2c.3g.20gb",
+				gpuSlices: 3, computeSlices: 2,
+				memoryTotal: 20 << 30, memoryUsed: 6 << 30,
+			},
+			nil,
+			{
+				gpuInstance: 5, computeInstance: 0,
+				uuid: "MIG-2f8e7d6c-5b4a-5392-8170-6f5e4d3c2b1a", name: "NVIDIA A100-SXM4-40GB MIG 2g.10gb",
+				gpuSlices: 2, computeSlices: 2,
+				memoryTotal: 10 << 30, memoryUsed: 1 << 30,
+			},
+		}},
+		{current: true, migs: []*fakeMigDevice{
+			{
+				gpuInstance: 9, computeInstance: 0,
+				uuid: "MIG-0e1d2c3b-4a59-5687-a9b8-c7d6e5f40312", name: "NVIDIA H100 80GB HBM3 MIG 1g.10gb",
+				gpuSlices: 1, computeSlices: 1,
+				memoryTotal: 10 << 30,
+			},
+			{
+				gpuInstance: 10, computeInstance: 0,
+				uuid: "MIG-9f8e7d6c-5b4a-5321-8f0e-d9c8b7a69584", name: "NVIDIA H100 80GB HBM3 MIG 1g.10gb+me",
+				gpuSlices: 1, computeSlices: 1,
+				memoryTotal: 10 << 30, memoryUsed: 2 << 30,
+			},
+		}},
+	}
+
+	var data Metrics
+	for i, parent := range parents {
+		mode, instances, err := collectMig(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		minor := strconv.Itoa(i)
+		data.Devices = append(data.Devices, &Device{
+			Index:          minor,
+			MinorNumber:    minor,
+			UtilizationGPU: 100,
+			MigMode:        mode,
+			MigInstances:   instances,
+		})
+	}
+
+	// Utilization of the parents is not exported while MIG is enabled.
+	var body bytes.Buffer
+	for _, f := range gatherFamilies(t, NewExporter(&staticBackend{metrics: &data})) {
+		if strings.HasPrefix(f.GetName(), "nvidia_mig_") || strings.HasPrefix(f.GetName(), "nvidia_utilization_") {
+			expfmt.MetricFamilyToText(&body, f)
+		}
+	}
+	goldenBytes(t, "testdata/mig/metrics.prom", body.Bytes())
+}
@@ -0,0 +1,20 @@
+//go:build !go1.24
+// +build !go1.24
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// h2cTransport would return a transport speaking HTTP/2 without TLS. The
+// standard library supports it from Go 1.24 on.
+func h2cTransport() (http.RoundTripper, error) {
+	return nil, errors.New("gRPC to a plaintext endpoint needs a build with Go 1.24 or later, use an https endpoint or the http/protobuf protocol")
+}
+
+// h2cServer would make srv speak HTTP/2 without TLS.
+func h2cServer(srv *http.Server) error {
+	return errors.New("the gRPC server needs a build with Go 1.24 or later")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strconv"
+)
+
+type NVLink struct {
+	Link           string  `json:"link"`
+	Active         float64 `json:"active"`
+	RemoteType     string  `json:"remote_type"`
+	RemoteBusID    string  `json:"remote_bus_id"`
+	TxBytes        float64 `json:"tx_bytes"`
+	RxBytes        float64 `json:"rx_bytes"`
+	ReplayErrors   float64 `json:"replay_errors"`
+	RecoveryErrors float64 `json:"recovery_errors"`
+	CRCFlitErrors  float64 `json:"crc_flit_errors"`
+	CRCDataErrors  float64 `json:"crc_data_errors"`
+}
+
+type Fabric struct {
+	State    string `json:"state"`
+	Status   string `json:"status"`
+	CliqueID string `json:"clique_id"`
+}
+
+// nvlinkDevice is the part of the NVML device API read by collectNVLinks.
+// nvmlDevice implements it.
+type nvlinkDevice interface {
+	NvLinkState(link uint) (bool, error)
+	NvLinkRemoteType(link uint) (string, error)
+	NvLinkRemoteBusID(link uint) (string, error)
+	NvLinkThroughput(link uint) (uint64, uint64, error)
+	NvLinkErrors(link uint) (map[string]uint64, error)
+}
+
+// collectNVLinks returns the NVLinks of the device. Devices without NVLink
+// return none. Counters the device doesn't support are recorded in errs as
+// nvlinks.<link>.<field>.
+func collectNVLinks(device nvlinkDevice, errs deviceErrors) ([]*NVLink, error) {
+	var links []*NVLink
+	for link := uint(0); link < nvmlNvLinkMaxLinks; link++ {
+		active, err := device.NvLinkState(link)
+		if err == errNVMLNotSupported || err == errNVMLNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		l := &NVLink{
+			Link:   strconv.Itoa(int(link)),
+			Active: boolToFloat64(active),
+		}
+		links = append(links, l)
+		if !active {
+			continue
+		}
+		field := func(name string) string {
+			return "nvlinks." + l.Link + "." + name
+		}
+
+		if l.RemoteType, err = device.NvLinkRemoteType(link); err != nil && err != errNVMLNotSupported {
+			return nil, err
+		}
+		if l.RemoteBusID, err = device.NvLinkRemoteBusID(link); err != nil && err != errNVMLNotSupported {
+			return nil, err
+		}
+
+		tx, rx, err := device.NvLinkThroughput(link)
+		if err = errs.optional(field("tx_bytes"), err); err != nil {
+			return nil, err
+		}
+		if _, failed := errs[field("tx_bytes")]; failed {
+			errs[field("rx_bytes")] = errs[field("tx_bytes")]
+		}
+		l.TxBytes, l.RxBytes = float64(tx), float64(rx)
+
+		counters, err := device.NvLinkErrors(link)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range []struct {
+			name  string
+			value *float64
+		}{
+			{"replay", &l.ReplayErrors},
+			{"recovery", &l.RecoveryErrors},
+			{"crc_flit", &l.CRCFlitErrors},
+			{"crc_data", &l.CRCDataErrors},
+		} {
+			value, ok := counters[c.name]
+			if !ok {
+				errs.optional(field(c.name+"_errors"), errNVMLNotSupported)
+				continue
+			}
+			*c.value = float64(value)
+		}
+	}
+	return links, nil
+}
+
+// collectFabric returns the fabric registration of the device, which is
+// only available on NVSwitch systems managed by the fabric manager. Other
+// devices return nil.
+func collectFabric(device nvmlDevice) (*Fabric, error) {
+	info, err := device.FabricInfo()
+	if err == errNVMLNotSupported {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.State == "not_supported" {
+		return nil, nil
+	}
+	return &Fabric{
+		State:    info.State,
+		Status:   info.Status,
+		CliqueID: strconv.Itoa(int(info.CliqueID)),
+	}, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fakeNVLinkDevice has the links of states, indexed by link. Links past the
+// end don't exist.
+type fakeNVLinkDevice struct {
+	states        []bool
+	throughputErr error
+	counters      map[string]uint64
+}
+
+func (d *fakeNVLinkDevice) NvLinkState(link uint) (bool, error) {
+	if link >= uint(len(d.states)) {
+		return false, errNVMLNotFound
+	}
+	return d.states[link], nil
+}
+func (d *fakeNVLinkDevice) NvLinkRemoteType(link uint) (string, error) { return "switch", nil }
+func (d *fakeNVLinkDevice) NvLinkRemoteBusID(link uint) (string, error) {
+	return "0000:05:00.0", nil
+}
+func (d *fakeNVLinkDevice) NvLinkThroughput(link uint) (uint64, uint64, error) {
+	return 4096, 8192, d.throughputErr
+}
+func (d *fakeNVLinkDevice) NvLinkErrors(link uint) (map[string]uint64, error) {
+	return d.counters, nil
+}
+
+func TestCollectNVLinks(t *testing.T) {
+	device := &fakeNVLinkDevice{
+		states:        []bool{true, false},
+		throughputErr: errNVMLNotSupported,
+		counters:      map[string]uint64{"replay": 2, "recovery": 1, "crc_flit": 7},
+	}
+	errs := deviceErrors{}
+	links, err := collectNVLinks(device, errs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*NVLink{
+		{Link: "0", Active: 1, RemoteType: "switch", RemoteBusID: "0000:05:00.0", TxBytes: 4096, RxBytes: 8192, ReplayErrors: 2, RecoveryErrors: 1, CRCFlitErrors: 7},
+		{Link: "1"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("got links %+v, want %+v", links, want)
+	}
+	wantErrs := deviceErrors{
+		"nvlinks.0.tx_bytes":        "not supported",
+		"nvlinks.0.rx_bytes":        "not supported",
+		"nvlinks.0.crc_data_errors": "not supported",
+	}
+	if !reflect.DeepEqual(errs, wantErrs) {
+		t.Errorf("got errors %v, want %v", errs, wantErrs)
+	}
+
+	device.throughputErr = errNVMLTimeout
+	if _, err := collectNVLinks(device, deviceErrors{}); err != errNVMLTimeout {
+		t.Errorf("got %v, want the timeout returned", err)
+	}
+}
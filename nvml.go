@@ -0,0 +1,1345 @@
+package main
+
+// The gonvml bindings only cover a small part of the NVML API. The functions
+// below load the same "libnvidia-ml.so.1" and resolve additional symbols on
+// demand. Symbols that are missing from the installed driver are reported as
+// NVML_ERROR_FUNCTION_NOT_FOUND instead of failing the whole library load.
+
+// #cgo CFLAGS: -I${SRCDIR}/vendor/github.com/mindprince/gonvml
+// #cgo LDFLAGS: -ldl
+/*
+#include <stddef.h>
+#include <dlfcn.h>
+#include <stdlib.h>
+
+#include "nvml.h"
+
+// Structures and constants introduced after the NVML version shipped with
+// gonvml. They are declared here with an nvmlx prefix to stay clear of
+// newer headers.
+#define NVMLX_DEVICE_MIG_ENABLE 1
+
+typedef struct {
+  unsigned int multiprocessorCount;
+  unsigned int sharedCopyEngineCount;
+  unsigned int sharedDecoderCount;
+  unsigned int sharedEncoderCount;
+  unsigned int sharedJpegCount;
+  unsigned int sharedOfaCount;
+  unsigned int gpuInstanceSliceCount;
+  unsigned int computeInstanceSliceCount;
+  unsigned long long memorySizeMB;
+} nvmlxDeviceAttributes_t;
+
+#define NVMLX_NVLINK_MAX_LINKS 18
+
+typedef struct {
+  unsigned char clusterUuid[16];
+  nvmlReturn_t status;
+  unsigned int cliqueId;
+  unsigned char state;
+} nvmlxGpuFabricInfo_t;
+
+// nvmlxHandle is set by the first successful dlopen and the library is never
+// closed, so a symbol that was looked up stays valid for the life of the
+// process. It is only written by nvmlxInit, which the Go side serializes.
+static void *nvmlxHandle;
+
+static int nvmlxLoaded(void) {
+  return nvmlxHandle != NULL;
+}
+
+static void *nvmlxSym(const char *name) {
+  if (nvmlxHandle == NULL) {
+    return NULL;
+  }
+  return dlsym(nvmlxHandle, name);
+}
+
+// nvmlxInit loads the library on first use and initializes NVML, which
+// counts the references of nvmlInit and nvmlShutdown itself.
+static nvmlReturn_t nvmlxInit(void) {
+  if (nvmlxHandle == NULL) {
+    nvmlxHandle = dlopen("libnvidia-ml.so.1", RTLD_LAZY);
+    if (nvmlxHandle == NULL) {
+      return NVML_ERROR_LIBRARY_NOT_FOUND;
+    }
+  }
+  nvmlReturn_t (*f)(void) = nvmlxSym("nvmlInit_v2");
+  return f == NULL ? NVML_ERROR_FUNCTION_NOT_FOUND : f();
+}
+
+static nvmlReturn_t nvmlxShutdown(void) {
+  nvmlReturn_t (*f)(void) = nvmlxSym("nvmlShutdown");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f();
+}
+
+static const char *nvmlxErrorString(nvmlReturn_t result) {
+  const char *(*f)(nvmlReturn_t) = nvmlxSym("nvmlErrorString");
+  if (f == NULL) {
+    return "nvmlErrorString Function Not Found";
+  }
+  return f(result);
+}
+
+static nvmlReturn_t nvmlxDeviceGetHandleByIndex(unsigned int index, nvmlDevice_t *device) {
+  nvmlReturn_t (*f)(unsigned int, nvmlDevice_t *) = nvmlxSym("nvmlDeviceGetHandleByIndex_v2");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(index, device);
+}
+
+static nvmlReturn_t nvmlxDeviceGetUUID(nvmlDevice_t device, char *uuid, unsigned int length) {
+  nvmlReturn_t (*f)(nvmlDevice_t, char *, unsigned int) = nvmlxSym("nvmlDeviceGetUUID");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, uuid, length);
+}
+
+static nvmlReturn_t nvmlxDeviceGetName(nvmlDevice_t device, char *name, unsigned int length) {
+  nvmlReturn_t (*f)(nvmlDevice_t, char *, unsigned int) = nvmlxSym("nvmlDeviceGetName");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, name, length);
+}
+
+static nvmlReturn_t nvmlxDeviceGetMemoryInfo(nvmlDevice_t device, nvmlMemory_t *memory) {
+  nvmlReturn_t (*f)(nvmlDevice_t, nvmlMemory_t *) = nvmlxSym("nvmlDeviceGetMemoryInfo");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, memory);
+}
+
+static nvmlReturn_t nvmlxDeviceGetMigMode(nvmlDevice_t device, unsigned int *current, unsigned int *pending) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *, unsigned int *) = nvmlxSym("nvmlDeviceGetMigMode");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, current, pending);
+}
+
+static nvmlReturn_t nvmlxDeviceGetMaxMigDeviceCount(nvmlDevice_t device, unsigned int *count) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *) = nvmlxSym("nvmlDeviceGetMaxMigDeviceCount");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, count);
+}
+
+static nvmlReturn_t nvmlxDeviceGetMigDeviceHandleByIndex(nvmlDevice_t device, unsigned int index, nvmlDevice_t *migDevice) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int, nvmlDevice_t *) = nvmlxSym("nvmlDeviceGetMigDeviceHandleByIndex");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, index, migDevice);
+}
+
+static nvmlReturn_t nvmlxDeviceGetGpuInstanceId(nvmlDevice_t device, unsigned int *id) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *) = nvmlxSym("nvmlDeviceGetGpuInstanceId");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, id);
+}
+
+static nvmlReturn_t nvmlxDeviceGetComputeInstanceId(nvmlDevice_t device, unsigned int *id) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *) = nvmlxSym("nvmlDeviceGetComputeInstanceId");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, id);
+}
+
+static nvmlReturn_t nvmlxDeviceGetAttributes(nvmlDevice_t device, nvmlxDeviceAttributes_t *attributes) {
+  nvmlReturn_t (*f)(nvmlDevice_t, nvmlxDeviceAttributes_t *) = nvmlxSym("nvmlDeviceGetAttributes_v2");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, attributes);
+}
+
+static nvmlReturn_t nvmlxDeviceGetVirtualizationMode(nvmlDevice_t device, nvmlGpuVirtualizationMode_t *mode) {
+  nvmlReturn_t (*f)(nvmlDevice_t, nvmlGpuVirtualizationMode_t *) = nvmlxSym("nvmlDeviceGetVirtualizationMode");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, mode);
+}
+
+static nvmlReturn_t nvmlxDeviceGetSupportedVgpus(nvmlDevice_t device, unsigned int *count, nvmlVgpuTypeId_t *ids) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *, nvmlVgpuTypeId_t *) = nvmlxSym("nvmlDeviceGetSupportedVgpus");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, count, ids);
+}
+
+static nvmlReturn_t nvmlxDeviceGetCreatableVgpus(nvmlDevice_t device, unsigned int *count, nvmlVgpuTypeId_t *ids) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *, nvmlVgpuTypeId_t *) = nvmlxSym("nvmlDeviceGetCreatableVgpus");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, count, ids);
+}
+
+static nvmlReturn_t nvmlxDeviceGetActiveVgpus(nvmlDevice_t device, unsigned int *count, nvmlVgpuInstance_t *instances) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *, nvmlVgpuInstance_t *) = nvmlxSym("nvmlDeviceGetActiveVgpus");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, count, instances);
+}
+
+static nvmlReturn_t nvmlxDeviceGetVgpuUtilization(nvmlDevice_t device, unsigned long long lastSeenTimeStamp, unsigned int *count, nvmlVgpuInstanceUtilizationSample_t *samples) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned long long, nvmlValueType_t *, unsigned int *, nvmlVgpuInstanceUtilizationSample_t *) = nvmlxSym("nvmlDeviceGetVgpuUtilization");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  nvmlValueType_t sampleValType;
+  return f(device, lastSeenTimeStamp, &sampleValType, count, samples);
+}
+
+static nvmlReturn_t nvmlxVgpuTypeGetName(nvmlVgpuTypeId_t id, char *name, unsigned int *size) {
+  nvmlReturn_t (*f)(nvmlVgpuTypeId_t, char *, unsigned int *) = nvmlxSym("nvmlVgpuTypeGetName");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(id, name, size);
+}
+
+static nvmlReturn_t nvmlxVgpuTypeGetClass(nvmlVgpuTypeId_t id, char *class, unsigned int *size) {
+  nvmlReturn_t (*f)(nvmlVgpuTypeId_t, char *, unsigned int *) = nvmlxSym("nvmlVgpuTypeGetClass");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(id, class, size);
+}
+
+static nvmlReturn_t nvmlxVgpuTypeGetFramebufferSize(nvmlVgpuTypeId_t id, unsigned long long *size) {
+  nvmlReturn_t (*f)(nvmlVgpuTypeId_t, unsigned long long *) = nvmlxSym("nvmlVgpuTypeGetFramebufferSize");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(id, size);
+}
+
+static nvmlReturn_t nvmlxVgpuTypeGetMaxInstances(nvmlDevice_t device, nvmlVgpuTypeId_t id, unsigned int *count) {
+  nvmlReturn_t (*f)(nvmlDevice_t, nvmlVgpuTypeId_t, unsigned int *) = nvmlxSym("nvmlVgpuTypeGetMaxInstances");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, id, count);
+}
+
+static nvmlReturn_t nvmlxVgpuInstanceGetVmID(nvmlVgpuInstance_t instance, char *id, unsigned int size, nvmlVgpuVmIdType_t *type) {
+  nvmlReturn_t (*f)(nvmlVgpuInstance_t, char *, unsigned int, nvmlVgpuVmIdType_t *) = nvmlxSym("nvmlVgpuInstanceGetVmID");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(instance, id, size, type);
+}
+
+static nvmlReturn_t nvmlxVgpuInstanceGetUUID(nvmlVgpuInstance_t instance, char *uuid, unsigned int size) {
+  nvmlReturn_t (*f)(nvmlVgpuInstance_t, char *, unsigned int) = nvmlxSym("nvmlVgpuInstanceGetUUID");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(instance, uuid, size);
+}
+
+static nvmlReturn_t nvmlxVgpuInstanceGetType(nvmlVgpuInstance_t instance, nvmlVgpuTypeId_t *id) {
+  nvmlReturn_t (*f)(nvmlVgpuInstance_t, nvmlVgpuTypeId_t *) = nvmlxSym("nvmlVgpuInstanceGetType");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(instance, id);
+}
+
+static nvmlReturn_t nvmlxVgpuInstanceGetFbUsage(nvmlVgpuInstance_t instance, unsigned long long *usage) {
+  nvmlReturn_t (*f)(nvmlVgpuInstance_t, unsigned long long *) = nvmlxSym("nvmlVgpuInstanceGetFbUsage");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(instance, usage);
+}
+
+static nvmlReturn_t nvmlxVgpuInstanceGetEncoderStats(nvmlVgpuInstance_t instance, unsigned int *sessions, unsigned int *averageFps, unsigned int *averageLatency) {
+  nvmlReturn_t (*f)(nvmlVgpuInstance_t, unsigned int *, unsigned int *, unsigned int *) = nvmlxSym("nvmlVgpuInstanceGetEncoderStats");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(instance, sessions, averageFps, averageLatency);
+}
+
+static nvmlReturn_t nvmlxDeviceGetCount(unsigned int *count) {
+  nvmlReturn_t (*f)(unsigned int *) = nvmlxSym("nvmlDeviceGetCount_v2");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(count);
+}
+
+static nvmlReturn_t nvmlxDeviceGetMinorNumber(nvmlDevice_t device, unsigned int *minor) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *) = nvmlxSym("nvmlDeviceGetMinorNumber");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, minor);
+}
+
+static nvmlReturn_t nvmlxDeviceGetSupportedEventTypes(nvmlDevice_t device, unsigned long long *types) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned long long *) = nvmlxSym("nvmlDeviceGetSupportedEventTypes");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, types);
+}
+
+static nvmlReturn_t nvmlxEventSetCreate(nvmlEventSet_t *set) {
+  nvmlReturn_t (*f)(nvmlEventSet_t *) = nvmlxSym("nvmlEventSetCreate");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(set);
+}
+
+static nvmlReturn_t nvmlxDeviceRegisterEvents(nvmlDevice_t device, unsigned long long types, nvmlEventSet_t set) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned long long, nvmlEventSet_t) = nvmlxSym("nvmlDeviceRegisterEvents");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, types, set);
+}
+
+static nvmlReturn_t nvmlxEventSetWait(nvmlEventSet_t set, nvmlEventData_t *data, unsigned int timeout) {
+  nvmlReturn_t (*f)(nvmlEventSet_t, nvmlEventData_t *, unsigned int) = nvmlxSym("nvmlEventSetWait");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(set, data, timeout);
+}
+
+static nvmlReturn_t nvmlxEventSetFree(nvmlEventSet_t set) {
+  nvmlReturn_t (*f)(nvmlEventSet_t) = nvmlxSym("nvmlEventSetFree");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(set);
+}
+
+static nvmlReturn_t nvmlxDeviceGetNvLinkState(nvmlDevice_t device, unsigned int link, nvmlEnableState_t *active) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int, nvmlEnableState_t *) = nvmlxSym("nvmlDeviceGetNvLinkState");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, link, active);
+}
+
+static nvmlReturn_t nvmlxDeviceGetNvLinkRemotePciInfo(nvmlDevice_t device, unsigned int link, nvmlPciInfo_t *pci) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int, nvmlPciInfo_t *) = nvmlxSym("nvmlDeviceGetNvLinkRemotePciInfo");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, link, pci);
+}
+
+static nvmlReturn_t nvmlxDeviceGetNvLinkRemoteDeviceType(nvmlDevice_t device, unsigned int link, unsigned int *type) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int, unsigned int *) = nvmlxSym("nvmlDeviceGetNvLinkRemoteDeviceType");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, link, type);
+}
+
+static nvmlReturn_t nvmlxDeviceGetNvLinkErrorCounter(nvmlDevice_t device, unsigned int link, nvmlNvLinkErrorCounter_t counter, unsigned long long *value) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int, nvmlNvLinkErrorCounter_t, unsigned long long *) = nvmlxSym("nvmlDeviceGetNvLinkErrorCounter");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, link, counter, value);
+}
+
+static nvmlReturn_t nvmlxDeviceGetFieldValues(nvmlDevice_t device, int count, nvmlFieldValue_t *values) {
+  nvmlReturn_t (*f)(nvmlDevice_t, int, nvmlFieldValue_t *) = nvmlxSym("nvmlDeviceGetFieldValues");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, count, values);
+}
+
+static nvmlReturn_t nvmlxDeviceGetGpuFabricInfo(nvmlDevice_t device, nvmlxGpuFabricInfo_t *info) {
+  nvmlReturn_t (*f)(nvmlDevice_t, nvmlxGpuFabricInfo_t *) = nvmlxSym("nvmlDeviceGetGpuFabricInfo");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, info);
+}
+static nvmlReturn_t nvmlxDeviceGetPciInfo(nvmlDevice_t device, nvmlPciInfo_t *pci) {
+  nvmlReturn_t (*f)(nvmlDevice_t, nvmlPciInfo_t *) = nvmlxSym("nvmlDeviceGetPciInfo_v2");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, pci);
+}
+
+static nvmlReturn_t nvmlxDeviceGetTopologyCommonAncestor(nvmlDevice_t device1, nvmlDevice_t device2, nvmlGpuTopologyLevel_t *level) {
+  nvmlReturn_t (*f)(nvmlDevice_t, nvmlDevice_t, nvmlGpuTopologyLevel_t *) = nvmlxSym("nvmlDeviceGetTopologyCommonAncestor");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device1, device2, level);
+}
+
+static nvmlReturn_t nvmlxDeviceGetP2PStatus(nvmlDevice_t device1, nvmlDevice_t device2, nvmlGpuP2PCapsIndex_t index, nvmlGpuP2PStatus_t *status) {
+  nvmlReturn_t (*f)(nvmlDevice_t, nvmlDevice_t, nvmlGpuP2PCapsIndex_t, nvmlGpuP2PStatus_t *) = nvmlxSym("nvmlDeviceGetP2PStatus");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device1, device2, index, status);
+}
+
+static nvmlReturn_t nvmlxDeviceGetCpuAffinity(nvmlDevice_t device, unsigned int size, unsigned long *cpuSet) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int, unsigned long *) = nvmlxSym("nvmlDeviceGetCpuAffinity");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, size, cpuSet);
+}
+
+static nvmlReturn_t nvmlxDeviceGetSerial(nvmlDevice_t device, char *serial, unsigned int length) {
+  nvmlReturn_t (*f)(nvmlDevice_t, char *, unsigned int) = nvmlxSym("nvmlDeviceGetSerial");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, serial, length);
+}
+
+static nvmlReturn_t nvmlxDeviceGetBoardPartNumber(nvmlDevice_t device, char *partNumber, unsigned int length) {
+  nvmlReturn_t (*f)(nvmlDevice_t, char *, unsigned int) = nvmlxSym("nvmlDeviceGetBoardPartNumber");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, partNumber, length);
+}
+
+static nvmlReturn_t nvmlxDeviceGetVbiosVersion(nvmlDevice_t device, char *version, unsigned int length) {
+  nvmlReturn_t (*f)(nvmlDevice_t, char *, unsigned int) = nvmlxSym("nvmlDeviceGetVbiosVersion");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, version, length);
+}
+
+static nvmlReturn_t nvmlxDeviceGetInforomImageVersion(nvmlDevice_t device, char *version, unsigned int length) {
+  nvmlReturn_t (*f)(nvmlDevice_t, char *, unsigned int) = nvmlxSym("nvmlDeviceGetInforomImageVersion");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, version, length);
+}
+
+static nvmlReturn_t nvmlxDeviceGetInforomVersion(nvmlDevice_t device, nvmlInforomObject_t object, char *version, unsigned int length) {
+  nvmlReturn_t (*f)(nvmlDevice_t, nvmlInforomObject_t, char *, unsigned int) = nvmlxSym("nvmlDeviceGetInforomVersion");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, object, version, length);
+}
+
+static nvmlReturn_t nvmlxDeviceGetBrand(nvmlDevice_t device, unsigned int *brand) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *) = nvmlxSym("nvmlDeviceGetBrand");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, brand);
+}
+
+static nvmlReturn_t nvmlxDeviceGetArchitecture(nvmlDevice_t device, unsigned int *architecture) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *) = nvmlxSym("nvmlDeviceGetArchitecture");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, architecture);
+}
+
+static nvmlReturn_t nvmlxDeviceGetCudaComputeCapability(nvmlDevice_t device, int *major, int *minor) {
+  nvmlReturn_t (*f)(nvmlDevice_t, int *, int *) = nvmlxSym("nvmlDeviceGetCudaComputeCapability");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, major, minor);
+}
+
+static nvmlReturn_t nvmlxDeviceGetMaxPcieLinkGeneration(nvmlDevice_t device, unsigned int *generation) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *) = nvmlxSym("nvmlDeviceGetMaxPcieLinkGeneration");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, generation);
+}
+
+static nvmlReturn_t nvmlxDeviceGetBoardId(nvmlDevice_t device, unsigned int *id) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *) = nvmlxSym("nvmlDeviceGetBoardId");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, id);
+}
+
+static nvmlReturn_t nvmlxDeviceGetMultiGpuBoard(nvmlDevice_t device, unsigned int *multiGpu) {
+  nvmlReturn_t (*f)(nvmlDevice_t, unsigned int *) = nvmlxSym("nvmlDeviceGetMultiGpuBoard");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(device, multiGpu);
+}
+static nvmlReturn_t nvmlxSystemGetNVMLVersion(char *version, unsigned int length) {
+  nvmlReturn_t (*f)(char *, unsigned int) = nvmlxSym("nvmlSystemGetNVMLVersion");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(version, length);
+}
+
+static nvmlReturn_t nvmlxSystemGetCudaDriverVersion(int *version) {
+  nvmlReturn_t (*f)(int *) = nvmlxSym("nvmlSystemGetCudaDriverVersion_v2");
+  if (f == NULL) {
+    f = nvmlxSym("nvmlSystemGetCudaDriverVersion");
+  }
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(version);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/mindprince/gonvml"
+)
+
+const (
+	szNVMLName     = C.NVML_DEVICE_NAME_BUFFER_SIZE
+	szNVMLUUID     = C.NVML_DEVICE_UUID_BUFFER_SIZE
+	szNVMLVgpuName = C.NVML_VGPU_NAME_BUFFER_SIZE
+)
+
+var (
+	errNVMLNotLoaded    = errors.New("could not load NVML library")
+	errNVMLNotSupported = errors.New("nvml: Not Supported")
+	errNVMLNotFound     = errors.New("nvml: Not Found")
+	errNVMLTimeout      = errors.New("nvml: Timeout")
+
+	// nvmlMu serializes nvmlInit and nvmlShutdown, which are called from
+	// concurrent collections and the event watcher.
+	nvmlMu sync.Mutex
+	// gonvmlLoaded is set once the gonvml bindings are initialized. They
+	// aren't shut down again, gonvml.Shutdown closes the library under the
+	// feet of concurrent collections.
+	gonvmlLoaded bool
+)
+
+var nvmlVirtualizationModes = map[C.nvmlGpuVirtualizationMode_t]string{
+	C.NVML_GPU_VIRTUALIZATION_MODE_NONE:        "none",
+	C.NVML_GPU_VIRTUALIZATION_MODE_PASSTHROUGH: "passthrough",
+	C.NVML_GPU_VIRTUALIZATION_MODE_VGPU:        "vgpu",
+	C.NVML_GPU_VIRTUALIZATION_MODE_HOST_VGPU:   "host_vgpu",
+	C.NVML_GPU_VIRTUALIZATION_MODE_HOST_VSGA:   "host_vsga",
+}
+
+var nvmlVMIDTypes = map[C.nvmlVgpuVmIdType_t]string{
+	C.NVML_VGPU_VM_ID_DOMAIN_ID: "domain_id",
+	C.NVML_VGPU_VM_ID_UUID:      "uuid",
+}
+
+// nvmlDevice is a device handle obtained through the extended bindings. It
+// is also used for MIG device handles.
+type nvmlDevice struct {
+	dev C.nvmlDevice_t
+}
+
+// nvmlInit initializes NVML for the gonvml and the extended bindings. Both
+// load the library on first use and keep it loaded for the life of the
+// process. Every call must be paired with nvmlShutdown.
+func nvmlInit() error {
+	nvmlMu.Lock()
+	defer nvmlMu.Unlock()
+	if !gonvmlLoaded {
+		if err := gonvml.Initialize(); err != nil {
+			return gonvmlError(err)
+		}
+		gonvmlLoaded = true
+	}
+	return nvmlError(C.nvmlxInit())
+}
+
+// nvmlShutdown releases the reference taken by nvmlInit. The library stays
+// loaded.
+func nvmlShutdown() error {
+	nvmlMu.Lock()
+	defer nvmlMu.Unlock()
+	return nvmlError(C.nvmlxShutdown())
+}
+
+// nvmlError converts a nvmlReturn_t into a golang error. Unsupported
+// operations and functions missing from the installed driver are both
+// reported as errNVMLNotSupported.
+func nvmlError(ret C.nvmlReturn_t) error {
+	switch {
+	case ret == C.NVML_SUCCESS:
+		return nil
+	case ret == C.NVML_ERROR_LIBRARY_NOT_FOUND || C.nvmlxLoaded() == 0:
+		return errNVMLNotLoaded
+	case ret == C.NVML_ERROR_NOT_SUPPORTED || ret == C.NVML_ERROR_FUNCTION_NOT_FOUND:
+		return errNVMLNotSupported
+	case ret == C.NVML_ERROR_NOT_FOUND:
+		return errNVMLNotFound
+	case ret == C.NVML_ERROR_TIMEOUT:
+		return errNVMLTimeout
+	}
+	return fmt.Errorf("nvml: %v", C.GoString(C.nvmlxErrorString(ret)))
+}
+
+// gonvmlError converts the errors of the gonvml bindings, which only carry
+// the message of the NVML return code, to the errors of nvmlError.
+func gonvmlError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch err.Error() {
+	case errNVMLNotSupported.Error():
+		return errNVMLNotSupported
+	case errNVMLNotLoaded.Error():
+		return errNVMLNotLoaded
+	}
+	return err
+}
+
+// nvmlDeviceByIndex returns the device handle for a particular index.
+func nvmlDeviceByIndex(index uint) (nvmlDevice, error) {
+	var dev C.nvmlDevice_t
+	r := C.nvmlxDeviceGetHandleByIndex(C.uint(index), &dev)
+	return nvmlDevice{dev}, nvmlError(r)
+}
+
+// UUID returns the UUID of the device. For MIG devices this is the MIG UUID.
+func (d nvmlDevice) UUID() (string, error) {
+	var uuid [szNVMLUUID]C.char
+	r := C.nvmlxDeviceGetUUID(d.dev, &uuid[0], szNVMLUUID)
+	return C.GoString(&uuid[0]), nvmlError(r)
+}
+
+// Name returns the product name of the device.
+func (d nvmlDevice) Name() (string, error) {
+	var name [szNVMLName]C.char
+	r := C.nvmlxDeviceGetName(d.dev, &name[0], szNVMLName)
+	return C.GoString(&name[0]), nvmlError(r)
+}
+
+// MemoryInfo returns the total and used memory (in bytes) of the device.
+func (d nvmlDevice) MemoryInfo() (uint64, uint64, error) {
+	var memory C.nvmlMemory_t
+	r := C.nvmlxDeviceGetMemoryInfo(d.dev, &memory)
+	return uint64(memory.total), uint64(memory.used), nvmlError(r)
+}
+
+// MigMode returns whether MIG is currently enabled and whether it will be
+// enabled after the next GPU reset.
+func (d nvmlDevice) MigMode() (bool, bool, error) {
+	var current, pending C.uint
+	r := C.nvmlxDeviceGetMigMode(d.dev, &current, &pending)
+	return current == C.NVMLX_DEVICE_MIG_ENABLE, pending == C.NVMLX_DEVICE_MIG_ENABLE, nvmlError(r)
+}
+
+// MaxMigDeviceCount returns the upper bound of MIG devices on the device.
+func (d nvmlDevice) MaxMigDeviceCount() (uint, error) {
+	var n C.uint
+	r := C.nvmlxDeviceGetMaxMigDeviceCount(d.dev, &n)
+	return uint(n), nvmlError(r)
+}
+
+// MigDeviceByIndex returns the MIG device handle at index. Indices without a
+// MIG device return errNVMLNotFound.
+func (d nvmlDevice) MigDeviceByIndex(index uint) (migDevice, error) {
+	var dev C.nvmlDevice_t
+	r := C.nvmlxDeviceGetMigDeviceHandleByIndex(d.dev, C.uint(index), &dev)
+	return nvmlDevice{dev}, nvmlError(r)
+}
+
+// GPUInstanceID returns the GPU instance ID of a MIG device.
+func (d nvmlDevice) GPUInstanceID() (uint, error) {
+	var n C.uint
+	r := C.nvmlxDeviceGetGpuInstanceId(d.dev, &n)
+	return uint(n), nvmlError(r)
+}
+
+// ComputeInstanceID returns the compute instance ID of a MIG device.
+func (d nvmlDevice) ComputeInstanceID() (uint, error) {
+	var n C.uint
+	r := C.nvmlxDeviceGetComputeInstanceId(d.dev, &n)
+	return uint(n), nvmlError(r)
+}
+
+// Slices returns the GPU instance and compute instance slice counts of a MIG
+// device.
+func (d nvmlDevice) Slices() (uint, uint, error) {
+	var attributes C.nvmlxDeviceAttributes_t
+	r := C.nvmlxDeviceGetAttributes(d.dev, &attributes)
+	return uint(attributes.gpuInstanceSliceCount), uint(attributes.computeInstanceSliceCount), nvmlError(r)
+}
+
+// VirtualizationMode returns the virtualization mode of the device, one of
+// none, passthrough, vgpu, host_vgpu and host_vsga.
+func (d nvmlDevice) VirtualizationMode() (string, error) {
+	var mode C.nvmlGpuVirtualizationMode_t
+	r := C.nvmlxDeviceGetVirtualizationMode(d.dev, &mode)
+	if name, ok := nvmlVirtualizationModes[mode]; ok {
+		return name, nvmlError(r)
+	}
+	return "unknown", nvmlError(r)
+}
+
+// SupportedVgpuTypes returns the vGPU types supported by the device.
+func (d nvmlDevice) SupportedVgpuTypes() ([]vgpuType, error) {
+	return nvmlVgpuTypes(d, func(count *C.uint, ids *C.nvmlVgpuTypeId_t) C.nvmlReturn_t {
+		return C.nvmlxDeviceGetSupportedVgpus(d.dev, count, ids)
+	})
+}
+
+// CreatableVgpuTypes returns the vGPU types that can currently be created on
+// the device.
+func (d nvmlDevice) CreatableVgpuTypes() ([]vgpuType, error) {
+	return nvmlVgpuTypes(d, func(count *C.uint, ids *C.nvmlVgpuTypeId_t) C.nvmlReturn_t {
+		return C.nvmlxDeviceGetCreatableVgpus(d.dev, count, ids)
+	})
+}
+
+// nvmlVgpuTypes calls one of the list functions for vGPU types, first to
+// learn the count and then to fill the ids.
+func nvmlVgpuTypes(d nvmlDevice, list func(*C.uint, *C.nvmlVgpuTypeId_t) C.nvmlReturn_t) ([]vgpuType, error) {
+	var count C.uint
+	r := list(&count, nil)
+	if r != C.NVML_SUCCESS && r != C.NVML_ERROR_INSUFFICIENT_SIZE {
+		return nil, nvmlError(r)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	ids := make([]C.nvmlVgpuTypeId_t, count)
+	if r := list(&count, &ids[0]); r != C.NVML_SUCCESS {
+		return nil, nvmlError(r)
+	}
+
+	types := make([]vgpuType, count)
+	for i := range types {
+		types[i] = nvmlVgpuType{d.dev, ids[i]}
+	}
+	return types, nil
+}
+
+// ActiveVgpus returns the vGPU instances currently running on the device.
+func (d nvmlDevice) ActiveVgpus() ([]vgpuInstance, error) {
+	var count C.uint
+	r := C.nvmlxDeviceGetActiveVgpus(d.dev, &count, nil)
+	if r != C.NVML_SUCCESS && r != C.NVML_ERROR_INSUFFICIENT_SIZE {
+		return nil, nvmlError(r)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	ids := make([]C.nvmlVgpuInstance_t, count)
+	if r := C.nvmlxDeviceGetActiveVgpus(d.dev, &count, &ids[0]); r != C.NVML_SUCCESS {
+		return nil, nvmlError(r)
+	}
+
+	instances := make([]vgpuInstance, count)
+	for i := range instances {
+		instances[i] = nvmlVgpuInstance{d.dev, ids[i]}
+	}
+	return instances, nil
+}
+
+// nvmlVgpuUtilization is a utilization sample of a vGPU instance in percent.
+type nvmlVgpuUtilization struct {
+	Instance uint
+	SM       uint
+	Memory   uint
+	Encoder  uint
+	Decoder  uint
+}
+
+// VgpuUtilization returns the utilization samples of the vGPU instances
+// running on the device collected in the last `since` duration.
+func (d nvmlDevice) VgpuUtilization(since time.Duration) ([]nvmlVgpuUtilization, error) {
+	lastTs := C.ulonglong(time.Now().Add(-1*since).UnixNano() / 1000)
+
+	var count C.uint
+	r := C.nvmlxDeviceGetVgpuUtilization(d.dev, lastTs, &count, nil)
+	if r != C.NVML_SUCCESS && r != C.NVML_ERROR_INSUFFICIENT_SIZE {
+		return nil, nvmlError(r)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	samples := make([]C.nvmlVgpuInstanceUtilizationSample_t, count)
+	if r := C.nvmlxDeviceGetVgpuUtilization(d.dev, lastTs, &count, &samples[0]); r != C.NVML_SUCCESS {
+		return nil, nvmlError(r)
+	}
+
+	utilization := make([]nvmlVgpuUtilization, count)
+	for i, s := range samples[:count] {
+		utilization[i] = nvmlVgpuUtilization{
+			Instance: uint(s.vgpuInstance),
+			SM:       nvmlValueUint(&s.smUtil),
+			Memory:   nvmlValueUint(&s.memUtil),
+			Encoder:  nvmlValueUint(&s.encUtil),
+			Decoder:  nvmlValueUint(&s.decUtil),
+		}
+	}
+	return utilization, nil
+}
+
+// nvmlValueUint reads the unsigned int member of a nvmlValue_t union.
+func nvmlValueUint(v *C.nvmlValue_t) uint {
+	return uint(*(*C.uint)(unsafe.Pointer(v)))
+}
+
+// nvmlVgpuType is a vGPU type id of a device.
+type nvmlVgpuType struct {
+	dev C.nvmlDevice_t
+	id  C.nvmlVgpuTypeId_t
+}
+
+// ID returns the vGPU type id.
+func (t nvmlVgpuType) ID() uint {
+	return uint(t.id)
+}
+
+// Name returns the name of the vGPU type, e.g. "GRID M60-2Q".
+func (t nvmlVgpuType) Name() (string, error) {
+	var name [szNVMLVgpuName]C.char
+	size := C.uint(szNVMLVgpuName)
+	r := C.nvmlxVgpuTypeGetName(t.id, &name[0], &size)
+	return C.GoString(&name[0]), nvmlError(r)
+}
+
+// Class returns the class of the vGPU type, e.g. "Quadro".
+func (t nvmlVgpuType) Class() (string, error) {
+	var class [szNVMLVgpuName]C.char
+	size := C.uint(szNVMLVgpuName)
+	r := C.nvmlxVgpuTypeGetClass(t.id, &class[0], &size)
+	return C.GoString(&class[0]), nvmlError(r)
+}
+
+// FramebufferSize returns the framebuffer size of the vGPU type in bytes.
+func (t nvmlVgpuType) FramebufferSize() (uint64, error) {
+	var n C.ulonglong
+	r := C.nvmlxVgpuTypeGetFramebufferSize(t.id, &n)
+	return uint64(n), nvmlError(r)
+}
+
+// MaxInstances returns the number of instances of the vGPU type that can be
+// created on the device.
+func (t nvmlVgpuType) MaxInstances() (uint, error) {
+	var n C.uint
+	r := C.nvmlxVgpuTypeGetMaxInstances(t.dev, t.id, &n)
+	return uint(n), nvmlError(r)
+}
+
+// nvmlVgpuInstance is an active vGPU instance of a device.
+type nvmlVgpuInstance struct {
+	dev C.nvmlDevice_t
+	id  C.nvmlVgpuInstance_t
+}
+
+// ID returns the vGPU instance id.
+func (v nvmlVgpuInstance) ID() uint {
+	return uint(v.id)
+}
+
+// VMID returns the id of the VM the vGPU instance is attached to and the
+// type of the id, either domain_id or uuid.
+func (v nvmlVgpuInstance) VMID() (string, string, error) {
+	var id [szNVMLUUID]C.char
+	var idType C.nvmlVgpuVmIdType_t
+	r := C.nvmlxVgpuInstanceGetVmID(v.id, &id[0], szNVMLUUID, &idType)
+	return C.GoString(&id[0]), nvmlVMIDTypes[idType], nvmlError(r)
+}
+
+// UUID returns the UUID of the vGPU instance.
+func (v nvmlVgpuInstance) UUID() (string, error) {
+	var uuid [szNVMLUUID]C.char
+	r := C.nvmlxVgpuInstanceGetUUID(v.id, &uuid[0], szNVMLUUID)
+	return C.GoString(&uuid[0]), nvmlError(r)
+}
+
+// Type returns the vGPU type of the instance.
+func (v nvmlVgpuInstance) Type() (vgpuType, error) {
+	var id C.nvmlVgpuTypeId_t
+	r := C.nvmlxVgpuInstanceGetType(v.id, &id)
+	return nvmlVgpuType{v.dev, id}, nvmlError(r)
+}
+
+// FramebufferUsage returns the framebuffer used by the vGPU instance in
+// bytes.
+func (v nvmlVgpuInstance) FramebufferUsage() (uint64, error) {
+	var n C.ulonglong
+	r := C.nvmlxVgpuInstanceGetFbUsage(v.id, &n)
+	return uint64(n), nvmlError(r)
+}
+
+// EncoderSessions returns the number of active encoder sessions of the vGPU
+// instance.
+func (v nvmlVgpuInstance) EncoderSessions() (uint, error) {
+	var sessions, averageFps, averageLatency C.uint
+	r := C.nvmlxVgpuInstanceGetEncoderStats(v.id, &sessions, &averageFps, &averageLatency)
+	return uint(sessions), nvmlError(r)
+}
+
+// nvmlDeviceCount returns the number of devices.
+func nvmlDeviceCount() (uint, error) {
+	var n C.uint
+	r := C.nvmlxDeviceGetCount(&n)
+	return uint(n), nvmlError(r)
+}
+
+// MinorNumber returns the minor number of the device, as in /dev/nvidia<minor>.
+func (d nvmlDevice) MinorNumber() (uint, error) {
+	var n C.uint
+	r := C.nvmlxDeviceGetMinorNumber(d.dev, &n)
+	return uint(n), nvmlError(r)
+}
+
+// SupportedEventTypes returns the bitmask of event types the device can
+// report.
+func (d nvmlDevice) SupportedEventTypes() (uint64, error) {
+	var types C.ulonglong
+	r := C.nvmlxDeviceGetSupportedEventTypes(d.dev, &types)
+	return uint64(types), nvmlError(r)
+}
+
+// The event types of nvmlDeviceRegisterEvents.
+const (
+	nvmlEventTypeDoubleBitECCError = uint64(C.nvmlEventTypeDoubleBitEccError)
+	nvmlEventTypePState            = uint64(C.nvmlEventTypePState)
+	nvmlEventTypeXidCriticalError  = uint64(C.nvmlEventTypeXidCriticalError)
+	nvmlEventTypeClock             = uint64(C.nvmlEventTypeClock)
+)
+
+// nvmlEventSet collects the events of the devices registered with it.
+type nvmlEventSet struct {
+	set C.nvmlEventSet_t
+}
+
+// nvmlEvent is an event delivered by nvmlEventSet.Wait. Data holds the Xid
+// of nvmlEventTypeXidCriticalError events.
+type nvmlEvent struct {
+	Device nvmlDevice
+	Type   uint64
+	Data   uint64
+}
+
+func nvmlEventSetCreate() (nvmlEventSet, error) {
+	var set C.nvmlEventSet_t
+	r := C.nvmlxEventSetCreate(&set)
+	return nvmlEventSet{set}, nvmlError(r)
+}
+
+// Register adds the given event types of the device to the set.
+func (s nvmlEventSet) Register(d nvmlDevice, types uint64) error {
+	return nvmlError(C.nvmlxDeviceRegisterEvents(d.dev, C.ulonglong(types), s.set))
+}
+
+// Wait blocks until an event arrives or the timeout passes, in which case
+// errNVMLTimeout is returned.
+func (s nvmlEventSet) Wait(timeout time.Duration) (nvmlEvent, error) {
+	var data C.nvmlEventData_t
+	r := C.nvmlxEventSetWait(s.set, &data, C.uint(timeout/time.Millisecond))
+	return nvmlEvent{
+		Device: nvmlDevice{data.device},
+		Type:   uint64(data.eventType),
+		Data:   uint64(data.eventData),
+	}, nvmlError(r)
+}
+
+func (s nvmlEventSet) Free() error {
+	return nvmlError(C.nvmlxEventSetFree(s.set))
+}
+
+// nvmlNvLinkMaxLinks is the number of NVLinks of the largest devices, links
+// beyond those of a device are reported as errNVMLNotFound.
+const nvmlNvLinkMaxLinks = C.NVMLX_NVLINK_MAX_LINKS
+
+// The NVLink error counters of nvmlDeviceGetNvLinkErrorCounter.
+var nvmlNvLinkErrorCounters = map[string]C.nvmlNvLinkErrorCounter_t{
+	"replay":   C.NVML_NVLINK_ERROR_DL_REPLAY,
+	"recovery": C.NVML_NVLINK_ERROR_DL_RECOVERY,
+	"crc_flit": C.NVML_NVLINK_ERROR_DL_CRC_FLIT,
+	"crc_data": C.NVML_NVLINK_ERROR_DL_CRC_DATA,
+}
+
+// nvmlNvLinkDeviceTypes maps nvmlIntNvLinkDeviceType_t.
+var nvmlNvLinkDeviceTypes = map[C.uint]string{
+	0:    "gpu",
+	1:    "ibmnpu",
+	2:    "switch",
+	0xff: "unknown",
+}
+
+// nvmlFabricStates maps nvmlGpuFabricState_t.
+var nvmlFabricStates = map[C.uchar]string{
+	0: "not_supported",
+	1: "not_started",
+	2: "in_progress",
+	3: "completed",
+}
+
+// The NVLink throughput fields of nvmlDeviceGetFieldValues, in KiB.
+const (
+	nvmlFieldNvLinkThroughputDataTx = 138
+	nvmlFieldNvLinkThroughputDataRx = 139
+)
+
+// NvLinkState returns whether the link is active.
+func (d nvmlDevice) NvLinkState(link uint) (bool, error) {
+	var active C.nvmlEnableState_t
+	r := C.nvmlxDeviceGetNvLinkState(d.dev, C.uint(link), &active)
+	if r == C.NVML_ERROR_INVALID_ARGUMENT {
+		return false, errNVMLNotFound
+	}
+	return active == C.NVML_FEATURE_ENABLED, nvmlError(r)
+}
+
+// NvLinkRemoteBusID returns the PCI bus id of the device at the other end of
+// the link.
+func (d nvmlDevice) NvLinkRemoteBusID(link uint) (string, error) {
+	var pci C.nvmlPciInfo_t
+	r := C.nvmlxDeviceGetNvLinkRemotePciInfo(d.dev, C.uint(link), &pci)
+	return C.GoString(&pci.busId[0]), nvmlError(r)
+}
+
+// NvLinkRemoteType returns the type of the device at the other end of the
+// link, gpu, ibmnpu, switch or unknown.
+func (d nvmlDevice) NvLinkRemoteType(link uint) (string, error) {
+	var t C.uint
+	r := C.nvmlxDeviceGetNvLinkRemoteDeviceType(d.dev, C.uint(link), &t)
+	if name, ok := nvmlNvLinkDeviceTypes[t]; ok {
+		return name, nvmlError(r)
+	}
+	return "unknown", nvmlError(r)
+}
+
+// NvLinkErrors returns the error counters of the link by name. Counters the
+// device doesn't support are left out.
+func (d nvmlDevice) NvLinkErrors(link uint) (map[string]uint64, error) {
+	errors := map[string]uint64{}
+	for name, counter := range nvmlNvLinkErrorCounters {
+		var value C.ulonglong
+		r := C.nvmlxDeviceGetNvLinkErrorCounter(d.dev, C.uint(link), counter, &value)
+		if err := nvmlError(r); err == errNVMLNotSupported {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		errors[name] = uint64(value)
+	}
+	return errors, nil
+}
+
+// NvLinkThroughput returns the data transmitted and received over the link
+// in bytes.
+func (d nvmlDevice) NvLinkThroughput(link uint) (uint64, uint64, error) {
+	values := [2]C.nvmlFieldValue_t{
+		{fieldId: nvmlFieldNvLinkThroughputDataTx, unused: C.uint(link)},
+		{fieldId: nvmlFieldNvLinkThroughputDataRx, unused: C.uint(link)},
+	}
+	if err := nvmlError(C.nvmlxDeviceGetFieldValues(d.dev, 2, &values[0])); err != nil {
+		return 0, 0, err
+	}
+	for _, v := range values {
+		if err := nvmlError(v.nvmlReturn); err != nil {
+			return 0, 0, err
+		}
+	}
+	tx := *(*C.ulonglong)(unsafe.Pointer(&values[0].value))
+	rx := *(*C.ulonglong)(unsafe.Pointer(&values[1].value))
+	return uint64(tx) << 10, uint64(rx) << 10, nil
+}
+
+// nvmlFabricInfo is the fabric registration of a device. Status is the
+// NVML status string of the registration.
+type nvmlFabricInfo struct {
+	State    string
+	Status   string
+	CliqueID uint
+}
+
+// FabricInfo returns the fabric registration of the device.
+func (d nvmlDevice) FabricInfo() (nvmlFabricInfo, error) {
+	var info C.nvmlxGpuFabricInfo_t
+	if err := nvmlError(C.nvmlxDeviceGetGpuFabricInfo(d.dev, &info)); err != nil {
+		return nvmlFabricInfo{}, err
+	}
+	state, ok := nvmlFabricStates[info.state]
+	if !ok {
+		state = "unknown"
+	}
+	return nvmlFabricInfo{
+		State:    state,
+		Status:   C.GoString(C.nvmlxErrorString(info.status)),
+		CliqueID: uint(info.cliqueId),
+	}, nil
+}
+
+// PCIBusID returns the PCI bus id of the device, e.g. "0000:07:00.0".
+func (d nvmlDevice) PCIBusID() (string, error) {
+	var pci C.nvmlPciInfo_t
+	r := C.nvmlxDeviceGetPciInfo(d.dev, &pci)
+	return C.GoString(&pci.busId[0]), nvmlError(r)
+}
+
+// nvmlTopologyLevels maps nvmlGpuTopologyLevel_t.
+var nvmlTopologyLevels = map[C.nvmlGpuTopologyLevel_t]string{
+	C.NVML_TOPOLOGY_INTERNAL:   "same_board",
+	C.NVML_TOPOLOGY_SINGLE:     "single_switch",
+	C.NVML_TOPOLOGY_MULTIPLE:   "multiple_switch",
+	C.NVML_TOPOLOGY_HOSTBRIDGE: "host_bridge",
+	C.NVML_TOPOLOGY_CPU:        "numa_node",
+	C.NVML_TOPOLOGY_SYSTEM:     "system",
+}
+
+// The P2P capabilities of nvmlDeviceGetP2PStatus.
+var nvmlP2PCapabilities = map[string]C.nvmlGpuP2PCapsIndex_t{
+	"read":    C.NVML_P2P_CAPS_INDEX_READ,
+	"write":   C.NVML_P2P_CAPS_INDEX_WRITE,
+	"nvlink":  C.NVML_P2P_CAPS_INDEX_NVLINK,
+	"atomics": C.NVML_P2P_CAPS_INDEX_ATOMICS,
+}
+
+// TopologyLevel returns the closest common ancestor of the devices by name
+// and its NVML level, lower levels being closer. peer is an nvmlDevice.
+func (d nvmlDevice) TopologyLevel(peer topologyDevice) (string, uint, error) {
+	var level C.nvmlGpuTopologyLevel_t
+	if err := nvmlError(C.nvmlxDeviceGetTopologyCommonAncestor(d.dev, peer.(nvmlDevice).dev, &level)); err != nil {
+		return "", 0, err
+	}
+	name, ok := nvmlTopologyLevels[level]
+	if !ok {
+		name = "unknown"
+	}
+	return name, uint(level), nil
+}
+
+// P2PCapabilities returns which P2P capabilities are available between the
+// devices. peer is an nvmlDevice.
+func (d nvmlDevice) P2PCapabilities(peer topologyDevice) (map[string]bool, error) {
+	caps := map[string]bool{}
+	for name, index := range nvmlP2PCapabilities {
+		var status C.nvmlGpuP2PStatus_t
+		if err := nvmlError(C.nvmlxDeviceGetP2PStatus(d.dev, peer.(nvmlDevice).dev, index, &status)); err != nil {
+			return nil, err
+		}
+		caps[name] = status == C.NVML_P2P_STATUS_OK
+	}
+	return caps, nil
+}
+
+// nvmlCPUSetSize is the size of the CPU affinity mask in words, enough for
+// 4096 CPUs.
+const nvmlCPUSetSize = 4096 / (8 * C.sizeof_ulong)
+
+// CPUAffinity returns the CPUs close to the device.
+func (d nvmlDevice) CPUAffinity() ([]uint, error) {
+	var set [nvmlCPUSetSize]C.ulong
+	if err := nvmlError(C.nvmlxDeviceGetCpuAffinity(d.dev, nvmlCPUSetSize, &set[0])); err != nil {
+		return nil, err
+	}
+	var cpus []uint
+	for i, word := range set {
+		for bit := uint(0); bit < 8*C.sizeof_ulong; bit++ {
+			if word&(1<<bit) != 0 {
+				cpus = append(cpus, uint(i)*8*C.sizeof_ulong+bit)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+const (
+	szNVMLSerial     = C.NVML_DEVICE_SERIAL_BUFFER_SIZE
+	szNVMLPartNumber = C.NVML_DEVICE_PART_NUMBER_BUFFER_SIZE
+	szNVMLVbios      = C.NVML_DEVICE_VBIOS_VERSION_BUFFER_SIZE
+	szNVMLInforom    = C.NVML_DEVICE_INFOROM_VERSION_BUFFER_SIZE
+)
+
+// nvmlBrands maps nvmlBrandType_t, including the brands added after the
+// NVML version shipped with gonvml.
+var nvmlBrands = map[C.uint]string{
+	0:  "unknown",
+	1:  "quadro",
+	2:  "tesla",
+	3:  "nvs",
+	4:  "grid",
+	5:  "geforce",
+	6:  "titan",
+	7:  "nvidia_vapps",
+	8:  "nvidia_vpc",
+	9:  "nvidia_vcs",
+	10: "nvidia_vws",
+	11: "nvidia_cloud_gaming",
+	12: "quadro_rtx",
+	13: "nvidia_rtx",
+	14: "nvidia",
+	15: "geforce_rtx",
+	16: "titan_rtx",
+}
+
+// nvmlArchitectures maps nvmlDeviceArchitecture_t.
+var nvmlArchitectures = map[C.uint]string{
+	2:  "kepler",
+	3:  "maxwell",
+	4:  "pascal",
+	5:  "volta",
+	6:  "turing",
+	7:  "ampere",
+	8:  "ada",
+	9:  "hopper",
+	10: "blackwell",
+}
+
+// The infoROM objects of nvmlDeviceGetInforomVersion.
+var nvmlInforomObjects = map[string]C.nvmlInforomObject_t{
+	"oem": C.NVML_INFOROM_OEM,
+	"ecc": C.NVML_INFOROM_ECC,
+}
+
+// nvmlString reads a string of at most size bytes with get.
+func nvmlString(size int, get func(*C.char, C.uint) C.nvmlReturn_t) (string, error) {
+	buf := make([]C.char, size)
+	r := get(&buf[0], C.uint(size))
+	return C.GoString(&buf[0]), nvmlError(r)
+}
+
+// Serial returns the serial number of the board.
+func (d nvmlDevice) Serial() (string, error) {
+	return nvmlString(szNVMLSerial, func(s *C.char, n C.uint) C.nvmlReturn_t {
+		return C.nvmlxDeviceGetSerial(d.dev, s, n)
+	})
+}
+
+// BoardPartNumber returns the part number of the board.
+func (d nvmlDevice) BoardPartNumber() (string, error) {
+	return nvmlString(szNVMLPartNumber, func(s *C.char, n C.uint) C.nvmlReturn_t {
+		return C.nvmlxDeviceGetBoardPartNumber(d.dev, s, n)
+	})
+}
+
+// VbiosVersion returns the version of the VBIOS.
+func (d nvmlDevice) VbiosVersion() (string, error) {
+	return nvmlString(szNVMLVbios, func(s *C.char, n C.uint) C.nvmlReturn_t {
+		return C.nvmlxDeviceGetVbiosVersion(d.dev, s, n)
+	})
+}
+
+// InforomImageVersion returns the version of the infoROM image.
+func (d nvmlDevice) InforomImageVersion() (string, error) {
+	return nvmlString(szNVMLInforom, func(s *C.char, n C.uint) C.nvmlReturn_t {
+		return C.nvmlxDeviceGetInforomImageVersion(d.dev, s, n)
+	})
+}
+
+// InforomVersion returns the version of an infoROM object, oem or ecc.
+func (d nvmlDevice) InforomVersion(object string) (string, error) {
+	return nvmlString(szNVMLInforom, func(s *C.char, n C.uint) C.nvmlReturn_t {
+		return C.nvmlxDeviceGetInforomVersion(d.dev, nvmlInforomObjects[object], s, n)
+	})
+}
+
+// Brand returns the brand of the device, e.g. tesla or geforce.
+func (d nvmlDevice) Brand() (string, error) {
+	var brand C.uint
+	if err := nvmlError(C.nvmlxDeviceGetBrand(d.dev, &brand)); err != nil {
+		return "", err
+	}
+	if name, ok := nvmlBrands[brand]; ok {
+		return name, nil
+	}
+	return "unknown", nil
+}
+
+// Architecture returns the architecture of the device, e.g. ampere.
+func (d nvmlDevice) Architecture() (string, error) {
+	var arch C.uint
+	if err := nvmlError(C.nvmlxDeviceGetArchitecture(d.dev, &arch)); err != nil {
+		return "", err
+	}
+	if name, ok := nvmlArchitectures[arch]; ok {
+		return name, nil
+	}
+	return "unknown", nil
+}
+
+// CudaComputeCapability returns the major and minor CUDA compute capability.
+func (d nvmlDevice) CudaComputeCapability() (int, int, error) {
+	var major, minor C.int
+	r := C.nvmlxDeviceGetCudaComputeCapability(d.dev, &major, &minor)
+	return int(major), int(minor), nvmlError(r)
+}
+
+// MaxPcieLinkGeneration returns the highest PCIe generation the device and
+// the system support.
+func (d nvmlDevice) MaxPcieLinkGeneration() (uint, error) {
+	var gen C.uint
+	r := C.nvmlxDeviceGetMaxPcieLinkGeneration(d.dev, &gen)
+	return uint(gen), nvmlError(r)
+}
+
+// BoardID returns the id of the board, shared by the devices of a multi-GPU
+// board.
+func (d nvmlDevice) BoardID() (uint, error) {
+	var id C.uint
+	r := C.nvmlxDeviceGetBoardId(d.dev, &id)
+	return uint(id), nvmlError(r)
+}
+
+// MultiGPUBoard returns whether the device is on a multi-GPU board.
+func (d nvmlDevice) MultiGPUBoard() (bool, error) {
+	var multi C.uint
+	r := C.nvmlxDeviceGetMultiGpuBoard(d.dev, &multi)
+	return multi != 0, nvmlError(r)
+}
+
+const szNVMLVersion = C.NVML_SYSTEM_NVML_VERSION_BUFFER_SIZE
+
+// nvmlVersion returns the version of the NVML library, e.g. "12.535.129.03".
+func nvmlVersion() (string, error) {
+	return nvmlString(szNVMLVersion, func(s *C.char, n C.uint) C.nvmlReturn_t {
+		return C.nvmlxSystemGetNVMLVersion(s, n)
+	})
+}
+
+// nvmlCudaDriverVersion returns the CUDA driver API version supported by the
+// driver, e.g. "12.2".
+func nvmlCudaDriverVersion() (string, error) {
+	var version C.int
+	if err := nvmlError(C.nvmlxSystemGetCudaDriverVersion(&version)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.%d", version/1000, version%1000/10), nil
+}
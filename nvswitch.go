@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	nvswitchLinkStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "nvswitch", "link_state"),
+		"State of the NVSwitch port as reported by dcgmi nvlink",
+		[]string{"physical_id", "link", "state"}, nil,
+	)
+
+	// nvswitchLinkStates maps the link status letters of dcgmi nvlink to
+	// states. Unsupported links ("_") are skipped.
+	nvswitchLinkStates = map[string]string{
+		"U": "up",
+		"D": "down",
+		"X": "disabled",
+	}
+
+	nvswitchLinkTxBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "nvswitch", "link_tx_bytes_total"),
+		"Data transmitted over the NVSwitch port in bytes",
+		[]string{"physical_id", "link"}, nil,
+	)
+	nvswitchLinkRxBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "nvswitch", "link_rx_bytes_total"),
+		"Data received over the NVSwitch port in bytes",
+		[]string{"physical_id", "link"}, nil,
+	)
+	nvswitchLinkErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "nvswitch", "link_errors_total"),
+		"NVSwitch port errors as reported by the host engine",
+		[]string{"physical_id", "link", "counter"}, nil,
+	)
+
+	// nvswitchLinkFields are the DCGM fields of an NVSwitch port read with
+	// dcgmi dmon, in the order of nvswitchLinkCounters.
+	nvswitchLinkFields = []string{"780", "781", "784", "785", "786", "787"}
+
+	// nvswitchLinkCounters are the error counters following the throughput
+	// in the output of dcgmi dmon, named like the counters of the NVLinks of
+	// a GPU.
+	nvswitchLinkCounters = []string{"replay", "recovery", "crc_flit", "crc_data"}
+
+	nvswitchTimeout = 10 * time.Second
+)
+
+// dcgmLinkEntityGroup is the entity group of NVSwitch ports in the packed
+// link entity ids of DCGM: the group in the lowest byte, then the port and
+// the physical id of the switch.
+const dcgmLinkEntityGroup = 3
+
+// nvswitchLinkCollector exports the state and the counters of the NVSwitch
+// ports. NVML doesn't expose the switches, so they are read from the host
+// engine with dcgmi.
+type nvswitchLinkCollector struct {
+	path string
+	host string
+}
+
+func newNVSwitchLinkCollector(path, host string) *nvswitchLinkCollector {
+	return &nvswitchLinkCollector{
+		path: path,
+		host: host,
+	}
+}
+
+func (c *nvswitchLinkCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- nvswitchLinkStateDesc
+	descs <- nvswitchLinkTxBytesDesc
+	descs <- nvswitchLinkRxBytesDesc
+	descs <- nvswitchLinkErrorsDesc
+}
+
+func (c *nvswitchLinkCollector) Collect(metrics chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), nvswitchTimeout)
+	defer cancel()
+
+	out, err := c.dcgmi(ctx, "nvlink", "-s")
+	if err != nil {
+		log.Printf("Failed to read NVSwitch link status: %s\n", err)
+		return
+	}
+
+	switches, err := parseNVSwitchLinkStatus(bytes.NewReader(out))
+	if err != nil {
+		log.Printf("Failed to parse NVSwitch link status: %s\n", err)
+		return
+	}
+	var entities []string
+	for id, links := range switches {
+		physicalID, _ := strconv.Atoi(id)
+		for link, status := range links {
+			state, ok := nvswitchLinkStates[status]
+			if !ok {
+				continue
+			}
+			metrics <- prometheus.MustNewConstMetric(nvswitchLinkStateDesc, prometheus.GaugeValue, 1, id, strconv.Itoa(link), state)
+			if state == "up" {
+				entities = append(entities, "link:"+strconv.Itoa(dcgmLinkEntityID(physicalID, link)))
+			}
+		}
+	}
+	if len(entities) == 0 {
+		return
+	}
+	sort.Strings(entities)
+
+	out, err = c.dcgmi(ctx, "dmon", "-c", "1", "-e", strings.Join(nvswitchLinkFields, ","), "-i", strings.Join(entities, ","))
+	if err != nil {
+		log.Printf("Failed to read NVSwitch link counters: %s\n", err)
+		return
+	}
+	counters, err := parseNVSwitchLinkCounters(bytes.NewReader(out))
+	if err != nil {
+		log.Printf("Failed to parse NVSwitch link counters: %s\n", err)
+		return
+	}
+	for _, l := range counters {
+		id, link := strconv.Itoa(l.physicalID), strconv.Itoa(l.link)
+		for i, value := range l.values {
+			if math.IsNaN(value) {
+				continue
+			}
+			switch i {
+			case 0:
+				metrics <- prometheus.MustNewConstMetric(nvswitchLinkTxBytesDesc, prometheus.CounterValue, value, id, link)
+			case 1:
+				metrics <- prometheus.MustNewConstMetric(nvswitchLinkRxBytesDesc, prometheus.CounterValue, value, id, link)
+			default:
+				metrics <- prometheus.MustNewConstMetric(nvswitchLinkErrorsDesc, prometheus.CounterValue, value, id, link, nvswitchLinkCounters[i-2])
+			}
+		}
+	}
+}
+
+// dcgmi runs dcgmi with args against the configured host engine.
+func (c *nvswitchLinkCollector) dcgmi(ctx context.Context, args ...string) ([]byte, error) {
+	if c.host != "" {
+		args = append(args, "--host", c.host)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.path, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s: %s", c.path, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// dcgmLinkEntityID returns the DCGM entity id of a port of the NVSwitch
+// with the physical id.
+func dcgmLinkEntityID(physicalID, link int) int {
+	return physicalID<<16 | link<<8 | dcgmLinkEntityGroup
+}
+
+// nvswitchLinkReading are the values of nvswitchLinkFields of a port.
+type nvswitchLinkReading struct {
+	physicalID int
+	link       int
+	values     []float64
+}
+
+// parseNVSwitchLinkCounters parses the output of dcgmi dmon for link
+// entities, e.g.
+//
+//	#Entity      NVSTX     NVSRX     NVSRP  NVSRC  NVSFL  NVSCR
+//	ID
+//	Link 524547  81920     73728     0      0      2      0
+//
+// Blank values, printed as N/A, are read as NaN. A counter reading 0 would
+// look like a reset.
+func parseNVSwitchLinkCounters(r io.Reader) ([]nvswitchLinkReading, error) {
+	var readings []nvswitchLinkReading
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		columns := strings.Fields(scanner.Text())
+		if len(columns) < 2 || columns[0] != "Link" {
+			continue
+		}
+		id, err := strconv.Atoi(columns[1])
+		if err != nil || id&0xff != dcgmLinkEntityGroup {
+			return nil, fmt.Errorf("invalid link entity in %q", scanner.Text())
+		}
+		if len(columns)-2 != len(nvswitchLinkFields) {
+			return nil, fmt.Errorf("expected %d values, got %q", len(nvswitchLinkFields), scanner.Text())
+		}
+		reading := nvswitchLinkReading{physicalID: id >> 16, link: id >> 8 & 0xff}
+		for _, v := range columns[2:] {
+			value, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				value = math.NaN()
+			}
+			reading.values = append(reading.values, value)
+		}
+		readings = append(readings, reading)
+	}
+	return readings, scanner.Err()
+}
+
+// parseNVSwitchLinkStatus parses the NvSwitches section of dcgmi nvlink -s,
+// e.g.
+//
+//	NvSwitches:
+//	    physicalId 8:
+//	        U U U D X _ ...
+//
+// and returns the link status letters by physical id.
+func parseNVSwitchLinkStatus(r io.Reader) (map[string][]string, error) {
+	switches := map[string][]string{}
+
+	var inSwitches bool
+	var id string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasSuffix(line, ":") && !strings.HasPrefix(line, "physicalId"):
+			// Section header, e.g. "GPUs:" or "NvSwitches:".
+			inSwitches = line == "NvSwitches:"
+			id = ""
+		case !inSwitches || strings.HasPrefix(line, "Key:"):
+		case strings.HasPrefix(line, "physicalId"):
+			id = strings.TrimSuffix(strings.TrimSpace(strings.TrimPrefix(line, "physicalId")), ":")
+			if _, err := strconv.Atoi(id); err != nil {
+				return nil, fmt.Errorf("invalid physical id in %q", line)
+			}
+		case id != "":
+			switches[id] = append(switches[id], strings.Fields(line)...)
+		}
+	}
+	return switches, scanner.Err()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeNVSwitchDCGMI writes a script in place of dcgmi that prints the link
+// status and counters of testdata/nvswitch and records the arguments of
+// dmon.
+func fakeNVSwitchDCGMI(t *testing.T) (path, args string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "dcgmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testdata, err := filepath.Abs("testdata/nvswitch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "dcgmi")
+	args = filepath.Join(dir, "args")
+	script := "#!/bin/sh\n" +
+		"case \"$1\" in\n" +
+		"nvlink) cat " + filepath.Join(testdata, "nvlink-status.txt") + " ;;\n" +
+		"dmon) echo \"$@\" > " + args + "; cat " + filepath.Join(testdata, "dmon.txt") + " ;;\n" +
+		"esac\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path, args, func() { os.RemoveAll(dir) }
+}
+
+func TestNVSwitchLinkCollector(t *testing.T) {
+	path, args, cleanup := fakeNVSwitchDCGMI(t)
+	defer cleanup()
+
+	goldenMetrics(t, "testdata/nvswitch/metrics.prom", newNVSwitchLinkCollector(path, "10.0.0.2"))
+
+	// Only the ports that are up are queried.
+	got, _ := ioutil.ReadFile(args)
+	if want := "dmon -c 1 -e 780,781,784,785,786,787 -i link:524291,link:524547,link:589827 --host 10.0.0.2\n"; string(got) != want {
+		t.Errorf("dmon called with %q, want %q", got, want)
+	}
+}
+
+func TestParseNVSwitchLinkStatus(t *testing.T) {
+	f, err := os.Open("testdata/nvswitch/nvlink-status.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	switches, err := parseNVSwitchLinkStatus(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"8": {"U", "U", "D", "X", "_", "_"},
+		"9": {"U", "D", "_", "_", "_", "_"},
+	}
+	if !reflect.DeepEqual(switches, want) {
+		t.Errorf("got %v, want %v", switches, want)
+	}
+}
+
+func TestParseNVSwitchLinkCounters(t *testing.T) {
+	for _, line := range []string{
+		"Link 524291  1  2  3",
+		"Link 0  1  2  3  4  5  6",
+		"Link port1  1  2  3  4  5  6",
+	} {
+		if _, err := parseNVSwitchLinkCounters(strings.NewReader(line)); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestDCGMLinkEntityID(t *testing.T) {
+	if got, want := dcgmLinkEntityID(8, 1), 524547; got != want {
+		t.Errorf("got entity id %d, want %d", got, want)
+	}
+}
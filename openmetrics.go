@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+var (
+	// legacyMetrics maps the metrics renamed to base units to their former
+	// name and the factor converting the value back to the former unit.
+	legacyMetrics = map[string]struct {
+		name   string
+		factor float64
+	}{
+		"nvidia_temperature_celsius":           {"nvidia_temperatures", 1},
+		"nvidia_power_usage_watts":             {"nvidia_power_usage", 1000},
+		"nvidia_power_usage_average_watts":     {"nvidia_power_usage_average", 1000},
+		"nvidia_memory_total_bytes":            {"nvidia_memory_total", 1},
+		"nvidia_memory_used_bytes":             {"nvidia_memory_used", 1},
+		"nvidia_mig_memory_total_bytes":        {"nvidia_mig_memory_total", 1},
+		"nvidia_mig_memory_used_bytes":         {"nvidia_mig_memory_used", 1},
+		"nvidia_vgpu_framebuffer_used_bytes":   {"nvidia_vgpu_framebuffer_used", 1},
+		"nvidia_vgpu_type_framebuffer_bytes":   {"nvidia_vgpu_type_framebuffer", 1},
+		"nvidia_process_memory_used_bytes":     {"nvidia_process_memory_used", 1},
+		"nvidia_clock_hertz":                   {"nvidia_clock", 1e-6},
+		"nvidia_clock_max_hertz":               {"nvidia_clock_max", 1e-6},
+		"nvidia_fan_speed_ratio":               {"nvidia_fanspeed", 100},
+		"nvidia_utilization_gpu_ratio":         {"nvidia_utilization_gpu", 100},
+		"nvidia_utilization_gpu_average_ratio": {"nvidia_utilization_gpu_average", 100},
+		"nvidia_utilization_memory_ratio":      {"nvidia_utilization_memory", 100},
+		"nvidia_nvlink_tx_bytes_total":         {"nvidia_nvlink_tx_bytes", 1},
+		"nvidia_nvlink_rx_bytes_total":         {"nvidia_nvlink_rx_bytes", 1},
+		"nvidia_nvlink_errors_total":           {"nvidia_nvlink_errors", 1},
+	}
+
+	// openMetricsUnits are the base units announced with # UNIT when a
+	// metric name ends with them.
+	openMetricsUnits = []string{"bytes", "celsius", "hertz", "joules", "ratio", "seconds", "volts", "watts"}
+
+	processStart = time.Now()
+
+	openMetricsEscape = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+)
+
+// counters are the counters kept by the exporter by name, see counterVec.
+var (
+	countersMu sync.Mutex
+	counters   = map[string]*counterVec{}
+)
+
+// counterVec is a CounterVec kept by the exporter. Its counters count from
+// zero when they are first used, which is exported as their _created
+// timestamp, and carry the exemplar of their last increment if it had one.
+// Counters read from the driver or the kernel don't have a known creation
+// time and are exported as const metrics instead.
+type counterVec struct {
+	*prometheus.CounterVec
+	labels []string
+
+	mu        sync.Mutex
+	created   map[string]time.Time
+	exemplars map[string]exemplar
+}
+
+// exemplar is the OpenMetrics exemplar of a counter increment.
+type exemplar struct {
+	labels    prometheus.Labels
+	value     float64
+	timestamp time.Time
+}
+
+// maxExemplarRunes is the limit of OpenMetrics on the combined length of the
+// names and values of the labels of an exemplar.
+const maxExemplarRunes = 128
+
+func newCounterVec(opts prometheus.CounterOpts, labels []string) *counterVec {
+	v := &counterVec{
+		CounterVec: prometheus.NewCounterVec(opts, labels),
+		labels:     labels,
+		created:    map[string]time.Time{},
+		exemplars:  map[string]exemplar{},
+	}
+	countersMu.Lock()
+	counters[prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)] = v
+	countersMu.Unlock()
+	return v
+}
+
+// newCounter returns a counter without labels, created now.
+func newCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	return newCounterVec(opts, nil).WithLabelValues()
+}
+
+// WithLabelValues returns the counter of the label values, recording its
+// creation when it is first used.
+func (v *counterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	key := strings.Join(lvs, "\xff")
+	v.mu.Lock()
+	if _, ok := v.created[key]; !ok {
+		v.created[key] = time.Now()
+	}
+	v.mu.Unlock()
+	return v.CounterVec.WithLabelValues(lvs...)
+}
+
+// addWithExemplar adds value to the counter of the label values and keeps
+// the exemplar labels for it. Exemplars over the length limit of OpenMetrics
+// are dropped.
+func (v *counterVec) addWithExemplar(value float64, labels prometheus.Labels, lvs ...string) {
+	v.WithLabelValues(lvs...).Add(value)
+
+	var n int
+	for name, value := range labels {
+		n += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	if n > maxExemplarRunes {
+		return
+	}
+	v.mu.Lock()
+	v.exemplars[strings.Join(lvs, "\xff")] = exemplar{labels: labels, value: value, timestamp: time.Now()}
+	v.mu.Unlock()
+}
+
+// lookup returns the creation time and the exemplar of the counter of m.
+func (v *counterVec) lookup(m *dto.Metric) (time.Time, *exemplar) {
+	values := make([]string, len(v.labels))
+	for i, name := range v.labels {
+		for _, l := range m.Label {
+			if l.GetName() == name {
+				values[i] = l.GetValue()
+			}
+		}
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var e *exemplar
+	if ex, ok := v.exemplars[key]; ok {
+		e = &ex
+	}
+	return v.created[key], e
+}
+
+// counterCreated returns the creation time and the exemplar of a counter
+// sample. The counters of the Go and process collectors count since the
+// process started.
+func counterCreated(name string, m *dto.Metric) (time.Time, *exemplar) {
+	countersMu.Lock()
+	v, ok := counters[name]
+	countersMu.Unlock()
+	switch {
+	case ok:
+		return v.lookup(m)
+	case strings.HasPrefix(name, "go_"), strings.HasPrefix(name, "process_"):
+		return processStart, nil
+	}
+	return time.Time{}, nil
+}
+
+// legacyGatherer adds the metrics renamed to base units under their former
+// names, for dashboards and alerts that haven't migrated yet.
+type legacyGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g legacyGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		legacy, ok := legacyMetrics[mf.GetName()]
+		if !ok {
+			continue
+		}
+		// The former metrics were all gauges, counters read from the
+		// devices included.
+		old := &dto.MetricFamily{
+			Name: proto.String(legacy.name),
+			Help: proto.String(mf.GetHelp() + " (deprecated, see " + mf.GetName() + ")"),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		for _, m := range mf.Metric {
+			value := m.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_COUNTER {
+				value = m.GetCounter().GetValue()
+			}
+			old.Metric = append(old.Metric, &dto.Metric{
+				Label: m.Label,
+				Gauge: &dto.Gauge{Value: proto.Float64(value * legacy.factor)},
+			})
+		}
+		mfs = append(mfs, old)
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, err
+}
+
+// metricsHandler serves the OpenMetrics text format to clients asking for
+// it and the formats of promhttp to all others.
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	classic := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsOpenMetrics(r.Header.Get("Accept")) {
+			classic.ServeHTTP(w, r)
+			return
+		}
+
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			log.Printf("Failed to gather metrics: %s\n", err)
+			if len(mfs) == 0 {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", openMetricsContentType)
+		if err := writeOpenMetrics(w, mfs); err != nil {
+			log.Printf("Failed to write metrics: %s\n", err)
+		}
+	})
+}
+
+// acceptsOpenMetrics reports whether an Accept header asks for OpenMetrics
+// before the classic text format.
+func acceptsOpenMetrics(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.Split(part, ";")[0])
+		switch mediaType {
+		case "application/openmetrics-text":
+			return true
+		case "text/plain", "application/vnd.google.protobuf":
+			return false
+		}
+	}
+	return false
+}
+
+// writeOpenMetrics writes the metric families in the OpenMetrics 1.0 text
+// format.
+func writeOpenMetrics(out io.Writer, mfs []*dto.MetricFamily) error {
+	names := map[string]bool{}
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+
+	w := bufio.NewWriter(out)
+	for _, mf := range mfs {
+		name := mf.GetName()
+		typ := "unknown"
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			// The _total suffix belongs to the sample, not the family. A
+			// counter whose family would clash with another metric, like
+			// go_memstats_alloc_bytes_total, is left untyped.
+			if names[strings.TrimSuffix(name, "_total")] {
+				break
+			}
+			typ = "counter"
+			name = strings.TrimSuffix(name, "_total")
+		case dto.MetricType_GAUGE:
+			typ = "gauge"
+		case dto.MetricType_SUMMARY:
+			typ = "summary"
+		case dto.MetricType_HISTOGRAM:
+			typ = "histogram"
+		}
+
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		for _, unit := range openMetricsUnits {
+			if strings.HasSuffix(name, "_"+unit) {
+				fmt.Fprintf(w, "# UNIT %s %s\n", name, unit)
+				break
+			}
+		}
+		if mf.Help != nil {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, openMetricsEscape.Replace(mf.GetHelp()))
+		}
+
+		for _, m := range mf.Metric {
+			switch {
+			case typ == "counter":
+				created, e := counterCreated(mf.GetName(), m)
+				writeOpenMetricsSample(w, name+"_total", m, "", "", m.GetCounter().GetValue(), e)
+				if !created.IsZero() {
+					writeOpenMetricsSample(w, name+"_created", m, "", "", float64(created.UnixNano())/1e9, nil)
+				}
+			case mf.GetType() == dto.MetricType_COUNTER:
+				writeOpenMetricsSample(w, name, m, "", "", m.GetCounter().GetValue(), nil)
+			case mf.GetType() == dto.MetricType_GAUGE:
+				writeOpenMetricsSample(w, name, m, "", "", m.GetGauge().GetValue(), nil)
+			case mf.GetType() == dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().Quantile {
+					writeOpenMetricsSample(w, name, m, "quantile", formatOpenMetricsFloat(q.GetQuantile()), q.GetValue(), nil)
+				}
+				writeOpenMetricsSample(w, name+"_sum", m, "", "", m.GetSummary().GetSampleSum(), nil)
+				writeOpenMetricsSample(w, name+"_count", m, "", "", float64(m.GetSummary().GetSampleCount()), nil)
+			case mf.GetType() == dto.MetricType_HISTOGRAM:
+				var inf bool
+				for _, b := range m.GetHistogram().Bucket {
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+					writeOpenMetricsSample(w, name+"_bucket", m, "le", formatOpenMetricsFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()), nil)
+				}
+				if !inf {
+					writeOpenMetricsSample(w, name+"_bucket", m, "le", "+Inf", float64(m.GetHistogram().GetSampleCount()), nil)
+				}
+				writeOpenMetricsSample(w, name+"_sum", m, "", "", m.GetHistogram().GetSampleSum(), nil)
+				writeOpenMetricsSample(w, name+"_count", m, "", "", float64(m.GetHistogram().GetSampleCount()), nil)
+			default:
+				writeOpenMetricsSample(w, name, m, "", "", m.GetUntyped().GetValue(), nil)
+			}
+		}
+	}
+	fmt.Fprint(w, "# EOF\n")
+	return w.Flush()
+}
+
+// writeOpenMetricsSample writes a sample with the labels of m, an optional
+// extra label, e.g. quantile or le, and an optional exemplar.
+func writeOpenMetricsSample(w *bufio.Writer, name string, m *dto.Metric, extraName, extraValue string, value float64, e *exemplar) {
+	w.WriteString(name)
+	if len(m.Label) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range m.Label {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, l.GetName(), openMetricsEscape.Replace(l.GetValue()))
+		}
+		if extraName != "" {
+			if len(m.Label) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatOpenMetricsFloat(value))
+	if m.TimestampMs != nil {
+		// OpenMetrics timestamps are in seconds.
+		w.WriteByte(' ')
+		w.WriteString(formatOpenMetricsFloat(float64(m.GetTimestampMs()) / 1000))
+	}
+	if e != nil {
+		names := make([]string, 0, len(e.labels))
+		for name := range e.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.WriteString(" # {")
+		for i, name := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, name, openMetricsEscape.Replace(e.labels[name]))
+		}
+		fmt.Fprintf(w, "} %s %s", formatOpenMetricsFloat(e.value), formatOpenMetricsFloat(float64(e.timestamp.UnixNano())/1e9))
+	}
+	w.WriteByte('\n')
+}
+
+func formatOpenMetricsFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// fixedTime is the creation time and the exemplar time of the counters in
+// the golden files.
+var fixedTime = time.Date(2026, 3, 9, 14, 2, 41, 0, time.UTC)
+
+// fixCounterTimes replaces the times recorded by v with fixedTime.
+func fixCounterTimes(v *counterVec) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key := range v.created {
+		v.created[key] = fixedTime
+	}
+	for key, e := range v.exemplars {
+		e.timestamp = fixedTime
+		v.exemplars[key] = e
+	}
+}
+
+func openMetricsBody(t *testing.T, gatherer prometheus.Gatherer) []byte {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if err := writeOpenMetrics(&body, mfs); err != nil {
+		t.Fatal(err)
+	}
+	return body.Bytes()
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	requests := newCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "openmetrics_test_requests_total",
+		Help:      "Requests \"sent\" or dropped",
+	}, []string{"result"})
+	requests.WithLabelValues("sent").Add(3)
+	requests.addWithExemplar(1, prometheus.Labels{"pid": "2211", "name": "python3"}, "dropped")
+	// Exemplars over the length limit are dropped, the count is kept.
+	requests.addWithExemplar(1, prometheus.Labels{"name": strings.Repeat("x", maxExemplarRunes)}, "timeout")
+	fixCounterTimes(requests)
+
+	restarts := newCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "openmetrics_test_restarts_total",
+		Help:      "Restarts",
+	})
+	fixCounterTimes(counters["nvidia_openmetrics_test_restarts_total"])
+
+	temperature := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "openmetrics_test_temperature_celsius",
+		Help:      "Temperature",
+	}, []string{"minor"})
+	temperature.WithLabelValues("0").Set(41)
+
+	// Counters read from the devices don't have a creation time.
+	deviceErrors := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "openmetrics_test_device_errors_total",
+		Help:      "Device errors",
+	}, func() float64 { return 7 })
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(requests, restarts, temperature, deviceErrors)
+	goldenBytes(t, "testdata/openmetrics/metrics.txt", openMetricsBody(t, registry))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newCounter(prometheus.CounterOpts{Namespace: namespace, Name: "openmetrics_test_scrapes_total", Help: "Scrapes"}))
+	handler := metricsHandler(registry)
+
+	for accept, want := range map[string]string{
+		"":                             "text/plain; version=0.0.4",
+		"text/plain;version=0.0.4":     "text/plain; version=0.0.4",
+		"application/openmetrics-text": openMetricsContentType,
+		"application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5": openMetricsContentType,
+		"text/plain;version=0.0.4,application/openmetrics-text":                     "text/plain; version=0.0.4",
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Accept %q: got status %d", accept, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != want {
+			t.Errorf("Accept %q: got content type %q, want %q", accept, got, want)
+		}
+		openMetrics := strings.HasSuffix(rec.Body.String(), "# EOF\n")
+		if openMetrics != (want == openMetricsContentType) {
+			t.Errorf("Accept %q: got body\n%s", accept, rec.Body)
+		}
+	}
+}
+
+func TestLegacyGatherer(t *testing.T) {
+	backend := &staticBackend{metrics: &Metrics{Devices: []*Device{{
+		Index:                 "0",
+		MinorNumber:           "0",
+		FanSpeed:              40,
+		PowerUsage:            254000,
+		UtilizationGPU:        87,
+		UtilizationGPUAverage: 80,
+		UtilizationMemory:     41,
+		Errors:                map[string]string{"power_usage_average_milliwatts": "not supported"},
+	}}}}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewExporter(backend))
+	mfs, err := legacyGatherer{registry}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	for _, mf := range mfs {
+		name := mf.GetName()
+		if strings.HasPrefix(name, "nvidia_fan") || strings.HasPrefix(name, "nvidia_power") || strings.HasPrefix(name, "nvidia_utilization") {
+			expfmt.MetricFamilyToText(&body, mf)
+		}
+	}
+	goldenBytes(t, "testdata/openmetrics/legacy.txt", body.Bytes())
+}
+
+func TestXidExemplar(t *testing.T) {
+	w := &xidWatcher{
+		procPath: "testdata/kernel/proc",
+		errors:   newCounterVec(prometheus.CounterOpts{Name: "openmetrics_test_xid_errors_total", Help: "Xid errors"}, []string{"minor", "xid"}),
+		last:     prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "openmetrics_test_last_xid", Help: "Last Xid"}, []string{"minor"}),
+	}
+	for _, line := range readLines(t, "testdata/xid/kmsg.log") {
+		w.logLine(line)
+	}
+	fixCounterTimes(w.errors)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(w.errors)
+	goldenBytes(t, "testdata/openmetrics/xid.txt", openMetricsBody(t, registry))
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// OTLPConfig configures exporting to an OpenTelemetry collector.
+type OTLPConfig struct {
+	Endpoint string
+	Protocol string
+	Headers  string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// otlpResource is a device with its readings.
+type otlpResource struct {
+	attributes [][2]string
+	metrics    []*otlpMetric
+}
+
+type otlpMetric struct {
+	name, description, unit string
+	points                  []otlpPoint
+}
+
+type otlpPoint struct {
+	attributes [][2]string
+	value      float64
+}
+
+// otlpResources maps the devices of a snapshot to resources with the
+// semantic attributes of a GPU.
+func otlpResources(data *Metrics, hostname string) []otlpResource {
+	var resources []otlpResource
+	for _, d := range data.Devices {
+		r := otlpResource{attributes: [][2]string{
+			{"service.name", "nvidia-exporter"},
+			{"service.version", VERSION},
+			{"host.name", hostname},
+			{"gpu.uuid", d.UUID},
+			{"gpu.model", d.Name},
+			{"gpu.index", d.Index},
+			{"gpu.minor", d.MinorNumber},
+		}}
+		if data.Version != "" {
+			r.attributes = append(r.attributes, [2]string{"gpu.driver.version", data.Version})
+		}
+		if d.PCIe != nil && d.PCIe.BusID != "" {
+			r.attributes = append(r.attributes, [2]string{"gpu.pci.bus_id", d.PCIe.BusID})
+		}
+
+		metric := func(name, unit, description string) *otlpMetric {
+			m := &otlpMetric{name: name, unit: unit, description: description}
+			r.metrics = append(r.metrics, m)
+			return m
+		}
+		point := func(m *otlpMetric, value float64, attributes ...[2]string) {
+			m.points = append(m.points, otlpPoint{attributes, value})
+		}
+
+		// Readings the device doesn't support are left out rather than sent
+		// as zero.
+		gauge := func(field, name, unit, description string, value float64) {
+			if d.supported(field) {
+				point(metric(name, unit, description), value)
+			}
+		}
+		gauge("temperature_celsius", "gpu.temperature", "Cel", "Temperature as reported by the device", d.Temperature)
+		gauge("power_usage_milliwatts", "gpu.power.usage", "W", "Power usage as reported by the device", d.PowerUsage/1000)
+		gauge("fan_speed_percent", "gpu.fan.speed", "%", "Fan speed as reported by the device", d.FanSpeed)
+		gauge("memory_total_bytes", "gpu.memory.limit", "By", "Total memory as reported by the device", d.MemoryTotal)
+		gauge("memory_used_bytes", "gpu.memory.usage", "By", "Used memory as reported by the device", d.MemoryUsed)
+		gauge("utilization_gpu_percent", "gpu.utilization", "1", "GPU utilization as reported by the device", d.UtilizationGPU/100)
+		gauge("utilization_memory_percent", "gpu.memory.utilization", "1", "Memory utilization as reported by the device", d.UtilizationMemory/100)
+
+		if c := d.Clocks; c != nil {
+			m := metric("gpu.clock.frequency", "Hz", "Current clock as reported by the device")
+			clock := func(field, name string, mhz float64) {
+				if d.supported(field) {
+					point(m, mhz*1e6, [2]string{"gpu.clock", name})
+				}
+			}
+			clock("clocks.graphics_mhz", "graphics", c.Graphics)
+			clock("clocks.sm_mhz", "sm", c.SM)
+			clock("clocks.memory_mhz", "memory", c.Memory)
+			clock("clocks.video_mhz", "video", c.Video)
+		}
+		if e := d.ECC; e != nil && e.Enabled == 1 {
+			// The error and replay counts start with the driver, which may
+			// have been loaded long before the exporter and reloaded while it
+			// runs, so they are gauges rather than sums without a known start.
+			m := metric("gpu.ecc.errors", "{error}", "ECC errors since the driver was loaded as reported by the device")
+			point(m, e.VolatileCorrected, [2]string{"error.type", "corrected"})
+			point(m, e.VolatileUncorrected, [2]string{"error.type", "uncorrected"})
+		}
+		if p := d.PCIe; p != nil {
+			m := metric("gpu.pcie.throughput", "By/s", "PCIe throughput as reported by the device")
+			point(m, p.TxBytes, [2]string{"network.io.direction", "transmit"})
+			point(m, p.RxBytes, [2]string{"network.io.direction", "receive"})
+			point(metric("gpu.pcie.replays", "{replay}", "PCIe replays as reported by the device"), p.ReplayCounter)
+		}
+		if len(d.Processes) > 0 {
+			m := metric("gpu.process.memory.usage", "By", "Used memory of a process running on the device")
+			for _, p := range d.Processes {
+				point(m, p.MemoryUsed, [2]string{"process.pid", p.PID}, [2]string{"process.executable.name", p.Name})
+			}
+		}
+		resources = append(resources, r)
+	}
+	return resources
+}
+
+// encodeOTLPRequest encodes the resources as an ExportMetricsServiceRequest
+// of opentelemetry/proto/collector/metrics/v1, every metric as a gauge.
+func encodeOTLPRequest(resources []otlpResource, now time.Time) []byte {
+	ts := uint64(now.UnixNano())
+
+	req := proto.NewBuffer(nil)
+	for _, r := range resources {
+		resource := proto.NewBuffer(nil)
+		for _, a := range r.attributes {
+			protoBytes(resource, 1, otlpKeyValue(a))
+		}
+
+		scope := proto.NewBuffer(nil)
+		protoString(scope, 1, "github.com/bugroger/nvidia-exporter")
+		protoString(scope, 2, VERSION)
+
+		scopeMetrics := proto.NewBuffer(nil)
+		protoBytes(scopeMetrics, 1, scope.Bytes())
+		for _, m := range r.metrics {
+			data := proto.NewBuffer(nil)
+			for _, p := range m.points {
+				point := proto.NewBuffer(nil)
+				protoFixed64(point, 3, ts)
+				protoFixed64(point, 4, math.Float64bits(p.value))
+				for _, a := range p.attributes {
+					protoBytes(point, 7, otlpKeyValue(a))
+				}
+				protoBytes(data, 1, point.Bytes())
+			}
+
+			metric := proto.NewBuffer(nil)
+			protoString(metric, 1, m.name)
+			protoString(metric, 2, m.description)
+			protoString(metric, 3, m.unit)
+			protoBytes(metric, 5, data.Bytes())
+			protoBytes(scopeMetrics, 2, metric.Bytes())
+		}
+
+		resourceMetrics := proto.NewBuffer(nil)
+		protoBytes(resourceMetrics, 1, resource.Bytes())
+		protoBytes(resourceMetrics, 2, scopeMetrics.Bytes())
+		protoBytes(req, 1, resourceMetrics.Bytes())
+	}
+	return req.Bytes()
+}
+
+func otlpKeyValue(a [2]string) []byte {
+	value := proto.NewBuffer(nil)
+	protoString(value, 1, a[1])
+	kv := proto.NewBuffer(nil)
+	protoString(kv, 1, a[0])
+	protoBytes(kv, 2, value.Bytes())
+	return kv.Bytes()
+}
+
+// otlpExporter periodically exports the snapshot of the backend to an
+// OpenTelemetry collector, with OTLP over HTTP/protobuf or gRPC.
+type otlpExporter struct {
+	config   OTLPConfig
+	backend  Backend
+	url      string
+	headers  map[string]string
+	hostname string
+	client   *http.Client
+	requests *counterVec
+}
+
+func newOTLPExporter(config OTLPConfig, backend Backend) (*otlpExporter, error) {
+	headers, err := parseKeyValues(config.Headers)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected an http or https URL", config.Endpoint)
+	}
+
+	client := &http.Client{Timeout: config.Timeout}
+	switch config.Protocol {
+	case "http/protobuf":
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+	case "grpc":
+		u.Path = otlpGRPCPath
+		// gRPC needs HTTP/2, the standard library negotiates it with TLS
+		// only.
+		if u.Scheme == "http" {
+			if client.Transport, err = h2cTransport(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, expected http/protobuf or grpc", config.Protocol)
+	}
+
+	hostname, _ := os.Hostname()
+	return &otlpExporter{
+		config:   config,
+		backend:  backend,
+		url:      u.String(),
+		headers:  headers,
+		hostname: hostname,
+		client:   client,
+		requests: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "otlp_export_requests_total",
+				Help:      "OTLP export requests by result, sent or dropped",
+			},
+			[]string{"result"},
+		),
+	}, nil
+}
+
+func (e *otlpExporter) Describe(descs chan<- *prometheus.Desc) {
+	e.requests.Describe(descs)
+}
+
+func (e *otlpExporter) Collect(metrics chan<- prometheus.Metric) {
+	e.requests.Collect(metrics)
+}
+
+// run exports every interval until the process exits.
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := e.export(time.Now()); err != nil {
+			log.Printf("Failed to export to %s: %s\n", e.config.Endpoint, err)
+			e.requests.WithLabelValues("dropped").Inc()
+		} else {
+			e.requests.WithLabelValues("sent").Inc()
+		}
+		<-ticker.C
+	}
+}
+
+func (e *otlpExporter) export(now time.Time) error {
+	data, err := e.backend.Collect()
+	if err != nil {
+		return err
+	}
+	msg := encodeOTLPRequest(otlpResources(data, e.hostname), now)
+	if e.config.Protocol == "grpc" {
+		return e.exportGRPC(msg)
+	}
+	return e.exportHTTP(msg)
+}
+
+func (e *otlpExporter) exportHTTP(msg []byte) error {
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "nvidia-exporter/"+VERSION)
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("server returned HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// exportGRPC calls MetricsService/Export. It's a single unary call, framed
+// by hand rather than pulling in a gRPC library.
+func (e *otlpExporter) exportGRPC(msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", "nvidia-exporter/"+VERSION)
+	req.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", e.config.Timeout/time.Millisecond))
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		return fmt.Errorf("server doesn't speak HTTP/2, is %s a gRPC endpoint?", e.config.Endpoint)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned HTTP status %d", resp.StatusCode)
+	}
+	// The status is in the trailers, read after the body, or in the
+	// headers of a response without a body.
+	io.Copy(ioutil.Discard, resp.Body)
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return fmt.Errorf("server returned gRPC status %s: %s", status, message)
+	}
+	return nil
+}
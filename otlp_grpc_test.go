@@ -0,0 +1,66 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newOTLPGRPCReceiver starts the receiver speaking HTTP/2, over TLS or
+// without it as a plaintext gRPC endpoint.
+func newOTLPGRPCReceiver(t *testing.T, receiver *otlpReceiver, tls bool) *httptest.Server {
+	server := httptest.NewUnstartedServer(receiver)
+	if tls {
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		return server
+	}
+	if err := h2cServer(server.Config); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	return server
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+	for _, tls := range []bool{false, true} {
+		receiver := &otlpReceiver{}
+		server := newOTLPGRPCReceiver(t, receiver, tls)
+
+		e, err := newOTLPExporter(OTLPConfig{
+			Endpoint: server.URL,
+			Protocol: "grpc",
+			Headers:  "Authorization=Bearer s3cr3t",
+			Timeout:  time.Second,
+		}, &staticBackend{metrics: testSnapshot()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tls {
+			e.client = server.Client()
+		}
+		if err := e.export(otlpTime); err != nil {
+			t.Errorf("TLS %t: %s", tls, err)
+		}
+
+		if len(receiver.requests) != 1 || len(receiver.requests[0].ResourceMetrics) != 2 {
+			t.Errorf("TLS %t: got requests %v, want one with a resource per device", tls, receiver.requests)
+		} else {
+			h := receiver.headers[0]
+			if h.Get("Authorization") != "Bearer s3cr3t" || h.Get("Te") != "trailers" || h.Get("Grpc-Timeout") != "1000m" {
+				t.Errorf("TLS %t: got headers %v", tls, h)
+			}
+		}
+
+		// Errors are reported in the trailers.
+		receiver.status, receiver.message = "16", "missing%20API%20key"
+		err = e.export(otlpTime)
+		if err == nil || err.Error() != "server returned gRPC status 16: missing API key" {
+			t.Errorf("TLS %t: got error %v, want gRPC status 16", tls, err)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The messages of opentelemetry/proto/collector/metrics/v1 the exporter
+// sends, decoded by the protobuf library to check the encoding by hand.
+
+type testOTLPRequest struct {
+	ResourceMetrics []*testOTLPResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics" json:"resource_metrics"`
+}
+
+type testOTLPResourceMetrics struct {
+	Resource     *testOTLPResource       `protobuf:"bytes,1,opt,name=resource" json:"resource"`
+	ScopeMetrics []*testOTLPScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics" json:"scope_metrics"`
+}
+
+type testOTLPResource struct {
+	Attributes []*testOTLPKeyValue `protobuf:"bytes,1,rep,name=attributes" json:"attributes"`
+}
+
+type testOTLPScopeMetrics struct {
+	Scope   *testOTLPScope    `protobuf:"bytes,1,opt,name=scope" json:"scope"`
+	Metrics []*testOTLPMetric `protobuf:"bytes,2,rep,name=metrics" json:"metrics"`
+}
+
+type testOTLPScope struct {
+	Name    string `protobuf:"bytes,1,opt,name=name,proto3" json:"name"`
+	Version string `protobuf:"bytes,2,opt,name=version,proto3" json:"version"`
+}
+
+type testOTLPMetric struct {
+	Name        string         `protobuf:"bytes,1,opt,name=name,proto3" json:"name"`
+	Description string         `protobuf:"bytes,2,opt,name=description,proto3" json:"description"`
+	Unit        string         `protobuf:"bytes,3,opt,name=unit,proto3" json:"unit"`
+	Gauge       *testOTLPGauge `protobuf:"bytes,5,opt,name=gauge" json:"gauge,omitempty"`
+	Sum         *testOTLPSum   `protobuf:"bytes,7,opt,name=sum" json:"sum,omitempty"`
+}
+
+type testOTLPGauge struct {
+	DataPoints []*testOTLPPoint `protobuf:"bytes,1,rep,name=data_points" json:"data_points"`
+}
+
+type testOTLPSum struct {
+	DataPoints             []*testOTLPPoint `protobuf:"bytes,1,rep,name=data_points" json:"data_points"`
+	AggregationTemporality int32            `protobuf:"varint,2,opt,name=aggregation_temporality,proto3" json:"aggregation_temporality"`
+	IsMonotonic            bool             `protobuf:"varint,3,opt,name=is_monotonic,proto3" json:"is_monotonic"`
+}
+
+type testOTLPPoint struct {
+	StartTimeUnixNano uint64              `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3" json:"start_time_unix_nano,omitempty"`
+	TimeUnixNano      uint64              `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3" json:"time_unix_nano"`
+	AsDouble          float64             `protobuf:"fixed64,4,opt,name=as_double,proto3" json:"as_double"`
+	Attributes        []*testOTLPKeyValue `protobuf:"bytes,7,rep,name=attributes" json:"attributes,omitempty"`
+}
+
+type testOTLPKeyValue struct {
+	Key   string            `protobuf:"bytes,1,opt,name=key,proto3" json:"key"`
+	Value *testOTLPAnyValue `protobuf:"bytes,2,opt,name=value" json:"value"`
+}
+
+type testOTLPAnyValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,proto3" json:"string_value"`
+}
+
+func (m *testOTLPRequest) Reset()                 { *m = testOTLPRequest{} }
+func (m *testOTLPRequest) String() string         { return proto.CompactTextString(m) }
+func (*testOTLPRequest) ProtoMessage()            {}
+func (m *testOTLPResourceMetrics) Reset()         { *m = testOTLPResourceMetrics{} }
+func (m *testOTLPResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*testOTLPResourceMetrics) ProtoMessage()    {}
+func (m *testOTLPResource) Reset()                { *m = testOTLPResource{} }
+func (m *testOTLPResource) String() string        { return proto.CompactTextString(m) }
+func (*testOTLPResource) ProtoMessage()           {}
+func (m *testOTLPScopeMetrics) Reset()            { *m = testOTLPScopeMetrics{} }
+func (m *testOTLPScopeMetrics) String() string    { return proto.CompactTextString(m) }
+func (*testOTLPScopeMetrics) ProtoMessage()       {}
+func (m *testOTLPScope) Reset()                   { *m = testOTLPScope{} }
+func (m *testOTLPScope) String() string           { return proto.CompactTextString(m) }
+func (*testOTLPScope) ProtoMessage()              {}
+func (m *testOTLPMetric) Reset()                  { *m = testOTLPMetric{} }
+func (m *testOTLPMetric) String() string          { return proto.CompactTextString(m) }
+func (*testOTLPMetric) ProtoMessage()             {}
+func (m *testOTLPGauge) Reset()                   { *m = testOTLPGauge{} }
+func (m *testOTLPGauge) String() string           { return proto.CompactTextString(m) }
+func (*testOTLPGauge) ProtoMessage()              {}
+func (m *testOTLPSum) Reset()                     { *m = testOTLPSum{} }
+func (m *testOTLPSum) String() string             { return proto.CompactTextString(m) }
+func (*testOTLPSum) ProtoMessage()                {}
+func (m *testOTLPPoint) Reset()                   { *m = testOTLPPoint{} }
+func (m *testOTLPPoint) String() string           { return proto.CompactTextString(m) }
+func (*testOTLPPoint) ProtoMessage()              {}
+func (m *testOTLPKeyValue) Reset()                { *m = testOTLPKeyValue{} }
+func (m *testOTLPKeyValue) String() string        { return proto.CompactTextString(m) }
+func (*testOTLPKeyValue) ProtoMessage()           {}
+func (m *testOTLPAnyValue) Reset()                { *m = testOTLPAnyValue{} }
+func (m *testOTLPAnyValue) String() string        { return proto.CompactTextString(m) }
+func (*testOTLPAnyValue) ProtoMessage()           {}
+
+var otlpTime = time.Unix(1552140161, 0)
+
+func decodeOTLPRequest(t *testing.T, body []byte) *testOTLPRequest {
+	var req testOTLPRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	return &req
+}
+
+func TestEncodeOTLPRequest(t *testing.T) {
+	body := encodeOTLPRequest(otlpResources(testSnapshot(), "gpu-node-17"), otlpTime)
+	req := decodeOTLPRequest(t, body)
+	golden(t, "testdata/otlp/request.json", req)
+
+	// Counts since the driver was loaded have no start the exporter knows.
+	for _, r := range req.ResourceMetrics {
+		for _, sm := range r.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Sum != nil {
+					t.Errorf("got %s as a sum, want a gauge", m.Name)
+				}
+			}
+		}
+	}
+}
+
+// otlpReceiver is an in-process OpenTelemetry collector. It records the
+// requests it receives over OTLP/HTTP and gRPC, and answers gRPC calls with
+// status.
+type otlpReceiver struct {
+	mu       sync.Mutex
+	requests []*testOTLPRequest
+	headers  []http.Header
+	status   string
+	message  string
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	grpc := req.Header.Get("Content-Type") == "application/grpc+proto"
+	if grpc {
+		// A single uncompressed message, prefixed by its length.
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:])) != len(body)-5 {
+			http.Error(w, "invalid gRPC frame", http.StatusBadRequest)
+			return
+		}
+		body = body[5:]
+	}
+	var msg testOTLPRequest
+	if err := proto.Unmarshal(body, &msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	r.requests = append(r.requests, &msg)
+	r.headers = append(r.headers, req.Header)
+	status, message := r.status, r.message
+	r.mu.Unlock()
+
+	if !grpc {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		return
+	}
+	if status == "" {
+		status = "0"
+	}
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Grpc-Status", status)
+	w.Header().Set("Grpc-Message", message)
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+	receiver := &otlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	e, err := newOTLPExporter(OTLPConfig{
+		Endpoint: server.URL,
+		Protocol: "http/protobuf",
+		Headers:  "Authorization=Bearer s3cr3t",
+		Timeout:  time.Second,
+	}, &staticBackend{metrics: testSnapshot()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.export(otlpTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(receiver.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(receiver.requests))
+	}
+	if got := len(receiver.requests[0].ResourceMetrics); got != 2 {
+		t.Errorf("got %d resources, want one per device", got)
+	}
+	for name, want := range map[string]string{
+		"Authorization": "Bearer s3cr3t",
+		"Content-Type":  "application/x-protobuf",
+	} {
+		if got := receiver.headers[0].Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+	if e.url != server.URL+"/v1/metrics" {
+		t.Errorf("exported to %s, want the /v1/metrics path", e.url)
+	}
+}
+
+func TestOTLPExportHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "metrics exporter is disabled", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	e, err := newOTLPExporter(OTLPConfig{Endpoint: server.URL, Protocol: "http/protobuf", Timeout: time.Second}, &staticBackend{metrics: testSnapshot()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.export(otlpTime)
+	if err == nil || !strings.Contains(err.Error(), "HTTP status 404: metrics exporter is disabled") {
+		t.Errorf("got error %v, want the message of the collector", err)
+	}
+}
+
+func TestOTLPExportGRPCNotHTTP2(t *testing.T) {
+	// An OTLP/HTTP endpoint configured for gRPC only speaks HTTP/1.1.
+	server := httptest.NewTLSServer(&otlpReceiver{})
+	defer server.Close()
+
+	e, err := newOTLPExporter(OTLPConfig{Endpoint: server.URL, Protocol: "grpc", Timeout: time.Second}, &staticBackend{metrics: testSnapshot()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.client = server.Client()
+	if err := e.export(otlpTime); err == nil || !strings.Contains(err.Error(), "HTTP/2") {
+		t.Errorf("got error %v, want a hint that the server doesn't speak HTTP/2", err)
+	}
+}
+
+func TestNewOTLPExporterInvalid(t *testing.T) {
+	for _, config := range []OTLPConfig{
+		{Endpoint: "otel-collector:4317", Protocol: "grpc"},
+		{Endpoint: "http://otel-collector:4318", Protocol: "http/json"},
+		{Endpoint: "http://otel-collector:4318", Protocol: "http/protobuf", Headers: "Authorization"},
+	} {
+		if _, err := newOTLPExporter(config, &staticBackend{}); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
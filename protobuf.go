@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The messages of remote write, OTLP and the gRPC service are encoded by
+// hand with proto.Buffer, there's no generated code.
+
+func protoString(b *proto.Buffer, field uint64, s string) {
+	b.EncodeVarint(field<<3 | proto.WireBytes)
+	b.EncodeStringBytes(s)
+}
+
+func protoBytes(b *proto.Buffer, field uint64, msg []byte) {
+	b.EncodeVarint(field<<3 | proto.WireBytes)
+	b.EncodeRawBytes(msg)
+}
+
+func protoFixed64(b *proto.Buffer, field uint64, v uint64) {
+	b.EncodeVarint(field<<3 | proto.WireFixed64)
+	b.EncodeFixed64(v)
+}
+
+func protoVarint(b *proto.Buffer, field uint64, v uint64) {
+	b.EncodeVarint(field<<3 | proto.WireVarint)
+	b.EncodeVarint(v)
+}
+
+// protoDouble encodes a proto3 double, which is omitted when zero.
+func protoDouble(b *proto.Buffer, field uint64, v float64) {
+	if v != 0 {
+		protoFixed64(b, field, math.Float64bits(v))
+	}
+}
+
+// protoStrings decodes the length delimited fields of msg by field number,
+// skipping the other fields.
+func protoStrings(msg []byte) (map[uint64][]string, error) {
+	fields := make(map[uint64][]string)
+	for len(msg) > 0 {
+		key, n := proto.DecodeVarint(msg)
+		if n == 0 {
+			return nil, fmt.Errorf("invalid field key")
+		}
+		msg = msg[n:]
+
+		field, size := key>>3, 0
+		switch key & 7 {
+		case proto.WireVarint:
+			if _, size = proto.DecodeVarint(msg); size == 0 {
+				return nil, fmt.Errorf("invalid varint in field %d", field)
+			}
+		case proto.WireFixed64:
+			size = 8
+		case proto.WireFixed32:
+			size = 4
+		case proto.WireBytes:
+			length, n := proto.DecodeVarint(msg)
+			if n == 0 || length > uint64(len(msg)-n) {
+				return nil, fmt.Errorf("invalid length of field %d", field)
+			}
+			fields[field] = append(fields[field], string(msg[n:n+int(length)]))
+			size = n + int(length)
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d of field %d", key&7, field)
+		}
+		if size > len(msg) {
+			return nil, fmt.Errorf("truncated field %d", field)
+		}
+		msg = msg[size:]
+	}
+	return fields, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// jobDevice summarizes the samples of a device over the run of a job.
+type jobDevice struct {
+	minor, uuid        string
+	samples            int
+	utilizationSamples int
+	utilizationSum     float64
+	utilizationMax     float64
+	memoryMax          float64
+	powerSamples       int
+	energy             float64
+	power              float64
+	last               time.Time
+}
+
+// jobSampler collects the samples of all devices seen during a job.
+type jobSampler struct {
+	devices []*jobDevice
+}
+
+func (s *jobSampler) add(metrics *Metrics, now time.Time) {
+	for _, d := range metrics.Devices {
+		var device *jobDevice
+		for _, jd := range s.devices {
+			if jd.uuid == d.UUID {
+				device = jd
+				break
+			}
+		}
+		if device == nil {
+			device = &jobDevice{minor: d.MinorNumber, uuid: d.UUID}
+			s.devices = append(s.devices, device)
+		}
+
+		// Readings the device doesn't support are zero and left out.
+		device.samples++
+		if d.supported("utilization_gpu_percent") {
+			device.utilizationSamples++
+			device.utilizationSum += d.UtilizationGPU
+			if d.UtilizationGPU > device.utilizationMax {
+				device.utilizationMax = d.UtilizationGPU
+			}
+		}
+		if d.MemoryUsed > device.memoryMax {
+			device.memoryMax = d.MemoryUsed
+		}
+		// Energy is the power in milliwatts integrated over the samples, not
+		// across samples without power.
+		if !d.supported("power_usage_milliwatts") {
+			device.last = time.Time{}
+			continue
+		}
+		if !device.last.IsZero() {
+			device.energy += (device.power + d.PowerUsage) / 2 / 1000 * now.Sub(device.last).Seconds()
+		}
+		device.powerSamples++
+		device.power = d.PowerUsage
+		device.last = now
+	}
+}
+
+// registry returns the summary of the job as metrics.
+func (s *jobSampler) registry(duration time.Duration, exitCode int) *prometheus.Registry {
+	gauge := func(name, help string) prometheus.Gauge {
+		return prometheus.NewGauge(prometheus.GaugeOpts{Namespace: namespace, Subsystem: "job", Name: name, Help: help})
+	}
+	gaugeVec := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: "job", Name: name, Help: help}, []string{"minor", "uuid"})
+	}
+	var (
+		durationSeconds    = gauge("duration_seconds", "Duration of the job")
+		exit               = gauge("exit_code", "Exit code of the job, 128 plus the signal if it was killed")
+		samples            = gaugeVec("samples", "Samples taken of the device during the job")
+		utilizationMax     = gaugeVec("utilization_gpu_max", "Maximum GPU utilization of the device during the job")
+		utilizationAverage = gaugeVec("utilization_gpu_average", "Average GPU utilization of the device during the job")
+		memoryMax          = gaugeVec("memory_used_max_bytes", "Peak used memory of the device during the job")
+		energy             = gaugeVec("energy_joules", "Energy consumed by the device during the job")
+	)
+
+	durationSeconds.Set(duration.Seconds())
+	exit.Set(float64(exitCode))
+	for _, d := range s.devices {
+		samples.WithLabelValues(d.minor, d.uuid).Set(float64(d.samples))
+		if d.utilizationSamples > 0 {
+			utilizationMax.WithLabelValues(d.minor, d.uuid).Set(d.utilizationMax)
+			utilizationAverage.WithLabelValues(d.minor, d.uuid).Set(d.utilizationSum / float64(d.utilizationSamples))
+		}
+		memoryMax.WithLabelValues(d.minor, d.uuid).Set(d.memoryMax)
+		if d.powerSamples > 0 {
+			energy.WithLabelValues(d.minor, d.uuid).Set(d.energy)
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(durationSeconds, exit, samples, utilizationMax, utilizationAverage, memoryMax, energy)
+	return registry
+}
+
+// runPush implements the push subcommand. It runs a command, samples the
+// devices while it runs and pushes a summary to a Pushgateway. It returns
+// the exit code of the command.
+func runPush(args []string) int {
+	hostname, _ := os.Hostname()
+	var (
+		fs            = flag.NewFlagSet("push", flag.ExitOnError)
+		gatewayURL    = fs.String("pushgateway.url", "http://localhost:9091", "URL of the Pushgateway.")
+		timeout       = fs.Duration("pushgateway.timeout", 10*time.Second, "Timeout of the push.")
+		job           = fs.String("job", "", "Job name the metrics are grouped by, defaults to the name of the command.")
+		instance      = fs.String("instance", hostname, "Instance the metrics are grouped by.")
+		interval      = fs.Duration("interval", 1*time.Second, "Sampling interval.")
+		backendName   = fs.String("backend", "nvml", "Backend to collect metrics with, one of nvml, nvidia-smi, nvidia-smi-query, dcgm, replay or simulator.")
+		backendConfig BackendConfig
+	)
+	backendConfig.addFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s push [flags] -- command [args...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *job == "" {
+		*job = filepath.Base(fs.Arg(0))
+	}
+
+	// The job runs even if the devices can't be sampled, only the push is
+	// skipped.
+	backend, err := NewBackend(*backendName, backendConfig)
+	if err != nil {
+		log.Printf("Failed to create the %s backend, not pushing: %s\n", *backendName, err)
+	}
+
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	var sampler jobSampler
+	sample := func() {
+		if backend == nil {
+			return
+		}
+		metrics, err := backend.Collect()
+		if err != nil {
+			log.Printf("Failed to sample devices: %s\n", err)
+			return
+		}
+		sampler.add(metrics, time.Now())
+	}
+
+	sample()
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to run %s: %s\n", fs.Arg(0), err)
+		return 127
+	}
+
+	// The command gets the signals meant for the job.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var exitCode int
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			sample()
+		case s := <-signals:
+			cmd.Process.Signal(s)
+		case err := <-done:
+			exitCode = commandExitCode(err)
+			break loop
+		}
+	}
+	duration := time.Since(start)
+	sample()
+
+	if backend == nil {
+		return exitCode
+	}
+	if err := pushToGateway(*gatewayURL, *job, *instance, sampler.registry(duration, exitCode), *timeout); err != nil {
+		log.Printf("Failed to push to %s: %s\n", *gatewayURL, err)
+	} else {
+		log.Printf("Pushed the metrics of %d devices for job %s to %s\n", len(sampler.devices), *job, *gatewayURL)
+	}
+	return exitCode
+}
+
+// commandExitCode returns the exit code of a command as a shell would.
+func commandExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// pushToGateway replaces the metrics grouped by job and instance on a
+// Pushgateway.
+func pushToGateway(gatewayURL, job, instance string, gatherer prometheus.Gatherer, timeout time.Duration) error {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	enc := expfmt.NewEncoder(&body, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	u := strings.TrimSuffix(gatewayURL, "/") + "/metrics/" +
+		pushgatewayGroupingKey("job", job) + "/" + pushgatewayGroupingKey("instance", instance)
+	req, err := http.NewRequest("PUT", u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("server returned HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// pushgatewayGroupingKey returns a label of the grouping key as a path,
+// base64 encoded if the value can't be part of a path. An empty value is
+// encoded as a single padding character, the path segment can't be empty.
+func pushgatewayGroupingKey(name, value string) string {
+	switch {
+	case value == "":
+		return name + "@base64/="
+	case strings.Contains(value, "/"):
+		return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakePushgateway records the pushes it receives.
+type fakePushgateway struct {
+	mu     sync.Mutex
+	pushes []fakePush
+}
+
+type fakePush struct {
+	method, path, body string
+}
+
+func (g *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	g.mu.Lock()
+	g.pushes = append(g.pushes, fakePush{r.Method, r.URL.EscapedPath(), string(body)})
+	g.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func TestPushgatewayGroupingKey(t *testing.T) {
+	for _, test := range []struct {
+		value, want string
+	}{
+		{"gpu-node-17", "instance/gpu-node-17"},
+		{"gpu node", "instance/gpu%20node"},
+		{"", "instance@base64/="},
+		{"/scratch/train", "instance@base64/L3NjcmF0Y2gvdHJhaW4"},
+	} {
+		if got := pushgatewayGroupingKey("instance", test.value); got != test.want {
+			t.Errorf("pushgatewayGroupingKey(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestJobSamplerUnsupported(t *testing.T) {
+	var sampler jobSampler
+	start := time.Unix(1552140161, 0)
+	for i := 0; i < 3; i++ {
+		data := testSnapshot()
+		if i == 1 {
+			// The A100 fails to report its power once.
+			data.Devices[0].Errors["power_usage_milliwatts"] = "not supported"
+		}
+		sampler.add(data, start.Add(time.Duration(i)*time.Second))
+	}
+
+	mfs, err := sampler.registry(3*time.Second, 0).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := map[string]*dto.MetricFamily{}
+	for _, f := range mfs {
+		families[f.GetName()] = f
+	}
+	for name, want := range map[string]int{
+		"nvidia_job_samples":                 2,
+		"nvidia_job_memory_used_max_bytes":   2,
+		"nvidia_job_utilization_gpu_max":     2,
+		"nvidia_job_utilization_gpu_average": 2,
+		// The T4 doesn't report its power, its energy is unknown.
+		"nvidia_job_energy_joules": 1,
+	} {
+		if got := len(families[name].GetMetric()); got != want {
+			t.Errorf("got %d devices with %s, want %d", got, name, want)
+		}
+	}
+
+	// Energy isn't integrated across the sample without power.
+	if got := families["nvidia_job_energy_joules"].Metric[0].Gauge.GetValue(); got != 0 {
+		t.Errorf("got %v joules, want 0 without consecutive power samples", got)
+	}
+}
+
+func TestRunPush(t *testing.T) {
+	gateway := &fakePushgateway{}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	code := runPush([]string{
+		"-pushgateway.url", server.URL,
+		"-backend", "simulator",
+		"-instance", "",
+		"-interval", "10ms",
+		"--", "sh", "-c", "sleep 0.1; exit 3",
+	})
+	if code != 3 {
+		t.Errorf("got exit code %d, want 3", code)
+	}
+
+	if len(gateway.pushes) != 1 {
+		t.Fatalf("got %d pushes, want 1", len(gateway.pushes))
+	}
+	push := gateway.pushes[0]
+	if want := "/metrics/job/sh/instance@base64/="; push.method != "PUT" || push.path != want {
+		t.Errorf("got %s %s, want PUT %s", push.method, push.path, want)
+	}
+	for _, want := range []string{
+		"nvidia_job_exit_code 3\n",
+		"nvidia_job_energy_joules{minor=\"0\",",
+		"nvidia_job_utilization_gpu_max{minor=\"0\",",
+	} {
+		if !strings.Contains(push.body, want) {
+			t.Errorf("pushed metrics don't contain %q:\n%s", want, push.body)
+		}
+	}
+}
+
+func TestRunPushWithoutBackend(t *testing.T) {
+	gateway := &fakePushgateway{}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	// The command runs without a backend, only the push is skipped.
+	dir, err := ioutil.TempDir("", "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	code := runPush([]string{
+		"-pushgateway.url", server.URL,
+		"-backend", "replay",
+		"-replay.file", dir + "/missing.gz",
+		"--", "sh", "-c", "touch " + dir + "/ran; exit 0",
+	})
+	if code != 0 {
+		t.Errorf("got exit code %d, want 0", code)
+	}
+	if _, err := ioutil.ReadFile(dir + "/ran"); err != nil {
+		t.Errorf("command didn't run: %s", err)
+	}
+	if len(gateway.pushes) != 0 {
+		t.Errorf("got %d pushes, want none", len(gateway.pushes))
+	}
+}
+
+func TestPushToGatewayError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "pushed metrics are invalid or inconsistent with existing metrics", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	var sampler jobSampler
+	err := pushToGateway(server.URL, "train", "gpu-node-17", sampler.registry(0, 0), 0)
+	if err == nil || !strings.Contains(err.Error(), "HTTP status 400: pushed metrics are invalid") {
+		t.Errorf("got error %v, want the message of the Pushgateway", err)
+	}
+}
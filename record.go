@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// snapshot is a single collection as written by the recorder, one JSON
+// object per line.
+type snapshot struct {
+	Timestamp time.Time `json:"timestamp"`
+	Metrics   *Metrics  `json:"metrics,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// recordingBackend writes every collection of the wrapped backend, including
+// failed ones, to a gzip compressed JSON-lines file. Every snapshot is a gzip
+// member of its own, so the file is complete after every write and can be
+// appended to after a restart.
+type recordingBackend struct {
+	Backend
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newRecordingBackend(backend Backend, path string) (*recordingBackend, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// A member cut short by a kill is dropped.
+	end, err := completeMembers(file)
+	if err == nil {
+		err = file.Truncate(end)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to append to %s: %s", path, err)
+	}
+	return &recordingBackend{
+		Backend: backend,
+		file:    file,
+	}, nil
+}
+
+func (b *recordingBackend) Collect() (*Metrics, error) {
+	metrics, err := b.Backend.Collect()
+
+	s := snapshot{
+		Timestamp: time.Now(),
+		Metrics:   metrics,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if err := b.record(s); err != nil {
+		log.Printf("Failed to record metrics: %s\n", err)
+	}
+
+	return metrics, err
+}
+
+// record writes a snapshot and syncs it, so that the file is usable even if
+// the exporter is killed.
+func (b *recordingBackend) record(s snapshot) error {
+	line, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return b.write(append(line, '\n'))
+}
+
+// write appends lines as a new gzip member.
+func (b *recordingBackend) write(lines []byte) error {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(lines)
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+// completeMembers returns the length of the complete gzip members at the
+// start of a recording.
+func completeMembers(r io.Reader) (int64, error) {
+	counter := &countingReader{r: r}
+	br := bufio.NewReader(counter)
+	z := new(gzip.Reader)
+	var end int64
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return end, nil
+		}
+		err := z.Reset(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		z.Multistream(false)
+
+		if _, err := io.Copy(ioutil.Discard, z); err == io.ErrUnexpectedEOF {
+			return end, nil
+		} else if err != nil {
+			return 0, err
+		}
+		end = counter.n - int64(br.Buffered())
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// replayBackend serves the snapshots of a recording. The recording is played
+// back from the start of the exporter, in real time multiplied by speed.
+type replayBackend struct {
+	snapshots []snapshot
+	speed     float64
+	loop      bool
+	started   time.Time
+}
+
+func newReplayBackend(path string, speed float64, loop bool) (*replayBackend, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("replay speed must be positive, got %v", speed)
+	}
+
+	snapshots, err := readSnapshots(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("%s holds no snapshots", path)
+	}
+
+	return &replayBackend{
+		snapshots: snapshots,
+		speed:     speed,
+		loop:      loop,
+		started:   time.Now(),
+	}, nil
+}
+
+func (b *replayBackend) Collect() (*Metrics, error) {
+	first := b.snapshots[0].Timestamp
+	last := b.snapshots[len(b.snapshots)-1].Timestamp
+
+	// The last snapshot is served for as long as the one before it.
+	length := last.Sub(first)
+	if n := len(b.snapshots); n > 1 {
+		length += last.Sub(b.snapshots[n-2].Timestamp)
+	}
+
+	elapsed := time.Duration(float64(time.Since(b.started)) * b.speed)
+	if elapsed >= length {
+		if !b.loop {
+			return nil, errors.New("end of recording")
+		}
+		if length > 0 {
+			elapsed %= length
+		}
+	}
+
+	// The latest snapshot taken at or before the elapsed time.
+	now := first.Add(elapsed)
+	i := sort.Search(len(b.snapshots), func(i int) bool {
+		return b.snapshots[i].Timestamp.After(now)
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	s := b.snapshots[i]
+	if s.Error != "" {
+		return nil, errors.New(s.Error)
+	}
+	return s.Metrics, nil
+}
+
+// readSnapshots reads a recording. The last gzip member may have been cut
+// short by a kill, so the unexpected end of the stream and a partially
+// written last line are expected. Any other line that can't be decoded is an
+// error.
+func readSnapshots(path string) ([]snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []snapshot
+	var corrupt error
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if corrupt != nil {
+			return nil, corrupt
+		}
+		var s snapshot
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			corrupt = fmt.Errorf("%s:%d: %s", path, line, err)
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	err = scanner.Err()
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if corrupt != nil && err == nil {
+		return nil, corrupt
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.Before(snapshots[j].Timestamp)
+	})
+
+	return snapshots, nil
+}
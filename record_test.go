@@ -0,0 +1,187 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempRecording(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "recording.gz"), func() { os.RemoveAll(dir) }
+}
+
+// recordVersions records a snapshot for each driver version, and a failed
+// collection for an empty one.
+func recordVersions(t *testing.T, path string, versions ...string) {
+	backend := &staticBackend{}
+	recorder, err := newRecordingBackend(backend, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.file.Close()
+	for _, v := range versions {
+		backend.metrics, backend.err = &Metrics{Version: v}, nil
+		if v == "" {
+			backend.metrics, backend.err = nil, errors.New("collection failed")
+		}
+		recorder.Collect()
+	}
+}
+
+func readVersions(t *testing.T, path string) []string {
+	snapshots, err := readSnapshots(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for _, s := range snapshots {
+		if s.Metrics == nil {
+			versions = append(versions, s.Error)
+			continue
+		}
+		versions = append(versions, s.Metrics.Version)
+	}
+	return versions
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRecordingAppends(t *testing.T) {
+	path, cleanup := tempRecording(t)
+	defer cleanup()
+
+	recordVersions(t, path, "390.87", "")
+	recordVersions(t, path, "470.103.01")
+
+	want := []string{"390.87", "collection failed", "470.103.01"}
+	if got := readVersions(t, path); !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRecordingRecoversPartialMember(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		cut      func(member int) int
+		versions []string
+	}{
+		{"trailer", func(member int) int { return 4 }, []string{"390.87", "535.129.03"}},
+		{"line", func(member int) int { return member / 2 }, []string{"390.87", "535.129.03"}},
+	} {
+		path, cleanup := tempRecording(t)
+
+		recordVersions(t, path, "390.87")
+		first, _ := ioutil.ReadFile(path)
+		recordVersions(t, path, "470.103.01")
+
+		// Cut the last member short, as a kill during a write would.
+		body, _ := ioutil.ReadFile(path)
+		ioutil.WriteFile(path, body[:len(body)-test.cut(len(body)-len(first))], 0644)
+
+		recordVersions(t, path, "535.129.03")
+		if got := readVersions(t, path); !equalStrings(got, test.versions) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.versions)
+		}
+		cleanup()
+	}
+}
+
+func TestReadSnapshotsCorrupt(t *testing.T) {
+	path, cleanup := tempRecording(t)
+	defer cleanup()
+
+	recordVersions(t, path, "390.87")
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	w := gzip.NewWriter(file)
+	w.Write([]byte(`{"timestamp":"2019-01-15T10:12:04Z","metrics":` + "\n"))
+	w.Close()
+	file.Close()
+	recordVersions(t, path, "470.103.01")
+
+	_, err := readSnapshots(path)
+	if want := path + ":2: "; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("got error %v, want one starting with %q", err, want)
+	}
+}
+
+func TestReadSnapshotsCutShort(t *testing.T) {
+	path, cleanup := tempRecording(t)
+	defer cleanup()
+
+	// The recorder was killed during its last write and not restarted.
+	recordVersions(t, path, "390.87", "470.103.01")
+	body, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, body[:len(body)-20], 0644)
+
+	if got, want := readVersions(t, path), []string{"390.87"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRecordingRefusesOtherFiles(t *testing.T) {
+	path, cleanup := tempRecording(t)
+	defer cleanup()
+
+	ioutil.WriteFile(path, []byte("not a recording\n"), 0644)
+	if _, err := newRecordingBackend(&staticBackend{}, path); err == nil {
+		t.Error("expected an error for a file that isn't a recording")
+	}
+	if body, _ := ioutil.ReadFile(path); string(body) != "not a recording\n" {
+		t.Errorf("file was modified to %q", body)
+	}
+}
+
+func TestReplayBackend(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	b := &replayBackend{
+		snapshots: []snapshot{
+			{Timestamp: start, Metrics: &Metrics{Version: "390.87"}},
+			{Timestamp: start.Add(time.Minute), Error: "collection failed"},
+			{Timestamp: start.Add(2 * time.Minute), Metrics: &Metrics{Version: "470.103.01"}},
+		},
+		speed: 60,
+	}
+
+	for _, test := range []struct {
+		elapsed time.Duration
+		version string
+		err     string
+	}{
+		{0, "390.87", ""},
+		{30 * time.Second, "390.87", ""},
+		{90 * time.Second, "", "collection failed"},
+		{150 * time.Second, "470.103.01", ""},
+		{200 * time.Second, "", "end of recording"},
+	} {
+		b.started = time.Now().Add(-test.elapsed / 60)
+		metrics, err := b.Collect()
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("at %s: got error %v, want %q", test.elapsed, err, test.err)
+			}
+			continue
+		}
+		if err != nil || metrics.Version != test.version {
+			t.Errorf("at %s: got %+v, %v, want version %s", test.elapsed, metrics, err, test.version)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	remoteWriteMinBackoff = 500 * time.Millisecond
+	remoteWriteMaxBackoff = 30 * time.Second
+)
+
+// RemoteWriteConfig configures pushing the registry with the Prometheus
+// remote_write protocol.
+type RemoteWriteConfig struct {
+	URL             string
+	Interval        time.Duration
+	Timeout         time.Duration
+	Username        string
+	PasswordFile    string
+	BearerTokenFile string
+	Labels          string
+	Retries         int
+	WALDir          string
+	WALMaxSize      int64
+}
+
+// remoteWriter periodically gathers the registry and sends it to a
+// remote_write receiver. Requests that can't be delivered are kept in a WAL
+// directory, if configured, and sent once the receiver is back.
+type remoteWriter struct {
+	config   RemoteWriteConfig
+	gatherer prometheus.Gatherer
+	labels   map[string]string
+	client   *http.Client
+
+	requests *counterVec
+	samples  prometheus.Counter
+	walSize  prometheus.Gauge
+}
+
+// remoteWriteError is a request rejected by the receiver.
+type remoteWriteError struct {
+	status      int
+	message     string
+	recoverable bool
+}
+
+func (e *remoteWriteError) Error() string {
+	return fmt.Sprintf("server returned HTTP status %d: %s", e.status, e.message)
+}
+
+func newRemoteWriter(config RemoteWriteConfig, gatherer prometheus.Gatherer) (*remoteWriter, error) {
+	labels, err := parseKeyValues(config.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := labels["instance"]; !ok {
+		if hostname, err := os.Hostname(); err == nil {
+			labels["instance"] = hostname
+		}
+	}
+	if config.WALDir != "" {
+		if err := os.MkdirAll(config.WALDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	w := &remoteWriter{
+		config:   config,
+		gatherer: gatherer,
+		labels:   labels,
+		client:   &http.Client{Timeout: config.Timeout},
+		requests: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "remote_write_requests_total",
+				Help:      "Remote write requests by result, sent, buffered in the WAL or dropped",
+			},
+			[]string{"result"},
+		),
+		samples: newCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "remote_write_samples_total",
+				Help:      "Samples gathered for remote write",
+			},
+		),
+		walSize: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "remote_write_wal_bytes",
+				Help:      "Size of the requests buffered in the remote write WAL",
+			},
+		),
+	}
+	w.walSize.Set(float64(w.walBytes()))
+	return w, nil
+}
+
+func (w *remoteWriter) Describe(descs chan<- *prometheus.Desc) {
+	w.requests.Describe(descs)
+	w.samples.Describe(descs)
+	w.walSize.Describe(descs)
+}
+
+func (w *remoteWriter) Collect(metrics chan<- prometheus.Metric) {
+	w.requests.Collect(metrics)
+	w.samples.Collect(metrics)
+	w.walSize.Collect(metrics)
+}
+
+// run pushes every interval until the process exits.
+func (w *remoteWriter) run() {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	for {
+		w.push(time.Now())
+		<-ticker.C
+	}
+}
+
+// push gathers the registry and sends it, after the requests in the WAL.
+func (w *remoteWriter) push(now time.Time) {
+	mfs, err := w.gatherer.Gather()
+	if err != nil {
+		log.Printf("Failed to gather metrics for remote write: %s\n", err)
+	}
+	series := remoteWriteSeries(mfs, w.labels, now)
+	for _, s := range series {
+		w.samples.Add(float64(len(s.samples)))
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+
+	if w.replayWAL() {
+		err = w.send(body)
+		if err == nil {
+			w.requests.WithLabelValues("sent").Inc()
+			return
+		}
+		if e, ok := err.(*remoteWriteError); ok && !e.recoverable {
+			log.Printf("Failed to remote write, dropping %d series: %s\n", len(series), err)
+			w.requests.WithLabelValues("dropped").Inc()
+			return
+		}
+		log.Printf("Failed to remote write: %s\n", err)
+	}
+
+	if w.config.WALDir == "" {
+		w.requests.WithLabelValues("dropped").Inc()
+		return
+	}
+	if err := w.appendWAL(now, body); err != nil {
+		log.Printf("Failed to buffer remote write request: %s\n", err)
+		w.requests.WithLabelValues("dropped").Inc()
+		return
+	}
+	w.requests.WithLabelValues("buffered").Inc()
+}
+
+// send posts a request, retrying recoverable errors with exponential
+// backoff.
+func (w *remoteWriter) send(body []byte) error {
+	backoff := remoteWriteMinBackoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			return nil
+		}
+		if e, ok := err.(*remoteWriteError); ok && !e.recoverable {
+			return err
+		}
+		if attempt >= w.config.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+func (w *remoteWriter) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "nvidia-exporter/"+VERSION)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	// Credentials are read for every request to pick up rotated secrets.
+	if w.config.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(w.config.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if w.config.Username != "" {
+		var password []byte
+		if w.config.PasswordFile != "" {
+			if password, err = ioutil.ReadFile(w.config.PasswordFile); err != nil {
+				return err
+			}
+		}
+		req.SetBasicAuth(w.config.Username, strings.TrimSpace(string(password)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	return &remoteWriteError{
+		status:      resp.StatusCode,
+		message:     strings.TrimSpace(string(message)),
+		recoverable: resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests,
+	}
+}
+
+// walFiles returns the requests in the WAL, oldest first.
+func (w *remoteWriter) walFiles() []string {
+	if w.config.WALDir == "" {
+		return nil
+	}
+	files, _ := filepath.Glob(filepath.Join(w.config.WALDir, "*.snappy"))
+	sort.Strings(files)
+	return files
+}
+
+func (w *remoteWriter) walBytes() int64 {
+	var size int64
+	for _, file := range w.walFiles() {
+		if fi, err := os.Stat(file); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// replayWAL sends the requests in the WAL, oldest first, and reports whether
+// the WAL is empty afterwards.
+func (w *remoteWriter) replayWAL() bool {
+	files := w.walFiles()
+	if len(files) == 0 {
+		return true
+	}
+	defer func() { w.walSize.Set(float64(w.walBytes())) }()
+
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Printf("Failed to read remote write WAL: %s\n", err)
+			os.Remove(file)
+			continue
+		}
+		err = w.send(body)
+		if e, ok := err.(*remoteWriteError); ok && !e.recoverable {
+			log.Printf("Failed to remote write %s, dropping it: %s\n", filepath.Base(file), err)
+			w.requests.WithLabelValues("dropped").Inc()
+		} else if err != nil {
+			log.Printf("Failed to remote write buffered requests: %s\n", err)
+			return false
+		} else {
+			w.requests.WithLabelValues("sent").Inc()
+		}
+		os.Remove(file)
+	}
+	log.Printf("Sent %d buffered remote write requests\n", len(files))
+	return true
+}
+
+// appendWAL buffers a request, dropping the oldest requests when the WAL
+// grows beyond its maximum size.
+func (w *remoteWriter) appendWAL(now time.Time, body []byte) error {
+	defer func() { w.walSize.Set(float64(w.walBytes())) }()
+
+	name := filepath.Join(w.config.WALDir, fmt.Sprintf("%020d.snappy", now.UnixNano()))
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+
+	size := w.walBytes()
+	for _, file := range w.walFiles() {
+		if size <= w.config.WALMaxSize || file == name {
+			break
+		}
+		if fi, err := os.Stat(file); err == nil {
+			size -= fi.Size()
+		}
+		os.Remove(file)
+		w.requests.WithLabelValues("dropped").Inc()
+	}
+	return nil
+}
+
+// parseKeyValues parses comma separated name=value pairs, e.g. the labels
+// added to every series.
+func parseKeyValues(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid %q, expected name=value", pair)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+type remoteWriteLabel struct {
+	name, value string
+}
+
+type remoteWriteSample struct {
+	value     float64
+	timestamp int64
+}
+
+type remoteWriteTimeSeries struct {
+	labels  []remoteWriteLabel
+	samples []remoteWriteSample
+}
+
+// remoteWriteSeries flattens the metric families into time series, the
+// way Prometheus would have scraped them, with the extra labels added.
+func remoteWriteSeries(mfs []*dto.MetricFamily, extra map[string]string, now time.Time) []remoteWriteTimeSeries {
+	ts := now.UnixNano() / int64(time.Millisecond)
+
+	var series []remoteWriteTimeSeries
+	add := func(name string, m *dto.Metric, value float64, labelName, labelValue string) {
+		labels := []remoteWriteLabel{{"__name__", name}}
+		seen := map[string]bool{}
+		for _, l := range m.Label {
+			labels = append(labels, remoteWriteLabel{l.GetName(), l.GetValue()})
+			seen[l.GetName()] = true
+		}
+		if labelName != "" {
+			labels = append(labels, remoteWriteLabel{labelName, labelValue})
+			seen[labelName] = true
+		}
+		for name, value := range extra {
+			if !seen[name] {
+				labels = append(labels, remoteWriteLabel{name, value})
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		t := ts
+		if m.TimestampMs != nil {
+			t = m.GetTimestampMs()
+		}
+		series = append(series, remoteWriteTimeSeries{labels, []remoteWriteSample{{value, t}}})
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue(), "", "")
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue(), "", "")
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().Quantile {
+					add(name, m, q.GetValue(), "quantile", strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64))
+				}
+				add(name+"_sum", m, m.GetSummary().GetSampleSum(), "", "")
+				add(name+"_count", m, float64(m.GetSummary().GetSampleCount()), "", "")
+			case dto.MetricType_HISTOGRAM:
+				var inf bool
+				for _, b := range m.GetHistogram().Bucket {
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), "le", strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64))
+				}
+				if !inf {
+					add(name+"_bucket", m, float64(m.GetHistogram().GetSampleCount()), "le", "+Inf")
+				}
+				add(name+"_sum", m, m.GetHistogram().GetSampleSum(), "", "")
+				add(name+"_count", m, float64(m.GetHistogram().GetSampleCount()), "", "")
+			default:
+				add(name, m, m.GetUntyped().GetValue(), "", "")
+			}
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest encodes the series as a prometheus.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []remoteWriteTimeSeries) []byte {
+	req := proto.NewBuffer(nil)
+	ts := proto.NewBuffer(nil)
+	msg := proto.NewBuffer(nil)
+	for _, s := range series {
+		ts.Reset()
+		for _, l := range s.labels {
+			msg.Reset()
+			protoString(msg, 1, l.name)
+			protoString(msg, 2, l.value)
+			protoBytes(ts, 1, msg.Bytes())
+		}
+		for _, sample := range s.samples {
+			msg.Reset()
+			protoFixed64(msg, 1, math.Float64bits(sample.value))
+			protoVarint(msg, 2, uint64(sample.timestamp))
+			protoBytes(ts, 2, msg.Bytes())
+		}
+		protoBytes(req, 1, ts.Bytes())
+	}
+	return req.Bytes()
+}
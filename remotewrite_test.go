@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The prometheus.WriteRequest messages, decoded by the protobuf library to
+// check the encoding by hand.
+
+type testWriteRequest struct {
+	Timeseries []*testTimeSeries `protobuf:"bytes,1,rep,name=timeseries"`
+}
+
+type testTimeSeries struct {
+	Labels  []*testLabel  `protobuf:"bytes,1,rep,name=labels"`
+	Samples []*testSample `protobuf:"bytes,2,rep,name=samples"`
+}
+
+type testLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+type testSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *testWriteRequest) Reset()         { *m = testWriteRequest{} }
+func (m *testWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*testWriteRequest) ProtoMessage()    {}
+func (m *testTimeSeries) Reset()           { *m = testTimeSeries{} }
+func (m *testTimeSeries) String() string   { return proto.CompactTextString(m) }
+func (*testTimeSeries) ProtoMessage()      {}
+func (m *testLabel) Reset()                { *m = testLabel{} }
+func (m *testLabel) String() string        { return proto.CompactTextString(m) }
+func (*testLabel) ProtoMessage()           {}
+func (m *testSample) Reset()               { *m = testSample{} }
+func (m *testSample) String() string       { return proto.CompactTextString(m) }
+func (*testSample) ProtoMessage()          {}
+
+func decodeWriteRequest(t *testing.T, body []byte) *testWriteRequest {
+	var req testWriteRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	return &req
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	series := []remoteWriteTimeSeries{
+		{
+			labels:  []remoteWriteLabel{{"__name__", "nvidia_temperature_celsius"}, {"minor", "0"}},
+			samples: []remoteWriteSample{{41, 1552140161000}},
+		},
+		{
+			// Zero values and timestamps before 1970 survive the encoding.
+			labels:  []remoteWriteLabel{{"__name__", "nvidia_up"}, {"instance", ""}},
+			samples: []remoteWriteSample{{0, -1000}, {math.Inf(1), 0}},
+		},
+	}
+	want := &testWriteRequest{Timeseries: []*testTimeSeries{
+		{
+			Labels:  []*testLabel{{"__name__", "nvidia_temperature_celsius"}, {"minor", "0"}},
+			Samples: []*testSample{{41, 1552140161000}},
+		},
+		{
+			Labels:  []*testLabel{{"__name__", "nvidia_up"}, {"instance", ""}},
+			Samples: []*testSample{{0, -1000}, {math.Inf(1), 0}},
+		},
+	}}
+	if got := decodeWriteRequest(t, encodeWriteRequest(series)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// remoteWriteReceiver records the requests it receives and answers with the
+// status codes of statuses, then with 204.
+type remoteWriteReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*testWriteRequest
+	headers  []http.Header
+}
+
+func (r *remoteWriteReceiver) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		compressed, _ := ioutil.ReadAll(req.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("request isn't snappy compressed: %s", err)
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, decodeWriteRequest(t, body))
+		r.headers = append(r.headers, req.Header)
+		if len(r.statuses) > 0 {
+			status := r.statuses[0]
+			r.statuses = r.statuses[1:]
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newTestRemoteWriter(t *testing.T, config RemoteWriteConfig, value float64) (*remoteWriter, prometheus.Gauge) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: namespace, Name: "temperature_celsius", Help: "Temperature"})
+	gauge.Set(value)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(gauge)
+	w, err := newRemoteWriter(config, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, gauge
+}
+
+func TestRemoteWriterPush(t *testing.T) {
+	receiver := &remoteWriteReceiver{}
+	server := httptest.NewServer(receiver.handler(t))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "remotewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	token := dir + "/token"
+	ioutil.WriteFile(token, []byte("s3cr3t\n"), 0600)
+
+	w, _ := newTestRemoteWriter(t, RemoteWriteConfig{
+		URL:             server.URL,
+		Timeout:         time.Second,
+		Labels:          "cluster=eu-de-1,instance=gpu-node-17",
+		BearerTokenFile: token,
+	}, 41)
+	now := time.Unix(1552140161, 0)
+	w.push(now)
+
+	if len(receiver.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(receiver.requests))
+	}
+	want := &testWriteRequest{Timeseries: []*testTimeSeries{{
+		Labels: []*testLabel{
+			{"__name__", "nvidia_temperature_celsius"},
+			{"cluster", "eu-de-1"},
+			{"instance", "gpu-node-17"},
+		},
+		Samples: []*testSample{{41, 1552140161000}},
+	}}}
+	if got := receiver.requests[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for name, want := range map[string]string{
+		"Authorization":                     "Bearer s3cr3t",
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := receiver.headers[0].Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRemoteWriterWAL(t *testing.T) {
+	// The receiver is down for the first push and rejects the third.
+	receiver := &remoteWriteReceiver{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(receiver.handler(t))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "remotewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, gauge := newTestRemoteWriter(t, RemoteWriteConfig{
+		URL:        server.URL,
+		Timeout:    time.Second,
+		Labels:     "instance=gpu-node-17",
+		WALDir:     dir,
+		WALMaxSize: 1 << 20,
+	}, 41)
+	start := time.Unix(1552140161, 0)
+	w.push(start)
+	if files := w.walFiles(); len(files) != 1 {
+		t.Fatalf("got %d requests in the WAL, want 1", len(files))
+	}
+
+	// The buffered request is sent before the current one.
+	gauge.Set(42)
+	w.push(start.Add(time.Minute))
+	if files := w.walFiles(); len(files) != 0 {
+		t.Errorf("got %d requests left in the WAL, want 0", len(files))
+	}
+
+	receiver.statuses = []int{http.StatusBadRequest}
+	w.push(start.Add(2 * time.Minute))
+	if files := w.walFiles(); len(files) != 0 {
+		t.Errorf("rejected request was buffered")
+	}
+
+	var values []float64
+	for _, req := range receiver.requests {
+		values = append(values, req.Timeseries[0].Samples[0].Value)
+	}
+	if want := []float64{41, 41, 42, 42}; !reflect.DeepEqual(values, want) {
+		t.Errorf("receiver got values %v, want %v", values, want)
+	}
+
+	results := map[string]float64{}
+	for _, m := range gather(t, w)["nvidia_remote_write_requests_total"].GetMetric() {
+		results[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+	}
+	if want := map[string]float64{"buffered": 1, "sent": 2, "dropped": 1}; !reflect.DeepEqual(results, want) {
+		t.Errorf("got requests %v, want %v", results, want)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// simulatorAmbient is the inlet temperature of all simulated devices.
+const simulatorAmbient = 30
+
+// simulatorSKU describes the physical limits of a simulated device. LoadTemp
+// is the temperature reached at TDP with nominal cooling.
+type simulatorSKU struct {
+	Name         string
+	Memory       float64
+	IdlePower    float64
+	TDP          float64
+	LoadTemp     float64
+	SlowdownTemp float64
+	ShutdownTemp float64
+	Fans         bool
+	Clocks       Clocks
+	LinkGen      float64
+	LinkWidth    float64
+}
+
+// simulatorSKUs are the devices the simulator can fabricate, by the name used
+// in the simulator configuration.
+var simulatorSKUs = map[string]simulatorSKU{
+	"A100-SXM4-40GB": {"NVIDIA A100-SXM4-40GB", 40960, 55, 400, 68, 89, 92, false,
+		Clocks{MaxGraphics: 1410, MaxSM: 1410, MaxMemory: 1215, MaxVideo: 1275}, 4, 16},
+	"A100-SXM4-80GB": {"NVIDIA A100-SXM4-80GB", 81920, 60, 400, 68, 89, 92, false,
+		Clocks{MaxGraphics: 1410, MaxSM: 1410, MaxMemory: 1593, MaxVideo: 1275}, 4, 16},
+	"H100-SXM5-80GB": {"NVIDIA H100 80GB HBM3", 81559, 70, 700, 72, 87, 90, false,
+		Clocks{MaxGraphics: 1980, MaxSM: 1980, MaxMemory: 2619, MaxVideo: 1755}, 5, 16},
+	"V100-SXM2-16GB": {"Tesla V100-SXM2-16GB", 16160, 40, 300, 65, 87, 90, false,
+		Clocks{MaxGraphics: 1530, MaxSM: 1530, MaxMemory: 877, MaxVideo: 1372}, 3, 16},
+	"T4": {"Tesla T4", 15360, 10, 70, 75, 93, 96, false,
+		Clocks{MaxGraphics: 1590, MaxSM: 1590, MaxMemory: 5001, MaxVideo: 1470}, 3, 16},
+	"L4": {"NVIDIA L4", 23034, 16, 72, 72, 92, 95, false,
+		Clocks{MaxGraphics: 2040, MaxSM: 2040, MaxMemory: 6251, MaxVideo: 1770}, 4, 16},
+	"A10": {"NVIDIA A10", 23028, 20, 150, 72, 95, 98, false,
+		Clocks{MaxGraphics: 1695, MaxSM: 1695, MaxMemory: 6251, MaxVideo: 1575}, 4, 16},
+	"RTX-A6000": {"NVIDIA RTX A6000", 49140, 25, 300, 80, 93, 98, true,
+		Clocks{MaxGraphics: 2100, MaxSM: 2100, MaxMemory: 8001, MaxVideo: 1950}, 4, 16},
+}
+
+// SimulatorConfig describes the devices fabricated by the simulator backend
+// and the workload profiles driving them.
+type SimulatorConfig struct {
+	Step          time.Duration               `yaml:"step"`
+	DriverVersion string                      `yaml:"driver_version"`
+	CUDAVersion   string                      `yaml:"cuda_version"`
+	Devices       []SimulatorDevices          `yaml:"devices"`
+	Profiles      map[string]SimulatorProfile `yaml:"profiles"`
+}
+
+// SimulatorDevices are Count devices of a SKU running a profile.
+type SimulatorDevices struct {
+	SKU     string `yaml:"sku"`
+	Count   int    `yaml:"count"`
+	Profile string `yaml:"profile"`
+}
+
+// SimulatorProfile is a workload made of phases that are run in order and
+// repeated. Devices that fell off the bus come back when the profile starts
+// over.
+type SimulatorProfile struct {
+	Phases []SimulatorPhase `yaml:"phases"`
+}
+
+// SimulatorPhase sets the targets the simulated devices move towards.
+// Utilization is in percent, Memory a fraction of the device memory, Burst
+// the probability of a step running at BurstUtilization, Cooling a factor on
+// the thermal resistance and the ECC rates are errors per second.
+type SimulatorPhase struct {
+	Duration         time.Duration `yaml:"duration"`
+	Utilization      float64       `yaml:"utilization"`
+	Jitter           float64       `yaml:"jitter"`
+	Burst            float64       `yaml:"burst"`
+	BurstUtilization float64       `yaml:"burst_utilization"`
+	Memory           float64       `yaml:"memory"`
+	Cooling          float64       `yaml:"cooling"`
+	ECCCorrected     float64       `yaml:"ecc_corrected"`
+	ECCUncorrected   float64       `yaml:"ecc_uncorrected"`
+	Lost             bool          `yaml:"lost"`
+}
+
+// defaultSimulatorConfig holds the built-in profiles and the devices
+// simulated when no configuration is given.
+const defaultSimulatorConfig = `
+step: 1s
+driver_version: 535.129.03
+cuda_version: "12.2"
+devices:
+- {sku: A100-SXM4-80GB, count: 4, profile: training}
+- {sku: L4, count: 2, profile: inference}
+- {sku: T4, count: 1, profile: idle}
+- {sku: A100-SXM4-80GB, count: 1, profile: ecc-storm}
+profiles:
+  idle:
+    phases:
+    - {duration: 1h, utilization: 0, jitter: 0.5, memory: 0.01}
+  training:
+    phases:
+    - {duration: 1m, utilization: 5, jitter: 3, memory: 0.3}
+    - {duration: 20m, utilization: 96, jitter: 3, memory: 0.92}
+    - {duration: 30s, utilization: 10, jitter: 5, memory: 0.92}
+  inference:
+    phases:
+    - {duration: 10m, utilization: 8, jitter: 4, burst: 0.15, burst_utilization: 90, memory: 0.45}
+  thermal-runaway:
+    phases:
+    - {duration: 5m, utilization: 95, jitter: 2, memory: 0.8}
+    - {duration: 5m, utilization: 95, jitter: 2, memory: 0.8, cooling: 1.3}
+    - {duration: 5m, utilization: 95, jitter: 2, memory: 0.8, cooling: 1.7}
+    - {duration: 10m, utilization: 95, jitter: 2, memory: 0.8, cooling: 4}
+  ecc-storm:
+    phases:
+    - {duration: 10m, utilization: 70, jitter: 10, memory: 0.6}
+    - {duration: 2m, utilization: 70, jitter: 10, memory: 0.6, ecc_corrected: 50, ecc_uncorrected: 0.05}
+  fallen-off-bus:
+    phases:
+    - {duration: 10m, utilization: 90, jitter: 3, memory: 0.8}
+    - {duration: 5m, lost: true}
+`
+
+// LoadSimulatorConfig reads a YAML simulator configuration. Profiles are
+// added to the built-in ones, replacing those of the same name, devices
+// replace the default devices. An empty path returns the defaults.
+func LoadSimulatorConfig(path string) (*SimulatorConfig, error) {
+	config := &SimulatorConfig{}
+	if err := yaml.UnmarshalStrict([]byte(defaultSimulatorConfig), config); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return config, config.validate()
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file SimulatorConfig
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+
+	if file.Step != 0 {
+		config.Step = file.Step
+	}
+	if file.DriverVersion != "" {
+		config.DriverVersion = file.DriverVersion
+	}
+	if file.CUDAVersion != "" {
+		config.CUDAVersion = file.CUDAVersion
+	}
+	if len(file.Devices) > 0 {
+		config.Devices = file.Devices
+	}
+	for name, profile := range file.Profiles {
+		config.Profiles[name] = profile
+	}
+	return config, config.validate()
+}
+
+func (c *SimulatorConfig) validate() error {
+	if c.Step <= 0 {
+		return fmt.Errorf("simulator step must be positive, got %s", c.Step)
+	}
+	for _, d := range c.Devices {
+		if _, ok := simulatorSKUs[d.SKU]; !ok {
+			return fmt.Errorf("unknown simulator SKU %q", d.SKU)
+		}
+		profile, ok := c.Profiles[d.Profile]
+		if !ok {
+			return fmt.Errorf("unknown simulator profile %q", d.Profile)
+		}
+		if len(profile.Phases) == 0 {
+			return fmt.Errorf("simulator profile %q has no phases", d.Profile)
+		}
+		for _, p := range profile.Phases {
+			if p.Duration <= 0 {
+				return fmt.Errorf("simulator profile %q has a phase without duration", d.Profile)
+			}
+		}
+	}
+	return nil
+}
+
+// simulatorBackend fabricates devices driven by workload profiles. Time is
+// advanced in fixed steps since the start of the exporter and every device
+// draws from its own source seeded from the seed and its index, so the
+// readings only depend on the seed, the configuration and the elapsed time.
+type simulatorBackend struct {
+	config *SimulatorConfig
+
+	mu      sync.Mutex
+	devices []*simulatedDevice
+	started time.Time
+	steps   int
+}
+
+func newSimulatorBackend(config *SimulatorConfig, seed int64) *simulatorBackend {
+	b := &simulatorBackend{
+		config:  config,
+		started: time.Now(),
+	}
+	for _, d := range config.Devices {
+		for i := 0; i < d.Count; i++ {
+			index := len(b.devices)
+			b.devices = append(b.devices, newSimulatedDevice(
+				index, simulatorSKUs[d.SKU], config.Profiles[d.Profile],
+				rand.New(rand.NewSource(seed+int64(index))),
+			))
+		}
+	}
+	return b
+}
+
+func (b *simulatorBackend) Collect() (*Metrics, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for steps := int(time.Since(b.started) / b.config.Step); b.steps < steps; b.steps++ {
+		for _, d := range b.devices {
+			d.step(b.config.Step)
+		}
+	}
+
+	metrics := &Metrics{
+		Version:     b.config.DriverVersion,
+		CUDAVersion: b.config.CUDAVersion,
+	}
+	for _, d := range b.devices {
+		// NVML fails every query on a lost GPU, and with it the collection.
+		if d.lost {
+			return nil, fmt.Errorf("GPU %s: GPU is lost", d.static.PCIe.BusID)
+		}
+		metrics.Devices = append(metrics.Devices, d.snapshot())
+	}
+
+	return metrics, nil
+}
+
+// simulatedDevice is the state of a single simulated device.
+type simulatedDevice struct {
+	sku     simulatorSKU
+	profile SimulatorProfile
+	rand    *rand.Rand
+	static  Device
+
+	phase   int
+	elapsed time.Duration
+	lost    bool
+
+	utilization        float64
+	utilizationMemory  float64
+	utilizationAverage float64
+	memoryUsed         float64
+	power              float64
+	powerAverage       float64
+	temperature        float64
+	txBytes            float64
+	rxBytes            float64
+	ecc                ECC
+}
+
+func newSimulatedDevice(index int, sku simulatorSKU, profile SimulatorProfile, r *rand.Rand) *simulatedDevice {
+	d := &simulatedDevice{
+		sku:     sku,
+		profile: profile,
+		rand:    r,
+		static: Device{
+			Index:       fmt.Sprint(index),
+			MinorNumber: fmt.Sprint(index),
+			Name:        sku.Name,
+			UUID: fmt.Sprintf("GPU-%08x-%04x-%04x-%04x-%012x",
+				r.Uint32(), r.Intn(1<<16), r.Intn(1<<16), r.Intn(1<<16), r.Int63n(1<<48)),
+			PCIe: &PCIe{
+				BusID:        fmt.Sprintf("00000000:%02X:00.0", 0x07+index*0x08),
+				LinkGen:      sku.LinkGen,
+				LinkGenMax:   sku.LinkGen,
+				LinkWidth:    sku.LinkWidth,
+				LinkWidthMax: sku.LinkWidth,
+			},
+		},
+		power:       sku.IdlePower,
+		temperature: simulatorAmbient + (sku.LoadTemp-simulatorAmbient)*sku.IdlePower/sku.TDP,
+	}
+	d.powerAverage = d.power
+	d.ecc.Enabled = 1
+	return d
+}
+
+// step advances the device by dt. Utilization follows the phase right away,
+// power follows utilization within a second and temperature follows power
+// within a minute. Above the slowdown temperature clocks, and with them
+// power, are throttled, at the shutdown temperature the device falls off the
+// bus.
+func (d *simulatedDevice) step(dt time.Duration) {
+	d.elapsed += dt
+	if d.elapsed >= d.profile.Phases[d.phase].Duration {
+		d.elapsed = 0
+		d.phase = (d.phase + 1) % len(d.profile.Phases)
+		if d.phase == 0 {
+			d.lost = false
+		}
+	}
+	phase := d.profile.Phases[d.phase]
+	if phase.Lost {
+		d.lost = true
+	}
+	seconds := dt.Seconds()
+
+	utilization := phase.Utilization
+	if phase.Burst > 0 && d.rand.Float64() < phase.Burst {
+		utilization = phase.BurstUtilization
+	}
+	utilization = clamp(utilization+d.rand.NormFloat64()*phase.Jitter, 0, 100)
+	power := d.sku.IdlePower + (d.sku.TDP-d.sku.IdlePower)*utilization/100*d.throttle()
+	memory := phase.Memory * d.sku.Memory * (1 << 20)
+	if d.lost {
+		utilization, power, memory = 0, 0, 0
+	}
+
+	cooling := phase.Cooling
+	if cooling == 0 {
+		cooling = 1
+	}
+
+	d.utilization = utilization
+	d.utilizationMemory = clamp(utilization*0.6+d.rand.NormFloat64()*2, 0, 100)
+	d.utilizationAverage = approach(d.utilizationAverage, utilization, seconds, averageDuration.Seconds())
+	d.power = approach(d.power, power, seconds, 1)
+	d.powerAverage = approach(d.powerAverage, d.power, seconds, averageDuration.Seconds())
+	d.temperature = approach(d.temperature,
+		simulatorAmbient+(d.sku.LoadTemp-simulatorAmbient)*d.power/d.sku.TDP*cooling,
+		seconds, 45)
+	d.memoryUsed = approach(d.memoryUsed, memory, seconds, 10)
+	d.txBytes = utilization / 100 * 2e9 * (0.8 + 0.4*d.rand.Float64())
+	d.rxBytes = utilization / 100 * 4e9 * (0.8 + 0.4*d.rand.Float64())
+
+	if d.temperature >= d.sku.ShutdownTemp {
+		d.lost = true
+	}
+
+	corrected := poisson(d.rand, phase.ECCCorrected*seconds)
+	uncorrected := poisson(d.rand, phase.ECCUncorrected*seconds)
+	d.ecc.VolatileCorrected += corrected
+	d.ecc.AggregateCorrected += corrected
+	d.ecc.VolatileUncorrected += uncorrected
+	d.ecc.AggregateUncorrected += uncorrected
+}
+
+// throttle returns the factor clocks are scaled with, from 1 at the slowdown
+// temperature down to 0.5 at the shutdown temperature.
+func (d *simulatedDevice) throttle() float64 {
+	over := (d.temperature - d.sku.SlowdownTemp) / (d.sku.ShutdownTemp - d.sku.SlowdownTemp)
+	return 1 - 0.5*clamp(over, 0, 1)
+}
+
+// snapshot returns the readings of the device in the units NVML uses.
+func (d *simulatedDevice) snapshot() *Device {
+	device := d.static
+	pcie := *d.static.PCIe
+	ecc := d.ecc
+
+	throttle := d.throttle()
+	clocks := d.sku.Clocks
+	clocks.Graphics = 210
+	clocks.SM = 210
+	clocks.Memory = clocks.MaxMemory
+	clocks.Video = 555
+	if d.utilization > 1 {
+		clocks.Graphics = math.Floor(clocks.MaxGraphics * throttle)
+		clocks.SM = math.Floor(clocks.MaxSM * throttle)
+		clocks.Video = math.Floor(clocks.MaxVideo * throttle)
+	}
+
+	if d.sku.Fans {
+		device.FanSpeed = math.Floor(clamp(30+(d.temperature-45)*1.5, 30, 100))
+	}
+	pcie.TxBytes = d.txBytes
+	pcie.RxBytes = d.rxBytes
+
+	device.Temperature = math.Floor(d.temperature)
+	device.PowerUsage = math.Floor(d.power * 1000)
+	device.PowerUsageAverage = math.Floor(d.powerAverage * 1000)
+	device.MemoryTotal = d.sku.Memory * (1 << 20)
+	device.MemoryUsed = math.Floor(d.memoryUsed)
+	device.UtilizationGPU = math.Floor(d.utilization)
+	device.UtilizationGPUAverage = math.Floor(d.utilizationAverage)
+	device.UtilizationMemory = math.Floor(d.utilizationMemory)
+	device.Clocks = &clocks
+	device.PCIe = &pcie
+	device.ECC = &ecc
+	return &device
+}
+
+// approach moves x towards target as a first order system with time
+// constant tau.
+func approach(x, target, dt, tau float64) float64 {
+	return target + (x-target)*math.Exp(-dt/tau)
+}
+
+func clamp(x, min, max float64) float64 {
+	return math.Max(min, math.Min(max, x))
+}
+
+// poisson draws from a Poisson distribution with mean lambda, approximated
+// by a normal distribution for large means.
+func poisson(r *rand.Rand, lambda float64) float64 {
+	if lambda <= 0 {
+		return 0
+	}
+	if lambda > 30 {
+		return math.Max(0, math.Floor(lambda+r.NormFloat64()*math.Sqrt(lambda)+0.5))
+	}
+	l, k, p := math.Exp(-lambda), 0.0, 1.0
+	for {
+		p *= r.Float64()
+		if p <= l {
+			return k
+		}
+		k++
+	}
+}
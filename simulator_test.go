@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// simulate collects from a new simulator backend that started elapsed ago.
+// Half a step is added so that the number of steps taken doesn't depend on
+// how long the test takes.
+func simulate(t *testing.T, config *SimulatorConfig, seed int64, elapsed time.Duration) (*Metrics, error) {
+	b := newSimulatorBackend(config, seed)
+	b.started = time.Now().Add(-elapsed - config.Step/2)
+	return b.Collect()
+}
+
+func TestSimulatorDeterministic(t *testing.T) {
+	config, err := LoadSimulatorConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, elapsed := range []time.Duration{0, time.Minute, 25 * time.Minute} {
+		first, err := simulate(t, config, 42, elapsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := simulate(t, config, 42, elapsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("after %s: readings differ with the same seed", elapsed)
+		}
+
+		other, err := simulate(t, config, 43, elapsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(first, other) {
+			t.Errorf("after %s: readings are the same with another seed", elapsed)
+		}
+	}
+}
+
+func TestSimulatorProfiles(t *testing.T) {
+	config, err := LoadSimulatorConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sku := simulatorSKUs["A100-SXM4-80GB"]
+
+	for _, test := range []struct {
+		profile string
+		elapsed time.Duration
+		check   func(d *Device) bool
+	}{
+		{"idle", 10 * time.Minute, func(d *Device) bool {
+			return d.UtilizationGPU < 5 && d.PowerUsage < 2*sku.IdlePower*1000
+		}},
+		{"training", 15 * time.Minute, func(d *Device) bool {
+			return d.UtilizationGPU > 85 && d.MemoryUsed > 0.9*d.MemoryTotal
+		}},
+		{"ecc-storm", 12 * time.Minute, func(d *Device) bool {
+			return d.ECC.AggregateCorrected > 0
+		}},
+	} {
+		config.Devices = []SimulatorDevices{{SKU: "A100-SXM4-80GB", Count: 1, Profile: test.profile}}
+		metrics, err := simulate(t, config, 1, test.elapsed)
+		if err != nil {
+			t.Errorf("%s: %s", test.profile, err)
+			continue
+		}
+		if d := metrics.Devices[0]; !test.check(d) {
+			t.Errorf("%s: unexpected readings after %s: %+v", test.profile, test.elapsed, d)
+		}
+	}
+
+	config.Devices = []SimulatorDevices{{SKU: "A100-SXM4-80GB", Count: 1, Profile: "fallen-off-bus"}}
+	if _, err := simulate(t, config, 1, 12*time.Minute); err == nil || !strings.Contains(err.Error(), "GPU is lost") {
+		t.Errorf("fallen-off-bus: got error %v, want GPU is lost", err)
+	}
+	if _, err := simulate(t, config, 1, 16*time.Minute); err != nil {
+		t.Errorf("fallen-off-bus: device didn't come back: %s", err)
+	}
+}
+
+func TestLoadSimulatorConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "simulator.yml")
+
+	for _, test := range []struct {
+		config string
+		err    string
+	}{
+		{"devices:\n- {sku: T4, count: 2, profile: busy}\nprofiles:\n  busy:\n    phases:\n    - {duration: 1m, utilization: 100}\n", ""},
+		{"devices:\n- {sku: H900, count: 1, profile: idle}\n", `unknown simulator SKU "H900"`},
+		{"devices:\n- {sku: T4, count: 1, profile: busy}\n", `unknown simulator profile "busy"`},
+		{"profiles:\n  idle:\n    phases:\n    - {utilization: 0}\n", `simulator profile "idle" has a phase without duration`},
+		{"step: 1s\nspeed: 2\n", "failed to parse"},
+	} {
+		ioutil.WriteFile(path, []byte(test.config), 0644)
+		config, err := LoadSimulatorConfig(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.config, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.config, err)
+			continue
+		}
+		if len(config.Devices) != 1 || config.Devices[0].Count != 2 {
+			t.Errorf("devices weren't replaced: %+v", config.Devices)
+		}
+		if _, ok := config.Profiles["training"]; !ok {
+			t.Error("built-in profiles were dropped")
+		}
+	}
+}
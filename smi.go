@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	smiTimeout = 10 * time.Second
+)
+
+// smiBackend runs `nvidia-smi -q -x` for every collection. It is meant for
+// hosts where libnvidia-ml can't be loaded into the exporter process but the
+// nvidia-smi binary is available.
+type smiBackend struct {
+	path string
+}
+
+func (b *smiBackend) Collect() (*Metrics, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), smiTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, b.path, "-q", "-x")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", b.path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseSMIXML(bytes.NewReader(out))
+}
+
+type smiLog struct {
+	DriverVersion string   `xml:"driver_version"`
+	CUDAVersion   string   `xml:"cuda_version"`
+	GPUs          []smiGPU `xml:"gpu"`
+}
+
+type smiGPU struct {
+	ProductName string `xml:"product_name"`
+	UUID        string `xml:"uuid"`
+	MinorNumber string `xml:"minor_number"`
+	MigMode     struct {
+		Current string `xml:"current_mig"`
+		Pending string `xml:"pending_mig"`
+	} `xml:"mig_mode"`
+	MigDevices []struct {
+		GPUInstanceID     string `xml:"gpu_instance_id"`
+		ComputeInstanceID string `xml:"compute_instance_id"`
+		FBMemoryUsage     struct {
+			Total string `xml:"total"`
+			Used  string `xml:"used"`
+		} `xml:"fb_memory_usage"`
+	} `xml:"mig_devices>mig_device"`
+	PCI struct {
+		BusID    string `xml:"pci_bus_id"`
+		LinkInfo struct {
+			Gen struct {
+				Max     string `xml:"max_link_gen"`
+				Current string `xml:"current_link_gen"`
+			} `xml:"pcie_gen"`
+			Width struct {
+				Max     string `xml:"max_link_width"`
+				Current string `xml:"current_link_width"`
+			} `xml:"link_widths"`
+		} `xml:"pci_gpu_link_info"`
+		ReplayCounter string `xml:"replay_counter"`
+		TxUtil        string `xml:"tx_util"`
+		RxUtil        string `xml:"rx_util"`
+	} `xml:"pci"`
+	FanSpeed      string `xml:"fan_speed"`
+	FBMemoryUsage struct {
+		Total string `xml:"total"`
+		Used  string `xml:"used"`
+	} `xml:"fb_memory_usage"`
+	Utilization struct {
+		GPU    string `xml:"gpu_util"`
+		Memory string `xml:"memory_util"`
+	} `xml:"utilization"`
+	ECCMode struct {
+		Current string `xml:"current_ecc"`
+	} `xml:"ecc_mode"`
+	ECCErrors struct {
+		Volatile  smiECCCounters `xml:"volatile"`
+		Aggregate smiECCCounters `xml:"aggregate"`
+	} `xml:"ecc_errors"`
+	Temperature struct {
+		GPU string `xml:"gpu_temp"`
+	} `xml:"temperature"`
+	// Drivers before R535 report power_readings, later ones
+	// gpu_power_readings.
+	PowerReadings    smiPowerReadings `xml:"power_readings"`
+	GPUPowerReadings smiPowerReadings `xml:"gpu_power_readings"`
+	Clocks           smiClocks        `xml:"clocks"`
+	MaxClocks        smiClocks        `xml:"max_clocks"`
+	// nvidia-smi -q doesn't report the NVLinks of the device, only its
+	// registration with the fabric manager since R535.
+	Fabric struct {
+		State    string `xml:"state"`
+		Status   string `xml:"status"`
+		CliqueID string `xml:"cliqueId"`
+	} `xml:"fabric"`
+	Processes []struct {
+		PID        string `xml:"pid"`
+		Type       string `xml:"type"`
+		Name       string `xml:"process_name"`
+		UsedMemory string `xml:"used_memory"`
+	} `xml:"processes>process_info"`
+}
+
+// smiECCCounters covers both the single_bit/double_bit layout of older
+// drivers and the sram/dram layout of newer ones. R550 splits the
+// uncorrectable SRAM errors into parity and SEC-DED errors, next to or in
+// place of their total.
+type smiECCCounters struct {
+	SingleBitTotal          string `xml:"single_bit>total"`
+	DoubleBitTotal          string `xml:"double_bit>total"`
+	SRAMCorrectable         string `xml:"sram_correctable"`
+	SRAMUncorrectable       string `xml:"sram_uncorrectable"`
+	SRAMUncorrectableParity string `xml:"sram_uncorrectable_parity"`
+	SRAMUncorrectableSECDED string `xml:"sram_uncorrectable_secded"`
+	DRAMCorrectable         string `xml:"dram_correctable"`
+	DRAMUncorrectable       string `xml:"dram_uncorrectable"`
+}
+
+type smiPowerReadings struct {
+	PowerDraw        string `xml:"power_draw"`
+	AveragePowerDraw string `xml:"average_power_draw"`
+	InstantPowerDraw string `xml:"instant_power_draw"`
+}
+
+type smiClocks struct {
+	Graphics string `xml:"graphics_clock"`
+	SM       string `xml:"sm_clock"`
+	Memory   string `xml:"mem_clock"`
+	Video    string `xml:"video_clock"`
+}
+
+// parseSMIXML converts the output of `nvidia-smi -q -x` into Metrics. Values
+// nvidia-smi reports as N/A or Not Supported are left at zero, for the main
+// readings and the clocks the reason is kept in the errors of the device.
+// The averaged readings are taken from the instantaneous ones where
+// nvidia-smi doesn't report an average.
+func parseSMIXML(r io.Reader) (*Metrics, error) {
+	var log smiLog
+	if err := xml.NewDecoder(r).Decode(&log); err != nil {
+		return nil, fmt.Errorf("failed to parse nvidia-smi output: %s", err)
+	}
+
+	metrics := &Metrics{
+		Version:     log.DriverVersion,
+		CUDAVersion: log.CUDAVersion,
+	}
+
+	for index, gpu := range log.GPUs {
+		power := gpu.PowerReadings
+		if power.PowerDraw == "" && power.InstantPowerDraw == "" {
+			power = gpu.GPUPowerReadings
+		}
+		powerUsage := smiValue(power.PowerDraw) * 1000
+		if power.InstantPowerDraw != "" {
+			powerUsage = smiValue(power.InstantPowerDraw) * 1000
+		}
+		powerUsageAverage := powerUsage
+		if power.AveragePowerDraw != "" {
+			powerUsageAverage = smiValue(power.AveragePowerDraw) * 1000
+		}
+
+		powerDraw := power.PowerDraw
+		if power.InstantPowerDraw != "" {
+			powerDraw = power.InstantPowerDraw
+		}
+		errs := deviceErrors{}
+		for field, value := range map[string]string{
+			"temperature_celsius":        gpu.Temperature.GPU,
+			"power_usage_milliwatts":     powerDraw,
+			"fan_speed_percent":          gpu.FanSpeed,
+			"utilization_gpu_percent":    gpu.Utilization.GPU,
+			"utilization_memory_percent": gpu.Utilization.Memory,
+			"clocks.graphics_mhz":        gpu.Clocks.Graphics,
+			"clocks.sm_mhz":              gpu.Clocks.SM,
+			"clocks.memory_mhz":          gpu.Clocks.Memory,
+			"clocks.video_mhz":           gpu.Clocks.Video,
+			"clocks.max_graphics_mhz":    gpu.MaxClocks.Graphics,
+			"clocks.max_sm_mhz":          gpu.MaxClocks.SM,
+			"clocks.max_memory_mhz":      gpu.MaxClocks.Memory,
+			"clocks.max_video_mhz":       gpu.MaxClocks.Video,
+		} {
+			if !smiSupported(value) {
+				errs[field] = smiError(value)
+			}
+		}
+		if _, failed := errs["power_usage_milliwatts"]; failed && power.AveragePowerDraw == "" {
+			errs["power_usage_average_milliwatts"] = errs["power_usage_milliwatts"]
+		}
+		if _, failed := errs["utilization_gpu_percent"]; failed {
+			errs["utilization_gpu_average_percent"] = errs["utilization_gpu_percent"]
+		}
+
+		device := &Device{
+			Index:                 strconv.Itoa(index),
+			MinorNumber:           gpu.MinorNumber,
+			Name:                  gpu.ProductName,
+			UUID:                  gpu.UUID,
+			Temperature:           smiValue(gpu.Temperature.GPU),
+			PowerUsage:            powerUsage,
+			PowerUsageAverage:     powerUsageAverage,
+			FanSpeed:              smiValue(gpu.FanSpeed),
+			MemoryTotal:           smiValue(gpu.FBMemoryUsage.Total),
+			MemoryUsed:            smiValue(gpu.FBMemoryUsage.Used),
+			UtilizationMemory:     smiValue(gpu.Utilization.Memory),
+			UtilizationGPU:        smiValue(gpu.Utilization.GPU),
+			UtilizationGPUAverage: smiValue(gpu.Utilization.GPU),
+			Errors:                errs.orNil(),
+			Clocks: &Clocks{
+				Graphics:    smiValue(gpu.Clocks.Graphics),
+				SM:          smiValue(gpu.Clocks.SM),
+				Memory:      smiValue(gpu.Clocks.Memory),
+				Video:       smiValue(gpu.Clocks.Video),
+				MaxGraphics: smiValue(gpu.MaxClocks.Graphics),
+				MaxSM:       smiValue(gpu.MaxClocks.SM),
+				MaxMemory:   smiValue(gpu.MaxClocks.Memory),
+				MaxVideo:    smiValue(gpu.MaxClocks.Video),
+			},
+			PCIe: &PCIe{
+				BusID:         gpu.PCI.BusID,
+				LinkGen:       smiValue(gpu.PCI.LinkInfo.Gen.Current),
+				LinkGenMax:    smiValue(gpu.PCI.LinkInfo.Gen.Max),
+				LinkWidth:     smiValue(gpu.PCI.LinkInfo.Width.Current),
+				LinkWidthMax:  smiValue(gpu.PCI.LinkInfo.Width.Max),
+				TxBytes:       smiValue(gpu.PCI.TxUtil),
+				RxBytes:       smiValue(gpu.PCI.RxUtil),
+				ReplayCounter: smiValue(gpu.PCI.ReplayCounter),
+			},
+		}
+
+		if smiSupported(gpu.MigMode.Current) {
+			device.MigMode = &MigMode{
+				Current: boolToFloat64(gpu.MigMode.Current == "Enabled"),
+				Pending: boolToFloat64(gpu.MigMode.Pending == "Enabled"),
+			}
+		}
+
+		// nvidia-smi -q doesn't report the profile, UUID and slices of MIG
+		// devices.
+		for _, m := range gpu.MigDevices {
+			device.MigInstances = append(device.MigInstances,
+				&MigInstance{
+					GPUInstance:     m.GPUInstanceID,
+					ComputeInstance: m.ComputeInstanceID,
+					MemoryTotal:     smiValue(m.FBMemoryUsage.Total),
+					MemoryUsed:      smiValue(m.FBMemoryUsage.Used),
+				})
+		}
+
+		if smiSupported(gpu.Fabric.State) {
+			device.Fabric = &Fabric{
+				State: strings.ToLower(strings.Replace(gpu.Fabric.State, " ", "_", -1)),
+			}
+			if smiSupported(gpu.Fabric.Status) {
+				device.Fabric.Status = gpu.Fabric.Status
+			}
+			if smiSupported(gpu.Fabric.CliqueID) {
+				device.Fabric.CliqueID = gpu.Fabric.CliqueID
+			}
+		}
+
+		if smiSupported(gpu.ECCMode.Current) {
+			device.ECC = &ECC{
+				Enabled:              boolToFloat64(gpu.ECCMode.Current == "Enabled"),
+				VolatileCorrected:    gpu.ECCErrors.Volatile.corrected(),
+				VolatileUncorrected:  gpu.ECCErrors.Volatile.uncorrected(),
+				AggregateCorrected:   gpu.ECCErrors.Aggregate.corrected(),
+				AggregateUncorrected: gpu.ECCErrors.Aggregate.uncorrected(),
+			}
+		}
+
+		for _, p := range gpu.Processes {
+			device.Processes = append(device.Processes,
+				&Process{
+					PID:        p.PID,
+					Name:       p.Name,
+					Type:       p.Type,
+					MemoryUsed: smiValue(p.UsedMemory),
+				})
+		}
+
+		metrics.Devices = append(metrics.Devices, device)
+	}
+
+	return metrics, nil
+}
+
+func (c smiECCCounters) corrected() float64 {
+	return smiValue(c.SingleBitTotal) + smiValue(c.SRAMCorrectable) + smiValue(c.DRAMCorrectable)
+}
+
+func (c smiECCCounters) uncorrected() float64 {
+	sram := smiValue(c.SRAMUncorrectable)
+	if !smiSupported(c.SRAMUncorrectable) {
+		sram = smiValue(c.SRAMUncorrectableParity) + smiValue(c.SRAMUncorrectableSECDED)
+	}
+	return smiValue(c.DoubleBitTotal) + sram + smiValue(c.DRAMUncorrectable)
+}
+
+// smiUnits maps the unit suffixes used by nvidia-smi to the factor that
+// converts the value into the unit used by Device. Memory is converted to
+// bytes and throughput to bytes per second.
+var smiUnits = map[string]float64{
+	"%":    1,
+	"C":    1,
+	"MHz":  1,
+	"W":    1,
+	"x":    1,
+	"B":    1,
+	"KiB":  1 << 10,
+	"MiB":  1 << 20,
+	"GiB":  1 << 30,
+	"KB/s": 1 << 10,
+	"MB/s": 1 << 20,
+}
+
+// smiValue parses a value such as "1024 MiB", "16x" or "42 %". Unsupported
+// values and unknown formats return 0. Power is returned in watts, callers
+// scale it as needed.
+func smiValue(s string) float64 {
+	s = strings.TrimSpace(s)
+	if !smiSupported(s) {
+		return 0
+	}
+
+	number, unit := s, ""
+	if i := strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.' || r == '-')
+	}); i >= 0 {
+		number, unit = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i:])
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0
+	}
+	if unit == "" {
+		return value
+	}
+	if factor, ok := smiUnits[unit]; ok {
+		return value * factor
+	}
+	return 0
+}
+
+// smiError returns the reason nvidia-smi gave for not returning a value.
+func smiError(s string) string {
+	if s = strings.Trim(strings.TrimSpace(s), "[]"); s == "" {
+		return "not reported"
+	}
+	return strings.ToLower(s)
+}
+
+// smiSupported reports whether nvidia-smi returned an actual value.
+func smiSupported(s string) bool {
+	switch strings.Trim(strings.TrimSpace(s), "[]") {
+	case "", "N/A", "Not Supported", "Unknown Error", "Requested functionality has been deprecated":
+		return false
+	}
+	return true
+}
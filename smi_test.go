@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParseSMIXML parses the output of `nvidia-smi -q -x` of several driver
+// generations, each next to the Metrics it parses into.
+func TestParseSMIXML(t *testing.T) {
+	files, err := filepath.Glob("testdata/nvidia-smi/*.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no nvidia-smi samples in testdata")
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics, err := parseSMIXML(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+		golden(t, strings.TrimSuffix(file, ".xml")+".json", metrics)
+	}
+}
+
+func TestParseSMIXMLInvalid(t *testing.T) {
+	if _, err := parseSMIXML(strings.NewReader("NVIDIA-SMI has failed")); err == nil {
+		t.Error("expected an error for output that isn't XML")
+	}
+}
+
+func TestSMIValue(t *testing.T) {
+	for s, want := range map[string]float64{
+		"1024 MiB":        1 << 30,
+		"16x":             16,
+		"42 %":            42,
+		"26.35 W":         26.35,
+		"2 MB/s":          2 << 20,
+		"1200 KB/s":       1200 << 10,
+		"3":               3,
+		"N/A":             0,
+		"[Not Supported]": 0,
+		"12 parsecs":      0,
+	} {
+		if got := smiValue(s); got != want {
+			t.Errorf("smiValue(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestSMIXMLClocksUnsupported(t *testing.T) {
+	f, err := os.Open("testdata/nvidia-smi/r550-h100-mig.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	metrics, err := parseSMIXML(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The video clock of the second device is N/A and not exported as 0 Hz.
+	clocks := map[string]bool{}
+	for _, m := range gather(t, NewExporter(&staticBackend{metrics: metrics}))["nvidia_clock_hertz"].GetMetric() {
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		clocks[labels["minor"]+"/"+labels["clock"]] = true
+	}
+	for _, clock := range []string{"0/graphics", "0/video", "1/graphics", "1/sm", "1/memory"} {
+		if !clocks[clock] {
+			t.Errorf("clock %s not exported", clock)
+		}
+	}
+	if clocks["1/video"] {
+		t.Error("unsupported video clock of device 1 exported")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// smiCSVField is a column of the `nvidia-smi --query-gpu` output and how it
+// is stored in Device. With nounits, values come without their unit suffix,
+// so every field carries the unit nvidia-smi would have used. Readings with a
+// field name record N/A and [Not Supported] values in the errors of the
+// device.
+type smiCSVField struct {
+	name  string
+	field string
+	set   func(d *Device, value string)
+}
+
+var smiCSVFields = []smiCSVField{
+	{"index", "", func(d *Device, v string) {
+		d.Index = v
+		// nvidia-smi can't be queried for the minor number, the index is
+		// used in its place.
+		d.MinorNumber = v
+	}},
+	{"name", "", func(d *Device, v string) { d.Name = v }},
+	{"uuid", "", func(d *Device, v string) { d.UUID = v }},
+	{"pci.bus_id", "", func(d *Device, v string) { d.PCIe.BusID = v }},
+	{"temperature.gpu", "temperature_celsius", func(d *Device, v string) { d.Temperature = smiCSVValue(v, "C") }},
+	{"power.draw", "power_usage_milliwatts", func(d *Device, v string) { d.PowerUsage = smiCSVValue(v, "W") * 1000 }},
+	{"fan.speed", "fan_speed_percent", func(d *Device, v string) { d.FanSpeed = smiCSVValue(v, "%") }},
+	{"memory.total", "", func(d *Device, v string) { d.MemoryTotal = smiCSVValue(v, "MiB") }},
+	{"memory.used", "", func(d *Device, v string) { d.MemoryUsed = smiCSVValue(v, "MiB") }},
+	{"utilization.gpu", "utilization_gpu_percent", func(d *Device, v string) { d.UtilizationGPU = smiCSVValue(v, "%") }},
+	{"utilization.memory", "utilization_memory_percent", func(d *Device, v string) { d.UtilizationMemory = smiCSVValue(v, "%") }},
+	{"clocks.gr", "", func(d *Device, v string) { d.Clocks.Graphics = smiCSVValue(v, "MHz") }},
+	{"clocks.sm", "", func(d *Device, v string) { d.Clocks.SM = smiCSVValue(v, "MHz") }},
+	{"clocks.mem", "", func(d *Device, v string) { d.Clocks.Memory = smiCSVValue(v, "MHz") }},
+	{"clocks.video", "", func(d *Device, v string) { d.Clocks.Video = smiCSVValue(v, "MHz") }},
+	{"clocks.max.gr", "", func(d *Device, v string) { d.Clocks.MaxGraphics = smiCSVValue(v, "MHz") }},
+	{"clocks.max.sm", "", func(d *Device, v string) { d.Clocks.MaxSM = smiCSVValue(v, "MHz") }},
+	{"clocks.max.mem", "", func(d *Device, v string) { d.Clocks.MaxMemory = smiCSVValue(v, "MHz") }},
+	{"pcie.link.gen.current", "", func(d *Device, v string) { d.PCIe.LinkGen = smiCSVValue(v, "") }},
+	{"pcie.link.gen.max", "", func(d *Device, v string) { d.PCIe.LinkGenMax = smiCSVValue(v, "") }},
+	{"pcie.link.width.current", "", func(d *Device, v string) { d.PCIe.LinkWidth = smiCSVValue(v, "") }},
+	{"pcie.link.width.max", "", func(d *Device, v string) { d.PCIe.LinkWidthMax = smiCSVValue(v, "") }},
+}
+
+// smiCSVBackend keeps `nvidia-smi --query-gpu ... -lms <interval>` running
+// as a child process and serves the most recent reading of every device. The
+// child is restarted with exponential backoff when it exits. Devices that
+// stop being reported, e.g. after a reset, are dropped once their reading is
+// stale.
+type smiCSVBackend struct {
+	path     string
+	interval time.Duration
+	restarts prometheus.Counter
+
+	mu      sync.Mutex
+	version string
+	devices map[string]*smiCSVReading
+	updated time.Time
+}
+
+// smiCSVReading is the most recent reading of a device.
+type smiCSVReading struct {
+	device  *Device
+	updated time.Time
+}
+
+func newSMICSVBackend(path string, interval time.Duration) *smiCSVBackend {
+	b := &smiCSVBackend{
+		path:     path,
+		interval: interval,
+		restarts: newCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "smi_restarts_total",
+				Help:      "Restarts of the nvidia-smi child process",
+			},
+		),
+		devices: map[string]*smiCSVReading{},
+	}
+	go supervise("nvidia-smi", b.restarts, b.stream)
+	return b
+}
+
+func (b *smiCSVBackend) Collect() (*Metrics, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.updated.IsZero() {
+		return nil, errors.New("no readings from nvidia-smi yet")
+	}
+	staleAfter := b.staleAfter()
+	if age := time.Since(b.updated); age > staleAfter {
+		return nil, fmt.Errorf("last reading from nvidia-smi is %s old", age)
+	}
+
+	metrics := &Metrics{
+		Version: b.version,
+	}
+	for index, r := range b.devices {
+		if time.Since(r.updated) > staleAfter {
+			delete(b.devices, index)
+			continue
+		}
+		device := *r.device
+		metrics.Devices = append(metrics.Devices, &device)
+	}
+	sort.Slice(metrics.Devices, func(i, j int) bool {
+		x, _ := strconv.Atoi(metrics.Devices[i].Index)
+		y, _ := strconv.Atoi(metrics.Devices[j].Index)
+		return x < y
+	})
+
+	return metrics, nil
+}
+
+// staleAfter is the age after which a reading is no longer served.
+func (b *smiCSVBackend) staleAfter() time.Duration {
+	staleAfter := 3 * b.interval
+	if staleAfter < smiTimeout {
+		staleAfter = smiTimeout
+	}
+	return staleAfter
+}
+
+func (b *smiCSVBackend) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{b.restarts}
+}
+
+// stream runs nvidia-smi until it exits and stores every reading.
+func (b *smiCSVBackend) stream() error {
+	names := []string{"driver_version"}
+	for _, f := range smiCSVFields {
+		names = append(names, f.name)
+	}
+
+	cmd := exec.Command(b.path,
+		"--query-gpu="+strings.Join(names, ","),
+		"--format=csv,noheader,nounits",
+		"-lms", strconv.Itoa(int(b.interval/time.Millisecond)),
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = b.read(stdout)
+	if err != nil {
+		cmd.Process.Kill()
+	}
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// read parses the CSV output of nvidia-smi until r is closed.
+func (b *smiCSVBackend) read(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(smiCSVFields) + 1
+	reader.TrimLeadingSpace = true
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return errors.New("unexpected end of output")
+		}
+		if err != nil {
+			return err
+		}
+
+		version, device := parseSMICSVRecord(record)
+
+		now := time.Now()
+		b.mu.Lock()
+		b.version = version
+		b.devices[device.Index] = &smiCSVReading{device, now}
+		b.updated = now
+		b.mu.Unlock()
+	}
+}
+
+// parseSMICSVRecord converts a line of `nvidia-smi --query-gpu` output with
+// the driver version followed by the columns of smiCSVFields into a Device.
+func parseSMICSVRecord(record []string) (string, *Device) {
+	device := &Device{
+		Clocks: &Clocks{},
+		PCIe:   &PCIe{},
+	}
+	errs := deviceErrors{}
+	for i, f := range smiCSVFields {
+		value := strings.TrimSpace(record[i+1])
+		if f.field != "" && !smiSupported(value) {
+			errs[f.field] = smiError(value)
+		}
+		f.set(device, value)
+	}
+	// nvidia-smi doesn't average, see the nvidia-smi XML backend.
+	device.PowerUsageAverage = device.PowerUsage
+	device.UtilizationGPUAverage = device.UtilizationGPU
+	if err, failed := errs["power_usage_milliwatts"]; failed {
+		errs["power_usage_average_milliwatts"] = err
+	}
+	if err, failed := errs["utilization_gpu_percent"]; failed {
+		errs["utilization_gpu_average_percent"] = err
+	}
+	device.Errors = errs.orNil()
+	return strings.TrimSpace(record[0]), device
+}
+
+// smiCSVValue parses a value printed with nounits. Values that still carry a
+// unit suffix are accepted as well.
+func smiCSVValue(s, unit string) float64 {
+	if !smiSupported(s) {
+		return 0
+	}
+	if unit == "" || strings.HasSuffix(s, unit) {
+		return smiValue(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return smiValue(s)
+	}
+	return smiValue(s + " " + unit)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	smiCSVTesla   = "390.87, 0, Tesla P100-PCIE-16GB, GPU-6a0c8e0f, 00000000:04:00.0, 31, 26.35, [Not Supported], 16280, 10, 0, 0, 1189, 1189, 715, 1063, 1328, 1328, 715, 3, 3, 16, 16"
+	smiCSVGeForce = "390.87, 1, GeForce GTX 1080, GPU-0e1d2c3b, 00000000:81:00.0, 45, [N/A], 30, 8119, 512, 4, 10, 139, 139, 405, 544, 1911, 1911, 5005, 1, 3, 16, 16"
+)
+
+func TestParseSMICSVRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		record string
+		device *Device
+	}{
+		{
+			name:   "fan not supported",
+			record: smiCSVTesla,
+			device: &Device{
+				Index: "0", MinorNumber: "0", Name: "Tesla P100-PCIE-16GB", UUID: "GPU-6a0c8e0f",
+				Temperature: 31, PowerUsage: 26350, PowerUsageAverage: 26350,
+				MemoryTotal: 16280 << 20, MemoryUsed: 10 << 20,
+				Clocks: &Clocks{
+					Graphics: 1189, SM: 1189, Memory: 715, Video: 1063,
+					MaxGraphics: 1328, MaxSM: 1328, MaxMemory: 715,
+				},
+				PCIe: &PCIe{
+					BusID: "00000000:04:00.0", LinkGen: 3, LinkGenMax: 3, LinkWidth: 16, LinkWidthMax: 16,
+				},
+				Errors: map[string]string{"fan_speed_percent": "not supported"},
+			},
+		},
+		{
+			name:   "power N/A",
+			record: smiCSVGeForce,
+			device: &Device{
+				Index: "1", MinorNumber: "1", Name: "GeForce GTX 1080", UUID: "GPU-0e1d2c3b",
+				Temperature: 45, FanSpeed: 30,
+				MemoryTotal: 8119 << 20, MemoryUsed: 512 << 20,
+				UtilizationGPU: 4, UtilizationGPUAverage: 4, UtilizationMemory: 10,
+				Clocks: &Clocks{
+					Graphics: 139, SM: 139, Memory: 405, Video: 544,
+					MaxGraphics: 1911, MaxSM: 1911, MaxMemory: 5005,
+				},
+				PCIe: &PCIe{
+					BusID: "00000000:81:00.0", LinkGen: 1, LinkGenMax: 3, LinkWidth: 16, LinkWidthMax: 16,
+				},
+				Errors: map[string]string{
+					"power_usage_milliwatts":         "n/a",
+					"power_usage_average_milliwatts": "n/a",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		version, device := parseSMICSVRecord(strings.Split(test.record, ","))
+		if version != "390.87" {
+			t.Errorf("%s: got version %q, want 390.87", test.name, version)
+		}
+		if !reflect.DeepEqual(device, test.device) {
+			t.Errorf("%s: got %+v, want %+v", test.name, device, test.device)
+		}
+	}
+}
+
+// fakeSMI writes a script that records its arguments and prints output in
+// place of nvidia-smi.
+func fakeSMI(t *testing.T, output string) (path, args string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "nvidia-smi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "nvidia-smi")
+	args = filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + args + "\ncat <<'EOF'\n" + output + "EOF\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path, args, func() { os.RemoveAll(dir) }
+}
+
+func TestSMICSVBackendStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		err     string
+		devices []string
+	}{
+		{
+			name:    "two devices",
+			output:  smiCSVTesla + "\n" + smiCSVGeForce + "\n",
+			err:     "unexpected end of output",
+			devices: []string{"GPU-6a0c8e0f", "GPU-0e1d2c3b"},
+		},
+		{
+			name:    "repeated readings",
+			output:  smiCSVTesla + "\n" + smiCSVTesla + "\n",
+			err:     "unexpected end of output",
+			devices: []string{"GPU-6a0c8e0f"},
+		},
+		{
+			name:   "missing columns",
+			output: "390.87, 0, Tesla P100-PCIE-16GB\n",
+			err:    "wrong number of fields",
+		},
+		{
+			name:   "no output",
+			output: "",
+			err:    "unexpected end of output",
+		},
+	}
+
+	for _, test := range tests {
+		path, args, cleanup := fakeSMI(t, test.output)
+		b := &smiCSVBackend{path: path, interval: time.Second, devices: map[string]*smiCSVReading{}}
+		err := b.stream()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+
+		called, _ := ioutil.ReadFile(args)
+		if !strings.Contains(string(called), "--query-gpu=driver_version,index,name,") ||
+			!strings.Contains(string(called), "--format=csv,noheader,nounits -lms 1000") {
+			t.Errorf("%s: nvidia-smi called with %q", test.name, called)
+		}
+		cleanup()
+
+		metrics, err := b.Collect()
+		if test.devices == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error without readings", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var uuids []string
+		for _, d := range metrics.Devices {
+			uuids = append(uuids, d.UUID)
+		}
+		if !reflect.DeepEqual(uuids, test.devices) {
+			t.Errorf("%s: got devices %v, want %v", test.name, uuids, test.devices)
+		}
+	}
+}
+
+func TestSMICSVBackendStale(t *testing.T) {
+	now := time.Now()
+	_, fresh := parseSMICSVRecord(strings.Split(smiCSVTesla, ","))
+	_, gone := parseSMICSVRecord(strings.Split(smiCSVGeForce, ","))
+	b := &smiCSVBackend{
+		interval: time.Second,
+		version:  "390.87",
+		updated:  now,
+		devices: map[string]*smiCSVReading{
+			"0": {fresh, now},
+			"1": {gone, now.Add(-time.Minute)},
+		},
+	}
+
+	metrics, err := b.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics.Devices) != 1 || metrics.Devices[0].UUID != fresh.UUID {
+		t.Errorf("got devices %+v, want only %s", metrics.Devices, fresh.UUID)
+	}
+	if _, ok := b.devices["1"]; ok {
+		t.Error("stale device wasn't dropped")
+	}
+
+	b.updated = now.Add(-time.Minute)
+	if _, err := b.Collect(); err == nil {
+		t.Error("expected an error for a stale nvidia-smi")
+	}
+}
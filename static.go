@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// staticDevice is the part of the NVML device API read by the static
+// collectors. nvmlDevice implements it.
+type staticDevice interface {
+	topologyDevice
+	inventoryDevice
+	MinorNumber() (uint, error)
+}
+
+// staticCollector exports metrics that don't change while the devices stay
+// the same. They are read with NVML at startup and again only when the set of
+// devices changes.
+type staticCollector struct {
+	name  string
+	descs []*prometheus.Desc
+	read  func(devices []staticDevice, minors []string) ([]prometheus.Metric, error)
+	// open returns the devices and a function that releases them.
+	open func() ([]staticDevice, func(), error)
+
+	mu      sync.Mutex
+	done    bool
+	uuids   string
+	metrics []prometheus.Metric
+}
+
+func newStaticCollector(name string, descs []*prometheus.Desc, read func([]staticDevice, []string) ([]prometheus.Metric, error)) *staticCollector {
+	c := &staticCollector{
+		name:  name,
+		descs: descs,
+		read:  read,
+		open:  openNVMLDevices,
+	}
+	if err := c.refresh(); err != nil {
+		log.Printf("Failed to read the %s: %s\n", c.name, err)
+	}
+	return c
+}
+
+func (c *staticCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		descs <- desc
+	}
+}
+
+func (c *staticCollector) Collect(metrics chan<- prometheus.Metric) {
+	if err := c.refresh(); err != nil {
+		log.Printf("Failed to read the %s: %s\n", c.name, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.metrics {
+		metrics <- m
+	}
+}
+
+// refresh reads the metrics again if the devices changed since the last
+// read.
+func (c *staticCollector) refresh() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	devices, release, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	minors := make([]string, len(devices))
+	uuids := make([]string, len(devices))
+	for index, device := range devices {
+		if uuids[index], err = device.UUID(); err != nil {
+			return err
+		}
+		minor, err := device.MinorNumber()
+		if err != nil {
+			return err
+		}
+		minors[index] = strconv.Itoa(int(minor))
+	}
+	if c.done && strings.Join(uuids, ",") == c.uuids {
+		return nil
+	}
+
+	metrics, err := c.read(devices, minors)
+	if err != nil {
+		return err
+	}
+
+	if c.done {
+		log.Printf("Devices changed, read the %s of %d devices\n", c.name, len(devices))
+	}
+	c.done = true
+	c.uuids = strings.Join(uuids, ",")
+	c.metrics = metrics
+	return nil
+}
+
+// openNVMLDevices initializes NVML and returns all devices. NVML is shut down
+// by the returned function.
+func openNVMLDevices() ([]staticDevice, func(), error) {
+	if err := nvmlInit(); err != nil {
+		return nil, nil, err
+	}
+
+	count, err := nvmlDeviceCount()
+	if err != nil {
+		nvmlShutdown()
+		return nil, nil, err
+	}
+	devices := make([]staticDevice, count)
+	for index := range devices {
+		device, err := nvmlDeviceByIndex(uint(index))
+		if err != nil {
+			nvmlShutdown()
+			return nil, nil, err
+		}
+		devices[index] = device
+	}
+	return devices, func() { nvmlShutdown() }, nil
+}
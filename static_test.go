@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeStaticDevice only implements the methods read by refresh.
+type fakeStaticDevice struct {
+	staticDevice
+	uuid  string
+	minor uint
+}
+
+func (d *fakeStaticDevice) UUID() (string, error)      { return d.uuid, nil }
+func (d *fakeStaticDevice) MinorNumber() (uint, error) { return d.minor, nil }
+
+func TestStaticCollectorRefresh(t *testing.T) {
+	desc := prometheus.NewDesc("static_info", "Static info", []string{"minor"}, nil)
+	var devices []staticDevice
+	var openErr error
+	released, reads := 0, 0
+	c := &staticCollector{
+		name:  "static info",
+		descs: []*prometheus.Desc{desc},
+		read: func(devices []staticDevice, minors []string) ([]prometheus.Metric, error) {
+			reads++
+			var metrics []prometheus.Metric
+			for _, minor := range minors {
+				metrics = append(metrics, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, minor))
+			}
+			return metrics, nil
+		},
+		open: func() ([]staticDevice, func(), error) {
+			if openErr != nil {
+				return nil, nil, openErr
+			}
+			return devices, func() { released++ }, nil
+		},
+	}
+
+	a := &fakeStaticDevice{uuid: "GPU-a", minor: 0}
+	b := &fakeStaticDevice{uuid: "GPU-b", minor: 1}
+	for _, step := range []struct {
+		name    string
+		devices []staticDevice
+		openErr error
+		reads   int
+		series  int
+	}{
+		{"first", []staticDevice{a}, nil, 1, 1},
+		{"same devices", []staticDevice{a}, nil, 1, 1},
+		{"device added", []staticDevice{a, b}, nil, 2, 2},
+		{"devices reordered", []staticDevice{b, a}, nil, 3, 2},
+		{"same devices again", []staticDevice{b, a}, nil, 3, 2},
+		// The metrics read last are kept when NVML fails.
+		{"NVML failing", nil, errors.New("nvml: Unknown Error"), 3, 2},
+	} {
+		devices, openErr = step.devices, step.openErr
+		if err := c.refresh(); err != openErr {
+			t.Errorf("%s: got error %v, want %v", step.name, err, openErr)
+		}
+		if reads != step.reads {
+			t.Errorf("%s: read %d times, want %d", step.name, reads, step.reads)
+		}
+		if series := len(gather(t, c)["static_info"].GetMetric()); series != step.series {
+			t.Errorf("%s: got %d series, want %d", step.name, series, step.series)
+		}
+	}
+	// Every open is released, including those of the scrapes.
+	if released != 10 {
+		t.Errorf("devices released %d times, want 10", released)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var statsdTagEscape = strings.NewReplacer(",", "_", "|", "_", "#", "_", " ", "_", "\n", "_")
+
+// StatsDConfig configures emitting gauges to a DogStatsD agent.
+type StatsDConfig struct {
+	Address       string
+	Prefix        string
+	Tags          string
+	Interval      time.Duration
+	MaxPacketSize int
+}
+
+// statsdEmitter periodically sends the readings of the backend as DogStatsD
+// gauges, batched into datagrams of at most MaxPacketSize bytes.
+type statsdEmitter struct {
+	config  StatsDConfig
+	backend Backend
+	network string
+	address string
+	tags    []string
+	conn    net.Conn
+	packets *counterVec
+}
+
+func newStatsDEmitter(config StatsDConfig, backend Backend) (*statsdEmitter, error) {
+	if config.MaxPacketSize <= 0 {
+		return nil, fmt.Errorf("invalid StatsD packet size %d", config.MaxPacketSize)
+	}
+	e := &statsdEmitter{
+		config:  config,
+		backend: backend,
+		network: "udp",
+		address: config.Address,
+		packets: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "statsd_packets_total",
+				Help:      "StatsD packets by result, sent or dropped",
+			},
+			[]string{"result"},
+		),
+	}
+	switch {
+	case strings.HasPrefix(config.Address, "unix://"):
+		e.network, e.address = "unixgram", strings.TrimPrefix(config.Address, "unix://")
+	case strings.HasPrefix(config.Address, "unixgram://"):
+		e.network, e.address = "unixgram", strings.TrimPrefix(config.Address, "unixgram://")
+	case strings.HasPrefix(config.Address, "udp://"):
+		e.address = strings.TrimPrefix(config.Address, "udp://")
+	}
+	for _, tag := range strings.Split(config.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			e.tags = append(e.tags, tag)
+		}
+	}
+	return e, nil
+}
+
+func (e *statsdEmitter) Describe(descs chan<- *prometheus.Desc) {
+	e.packets.Describe(descs)
+}
+
+func (e *statsdEmitter) Collect(metrics chan<- prometheus.Metric) {
+	e.packets.Collect(metrics)
+}
+
+// run emits every interval until the process exits.
+func (e *statsdEmitter) run() {
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := e.emit(); err != nil {
+			log.Printf("Failed to send to StatsD %s: %s\n", e.config.Address, err)
+		}
+		<-ticker.C
+	}
+}
+
+func (e *statsdEmitter) emit() error {
+	data, err := e.backend.Collect()
+	if err != nil {
+		return err
+	}
+
+	if e.conn == nil {
+		if e.conn, err = net.Dial(e.network, e.address); err != nil {
+			e.conn = nil
+			return err
+		}
+	}
+
+	var writeErr error
+	for _, packet := range statsdPackets(statsdLines(data, e.config.Prefix, e.tags), e.config.MaxPacketSize) {
+		if _, err := e.conn.Write(packet); err != nil {
+			if writeErr == nil {
+				writeErr = err
+			}
+			e.packets.WithLabelValues("dropped").Inc()
+			continue
+		}
+		e.packets.WithLabelValues("sent").Inc()
+	}
+	if writeErr != nil {
+		// The agent may have restarted and recreated its socket, dial it
+		// again next time.
+		e.conn.Close()
+		e.conn = nil
+	}
+	return writeErr
+}
+
+// statsdLines returns a gauge line for every finite reading of every
+// device, tagged with the identity of the device.
+func statsdLines(data *Metrics, prefix string, tags []string) []string {
+	var lines []string
+	for _, d := range data.Devices {
+		deviceTags := append([]string{
+			"uuid:" + statsdTagEscape.Replace(d.UUID),
+			"minor:" + d.MinorNumber,
+			"name:" + statsdTagEscape.Replace(d.Name),
+		}, tags...)
+
+		readings := d.readings()
+		names := make([]string, 0, len(readings))
+		for name := range readings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if line := statsdGauge(prefix+name, readings[name], deviceTags); line != "" {
+				lines = append(lines, line)
+			}
+		}
+
+		for _, p := range d.Processes {
+			processTags := append([]string{"pid:" + p.PID, "process_name:" + statsdTagEscape.Replace(p.Name)}, deviceTags...)
+			lines = append(lines, statsdGauge(prefix+"process_memory_used_bytes", p.MemoryUsed, processTags))
+		}
+	}
+	return lines
+}
+
+func statsdGauge(name string, value float64, tags []string) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ""
+	}
+	line := fmt.Sprintf("%s:%s|g", name, strconv.FormatFloat(value, 'f', -1, 64))
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// statsdPackets batches lines into newline separated packets of at most
+// size bytes. A line longer than size is sent on its own.
+func statsdPackets(lines []string, size int) [][]byte {
+	var packets [][]byte
+	var packet []byte
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if len(packet) > 0 && len(packet)+1+len(line) > size {
+			packets = append(packets, packet)
+			packet = nil
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDLines(t *testing.T) {
+	lines := statsdLines(testSnapshot(), "nvidia.", []string{"env:prod"})
+	goldenBytes(t, "testdata/statsd/lines.txt", []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+func TestStatsDGauge(t *testing.T) {
+	if got, want := statsdGauge("nvidia.temperature", 41.5, nil), "nvidia.temperature:41.5|g"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	tags := []string{"name:" + statsdTagEscape.Replace("Tesla T4, rev|1#2")}
+	if got, want := statsdGauge("nvidia.power", 1e6, tags), "nvidia.power:1000000|g|#name:Tesla_T4__rev_1_2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStatsDPackets(t *testing.T) {
+	lines := []string{"a:1|g", "", "bb:2|g", "ccc:3|g", "a_line_longer_than_a_packet:4|g", "d:5|g"}
+	var got []string
+	for _, packet := range statsdPackets(lines, 16) {
+		if len(packet) > 16 && strings.Contains(string(packet), "\n") {
+			t.Errorf("packet %q is larger than 16 bytes", packet)
+		}
+		got = append(got, string(packet))
+	}
+	want := []string{
+		"a:1|g\nbb:2|g",
+		"ccc:3|g",
+		"a_line_longer_than_a_packet:4|g",
+		"d:5|g",
+	}
+	if !equalStrings(got, want) {
+		t.Errorf("got packets %q, want %q", got, want)
+	}
+
+	if packets := statsdPackets([]string{"", ""}, 16); len(packets) != 0 {
+		t.Errorf("got packets %q without lines", packets)
+	}
+}
+
+func TestStatsDEmitter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	e, err := newStatsDEmitter(StatsDConfig{
+		Address:       "udp://" + conn.LocalAddr().String(),
+		Prefix:        "nvidia.",
+		Tags:          "env:prod, ,team:ml",
+		MaxPacketSize: 512,
+	}, &staticBackend{metrics: testSnapshot()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.emit(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := statsdPackets(statsdLines(testSnapshot(), "nvidia.", []string{"env:prod", "team:ml"}), 512)
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := range want {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("packet %d: %s", i, err)
+		}
+		if n > 512 {
+			t.Errorf("packet %d has %d bytes, want at most 512", i, n)
+		}
+		if string(buf[:n]) != string(want[i]) {
+			t.Errorf("packet %d is\n%s\nwant\n%s", i, buf[:n], want[i])
+		}
+	}
+
+	sent := gather(t, e)["nvidia_statsd_packets_total"]
+	if sent == nil || sent.Metric[0].Counter.GetValue() != float64(len(want)) {
+		t.Errorf("got %v, want %d sent packets", sent, len(want))
+	}
+}
+
+func TestNewStatsDEmitter(t *testing.T) {
+	for address, want := range map[string][2]string{
+		"localhost:8125":                         {"udp", "localhost:8125"},
+		"udp://localhost:8125":                   {"udp", "localhost:8125"},
+		"unix:///var/run/datadog/dsd.socket":     {"unixgram", "/var/run/datadog/dsd.socket"},
+		"unixgram:///var/run/datadog/dsd.socket": {"unixgram", "/var/run/datadog/dsd.socket"},
+	} {
+		e, err := newStatsDEmitter(StatsDConfig{Address: address, MaxPacketSize: 1432}, &staticBackend{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.network != want[0] || e.address != want[1] {
+			t.Errorf("%s: got %s %s, want %s %s", address, e.network, e.address, want[0], want[1])
+		}
+	}
+	if _, err := newStatsDEmitter(StatsDConfig{Address: "localhost:8125"}, &staticBackend{}); err == nil {
+		t.Error("expected an error for a packet size of 0")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// streamIdentity are the device fields sent regardless of the field filter.
+var streamIdentity = []string{"index", "minor_number", "name", "uuid"}
+
+// streamFrame is a collection broadcast to the subscribers, either a
+// snapshot or the error of the collection.
+type streamFrame struct {
+	snapshot *APIDevices
+	err      error
+}
+
+// streamClient is a subscriber. frames holds at most the latest frame, a
+// client that can't keep up misses the frames in between.
+type streamClient struct {
+	frames  chan streamFrame
+	fields  map[string]bool
+	devices map[string]bool
+}
+
+// streamer collects from the backend every interval while there are
+// subscribers, and broadcasts every snapshot to all of them.
+type streamer struct {
+	backend  Backend
+	interval time.Duration
+
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+	running bool
+
+	subscribers prometheus.Gauge
+	frames      *counterVec
+}
+
+func newStreamer(backend Backend, interval time.Duration) *streamer {
+	return &streamer{
+		backend:  backend,
+		interval: interval,
+		clients:  make(map[*streamClient]struct{}),
+		subscribers: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "stream_subscribers",
+				Help:      "Number of clients subscribed to the stream",
+			},
+		),
+		frames: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "stream_frames_total",
+				Help:      "Stream frames by result, sent or dropped for slow clients",
+			},
+			[]string{"result"},
+		),
+	}
+}
+
+func (s *streamer) Describe(descs chan<- *prometheus.Desc) {
+	s.subscribers.Describe(descs)
+	s.frames.Describe(descs)
+}
+
+func (s *streamer) Collect(metrics chan<- prometheus.Metric) {
+	s.subscribers.Collect(metrics)
+	s.frames.Collect(metrics)
+}
+
+func (s *streamer) subscribe(c *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c] = struct{}{}
+	s.subscribers.Set(float64(len(s.clients)))
+	if !s.running {
+		s.running = true
+		go s.poll()
+	}
+}
+
+func (s *streamer) unsubscribe(c *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+	s.subscribers.Set(float64(len(s.clients)))
+}
+
+// poll collects every interval until the last subscriber is gone.
+func (s *streamer) poll() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		data, err := s.backend.Collect()
+		frame := streamFrame{err: err}
+		if err == nil {
+			frame.snapshot = &APIDevices{time.Now().UTC(), data.Devices}
+		}
+
+		s.mu.Lock()
+		if len(s.clients) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		for c := range s.clients {
+			s.send(c, frame)
+		}
+		s.mu.Unlock()
+
+		<-ticker.C
+	}
+}
+
+// send replaces a frame the client hasn't picked up yet, so that a slow
+// client never blocks the collection. poll is the only sender.
+func (s *streamer) send(c *streamClient, frame streamFrame) {
+	select {
+	case c.frames <- frame:
+		s.frames.WithLabelValues("sent").Inc()
+		return
+	default:
+	}
+	select {
+	case <-c.frames:
+		s.frames.WithLabelValues("dropped").Inc()
+	default:
+	}
+	c.frames <- frame
+	s.frames.WithLabelValues("sent").Inc()
+}
+
+// ServeHTTP streams the snapshots as Server-Sent Events, or as WebSocket
+// text messages if the client asks for an upgrade.
+//
+// The fields parameter limits the devices to the listed fields and the
+// uuid parameter to the listed devices, e.g.
+// ?fields=temperature_celsius,power_usage_milliwatts&uuid=GPU-...
+func (s *streamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := newStreamClient(r)
+	if err != nil {
+		writeAPI(w, http.StatusBadRequest, APIError{err.Error()})
+		return
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			writeAPI(w, http.StatusBadRequest, APIError{err.Error()})
+			return
+		}
+		defer ws.Close()
+
+		s.subscribe(c)
+		defer s.unsubscribe(c)
+		for {
+			select {
+			case frame := <-c.frames:
+				if err := ws.WriteText(c.encode(frame)); err != nil {
+					return
+				}
+			case <-ws.Closed():
+				return
+			}
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPI(w, http.StatusInternalServerError, APIError{"streaming not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	s.subscribe(c)
+	defer s.unsubscribe(c)
+	for {
+		select {
+		case frame := <-c.frames:
+			event := "snapshot"
+			if frame.err != nil {
+				event = "error"
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, c.encode(frame)); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func newStreamClient(r *http.Request) (*streamClient, error) {
+	c := &streamClient{frames: make(chan streamFrame, 1)}
+	if fields := splitQuery(r, "fields"); len(fields) > 0 {
+		known := deviceFields()
+		c.fields = make(map[string]bool)
+		for _, f := range fields {
+			if !known[f] {
+				return nil, fmt.Errorf("unknown device field %q", f)
+			}
+			c.fields[f] = true
+		}
+		for _, f := range streamIdentity {
+			c.fields[f] = true
+		}
+	}
+	if uuids := splitQuery(r, "uuid"); len(uuids) > 0 {
+		c.devices = make(map[string]bool)
+		for _, u := range uuids {
+			c.devices[strings.ToLower(u)] = true
+		}
+	}
+	return c, nil
+}
+
+// splitQuery returns the comma separated values of a repeatable query
+// parameter.
+func splitQuery(r *http.Request, name string) []string {
+	var values []string
+	for _, v := range r.URL.Query()[name] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// deviceFields returns the JSON names of the fields of Device.
+func deviceFields() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(Device{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// encode returns the frame as JSON, filtered for the client.
+func (c *streamClient) encode(frame streamFrame) []byte {
+	if frame.err != nil {
+		body, _ := json.Marshal(APIError{frame.err.Error()})
+		return body
+	}
+
+	filtered := struct {
+		Timestamp time.Time     `json:"timestamp"`
+		Devices   []interface{} `json:"devices"`
+	}{frame.snapshot.Timestamp, []interface{}{}}
+	for _, d := range frame.snapshot.Devices {
+		if c.devices != nil && !c.devices[strings.ToLower(d.UUID)] {
+			continue
+		}
+		if c.fields == nil {
+			filtered.Devices = append(filtered.Devices, d)
+			continue
+		}
+		device, err := filterDevice(d, c.fields)
+		if err != nil {
+			log.Printf("Failed to encode device %s for stream: %s\n", d.UUID, err)
+			continue
+		}
+		filtered.Devices = append(filtered.Devices, device)
+	}
+
+	body, err := json.Marshal(filtered)
+	if err != nil {
+		body, _ = json.Marshal(APIError{err.Error()})
+	}
+	return body
+}
+
+// filterDevice returns the given JSON fields of the device. Unless errors
+// is one of them, the errors of the device are limited to these fields.
+func filterDevice(d *Device, fields map[string]bool) (map[string]interface{}, error) {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(body, &all); err != nil {
+		return nil, err
+	}
+
+	device := make(map[string]interface{})
+	for name, value := range all {
+		if fields[name] {
+			device[name] = value
+		}
+	}
+	if fields["errors"] {
+		return device, nil
+	}
+	errs := make(map[string]string)
+	for field, reason := range d.Errors {
+		if fields[field] {
+			errs[field] = reason
+		}
+	}
+	if len(errs) > 0 {
+		device["errors"] = errs
+	}
+	return device, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// streamSnapshot returns testSnapshot with finite DCGM readings, the
+// backends don't report others, see dcgmValue.
+func streamSnapshot() *Metrics {
+	data := testSnapshot()
+	data.Devices[1].DCGMFields["sm_active"] = 0.25
+	return data
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// readEvent reads the next Server-Sent Event.
+func readEvent(t *testing.T, r *bufio.Reader) (event, data string) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch line = strings.TrimSuffix(line, "\n"); {
+		case line == "" && event != "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// getStream opens the event stream of the server at path.
+func getStream(t *testing.T, server *httptest.Server, path string) (*http.Response, *bufio.Reader) {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d and %s, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestStreamSSE(t *testing.T) {
+	server := httptest.NewServer(newStreamer(&staticBackend{metrics: streamSnapshot()}, 10*time.Millisecond))
+	defer server.Close()
+
+	resp, r := getStream(t, server, "/api/v1/stream?fields=temperature_celsius&uuid=GPU-9b2d1c7e-0f43-4a55-8e61-2c7d9a0b3e12")
+	defer resp.Body.Close()
+	for i := 0; i < 2; i++ {
+		event, data := readEvent(t, r)
+		var snapshot struct {
+			Timestamp time.Time                `json:"timestamp"`
+			Devices   []map[string]interface{} `json:"devices"`
+		}
+		if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+			t.Fatalf("frame %d: %s: %q", i, err, data)
+		}
+		if event != "snapshot" || snapshot.Timestamp.IsZero() || len(snapshot.Devices) != 1 || snapshot.Devices[0]["temperature_celsius"] != 35.0 {
+			t.Errorf("frame %d: got %s %q, want the temperature of the Tesla T4", i, event, data)
+		}
+	}
+
+	errServer := httptest.NewServer(newStreamer(&staticBackend{err: errors.New("NVML is not loaded")}, 10*time.Millisecond))
+	defer errServer.Close()
+	resp, r = getStream(t, errServer, "/api/v1/stream")
+	defer resp.Body.Close()
+	if event, data := readEvent(t, r); event != "error" || data != `{"error":"NVML is not loaded"}` {
+		t.Errorf("got %s %q, want the error of the collection", event, data)
+	}
+}
+
+func TestStreamFilter(t *testing.T) {
+	timestamp, _ := json.Marshal(fixedTime)
+	frame := streamFrame{snapshot: &APIDevices{fixedTime, streamSnapshot().Devices}}
+	for _, test := range []struct {
+		query   string
+		devices string
+		err     string
+	}{
+		{
+			query:   "fields=power_usage_milliwatts",
+			devices: `[{"index":"0","minor_number":"0","name":"NVIDIA A100-SXM4-40GB","power_usage_milliwatts":254120,"uuid":"GPU-3f1a2b4c-5d6e-7f80-91a2-b3c4d5e6f701"},{"errors":{"power_usage_milliwatts":"not supported"},"index":"1","minor_number":"1","name":"Tesla T4","power_usage_milliwatts":0,"uuid":"GPU-9b2d1c7e-0f43-4a55-8e61-2c7d9a0b3e12"}]`,
+		},
+		{
+			query:   "fields=temperature_celsius&fields=errors&uuid=GPU-9B2D1C7E-0F43-4A55-8E61-2C7D9A0B3E12",
+			devices: `[{"errors":{"fan_speed_percent":"not supported","power_usage_average_milliwatts":"not supported","power_usage_milliwatts":"not supported"},"index":"1","minor_number":"1","name":"Tesla T4","temperature_celsius":35,"uuid":"GPU-9b2d1c7e-0f43-4a55-8e61-2c7d9a0b3e12"}]`,
+		},
+		{
+			query:   "uuid=GPU-00000000-0000-0000-0000-000000000000",
+			devices: `[]`,
+		},
+		{
+			query: "fields=temperature_celsius,bogus",
+			err:   `unknown device field "bogus"`,
+		},
+	} {
+		c, err := newStreamClient(httptest.NewRequest("GET", "/api/v1/stream?"+test.query, nil))
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.query, err)
+		}
+		want := fmt.Sprintf(`{"timestamp":%s,"devices":%s}`, timestamp, test.devices)
+		if got := string(c.encode(frame)); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.query, got, want)
+		}
+	}
+
+	// Without filters, devices are sent as they are.
+	c, _ := newStreamClient(httptest.NewRequest("GET", "/api/v1/stream", nil))
+	var all APIDevices
+	if err := json.Unmarshal(c.encode(frame), &all); err != nil || len(all.Devices) != 2 || all.Devices[0].PCIe == nil {
+		t.Errorf("got %v, %v, want both devices", all.Devices, err)
+	}
+}
+
+func TestStreamerSendDropsOldest(t *testing.T) {
+	s := newStreamer(&staticBackend{}, time.Hour)
+	c := &streamClient{frames: make(chan streamFrame, 1)}
+	s.send(c, streamFrame{err: errors.New("first")})
+	s.send(c, streamFrame{err: errors.New("second")})
+	if frame := <-c.frames; frame.err.Error() != "second" {
+		t.Errorf("got frame %v, want the latest", frame.err)
+	}
+	if sent, dropped := counterValue(t, s.frames.WithLabelValues("sent")), counterValue(t, s.frames.WithLabelValues("dropped")); sent != 2 || dropped != 1 {
+		t.Errorf("got %v sent and %v dropped frames, want 2 and 1", sent, dropped)
+	}
+}
+
+func TestStreamSlowClient(t *testing.T) {
+	s := newStreamer(&staticBackend{metrics: streamSnapshot()}, 10*time.Millisecond)
+	// The slow client never picks up its frames.
+	slow := &streamClient{frames: make(chan streamFrame, 1)}
+	s.subscribe(slow)
+	defer s.unsubscribe(slow)
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+	resp, r := getStream(t, server, "/api/v1/stream")
+	defer resp.Body.Close()
+	for i := 0; i < 3; i++ {
+		if event, data := readEvent(t, r); event != "snapshot" {
+			t.Fatalf("frame %d: got %s %q", i, event, data)
+		}
+	}
+
+	if dropped := counterValue(t, s.frames.WithLabelValues("dropped")); dropped < 2 {
+		t.Errorf("got %v dropped frames, want those of the slow client", dropped)
+	}
+	if len(slow.frames) != 1 {
+		t.Errorf("got %d frames pending for the slow client, want the latest", len(slow.frames))
+	}
+}
+
+// dialWebSocket completes the opening handshake with the key of the example
+// of RFC 6455 and checks its accept key.
+func dialWebSocket(t *testing.T, server *httptest.Server, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", path, server.Listener.Addr())
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got status %d and accept key %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return conn, r
+}
+
+// wsClientFrame returns a masked frame of a client.
+func wsClientFrame(opcode byte, payload []byte) []byte {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readWSFrame reads an unmasked frame of the server.
+func readWSFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// readWSControl skips the snapshots up to the next control frame.
+func readWSControl(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	for {
+		if opcode, payload := readWSFrame(t, r); opcode != wsOpText {
+			return opcode, payload
+		}
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	server := httptest.NewServer(newStreamer(&staticBackend{metrics: streamSnapshot()}, 10*time.Millisecond))
+	defer server.Close()
+
+	conn, r := dialWebSocket(t, server, "/api/v1/stream?fields=temperature_celsius&uuid=GPU-9b2d1c7e-0f43-4a55-8e61-2c7d9a0b3e12")
+	defer conn.Close()
+	opcode, payload := readWSFrame(t, r)
+	var snapshot APIDevices
+	if err := json.Unmarshal(payload, &snapshot); opcode != wsOpText || err != nil || len(snapshot.Devices) != 1 || snapshot.Devices[0].Temperature != 35 {
+		t.Errorf("got frame %#x %q, want the temperature of the Tesla T4", opcode, payload)
+	}
+
+	conn.Write(wsClientFrame(wsOpPing, []byte("are you there")))
+	if opcode, payload := readWSControl(t, r); opcode != wsOpPong || string(payload) != "are you there" {
+		t.Errorf("got frame %#x %q, want the pong", opcode, payload)
+	}
+
+	conn.Write(wsClientFrame(wsOpClose, []byte{0x03, 0xe8}))
+	if opcode, payload := readWSControl(t, r); opcode != wsOpClose || string(payload) != "\x03\xe8" {
+		t.Errorf("got frame %#x %q, want the close echoed", opcode, payload)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("got %s, want the server to close the connection", err)
+	}
+}
+
+func TestStreamWebSocketFrameLimit(t *testing.T) {
+	server := httptest.NewServer(newStreamer(&staticBackend{metrics: streamSnapshot()}, 10*time.Millisecond))
+	defer server.Close()
+
+	conn, r := dialWebSocket(t, server, "/api/v1/stream")
+	defer conn.Close()
+	// A binary frame of 2^62 bytes.
+	frame := []byte{0x82, 0x80 | 127, 0x40, 0, 0, 0, 0, 0, 0, 0, 0x37, 0xfa, 0x21, 0x3d}
+	conn.Write(frame)
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("got %s, want the server to close the connection", err)
+	}
+}
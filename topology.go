@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	topologyLevelDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "topology_level"),
+		"Closest common ancestor of the device and its peer, the value is the NVML level, lower is closer",
+		[]string{"minor", "peer_minor", "level"}, nil,
+	)
+	p2pSupportedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "p2p_supported"),
+		"Whether the P2P capability is available between the device and its peer",
+		[]string{"minor", "peer_minor", "capability"}, nil,
+	)
+	cpuAffinityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cpu_affinity_info"),
+		"CPUs close to the device",
+		[]string{"minor", "cpus"}, nil,
+	)
+	numaNodeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "numa_node"),
+		"NUMA node of the device as reported by sysfs",
+		[]string{"minor"}, nil,
+	)
+)
+
+// topologyDevice is the part of the NVML device API read by readTopology.
+// The peers are devices of the same kind.
+type topologyDevice interface {
+	TopologyLevel(peer topologyDevice) (string, uint, error)
+	P2PCapabilities(peer topologyDevice) (map[string]bool, error)
+	CPUAffinity() ([]uint, error)
+	PCIBusID() (string, error)
+}
+
+// newTopologyCollector exports the topology of the devices, as shown by
+// nvidia-smi topo -m.
+func newTopologyCollector(sysPath string) *staticCollector {
+	descs := []*prometheus.Desc{topologyLevelDesc, p2pSupportedDesc, cpuAffinityDesc, numaNodeDesc}
+	return newStaticCollector("device topology", descs, func(devices []staticDevice, minors []string) ([]prometheus.Metric, error) {
+		topology := make([]topologyDevice, len(devices))
+		for i, device := range devices {
+			topology[i] = device
+		}
+		return readTopology(sysPath, topology, minors)
+	})
+}
+
+func readTopology(sysPath string, devices []topologyDevice, minors []string) ([]prometheus.Metric, error) {
+	var metrics []prometheus.Metric
+	for i, device := range devices {
+		for j, peer := range devices {
+			if i == j {
+				continue
+			}
+
+			name, level, err := device.TopologyLevel(peer)
+			if err != nil && err != errNVMLNotSupported {
+				return nil, err
+			}
+			if err == nil {
+				metrics = append(metrics, prometheus.MustNewConstMetric(topologyLevelDesc, prometheus.GaugeValue,
+					float64(level), minors[i], minors[j], name))
+			}
+
+			caps, err := device.P2PCapabilities(peer)
+			if err != nil && err != errNVMLNotSupported {
+				return nil, err
+			}
+			for capability, supported := range caps {
+				metrics = append(metrics, prometheus.MustNewConstMetric(p2pSupportedDesc, prometheus.GaugeValue,
+					boolToFloat64(supported), minors[i], minors[j], capability))
+			}
+		}
+
+		cpus, err := device.CPUAffinity()
+		if err != nil && err != errNVMLNotSupported {
+			return nil, err
+		}
+		if len(cpus) > 0 {
+			metrics = append(metrics, prometheus.MustNewConstMetric(cpuAffinityDesc, prometheus.GaugeValue,
+				1, minors[i], formatCPUList(cpus)))
+		}
+
+		busID, err := device.PCIBusID()
+		if err != nil && err != errNVMLNotSupported {
+			return nil, err
+		}
+		// numa_node is -1 on systems without NUMA.
+		if s, err := readSysfsString(filepath.Join(sysPath, "bus/pci/devices", normalizeBusID(busID), "numa_node")); err == nil {
+			if node, err := strconv.Atoi(s); err == nil && node >= 0 {
+				metrics = append(metrics, prometheus.MustNewConstMetric(numaNodeDesc, prometheus.GaugeValue,
+					float64(node), minors[i]))
+			}
+		}
+	}
+
+	return metrics, nil
+}
+
+// formatCPUList formats sorted CPU numbers as a list of ranges, as in
+// /sys/devices/system/cpu/online, e.g. "0-23,48-71".
+func formatCPUList(cpus []uint) string {
+	var ranges []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprint(cpus[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
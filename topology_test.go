@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeTopologyDevice is a GPU of a fake two socket system. Devices on the
+// same socket share a PCIe switch.
+type fakeTopologyDevice struct {
+	socket int
+	busID  string
+	cpus   []uint
+	p2pErr error
+}
+
+func (d *fakeTopologyDevice) TopologyLevel(peer topologyDevice) (string, uint, error) {
+	if d.socket == peer.(*fakeTopologyDevice).socket {
+		return "single_switch", 20, nil
+	}
+	return "system", 50, nil
+}
+func (d *fakeTopologyDevice) P2PCapabilities(peer topologyDevice) (map[string]bool, error) {
+	if d.p2pErr != nil {
+		return nil, d.p2pErr
+	}
+	return map[string]bool{"read": true, "write": true, "nvlink": false, "atomics": false}, nil
+}
+func (d *fakeTopologyDevice) CPUAffinity() ([]uint, error) {
+	if d.cpus == nil {
+		return nil, errNVMLNotSupported
+	}
+	return d.cpus, nil
+}
+func (d *fakeTopologyDevice) PCIBusID() (string, error) { return d.busID, nil }
+
+// metricsCollector exports fixed metrics.
+type metricsCollector []prometheus.Metric
+
+func (c metricsCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, m := range c {
+		descs <- m.Desc()
+	}
+}
+
+func (c metricsCollector) Collect(metrics chan<- prometheus.Metric) {
+	for _, m := range c {
+		metrics <- m
+	}
+}
+
+func TestReadTopology(t *testing.T) {
+	// The fixture tree has the NUMA node of the first GPU, the second is on
+	// a system without NUMA, and doesn't support P2P nor report its CPUs.
+	devices := []topologyDevice{
+		&fakeTopologyDevice{socket: 0, busID: "00000000:07:00.0", cpus: []uint{0, 1, 2, 3, 8, 10, 11}},
+		&fakeTopologyDevice{socket: 1, busID: "00000000:0F:00.0", p2pErr: errNVMLNotSupported},
+	}
+	metrics, err := readTopology("testdata/kernel/sys", devices, []string{"0", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	goldenMetrics(t, "testdata/topology/metrics.prom", metricsCollector(metrics))
+
+	devices[1].(*fakeTopologyDevice).p2pErr = errNVMLTimeout
+	if _, err := readTopology("testdata/kernel/sys", devices, []string{"0", "1"}); err != errNVMLTimeout {
+		t.Errorf("got %v, want the timeout returned", err)
+	}
+}
+
+func TestFormatCPUList(t *testing.T) {
+	for _, test := range []struct {
+		cpus []uint
+		want string
+	}{
+		{nil, ""},
+		{[]uint{5}, "5"},
+		{[]uint{0, 1}, "0-1"},
+		{[]uint{0, 2, 4}, "0,2,4"},
+		{[]uint{0, 1, 2, 3, 8, 10, 11}, "0-3,8,10-11"},
+		{[]uint{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 48}, "0-23,48"},
+	} {
+		if got := formatCPUList(test.cpus); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.cpus, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+type Vgpu struct {
+	Instance           string  `json:"instance"`
+	UUID               string  `json:"uuid"`
+	Type               string  `json:"type"`
+	VMID               string  `json:"vm_id"`
+	VMIDType           string  `json:"vm_id_type"`
+	FramebufferUsed    float64 `json:"framebuffer_used_bytes"`
+	EncoderSessions    float64 `json:"encoder_sessions"`
+	UtilizationSM      float64 `json:"utilization_sm_percent"`
+	UtilizationMemory  float64 `json:"utilization_memory_percent"`
+	UtilizationEncoder float64 `json:"utilization_encoder_percent"`
+	UtilizationDecoder float64 `json:"utilization_decoder_percent"`
+}
+
+type VgpuType struct {
+	Name         string  `json:"name"`
+	Class        string  `json:"class"`
+	Framebuffer  float64 `json:"framebuffer_bytes"`
+	MaxInstances float64 `json:"max_instances"`
+	Creatable    bool    `json:"creatable"`
+}
+
+// vgpuDevice is the part of the NVML device API read by collectVgpu.
+// nvmlDevice implements it.
+type vgpuDevice interface {
+	VirtualizationMode() (string, error)
+	SupportedVgpuTypes() ([]vgpuType, error)
+	CreatableVgpuTypes() ([]vgpuType, error)
+	ActiveVgpus() ([]vgpuInstance, error)
+	VgpuUtilization(since time.Duration) ([]nvmlVgpuUtilization, error)
+}
+
+// vgpuType is a vGPU type of a device. nvmlVgpuType implements it.
+type vgpuType interface {
+	ID() uint
+	Name() (string, error)
+	Class() (string, error)
+	FramebufferSize() (uint64, error)
+	MaxInstances() (uint, error)
+}
+
+// vgpuInstance is a vGPU instance running on a device. nvmlVgpuInstance
+// implements it.
+type vgpuInstance interface {
+	ID() uint
+	UUID() (string, error)
+	VMID() (string, string, error)
+	Type() (vgpuType, error)
+	FramebufferUsage() (uint64, error)
+	EncoderSessions() (uint, error)
+}
+
+// collectVgpu returns the virtualization mode of the device and, for devices
+// in vGPU host mode, the active vGPU instances and the supported vGPU types.
+// Instances that fail to report, usually because their VM shut down since
+// they were listed, are skipped.
+func collectVgpu(device vgpuDevice) (string, []*Vgpu, []*VgpuType, error) {
+	mode, err := device.VirtualizationMode()
+	if err == errNVMLNotSupported {
+		return "", nil, nil, nil
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if mode != "host_vgpu" {
+		return mode, nil, nil, nil
+	}
+
+	types, err := collectVgpuTypes(device)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	instances, err := device.ActiveVgpus()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	samples, err := device.VgpuUtilization(averageDuration)
+	if err != nil && err != errNVMLNotFound {
+		return "", nil, nil, err
+	}
+	utilization := averageVgpuUtilization(samples)
+
+	var vgpus []*Vgpu
+	for _, instance := range instances {
+		vgpu, err := collectVgpuInstance(instance)
+		if err != nil {
+			log.Printf("Skipping vGPU instance %d: %s\n", instance.ID(), err)
+			continue
+		}
+		u := utilization[instance.ID()]
+		vgpu.UtilizationSM = u.UtilizationSM
+		vgpu.UtilizationMemory = u.UtilizationMemory
+		vgpu.UtilizationEncoder = u.UtilizationEncoder
+		vgpu.UtilizationDecoder = u.UtilizationDecoder
+		vgpus = append(vgpus, vgpu)
+	}
+
+	return mode, vgpus, types, nil
+}
+
+// collectVgpuInstance returns the state of a vGPU instance without its
+// utilization.
+func collectVgpuInstance(instance vgpuInstance) (*Vgpu, error) {
+	uuid, err := instance.UUID()
+	if err != nil {
+		return nil, err
+	}
+
+	vmID, vmIDType, err := instance.VMID()
+	if err != nil {
+		return nil, err
+	}
+
+	vgpuType, err := instance.Type()
+	if err != nil {
+		return nil, err
+	}
+
+	typeName, err := vgpuType.Name()
+	if err != nil {
+		return nil, err
+	}
+
+	framebufferUsed, err := instance.FramebufferUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	encoderSessions, err := instance.EncoderSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Vgpu{
+		Instance:        strconv.Itoa(int(instance.ID())),
+		UUID:            uuid,
+		Type:            typeName,
+		VMID:            vmID,
+		VMIDType:        vmIDType,
+		FramebufferUsed: float64(framebufferUsed),
+		EncoderSessions: float64(encoderSessions),
+	}, nil
+}
+
+// averageVgpuUtilization averages the utilization samples of each vGPU
+// instance. NVML returns every sample taken since the given time.
+func averageVgpuUtilization(samples []nvmlVgpuUtilization) map[uint]Vgpu {
+	averages := map[uint]Vgpu{}
+	counts := map[uint]float64{}
+	for _, s := range samples {
+		v := averages[s.Instance]
+		v.UtilizationSM += float64(s.SM)
+		v.UtilizationMemory += float64(s.Memory)
+		v.UtilizationEncoder += float64(s.Encoder)
+		v.UtilizationDecoder += float64(s.Decoder)
+		averages[s.Instance] = v
+		counts[s.Instance]++
+	}
+	for instance, v := range averages {
+		n := counts[instance]
+		v.UtilizationSM /= n
+		v.UtilizationMemory /= n
+		v.UtilizationEncoder /= n
+		v.UtilizationDecoder /= n
+		averages[instance] = v
+	}
+	return averages
+}
+
+// collectVgpuTypes returns the vGPU types supported by the device, marking
+// those that can currently be created.
+func collectVgpuTypes(device vgpuDevice) ([]*VgpuType, error) {
+	supported, err := device.SupportedVgpuTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	creatable, err := device.CreatableVgpuTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	isCreatable := map[uint]bool{}
+	for _, t := range creatable {
+		isCreatable[t.ID()] = true
+	}
+
+	var types []*VgpuType
+	for _, t := range supported {
+		name, err := t.Name()
+		if err != nil {
+			return nil, err
+		}
+
+		class, err := t.Class()
+		if err != nil {
+			return nil, err
+		}
+
+		framebuffer, err := t.FramebufferSize()
+		if err != nil {
+			return nil, err
+		}
+
+		maxInstances, err := t.MaxInstances()
+		if err != nil {
+			return nil, err
+		}
+
+		types = append(types,
+			&VgpuType{
+				Name:         name,
+				Class:        class,
+				Framebuffer:  float64(framebuffer),
+				MaxInstances: float64(maxInstances),
+				Creatable:    isCreatable[t.ID()],
+			})
+	}
+
+	return types, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeVgpuDevice is a device of a fake vGPU host.
+type fakeVgpuDevice struct {
+	mode      string
+	modeErr   error
+	supported []vgpuType
+	creatable []vgpuType
+	instances []vgpuInstance
+	samples   []nvmlVgpuUtilization
+}
+
+func (d *fakeVgpuDevice) VirtualizationMode() (string, error)     { return d.mode, d.modeErr }
+func (d *fakeVgpuDevice) SupportedVgpuTypes() ([]vgpuType, error) { return d.supported, nil }
+func (d *fakeVgpuDevice) CreatableVgpuTypes() ([]vgpuType, error) { return d.creatable, nil }
+func (d *fakeVgpuDevice) ActiveVgpus() ([]vgpuInstance, error)    { return d.instances, nil }
+func (d *fakeVgpuDevice) VgpuUtilization(time.Duration) ([]nvmlVgpuUtilization, error) {
+	if d.samples == nil {
+		return nil, errNVMLNotFound
+	}
+	return d.samples, nil
+}
+
+type fakeVgpuType struct {
+	id           uint
+	name, class  string
+	framebuffer  uint64
+	maxInstances uint
+}
+
+func (t *fakeVgpuType) ID() uint                         { return t.id }
+func (t *fakeVgpuType) Name() (string, error)            { return t.name, nil }
+func (t *fakeVgpuType) Class() (string, error)           { return t.class, nil }
+func (t *fakeVgpuType) FramebufferSize() (uint64, error) { return t.framebuffer, nil }
+func (t *fakeVgpuType) MaxInstances() (uint, error)      { return t.maxInstances, nil }
+
+// fakeVgpuInstance is a vGPU instance, its VM has shut down if err is set.
+type fakeVgpuInstance struct {
+	id              uint
+	uuid, vmID      string
+	vgpuType        vgpuType
+	framebufferUsed uint64
+	encoderSessions uint
+	err             error
+}
+
+func (v *fakeVgpuInstance) ID() uint                          { return v.id }
+func (v *fakeVgpuInstance) UUID() (string, error)             { return v.uuid, nil }
+func (v *fakeVgpuInstance) VMID() (string, string, error)     { return v.vmID, "uuid", v.err }
+func (v *fakeVgpuInstance) Type() (vgpuType, error)           { return v.vgpuType, nil }
+func (v *fakeVgpuInstance) FramebufferUsage() (uint64, error) { return v.framebufferUsed, nil }
+func (v *fakeVgpuInstance) EncoderSessions() (uint, error)    { return v.encoderSessions, nil }
+
+func TestCollectVgpu(t *testing.T) {
+	a16q := &fakeVgpuType{id: 11, name: "NVIDIA A16-4Q", class: "Quadro", framebuffer: 4 << 30, maxInstances: 4}
+	a16c := &fakeVgpuType{id: 12, name: "NVIDIA A16-8C", class: "Compute", framebuffer: 8 << 30, maxInstances: 2}
+
+	tests := []struct {
+		name   string
+		device *fakeVgpuDevice
+		mode   string
+		vgpus  []*Vgpu
+		types  []*VgpuType
+	}{
+		{
+			name:   "not supported",
+			device: &fakeVgpuDevice{modeErr: errNVMLNotSupported},
+		},
+		{
+			name:   "passthrough",
+			device: &fakeVgpuDevice{mode: "passthrough"},
+			mode:   "passthrough",
+		},
+		{
+			name:   "host without instances",
+			device: &fakeVgpuDevice{mode: "host_vgpu", supported: []vgpuType{a16q, a16c}, creatable: []vgpuType{a16q, a16c}},
+			mode:   "host_vgpu",
+			types: []*VgpuType{
+				{Name: "NVIDIA A16-4Q", Class: "Quadro", Framebuffer: 4 << 30, MaxInstances: 4, Creatable: true},
+				{Name: "NVIDIA A16-8C", Class: "Compute", Framebuffer: 8 << 30, MaxInstances: 2, Creatable: true},
+			},
+		},
+		{
+			name: "host with instances",
+			device: &fakeVgpuDevice{
+				mode:      "host_vgpu",
+				supported: []vgpuType{a16q, a16c},
+				creatable: []vgpuType{a16q},
+				instances: []vgpuInstance{
+					&fakeVgpuInstance{id: 3, uuid: "VGPU-3", vmID: "vm-a", vgpuType: a16q, framebufferUsed: 1 << 30, encoderSessions: 2},
+					&fakeVgpuInstance{id: 4, uuid: "VGPU-4", vgpuType: a16q, err: errors.New("nvml: Invalid Argument")},
+					&fakeVgpuInstance{id: 5, uuid: "VGPU-5", vmID: "vm-b", vgpuType: a16c, framebufferUsed: 6 << 30},
+				},
+				// Utilization is averaged over the samples of each instance.
+				samples: []nvmlVgpuUtilization{
+					{Instance: 3, SM: 20, Memory: 10, Encoder: 5},
+					{Instance: 5, SM: 90, Memory: 60, Decoder: 1},
+					{Instance: 3, SM: 40, Memory: 30, Encoder: 15},
+				},
+			},
+			mode: "host_vgpu",
+			vgpus: []*Vgpu{
+				{
+					Instance: "3", UUID: "VGPU-3", Type: "NVIDIA A16-4Q", VMID: "vm-a", VMIDType: "uuid",
+					FramebufferUsed: 1 << 30, EncoderSessions: 2,
+					UtilizationSM: 30, UtilizationMemory: 20, UtilizationEncoder: 10,
+				},
+				{
+					Instance: "5", UUID: "VGPU-5", Type: "NVIDIA A16-8C", VMID: "vm-b", VMIDType: "uuid",
+					FramebufferUsed: 6 << 30,
+					UtilizationSM:   90, UtilizationMemory: 60, UtilizationDecoder: 1,
+				},
+			},
+			types: []*VgpuType{
+				{Name: "NVIDIA A16-4Q", Class: "Quadro", Framebuffer: 4 << 30, MaxInstances: 4, Creatable: true},
+				{Name: "NVIDIA A16-8C", Class: "Compute", Framebuffer: 8 << 30, MaxInstances: 2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		mode, vgpus, types, err := collectVgpu(test.device)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if mode != test.mode {
+			t.Errorf("%s: got mode %q, want %q", test.name, mode, test.mode)
+		}
+		if !reflect.DeepEqual(vgpus, test.vgpus) {
+			t.Errorf("%s: got vGPUs %+v, want %+v", test.name, vgpus, test.vgpus)
+		}
+		if !reflect.DeepEqual(types, test.types) {
+			t.Errorf("%s: got types %+v, want %+v", test.name, types, test.types)
+		}
+	}
+
+	if _, _, _, err := collectVgpu(&fakeVgpuDevice{modeErr: errNVMLTimeout}); err != errNVMLTimeout {
+		t.Errorf("got %v, want the error of the device", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the key of the handshake, see RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	// wsMaxControl is the maximum payload of a control frame. Clients only
+	// send control frames to the stream, larger frames close the connection.
+	wsMaxControl = 125
+
+	// wsMaxData is the maximum payload of a data frame. They are discarded,
+	// larger frames close the connection rather than being read.
+	wsMaxData = 64 << 10
+
+	wsWriteTimeout = 10 * time.Second
+)
+
+// webSocket is the server side of a WebSocket connection that only sends
+// text messages. It answers pings and closes when the client does.
+type webSocket struct {
+	conn   net.Conn
+	mu     sync.Mutex
+	closed chan struct{}
+	once   sync.Once
+}
+
+// upgradeWebSocket completes the opening handshake and starts reading the
+// frames of the client.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocket, error) {
+	if r.Method != "GET" {
+		return nil, errors.New("websocket handshake must be a GET request")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") {
+		return nil, errors.New("websocket handshake without Connection: Upgrade")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version, expected 13")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		return nil, errors.New("websocket handshake without Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &webSocket{conn: conn, closed: make(chan struct{})}
+	go ws.read(rw.Reader)
+	return ws, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Closed is closed when the connection is.
+func (ws *webSocket) Closed() <-chan struct{} {
+	return ws.closed
+}
+
+// WriteText sends a text message in a single frame.
+func (ws *webSocket) WriteText(payload []byte) error {
+	return ws.write(wsOpText, payload)
+}
+
+// Close sends a close frame and closes the connection.
+func (ws *webSocket) Close() error {
+	ws.write(wsOpClose, []byte{0x03, 0xe8}) // 1000, normal closure
+	return ws.close()
+}
+
+func (ws *webSocket) close() error {
+	var err error
+	ws.once.Do(func() {
+		err = ws.conn.Close()
+		close(ws.closed)
+	})
+	return err
+}
+
+func (ws *webSocket) write(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode} // FIN
+	switch n := len(payload); {
+	case n <= 125:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		ws.close()
+		return err
+	}
+	return nil
+}
+
+// read handles the frames of the client until it closes the connection.
+// Data frames are discarded.
+func (ws *webSocket) read(r *bufio.Reader) {
+	defer ws.close()
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		n := uint64(header[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		// Frames of clients must be masked.
+		if !masked {
+			return
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return
+		}
+
+		if opcode < wsOpClose {
+			if n > wsMaxData {
+				return
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, int64(n)); err != nil {
+				return
+			}
+			continue
+		}
+		if n > wsMaxControl {
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsOpClose:
+			ws.write(wsOpClose, payload)
+			return
+		case wsOpPing:
+			ws.write(wsOpPong, payload)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// xidLine matches the Xid reports of the NVIDIA kernel module, e.g.
+	// "NVRM: Xid (PCI:0000:07:00): 79, pid=0, GPU has fallen off the bus." or
+	// "NVRM: Xid (0000:03:00): 13, 0003 00000000 ..." on older drivers.
+	xidLine = regexp.MustCompile(`NVRM: Xid \((?:PCI:)?([0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2})(?:\.[0-7])?\): (\d+)`)
+
+	// xidProcess matches the process an Xid report names, e.g.
+	// "pid=2211, name=python3". Reports of the kernel itself have pid 0.
+	xidProcess = regexp.MustCompile(`, pid=([1-9]\d*)(?:, name=([^,\s]+))?`)
+
+	// xidEvents are the NVML events watched and the names they are counted
+	// under in nvidia_events_total.
+	xidEvents = []struct {
+		eventType uint64
+		name      string
+	}{
+		{nvmlEventTypeXidCriticalError, "xid"},
+		{nvmlEventTypeDoubleBitECCError, "double_bit_ecc"},
+		{nvmlEventTypePState, "pstate"},
+		{nvmlEventTypeClock, "clock"},
+	}
+
+	xidWaitTimeout = 5 * time.Second
+)
+
+// xidWatcher counts Xid errors and other NVML events as they happen. Events
+// are taken from NVML or, when NVML events are not available, from the Xid
+// reports in the kernel log.
+type xidWatcher struct {
+	source   string
+	logPath  string
+	procPath string
+
+	errors   *counterVec
+	last     *prometheus.GaugeVec
+	events   *counterVec
+	restarts prometheus.Counter
+}
+
+// newXidWatcher starts watching. source is nvml, log or auto, which uses
+// NVML and falls back to the log at logPath.
+func newXidWatcher(source, logPath, procPath string) *xidWatcher {
+	w := &xidWatcher{
+		source:   source,
+		logPath:  logPath,
+		procPath: procPath,
+		errors: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "xid_errors_total",
+				Help:      "Xid errors reported for the device",
+			},
+			[]string{"minor", "xid"},
+		),
+		last: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "last_xid",
+				Help:      "Last Xid error reported for the device",
+			},
+			[]string{"minor"},
+		),
+		events: newCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "events_total",
+				Help:      "NVML events reported for the device",
+			},
+			[]string{"minor", "event"},
+		),
+		restarts: newCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "event_watcher_restarts_total",
+				Help:      "Restarts of the Xid event watcher",
+			},
+		),
+	}
+	go supervise("Xid watcher", w.restarts, w.run)
+	return w
+}
+
+func (w *xidWatcher) Describe(descs chan<- *prometheus.Desc) {
+	w.errors.Describe(descs)
+	w.last.Describe(descs)
+	w.events.Describe(descs)
+	w.restarts.Describe(descs)
+}
+
+func (w *xidWatcher) Collect(metrics chan<- prometheus.Metric) {
+	w.errors.Collect(metrics)
+	w.last.Collect(metrics)
+	w.events.Collect(metrics)
+	w.restarts.Collect(metrics)
+}
+
+func (w *xidWatcher) run() error {
+	switch w.source {
+	case "nvml":
+		return w.watchNVML()
+	case "log":
+		return w.watchLog()
+	case "auto":
+		err := w.watchNVML()
+		if err != errNVMLNotLoaded && err != errNVMLNotSupported {
+			return err
+		}
+		log.Printf("NVML events not available (%s), watching %s for Xid errors\n", err, w.logPath)
+		w.source = "log"
+		return w.watchLog()
+	}
+	return fmt.Errorf("unknown Xid source %q", w.source)
+}
+
+// watchNVML registers all devices for the events of xidEvents they support
+// and waits for events until NVML fails.
+func (w *xidWatcher) watchNVML() error {
+	if err := nvmlInit(); err != nil {
+		return err
+	}
+	defer nvmlShutdown()
+
+	set, err := nvmlEventSetCreate()
+	if err != nil {
+		return err
+	}
+	defer set.Free()
+
+	count, err := nvmlDeviceCount()
+	if err != nil {
+		return err
+	}
+
+	minors := map[nvmlDevice]string{}
+	for index := uint(0); index < count; index++ {
+		device, err := nvmlDeviceByIndex(index)
+		if err != nil {
+			return err
+		}
+		minor, err := device.MinorNumber()
+		if err != nil {
+			return err
+		}
+		supported, err := device.SupportedEventTypes()
+		if err == errNVMLNotSupported {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var types uint64
+		for _, e := range xidEvents {
+			types |= e.eventType
+		}
+		if types&supported == 0 {
+			continue
+		}
+		if err := set.Register(device, types&supported); err != nil {
+			return err
+		}
+		minors[device] = strconv.Itoa(int(minor))
+	}
+	if len(minors) == 0 {
+		return errNVMLNotSupported
+	}
+
+	for {
+		event, err := set.Wait(xidWaitTimeout)
+		if err == errNVMLTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		minor := minors[event.Device]
+		for _, e := range xidEvents {
+			if event.Type&e.eventType != 0 {
+				w.events.WithLabelValues(minor, e.name).Inc()
+			}
+		}
+		if event.Type&nvmlEventTypeXidCriticalError != 0 {
+			w.xid(minor, int(event.Data), nil)
+		}
+	}
+}
+
+// watchLog follows the kernel log for Xid reports. Reports written before
+// the watcher started are skipped.
+func (w *xidWatcher) watchLog() error {
+	return followLog(w.logPath, w.logLine)
+}
+
+// logLine counts the Xid reported in a kernel log line, if any. The process
+// named by the report is kept as the exemplar of the count.
+func (w *xidWatcher) logLine(line string) {
+	bus, xid, ok := parseXid(line)
+	if !ok {
+		return
+	}
+	var process prometheus.Labels
+	if m := xidProcess.FindStringSubmatch(line); m != nil {
+		process = prometheus.Labels{"pid": m[1]}
+		if m[2] != "" {
+			process["name"] = m[2]
+		}
+	}
+	w.xid(w.minor(bus), xid, process)
+}
+
+func (w *xidWatcher) xid(minor string, xid int, process prometheus.Labels) {
+	log.Printf("Xid %d on GPU %s\n", xid, minor)
+	if process != nil {
+		w.errors.addWithExemplar(1, process, minor, strconv.Itoa(xid))
+	} else {
+		w.errors.WithLabelValues(minor, strconv.Itoa(xid)).Inc()
+	}
+	w.last.WithLabelValues(minor).Set(float64(xid))
+}
+
+// minor looks up the minor number of the GPU at the PCI bus id reported in
+// the kernel log.
+func (w *xidWatcher) minor(bus string) string {
+	path := filepath.Join(w.procPath, "driver/nvidia/gpus", strings.ToLower(bus)+".0", "information")
+	info, err := readKeyValues(path)
+	if err != nil {
+		log.Printf("Failed to look up the minor number of GPU %s: %s\n", bus, err)
+		return ""
+	}
+	return info["Device Minor"]
+}
+
+// parseXid returns the PCI bus id and the Xid of a kernel log line.
+func parseXid(line string) (string, int, bool) {
+	m := xidLine.FindStringSubmatch(line)
+	if m == nil {
+		return "", 0, false
+	}
+	xid, err := strconv.Atoi(m[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return m[1], xid, true
+}
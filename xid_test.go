@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type xidReport struct {
+	bus string
+	xid int
+}
+
+// xidLogs are kernel logs as read from /dev/kmsg, syslog and the syslog of a
+// driver before R400, which didn't prefix the bus id with PCI.
+var xidLogs = []struct {
+	path    string
+	reports []xidReport
+	errors  map[string]float64
+}{
+	{
+		path: "testdata/xid/kmsg.log",
+		reports: []xidReport{
+			{"0000:07:00", 79}, {"0000:07:00", 154}, {"0000:0f:00", 48}, {"0000:0f:00", 63},
+		},
+		errors: map[string]float64{"0/79": 1, "0/154": 1, "/48": 1, "/63": 1},
+	},
+	{
+		path: "testdata/xid/syslog.log",
+		reports: []xidReport{
+			{"0000:07:00", 31}, {"0000:07:00", 43}, {"0000:0F:00", 94},
+		},
+		errors: map[string]float64{"0/31": 1, "0/43": 1, "/94": 1},
+	},
+	{
+		path: "testdata/xid/pre-r400.log",
+		reports: []xidReport{
+			{"0000:03:00", 13}, {"0000:03:00", 32},
+		},
+		errors: map[string]float64{"/13": 1, "/32": 1},
+	},
+}
+
+func readLines(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text()+"\n")
+	}
+	return lines
+}
+
+func TestParseXid(t *testing.T) {
+	for _, test := range xidLogs {
+		var reports []xidReport
+		for _, line := range readLines(t, test.path) {
+			if bus, xid, ok := parseXid(line); ok {
+				reports = append(reports, xidReport{bus, xid})
+			}
+		}
+		if !reflect.DeepEqual(reports, test.reports) {
+			t.Errorf("%s: got %v, want %v", test.path, reports, test.reports)
+		}
+	}
+}
+
+func TestXidWatcherLogLine(t *testing.T) {
+	for _, test := range xidLogs {
+		// Only the GPU at 0000:07:00.0 is known to the kernel module of the
+		// fixture tree, the others count without a minor number.
+		w := &xidWatcher{
+			procPath: "testdata/kernel/proc",
+			errors:   newCounterVec(prometheus.CounterOpts{Name: "xid_errors_total", Help: "Xid errors"}, []string{"minor", "xid"}),
+			last:     prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "last_xid", Help: "Last Xid"}, []string{"minor"}),
+		}
+		for _, line := range readLines(t, test.path) {
+			w.logLine(line)
+		}
+
+		errors := map[string]float64{}
+		for _, m := range gather(t, w.errors)["xid_errors_total"].GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			errors[labels["minor"]+"/"+labels["xid"]] = m.GetCounter().GetValue()
+		}
+		if !reflect.DeepEqual(errors, test.errors) {
+			t.Errorf("%s: got errors %v, want %v", test.path, errors, test.errors)
+		}
+	}
+}
+
+func TestXidWatcherAutoFallback(t *testing.T) {
+	if err := nvmlInit(); err == nil {
+		nvmlShutdown()
+		t.Skip("NVML is available")
+	}
+
+	// Without NVML the watcher switches to the log, which is missing here.
+	w := &xidWatcher{source: "auto", logPath: "testdata/xid/missing.log"}
+	if err := w.run(); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the error of the missing log", err)
+	}
+	if w.source != "log" {
+		t.Errorf("got source %s, want log", w.source)
+	}
+}